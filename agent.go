@@ -2,9 +2,11 @@ package ai_agent
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -14,7 +16,11 @@ import (
 	"github.com/luoxiaojun1992/ai-agent/pkg/ollama"
 	"github.com/luoxiaojun1992/ai-agent/skill"
 	"github.com/luoxiaojun1992/ai-agent/util/contextcompress"
+	"github.com/luoxiaojun1992/ai-agent/util/guardrail"
 	"github.com/luoxiaojun1992/ai-agent/util/prompt"
+	"github.com/luoxiaojun1992/ai-agent/util/retrieval"
+	"github.com/luoxiaojun1992/ai-agent/util/review"
+	"github.com/luoxiaojun1992/ai-agent/util/tokenizer"
 )
 
 type AgentMode string
@@ -30,8 +36,21 @@ type Config struct {
 	SupervisorModel string
 
 	ModelTemperature float32
+	// Sampling holds the remaining generation options of the models.
+	Sampling SamplingOptions
 
 	SupervisorSwitch bool
+	// SupervisorRubrics names the built-in rubrics responses are reviewed on:
+	// logic, safety, tool_use and policy. Empty selects all of them.
+	SupervisorRubrics []string
+	// SupervisorPolicy is the policy text the policy rubric checks against.
+	SupervisorPolicy string
+	// SupervisorMaxRevisions bounds how often a rejected response is sent
+	// back to the chat model with the critique.
+	SupervisorMaxRevisions int
+	// SupervisorFailSeverity is the lowest severity of a failed rubric that
+	// rejects a response.
+	SupervisorFailSeverity review.Severity
 
 	OllamaHost    string
 	OllamaAPIType string
@@ -44,17 +63,69 @@ type Config struct {
 	HttpAllowRedirects bool
 	HttpMaxRedirects   int
 
-	ChatModelContextLimit  int
-	ContextReserveTokens   int
-	NearDuplicateThreshold float64
+	ChatModelContextLimit     int
+	ContextLimitAutoDiscovery bool
+	ContextReserveTokens      int
+	NearDuplicateThreshold    float64
+	TokenizerFiles            map[string]string
+	ImageTokenCost            int
+	MaxToolOutputTokens       int
+
+	// Think enables or disables reasoning of thinking models; nil keeps the
+	// model default.
+	Think *bool
+	// KeepThinkingInMemory stores reasoning in assistant memory wrapped in
+	// `<think>` tags instead of dropping it.
+	KeepThinkingInMemory bool
+
+	// StructuredOutputRetries bounds how often ListenAndWatchWithSchema asks
+	// the model again after an answer failed schema validation.
+	StructuredOutputRetries int
+
+	// Guardrails are the content rules applied to user input, tool results
+	// and model output.
+	Guardrails []guardrail.RuleConfig
+	// GuardrailModel serves the classifier rules; empty uses ChatModel.
+	GuardrailModel string
+
+	// UntrustedSkills and DestructiveSkills name skills to treat as untrusted
+	// or destructive in addition to those that declare it themselves.
+	UntrustedSkills   []string
+	DestructiveSkills []string
+	// ApprovedSkills are destructive skills allowed to run in turns that
+	// contain untrusted content.
+	ApprovedSkills []string
+
+	// FunctionCallRepairAttempts bounds the extra rounds the model gets to fix
+	// `<tool>` blocks that could not be parsed.
+	FunctionCallRepairAttempts int
 
 	AgentMode         AgentMode
 	AgentLoopDuration time.Duration
+
+	RecallTopK           int
+	RecallRRFK           int
+	RecallMMRLambda      float64
+	RecallDedupThreshold float64
+	RecallRerankModel    string
+
+	SummarizerModel string
+	SummaryPrompt   string
+
+	MemoryWriterSwitch        bool
+	MemoryWriterModel         string
+	MemoryWriterDedupDistance float64
 }
 
 const (
 	defaultContextReserveTokens   = 256
 	defaultNearDuplicateThreshold = 0.90
+	// compressionAttempts bounds the retries of a compression that raced with
+	// a memory change.
+	compressionAttempts = 3
+
+	defaultFunctionCallRepairAttempts = 1
+	defaultStructuredOutputRetries    = 2
 )
 
 type personalInfo struct {
@@ -138,6 +209,10 @@ type Agent struct {
 	ollamaCli ollama.IClient
 	milvusCli milvus.IClient
 	httpCli   httpPKG.IClient
+
+	// keywordIndexes holds the keyword index of each collection.
+	keywordIndexes   map[string]*keywordIndex
+	keywordIndexesMu sync.Mutex
 }
 
 func NewAgent(ctx context.Context, optionFuncs ...func(option *AgentOption)) (*Agent, error) {
@@ -249,46 +324,67 @@ func (a *Agent) Command(ctx context.Context, skillName string, cmdCtx any, callb
 	return processor.Do(ctx, cmdCtx, callback)
 }
 
-func (a *Agent) talkToOllama(model string, messages []*ollama.Message, callback func(response string) error) (string, error) {
-	var responseContent strings.Builder
-	var modelTemperature float32 = 0.1
-	if a.config.ModelTemperature > 0.0 {
-		modelTemperature = a.config.ModelTemperature
+func (a *Agent) talkToOllama(ctx context.Context, model string, messages []*ollama.Message, callback func(response string) error) (string, error) {
+	content, _, err := a.talkToOllamaWithThinking(ctx, model, messages, chatOptions{think: a.config.Think, sampling: a.config.Sampling}, callback, nil)
+	return content, err
+}
+
+// chatOptions are the per-call settings of a chat request.
+type chatOptions struct {
+	think *bool
+	// format is the Ollama `format` value: "json" or a JSON Schema.
+	format   json.RawMessage
+	sampling SamplingOptions
+	// usage receives the token usage reported by the server.
+	usage func(model string, usage ollama.Usage)
+}
+
+// talkToOllamaWithThinking streams the answer to callback and the reasoning,
+// reported by the server or wrapped in `<think>` tags, to thinkingCallback.
+// It returns the answer and the reasoning separately.
+func (a *Agent) talkToOllamaWithThinking(ctx context.Context, model string, messages []*ollama.Message, opts chatOptions, callback func(response string) error, thinkingCallback func(thinking string) error) (string, string, error) {
+	var responseContent, thinkingContent strings.Builder
+
+	emit := func(content, thinking string) error {
+		if thinking != "" {
+			thinkingContent.WriteString(thinking)
+			if thinkingCallback != nil {
+				if err := thinkingCallback(thinking); err != nil {
+					return err
+				}
+			}
+		}
+		if content == "" {
+			return nil
+		}
+		responseContent.WriteString(content)
+		return callback(content)
 	}
-	if err := a.ollamaCli.Talk(&ollama.ChatRequest{
-		Model:    model,
-		Messages: messages,
-		Options: &ollama.ChatRequestOptions{
-			Temperature: modelTemperature,
-		},
-	}, func(response string) error {
-		if _, err := responseContent.WriteString(response); err != nil {
+
+	splitter := prompt.NewThinkingSplitter()
+	if err := a.ollamaCli.TalkWithThinking(ctx, &ollama.ChatRequest{
+		Model:     model,
+		Messages:  messages,
+		Options:   a.chatRequestOptions(opts.sampling),
+		Think:     opts.think,
+		Format:    opts.format,
+		KeepAlive: opts.sampling.KeepAlive,
+	}, func(delta *ollama.ChatDelta) error {
+		if delta.Usage != nil && opts.usage != nil {
+			opts.usage(model, *delta.Usage)
+		}
+		if err := emit("", delta.Thinking); err != nil {
 			return err
 		}
-		return callback(response)
+		return emit(splitter.Feed(delta.Content))
 	}); err != nil {
-		return "", err
+		return "", "", err
 	}
-
-	return responseContent.String(), nil
-}
-
-func (a *Agent) reviewResponse(response string) (bool, error) {
-	checkResult, err := a.talkToOllama(a.config.SupervisorModel, []*ollama.Message{
-		{
-			Role: "system",
-			Content: `Analyze the logical coherence of the following content.
-If there are logical problems such as contradictions, unreasonable causal relationships, or incomplete reasoning, output 'true';
-if there are no logical problems, output 'false'.
-Content to be analyzed:` + "\n" + response,
-		},
-	}, func(_ string) error {
-		return nil
-	})
-	if err != nil {
-		return false, err
+	if err := emit(splitter.Flush()); err != nil {
+		return "", "", err
 	}
-	return checkResult == "true", nil
+
+	return responseContent.String(), thinkingContent.String(), nil
 }
 
 func (a *Agent) Close() error {
@@ -296,9 +392,58 @@ func (a *Agent) Close() error {
 }
 
 type MemoryCtx struct {
-	Role    string
-	Content string
-	Images  []string
+	ID      string   `json:"id"`
+	Role    string   `json:"role"`
+	Content string   `json:"content"`
+	Images  []string `json:"images,omitempty"`
+	// Name is the function name for tool outputs.
+	Name string `json:"name,omitempty"`
+	// ToolCallID links tool outputs to the function call that produced them.
+	ToolCallID string `json:"toolCallId,omitempty"`
+	// ToolCalls are the function calls an assistant message issued.
+	ToolCalls []ToolCall `json:"toolCalls,omitempty"`
+	// Source tells where the context came from, see the MemorySource constants.
+	Source    string    `json:"source,omitempty"`
+	Tokens    int       `json:"tokens"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	// Pinned contexts are never evicted by context compression.
+	Pinned bool `json:"pinned,omitempty"`
+	// Priority orders eviction: lower priority contexts are dropped first.
+	Priority int `json:"priority,omitempty"`
+	// ExpiresAt drops the context at the next compression once passed.
+	ExpiresAt time.Time `json:"expiresAt,omitzero"`
+	// Trust is the trust level of tool outputs.
+	Trust skill.TrustLevel `json:"trust,omitempty"`
+}
+
+// ToolCall is a function call issued by an assistant message; the tool
+// outputs it produced carry its ID.
+type ToolCall struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Arguments is the JSON encoded context of the call.
+	Arguments string `json:"arguments,omitempty"`
+}
+
+// MemoryAttributes controls how a memory context is attributed and treated by
+// compression.
+type MemoryAttributes struct {
+	Name       string
+	ToolCallID string
+	ToolCalls  []ToolCall
+	Source     string
+	Trust      skill.TrustLevel
+	Pinned     bool
+	Priority   int
+	ExpiresAt  time.Time
+}
+
+func (mc *MemoryCtx) clone() *MemoryCtx {
+	cloned := *mc
+	cloned.Images = append(make([]string, 0, len(mc.Images)), mc.Images...)
+	cloned.ToolCalls = slices.Clone(mc.ToolCalls)
+	return &cloned
 }
 
 func (mc *MemoryCtx) toOllamaMessage() *ollama.Message {
@@ -324,6 +469,11 @@ type AgentDoubleOption struct {
 	role       string
 	skillSet   map[string]skill.Skill
 	checkpoint Checkpoint
+	reranker   retrieval.Reranker
+	reviewer   review.Reviewer
+	guard      *guardrail.Guard
+
+	compressionStages []contextcompress.Stage
 }
 
 func (ado *AgentDoubleOption) SetConfig(config *Config) *AgentDoubleOption {
@@ -356,8 +506,32 @@ func (ado *AgentDoubleOption) SetCheckpoint(checkpoint Checkpoint) *AgentDoubleO
 	return ado
 }
 
+func (ado *AgentDoubleOption) SetReranker(reranker retrieval.Reranker) *AgentDoubleOption {
+	ado.reranker = reranker
+	return ado
+}
+
+// SetReviewer replaces the model-backed supervisor.
+func (ado *AgentDoubleOption) SetReviewer(reviewer review.Reviewer) *AgentDoubleOption {
+	ado.reviewer = reviewer
+	return ado
+}
+
+// SetCompressionStages replaces the default context compression pipeline.
+func (ado *AgentDoubleOption) SetCompressionStages(stages ...contextcompress.Stage) *AgentDoubleOption {
+	ado.compressionStages = stages
+	return ado
+}
+
+// SetGuard replaces the guard built from Config.Guardrails.
+func (ado *AgentDoubleOption) SetGuard(guard *guardrail.Guard) *AgentDoubleOption {
+	ado.guard = guard
+	return ado
+}
+
 type AgentDouble struct {
-	config *Config
+	config   *Config
+	configMu sync.RWMutex
 
 	Agent        *Agent
 	personalInfo *personalInfo
@@ -365,6 +539,29 @@ type AgentDouble struct {
 	memory       *Memory
 	memoryMu     sync.RWMutex
 	checkpoint   Checkpoint
+	reranker     retrieval.Reranker
+	reviewer     review.Reviewer
+	guard        *guardrail.Guard
+	// compressionStages replace the default compression pipeline when set.
+	compressionStages []contextcompress.Stage
+
+	// memoryVersion counts the changes of memory, so a compression computed
+	// from a snapshot is only applied when nothing changed meanwhile.
+	memoryVersion uint64
+	turns         memoryTurns
+
+	memoryWriterWG sync.WaitGroup
+
+	tokenizers     *tokenizer.Registry
+	contextLimits  map[string]modelContext
+	contextLimitMu sync.Mutex
+	// tokenizerFailures holds the models whose tokenizer failed to load.
+	tokenizerFailures sync.Map
+
+	lastCompressionReport *contextcompress.Report
+
+	branches       map[string]*conversationBranch
+	activeBranchID string
 }
 
 func NewAgentDouble(ctx context.Context, optionFuncs ...func(option *AgentDoubleOption)) (*AgentDouble, error) {
@@ -386,6 +583,13 @@ func NewAgentDouble(ctx context.Context, optionFuncs ...func(option *AgentDouble
 		}
 		doubleOption.SetAgent(agent)
 	}
+	if doubleOption.guard == nil {
+		guard, err := newGuard(doubleOption.agent, doubleOption.config.Guardrails)
+		if err != nil {
+			return nil, err
+		}
+		doubleOption.SetGuard(guard)
+	}
 
 	return &AgentDouble{
 		config: doubleOption.config,
@@ -394,9 +598,15 @@ func NewAgentDouble(ctx context.Context, optionFuncs ...func(option *AgentDouble
 			character: doubleOption.character,
 			role:      doubleOption.role,
 		},
-		skillSet:   doubleOption.skillSet,
-		memory:     NewMemory(),
-		checkpoint: doubleOption.checkpoint,
+		skillSet:          doubleOption.skillSet,
+		memory:            NewMemory(),
+		checkpoint:        doubleOption.checkpoint,
+		reranker:          doubleOption.reranker,
+		reviewer:          doubleOption.reviewer,
+		guard:             doubleOption.guard,
+		compressionStages: doubleOption.compressionStages,
+		tokenizers:        tokenizer.NewRegistry(doubleOption.config.TokenizerFiles),
+		contextLimits:     make(map[string]modelContext),
 	}, nil
 }
 
@@ -457,15 +667,24 @@ func (ad *AgentDouble) Command(ctx context.Context, skillName string, cmdCtx any
 }
 
 func (ad *AgentDouble) AddMemory(role, content string, images []string) *AgentDouble {
+	return ad.AddMemoryWithAttributes(role, content, images, MemoryAttributes{})
+}
+
+func (ad *AgentDouble) AddMemoryWithAttributes(role, content string, images []string, attrs MemoryAttributes) *AgentDouble {
+	ad.appendMemory(ad.newMemoryCtx(role, content, images, attrs))
+	return ad
+}
+
+func (ad *AgentDouble) appendMemory(memCtx *MemoryCtx) {
 	ad.memoryMu.Lock()
 	defer ad.memoryMu.Unlock()
 
-	ad.memory.Contexts = append(ad.memory.Contexts, &MemoryCtx{
-		Role:    role,
-		Content: content,
-		Images:  images,
-	})
-	return ad
+	ad.memory.Contexts = append(ad.memory.Contexts, memCtx)
+	ad.memoryVersion++
+}
+
+func (ad *AgentDouble) AddPinnedMemory(role, content string, images []string) *AgentDouble {
+	return ad.AddMemoryWithAttributes(role, content, images, MemoryAttributes{Pinned: true})
 }
 
 func (ad *AgentDouble) AddSystemMemory(content string, images []string) *AgentDouble {
@@ -485,27 +704,41 @@ func (ad *AgentDouble) AddToolMemory(content string, images []string) *AgentDoub
 }
 
 func (ad *AgentDouble) InitMemory() *AgentDouble {
-	ado := ad.AddAssistantMemory(ad.Agent.personalInfo.prompt(), nil).
-		AddAssistantMemory(ad.personalInfo.prompt(), nil).
-		AddSystemMemory(ad.embeddingModelPrompt(), nil).
-		AddSystemMemory(ad.milvusPrompt(), nil)
+	initAttrs := MemoryAttributes{Source: MemorySourceInit}
+	ado := ad.AddMemoryWithAttributes("assistant", ad.Agent.personalInfo.prompt(), nil, initAttrs).
+		AddMemoryWithAttributes("assistant", ad.personalInfo.prompt(), nil, initAttrs).
+		AddMemoryWithAttributes("system", ad.embeddingModelPrompt(), nil, initAttrs).
+		AddMemoryWithAttributes("system", ad.milvusPrompt(), nil, initAttrs)
 	if len(ad.Agent.skillSet) > 0 {
-		ado.AddSystemMemory(ad.Agent.toolPrompt(), nil)
+		ado.AddMemoryWithAttributes("system", ad.Agent.toolPrompt(), nil, initAttrs)
 	}
 	if len(ad.skillSet) > 0 {
-		ado.AddSystemMemory(ad.toolPrompt(), nil)
+		ado.AddMemoryWithAttributes("system", ad.toolPrompt(), nil, initAttrs)
+	}
+	if len(ad.Agent.skillSet) > 0 || len(ad.skillSet) > 0 {
+		ado.AddMemoryWithAttributes("system", ad.provenancePrompt(), nil, initAttrs)
 	}
 	if ad.config.AgentMode == AgentModeLoop {
-		ado.AddAssistantMemory(ad.loopPrompt(), nil)
+		ado.AddMemoryWithAttributes("assistant", ad.loopPrompt(), nil, initAttrs)
 	}
 	return ado
 }
 
 func (ad *AgentDouble) talkToOllamaWithMemory(ctx context.Context, callback func(response string) error) error {
 	var previousResponseCOntent string
+	repairAttempts := 0
+	revisions := 0
+	// drafts are the rejected responses and their critiques, which the model
+	// sees while it revises; they leave the memory with the turn.
+	var drafts []string
+	defer func() {
+		ad.forgetMemories(drafts...)
+	}()
 
 	for {
-		ad.compressContextByTokenBudget()
+		if err := ad.compressContextByTokenBudget(ctx); err != nil {
+			return err
+		}
 
 		memorySnapshot := ad.MemorySnapshot()
 		ollamaMessages := make([]*ollama.Message, 0, len(memorySnapshot.Contexts))
@@ -515,7 +748,22 @@ func (ad *AgentDouble) talkToOllamaWithMemory(ctx context.Context, callback func
 
 		//todo select chat model
 
-		responseContentStr, err := ad.Agent.talkToOllama(ad.config.ChatModel, ollamaMessages, callback)
+		// Hold the answer back while output guardrails may block or redact it
+		// or the supervisor may reject it.
+		holdOutput := ad.config.SupervisorSwitch || ad.guard.Rewrites(guardrail.StageOutput)
+		modelCallback := callback
+		if holdOutput {
+			modelCallback = func(_ string) error {
+				return nil
+			}
+		}
+
+		responseContentStr, thinkingStr, err := ad.Agent.talkToOllamaWithThinking(ctx, ad.config.ChatModel, ollamaMessages, chatOptions{
+			think:    ad.config.Think,
+			format:   responseFormatFromContext(ctx),
+			sampling: ad.config.Sampling.merge(samplingOptionsFromContext(ctx)),
+			usage:    usageCallbackFromContext(ctx),
+		}, modelCallback, thinkingCallbackFromContext(ctx))
 		if err != nil {
 			return err
 		}
@@ -524,32 +772,114 @@ func (ad *AgentDouble) talkToOllamaWithMemory(ctx context.Context, callback func
 			return nil
 		}
 
+		if responseContentStr, err = ad.checkGuardrails(ctx, guardrail.StageOutput, responseContentStr); err != nil {
+			return err
+		}
+		if holdOutput && !ad.config.SupervisorSwitch {
+			if err := callback(responseContentStr); err != nil {
+				return err
+			}
+		}
+
 		if responseContentStr == previousResponseCOntent {
 			return nil
 		}
 
+		assistantMemory := responseContentStr
+		if ad.config.KeepThinkingInMemory && thinkingStr != "" {
+			assistantMemory = "<think>" + thinkingStr + "</think>" + responseContentStr
+		}
+
 		if ad.config.SupervisorSwitch {
-			isCompliant, err := ad.Agent.reviewResponse(responseContentStr)
+			blocking, err := ad.reviewResponse(ctx, responseContentStr, revisions)
 			if err != nil {
 				return err
 			}
-			if !isCompliant {
-				return errors.New("response from model is non-compliant")
+			if len(blocking) > 0 {
+				if revisions >= ad.supervisorMaxRevisions() {
+					return &ReviewError{Revisions: revisions, Verdicts: blocking}
+				}
+				// Keep the rejected response and feed the critique back so the
+				// model can revise it; its tool calls are not executed.
+				revisions++
+				draft := ad.newMemoryCtx("assistant", assistantMemory, nil, MemoryAttributes{Source: MemorySourceModel})
+				critique := ad.newMemoryCtx("user", critiqueMemory(blocking), nil, MemoryAttributes{Source: MemorySourceReview})
+				ad.appendMemory(draft)
+				ad.appendMemory(critique)
+				drafts = append(drafts, draft.ID, critique.ID)
+				continue
+			}
+			// The approved answer replaces the drafts that led to it
+			ad.forgetMemories(drafts...)
+			drafts = nil
+			// Only approved answers reach the caller
+			if err := callback(responseContentStr); err != nil {
+				return err
 			}
 		}
 
 		previousResponseCOntent = responseContentStr
-		ad.AddAssistantMemory(responseContentStr, nil)
 
-		functionCallList, err := prompt.ParseFunctionCalling(responseContentStr)
-		if err != nil {
-			return err
+		// The assistant message records the ids of its calls, which the tool
+		// outputs refer to.
+		functionCallList, parseErrs := prompt.ParseFunctionCallingTolerant(responseContentStr)
+		toolCalls := make([]ToolCall, 0, len(parseErrs)+len(functionCallList))
+		for _, parseErr := range parseErrs {
+			toolCalls = append(toolCalls, newToolCall(invalidFunctionCallName, map[string]string{"raw": parseErr.Raw}))
 		}
 		for _, functionCall := range functionCallList {
+			toolCalls = append(toolCalls, newToolCall(functionCall.Function, functionCall.Context))
+		}
+		ad.AddMemoryWithAttributes("assistant", assistantMemory, nil, MemoryAttributes{Source: MemorySourceModel, ToolCalls: toolCalls})
+
+		for i, parseErr := range parseErrs {
+			// Report the defect back so the model can correct the call on the next round.
+			errorOfParse := fmt.Sprintf("The function call %s could not be parsed: %v. Please output it again as a valid <tool> block.",
+				parseErr.Raw,
+				parseErr.Err)
+			ad.AddMemoryWithAttributes("tool", errorOfParse, nil, MemoryAttributes{
+				Name:       invalidFunctionCallName,
+				ToolCallID: toolCalls[i].ID,
+				Source:     MemorySourceTool,
+			})
+			if err := callback(errorOfParse); err != nil {
+				return err
+			}
+		}
+		for i, functionCall := range functionCallList {
+			toolAttrs := MemoryAttributes{
+				Name:       functionCall.Function,
+				ToolCallID: toolCalls[len(parseErrs)+i].ID,
+				Source:     MemorySourceTool,
+				Trust:      ad.skillTrustLevel(functionCall.Function),
+			}
+			denial, err := ad.deniedDestructiveCall(ctx, functionCall.Function, functionCall.Context)
+			if err != nil {
+				return err
+			}
+			if denial != "" {
+				ad.AddMemoryWithAttributes("tool", denial, nil, toolAttrs)
+				if err := callback(denial); err != nil {
+					return err
+				}
+				if functionCall.AbortOnError {
+					break
+				}
+				continue
+			}
 			funcCallback := func(output any) (any, error) {
-				resultOfFunCall := fmt.Sprintf("The result of function [%s]: %v", functionCall.Function, output)
-				ad.AddToolMemory(resultOfFunCall, nil)
-				err := callback(resultOfFunCall)
+				resultOfFunCall, err := ad.checkGuardrails(ctx, guardrail.StageTool, fmt.Sprintf("The result of function [%s]: %v", functionCall.Function, output))
+				var blockedErr *guardrail.BlockedError
+				if errors.As(err, &blockedErr) {
+					resultOfFunCall = fmt.Sprintf("The result of function [%s] was withheld: %v.", functionCall.Function, blockedErr)
+				} else if err != nil {
+					return nil, err
+				}
+				resultAttrs := toolAttrs
+				var wrapped string
+				wrapped, resultAttrs.Trust = wrapToolResult(functionCall.Function, "", toolAttrs.Trust, resultOfFunCall)
+				ad.AddMemoryWithAttributes("tool", wrapped, nil, resultAttrs)
+				err = callback(resultOfFunCall)
 				return nil, err
 			}
 			var cmdErr error
@@ -562,7 +892,7 @@ func (ad *AgentDouble) talkToOllamaWithMemory(ctx context.Context, callback func
 				errorOfFuncCall := fmt.Sprintf("The error [%s] happened during executing the function [%s].",
 					cmdErr.Error(),
 					functionCall.Function)
-				ad.AddToolMemory(errorOfFuncCall, nil)
+				ad.AddMemoryWithAttributes("tool", errorOfFuncCall, nil, toolAttrs)
 				if err := callback(errorOfFuncCall); err != nil {
 					return err
 				}
@@ -573,7 +903,7 @@ func (ad *AgentDouble) talkToOllamaWithMemory(ctx context.Context, callback func
 			}
 
 			successOfFuncCall := fmt.Sprintf("The function [%s] has been executed successfully.", functionCall.Function)
-			ad.AddToolMemory(successOfFuncCall, nil)
+			ad.AddMemoryWithAttributes("tool", successOfFuncCall, nil, toolAttrs)
 			callback(successOfFuncCall)
 		}
 
@@ -583,22 +913,91 @@ func (ad *AgentDouble) talkToOllamaWithMemory(ctx context.Context, callback func
 			}
 		}
 
-		ad.compressContextByTokenBudget()
+		if err := ad.compressContextByTokenBudget(ctx); err != nil {
+			return err
+		}
+
+		if len(parseErrs) > 0 && repairAttempts < ad.functionCallRepairAttempts() {
+			repairAttempts++
+			continue
+		}
 
 		if ad.config.AgentMode != AgentModeLoop || prompt.ParseLoopEnd(responseContentStr) {
 			break
 		}
 
-		time.Sleep(ad.config.AgentLoopDuration)
+		select {
+		case <-time.After(ad.config.AgentLoopDuration):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 
 	return nil
 }
 
-func (ad *AgentDouble) compressContextByTokenBudget() {
-	memorySnapshot := ad.MemorySnapshot()
-	if ad.config == nil || ad.config.ChatModelContextLimit <= 0 || len(memorySnapshot.Contexts) <= 1 {
-		return
+func (ad *AgentDouble) functionCallRepairAttempts() int {
+	if ad.config.FunctionCallRepairAttempts > 0 {
+		return ad.config.FunctionCallRepairAttempts
+	}
+	return defaultFunctionCallRepairAttempts
+}
+
+// errCompressionConflict reports a compression that memory changes kept
+// invalidating.
+var errCompressionConflict = errors.New("context compression conflicted with concurrent memory changes")
+
+// modelSummarizer summarizes compressed context spans with a chat model. ctx
+// is the turn the compression runs for, so cancelling the turn stops the
+// summarization.
+type modelSummarizer struct {
+	ctx   context.Context
+	agent *Agent
+	model string
+}
+
+func (ms *modelSummarizer) Summarize(messages []contextcompress.Message, summaryPrompt string) (string, error) {
+	var transcript strings.Builder
+	for _, msg := range messages {
+		transcript.WriteString(msg.Role)
+		transcript.WriteString(": ")
+		transcript.WriteString(msg.Content)
+		transcript.WriteString("\n")
+	}
+	return ms.agent.talkToOllama(ms.ctx, ms.model, []*ollama.Message{
+		{
+			Role:    "system",
+			Content: summaryPrompt + "\n" + "Conversation excerpt:" + "\n" + transcript.String(),
+		},
+	}, func(_ string) error {
+		return nil
+	})
+}
+
+// compressContextByTokenBudget compresses memory to the context budget. The
+// compression works on a snapshot and is redone when memory changed
+// meanwhile, so concurrent changes are never lost; it fails with
+// errCompressionConflict when every attempt conflicted.
+func (ad *AgentDouble) compressContextByTokenBudget(ctx context.Context) error {
+	for attempt := 0; attempt < compressionAttempts; attempt++ {
+		applied, err := ad.tryCompressContextByTokenBudget(ctx)
+		if err != nil || applied {
+			return err
+		}
+	}
+	return errCompressionConflict
+}
+
+// tryCompressContextByTokenBudget returns false when memory changed while the
+// compression was computed, in which case memory is left as it is.
+func (ad *AgentDouble) tryCompressContextByTokenBudget(ctx context.Context) (bool, error) {
+	memorySnapshot, version := ad.memorySnapshotWithVersion()
+	if ad.config == nil || len(memorySnapshot.Contexts) <= 1 {
+		return true, nil
+	}
+	contextLimit := ad.contextLimit(ctx)
+	if contextLimit <= 0 {
+		return true, nil
 	}
 
 	messages := make([]contextcompress.Message, 0, len(memorySnapshot.Contexts))
@@ -610,12 +1009,18 @@ func (ad *AgentDouble) compressContextByTokenBudget() {
 		}
 	}
 
+	originals := make(map[string]*MemoryCtx, len(memorySnapshot.Contexts))
 	for i, memCtx := range memorySnapshot.Contexts {
+		isSummary := memCtx.Role == contextcompress.SummaryRole && strings.HasPrefix(memCtx.Content, contextcompress.SummaryContentPrefix)
+		originals[memCtx.ID] = memCtx
 		messages = append(messages, contextcompress.Message{
+			ID:        memCtx.ID,
 			Role:      memCtx.Role,
 			Content:   memCtx.Content,
 			Images:    append(make([]string, 0, len(memCtx.Images)), memCtx.Images...),
-			Protected: memCtx.Role == "system" || i == lastUserIdx,
+			Protected: memCtx.Pinned || (memCtx.Role == "system" && !isSummary) || i == lastUserIdx,
+			Priority:  memCtx.Priority,
+			ExpiresAt: memCtx.ExpiresAt,
 		})
 	}
 
@@ -629,43 +1034,99 @@ func (ad *AgentDouble) compressContextByTokenBudget() {
 		nearDuplicateThreshold = defaultNearDuplicateThreshold
 	}
 
-	compressed := contextcompress.NewCompressor(contextcompress.Config{
-		BudgetTokens:           ad.config.ChatModelContextLimit,
+	compressorConfig := contextcompress.Config{
+		BudgetTokens:           contextLimit,
 		ReserveTokens:          reserveTokens,
 		Model:                  ad.config.ChatModel,
 		NearDuplicateThreshold: nearDuplicateThreshold,
-	}).Compress(messages)
+		SummaryPrompt:          ad.config.SummaryPrompt,
+		TokenCounter:           ad.tokenCounter(ad.config.ChatModel),
+		ImageTokenCost:         ad.config.ImageTokenCost,
+		MaxToolOutputTokens:    ad.config.MaxToolOutputTokens,
+		Stages:                 ad.compressionStages,
+	}
+	if ad.config.SummarizerModel != "" {
+		compressorConfig.Summarizer = &modelSummarizer{ctx: ctx, agent: ad.Agent, model: ad.config.SummarizerModel}
+	}
+	compressed, report := contextcompress.NewCompressor(compressorConfig).CompressWithReport(messages)
+	// A summarization interrupted by the end of the turn is not applied
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
 
 	newMemory := make([]*MemoryCtx, 0, len(compressed))
 	for _, msg := range compressed {
-		newMemory = append(newMemory, &MemoryCtx{
-			Role:    msg.Role,
-			Content: msg.Content,
-			Images:  append(make([]string, 0, len(msg.Images)), msg.Images...),
-		})
+		original, ok := originals[msg.ID]
+		if !ok || msg.ID == "" {
+			newMemory = append(newMemory, ad.newMemoryCtx(msg.Role, msg.Content, msg.Images, MemoryAttributes{
+				Source:    MemorySourceSummary,
+				Priority:  msg.Priority,
+				ExpiresAt: msg.ExpiresAt,
+			}))
+			continue
+		}
+		if msg.Content != original.Content {
+			original.Content = msg.Content
+			original.Tokens = ad.countMemoryTokens(original)
+			original.UpdatedAt = time.Now()
+		}
+		newMemory = append(newMemory, original)
 	}
 
 	ad.memoryMu.Lock()
+	defer ad.memoryMu.Unlock()
+	if ad.memoryVersion != version {
+		return false, nil
+	}
 	ad.memory.Contexts = newMemory
-	ad.memoryMu.Unlock()
+	ad.memoryVersion++
+	ad.lastCompressionReport = report
+	return true, nil
 }
 
+// ListenAndWatch answers message. Concurrent calls take turns: a call waits
+// until the turns that arrived before it finished.
 func (ad *AgentDouble) ListenAndWatch(ctx context.Context, message string, images []string, callback func(response string) error) error {
+	endTurn, err := ad.beginTurn(ctx)
+	if err != nil {
+		return err
+	}
+	defer endTurn()
+	return ad.listenAndWatch(ctx, message, images, callback)
+}
+
+func (ad *AgentDouble) listenAndWatch(ctx context.Context, message string, images []string, callback func(response string) error) error {
+	message, err := ad.checkGuardrails(ctx, guardrail.StageInput, message)
+	if err != nil {
+		return err
+	}
+
 	//Search context
 	ctxVectors, err := ad.Recall(ctx, message)
 	if err != nil {
 		return err
 	}
 	if len(ctxVectors) > 0 {
-		ad.AddSystemMemory("Context: \n"+strings.Join(ctxVectors, "\n"), nil)
+		ad.AddMemoryWithAttributes("system", "Context: \n"+strings.Join(ctxVectors, "\n"), nil, MemoryAttributes{Source: MemorySourceRecall})
 	}
 
 	//Generate response
-	ad.AddUserMemory(message, images)
-	return ad.talkToOllamaWithMemory(ctx, callback)
+	userCtx := ad.newMemoryCtx("user", message, images, MemoryAttributes{Source: MemorySourceUser})
+	ad.appendMemory(userCtx)
+	if err := ad.talkToOllamaWithMemory(ctx, callback); err != nil {
+		return err
+	}
+
+	ad.scheduleMemoryWriter(ctx, userCtx.ID)
+	return nil
 }
 
 func (ad *AgentDouble) Think(ctx context.Context, callback func(output any) error) error {
+	endTurn, err := ad.beginTurn(ctx)
+	if err != nil {
+		return err
+	}
+	defer endTurn()
 	ad.AddAssistantMemory("Let me think and output something", nil)
 	return ad.talkToOllamaWithMemory(ctx, func(response string) error {
 		return callback(response)
@@ -685,7 +1146,17 @@ func (ad *AgentDouble) Read(url string) error {
 		return fmt.Errorf("bad http code while reading in agent double")
 	}
 	if len(resp.Body) > 0 {
-		ad.AddAssistantMemory(string(resp.Body), nil)
+		// Pages are outside content, keep them apart from what the model said.
+		content, err := ad.checkGuardrails(context.Background(), guardrail.StageTool, string(resp.Body))
+		if err != nil {
+			return err
+		}
+		wrapped, trust := wrapToolResult("read", url, skill.TrustLevelUntrusted, content)
+		ad.AddMemoryWithAttributes("tool", wrapped, nil, MemoryAttributes{
+			Name:   "read",
+			Source: MemorySourceTool,
+			Trust:  trust,
+		})
 	}
 	return nil
 }
@@ -699,29 +1170,16 @@ func (ad *AgentDouble) Remember(ctx context.Context, info string) error {
 		return err
 	}
 	if len(embeddingResponse.Embeddings) > 0 && len(embeddingResponse.Embeddings[0]) > 0 {
-		return ad.Agent.milvusCli.InsertVector(ctx, ad.config.MilvusCollection, info, embeddingResponse.Embeddings[0])
+		if err := ad.Agent.milvusCli.InsertVector(ctx, ad.config.MilvusCollection, info, embeddingResponse.Embeddings[0]); err != nil {
+			return err
+		}
+		ad.keywordIndex(ctx).Add(info)
 	}
 	return nil
 }
 
 func (ad *AgentDouble) Recall(ctx context.Context, prompt string) ([]string, error) {
-	embeddingResponse, err := ad.Agent.ollamaCli.EmbeddingPrompt(&ollama.EmbedRequest{
-		Model: ad.config.EmbeddingModel,
-		Input: prompt,
-	})
-	if err != nil {
-		return nil, err
-	}
-	if len(embeddingResponse.Embeddings) > 0 && len(embeddingResponse.Embeddings[0]) > 0 {
-		ctxVectors, err := ad.Agent.milvusCli.SearchVector(ctx, ad.config.MilvusCollection, embeddingResponse.Embeddings[0])
-		if err != nil {
-			return nil, err
-		}
-		if len(ctxVectors) > 0 {
-			return ctxVectors, nil
-		}
-	}
-	return nil, nil
+	return ad.hybridSearch(ctx, prompt)
 }
 
 func (ad *AgentDouble) Forget(number int) *AgentDouble {
@@ -738,6 +1196,7 @@ func (ad *AgentDouble) Forget(number int) *AgentDouble {
 
 	leftMemoryLen := memoryLen - number
 
+	ad.memoryVersion++
 	if leftMemoryLen <= 0 {
 		ad.memory.Contexts = nil
 		return ad
@@ -747,7 +1206,20 @@ func (ad *AgentDouble) Forget(number int) *AgentDouble {
 	return ad
 }
 
+// LastCompressionReport returns what the most recent context compression
+// removed, truncated or added, or nil if no compression ran yet.
+func (ad *AgentDouble) LastCompressionReport() *contextcompress.Report {
+	ad.memoryMu.RLock()
+	defer ad.memoryMu.RUnlock()
+	return ad.lastCompressionReport
+}
+
+// ResetMemory drops the memory and the conversation branches and adds the
+// initial memory again. Call it through BetweenTurns while turns may run.
 func (ad *AgentDouble) ResetMemory() *AgentDouble {
+	ad.memoryMu.Lock()
+	ad.resetBranchesLocked()
+	ad.memoryMu.Unlock()
 	return ad.Forget(-1).InitMemory()
 }
 
@@ -758,7 +1230,18 @@ func (ad *AgentDouble) MemorySnapshot() *Memory {
 func (ad *AgentDouble) MemorySnapshotWithLimit(limit int) *Memory {
 	ad.memoryMu.RLock()
 	defer ad.memoryMu.RUnlock()
+	return ad.memorySnapshotLocked(limit)
+}
+
+// memorySnapshotWithVersion returns a copy of memory and the version it was
+// taken at.
+func (ad *AgentDouble) memorySnapshotWithVersion() (*Memory, uint64) {
+	ad.memoryMu.RLock()
+	defer ad.memoryMu.RUnlock()
+	return ad.memorySnapshotLocked(0), ad.memoryVersion
+}
 
+func (ad *AgentDouble) memorySnapshotLocked(limit int) *Memory {
 	start := 0
 	if limit > 0 && limit < len(ad.memory.Contexts) {
 		start = len(ad.memory.Contexts) - limit
@@ -768,11 +1251,7 @@ func (ad *AgentDouble) MemorySnapshotWithLimit(limit int) *Memory {
 		Contexts: make([]*MemoryCtx, 0, len(ad.memory.Contexts)-start),
 	}
 	for _, memoryCtx := range ad.memory.Contexts[start:] {
-		memorySnapshot.Contexts = append(memorySnapshot.Contexts, &MemoryCtx{
-			Role:    memoryCtx.Role,
-			Content: memoryCtx.Content,
-			Images:  append(make([]string, 0, len(memoryCtx.Images)), memoryCtx.Images...),
-		})
+		memorySnapshot.Contexts = append(memorySnapshot.Contexts, memoryCtx.clone())
 	}
 	return memorySnapshot
 }
@@ -780,14 +1259,25 @@ func (ad *AgentDouble) MemorySnapshotWithLimit(limit int) *Memory {
 func (ad *AgentDouble) LoadMemory(snapshot *Memory) *AgentDouble {
 	newMemory := &Memory{}
 	for _, memoryCtx := range snapshot.Contexts {
-		newMemory.Contexts = append(newMemory.Contexts, &MemoryCtx{
-			Role:    memoryCtx.Role,
-			Content: memoryCtx.Content,
-			Images:  append(make([]string, 0, len(memoryCtx.Images)), memoryCtx.Images...),
-		})
+		loaded := memoryCtx.clone()
+		// Snapshots built by hand may lack the generated fields.
+		if loaded.ID == "" {
+			loaded.ID = newMemoryID()
+		}
+		if loaded.CreatedAt.IsZero() {
+			loaded.CreatedAt = time.Now()
+		}
+		if loaded.UpdatedAt.IsZero() {
+			loaded.UpdatedAt = loaded.CreatedAt
+		}
+		if loaded.Tokens <= 0 {
+			loaded.Tokens = ad.countMemoryTokens(loaded)
+		}
+		newMemory.Contexts = append(newMemory.Contexts, loaded)
 	}
 	ad.memoryMu.Lock()
 	ad.memory = newMemory
+	ad.memoryVersion++
 	ad.memoryMu.Unlock()
 	return ad
 }
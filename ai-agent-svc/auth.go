@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luoxiaojun1992/ai-agent/util/auth"
+)
+
+// Scopes guarding the routes of the service.
+const (
+	scopeChat   = "chat"
+	scopeSkill  = "skill"
+	scopeConfig = "config"
+	scopeMemory = "memory"
+)
+
+const principalKey = "principal"
+
+// errScopesExpired rejects background work of a JWT subject once the token
+// that saved its scopes expired.
+var errScopesExpired = errors.New("saved scopes expired")
+
+// Browsers can't set headers on WebSocket connections, so /ws also takes the
+// credentials from the access_token query parameter or from a subprotocol
+// "bearer.<token>" offered next to wsProtocol.
+const (
+	accessTokenParam      = "access_token"
+	accessTokenKey        = "accessToken"
+	wsTokenProtocolPrefix = "bearer."
+	wsProtocol            = "ai-agent"
+)
+
+// anonymousPrincipal is the caller of every request while no authenticator is
+// configured.
+var anonymousPrincipal = &auth.Principal{ID: "anonymous", Method: "none", Scopes: []string{auth.ScopeAll}}
+
+type AuthConfig struct {
+	APIKeys []auth.APIKey
+	JWT     *auth.JWTConfig
+	// Required refuses to start without an authenticator.
+	Required bool
+}
+
+func loadAuthConfig() AuthConfig {
+	config := AuthConfig{Required: getBoolEnv("AUTH_REQUIRED", false)}
+	keys, err := auth.ParseAPIKeys(getEnv("AUTH_API_KEYS", ""))
+	if err != nil {
+		log.Fatal("Error parsing environment variable", "AUTH_API_KEYS", ":", err)
+	}
+	config.APIKeys = keys
+	if secret := getEnv("AUTH_JWT_SECRET", ""); secret != "" {
+		config.JWT = &auth.JWTConfig{
+			Secret:          []byte(secret),
+			Issuer:          getEnv("AUTH_JWT_ISSUER", ""),
+			Audience:        getEnv("AUTH_JWT_AUDIENCE", ""),
+			Leeway:          time.Duration(getIntEnv("AUTH_JWT_LEEWAY_SECONDS", 30)) * time.Second,
+			AllowMissingExp: getBoolEnv("AUTH_JWT_ALLOW_MISSING_EXP", false),
+		}
+	}
+	return config
+}
+
+// secrets returns the credentials the redactor must mask.
+func (c AuthConfig) secrets() []string {
+	var secrets []string
+	for _, key := range c.APIKeys {
+		secrets = append(secrets, key.Key)
+	}
+	if c.JWT != nil {
+		secrets = append(secrets, string(c.JWT.Secret))
+	}
+	return secrets
+}
+
+// newAuthenticator chains the configured authenticators. It returns nil when
+// none is configured, which leaves the service open.
+func newAuthenticator(config AuthConfig) (auth.Authenticator, error) {
+	var chain auth.Chain
+	if len(config.APIKeys) > 0 {
+		chain = append(chain, auth.NewAPIKeyAuthenticator(config.APIKeys))
+	}
+	if config.JWT != nil {
+		authenticator, err := auth.NewJWTAuthenticator(*config.JWT)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, authenticator)
+	}
+	if len(chain) == 0 {
+		if config.Required {
+			return nil, fmt.Errorf("AUTH_REQUIRED is set but neither AUTH_API_KEYS nor AUTH_JWT_SECRET is configured")
+		}
+		log.Println("Warning: no authentication configured, all endpoints are open")
+		return nil, nil
+	}
+	return chain, nil
+}
+
+// audit logs who made each request and its outcome. Request and response
+// bodies are never logged.
+func (s *Server) audit(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	principal := "-"
+	method := "-"
+	if p := principalFromContext(c); p != nil {
+		principal, method = p.ID, p.Method
+	}
+	path := c.FullPath()
+	if path == "" {
+		path = c.Request.URL.Path
+	}
+	log.Printf("audit principal=%s auth=%s method=%s path=%s status=%d latency=%s",
+		principal, method, c.Request.Method, path, c.Writer.Status(), time.Since(start).Round(time.Millisecond))
+}
+
+// stripAccessToken removes the access_token query parameter from the request
+// URL before it is logged and keeps it for authenticate.
+func stripAccessToken(c *gin.Context) {
+	query := c.Request.URL.Query()
+	if !query.Has(accessTokenParam) {
+		return
+	}
+	c.Set(accessTokenKey, query.Get(accessTokenParam))
+	query.Del(accessTokenParam)
+	c.Request.URL.RawQuery = query.Encode()
+	c.Request.RequestURI = c.Request.URL.RequestURI()
+}
+
+// authenticate resolves the principal of a request from its bearer token or
+// X-API-Key header, or for /ws also from the access_token query parameter or
+// the bearer subprotocol.
+func (s *Server) authenticate(c *gin.Context) {
+	if s.authenticator == nil {
+		c.Set(principalKey, anonymousPrincipal)
+		return
+	}
+	token := auth.TokenFromRequest(c.Request)
+	if token == "" && c.FullPath() == "/ws" {
+		token = webSocketToken(c)
+	}
+	principal, err := s.authenticator.Authenticate(token)
+	if err != nil {
+		c.Header("WWW-Authenticate", `Bearer realm="ai-agent"`)
+		c.AbortWithStatusJSON(401, gin.H{"error": "Unauthorized"})
+		return
+	}
+	c.Set(principalKey, principal)
+}
+
+// webSocketToken returns the credentials of a WebSocket client from the
+// access_token query parameter or the bearer subprotocol.
+func webSocketToken(c *gin.Context) string {
+	if token := c.GetString(accessTokenKey); token != "" {
+		return token
+	}
+	for _, protocol := range strings.Split(c.GetHeader("Sec-WebSocket-Protocol"), ",") {
+		if token, ok := strings.CutPrefix(strings.TrimSpace(protocol), wsTokenProtocolPrefix); ok {
+			return token
+		}
+	}
+	return ""
+}
+
+// reauthorize checks that the principal id stored with background work is
+// still accepted and still has scope, and returns it as currently configured.
+// JWT subjects can't be looked up: they keep the scopes recorded with the
+// work until scopesExpireAt, the expiry of the token that recorded them.
+func (s *Server) reauthorize(id string, scopes []string, scopesExpireAt int64, scope string) (*auth.Principal, error) {
+	var principal *auth.Principal
+	resolver, ok := s.authenticator.(auth.Resolver)
+	switch {
+	case s.authenticator == nil && id == anonymousPrincipal.ID:
+		principal = anonymousPrincipal
+	case !ok:
+		return nil, auth.ErrUnknownPrincipal
+	default:
+		var err error
+		if principal, err = resolver.Resolve(id); err != nil {
+			return nil, err
+		}
+		if principal.Method == "jwt" {
+			if scopesExpireAt == 0 || !time.Now().Before(time.Unix(scopesExpireAt, 0)) {
+				return nil, errScopesExpired
+			}
+			principal.Scopes = scopes
+			principal.ExpiresAt = scopesExpireAt
+		}
+	}
+	if !principal.HasScope(scope) {
+		return nil, fmt.Errorf("missing scope %s", scope)
+	}
+	return principal, nil
+}
+
+// canRunInBackground reports whether the scopes of principal can be saved
+// with background work: JWT subjects can't be looked up again, so their
+// scopes are only kept until their token expires, and tokens without exp are
+// refused.
+func canRunInBackground(principal *auth.Principal) bool {
+	return principal.Method != "jwt" || principal.ExpiresAt != 0
+}
+
+// requireScope rejects principals that were not granted scope.
+func (s *Server) requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !principalFromContext(c).HasScope(scope) {
+			c.AbortWithStatusJSON(403, gin.H{"error": "Missing scope " + scope})
+		}
+	}
+}
+
+func principalFromContext(c *gin.Context) *auth.Principal {
+	value, _ := c.Get(principalKey)
+	principal, _ := value.(*auth.Principal)
+	return principal
+}
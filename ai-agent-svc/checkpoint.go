@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	ai_agent "github.com/luoxiaojun1992/ai-agent"
+)
+
+// fileCheckpoint saves the memory to a file after each loop iteration and on
+// shutdown, so a restarted loop-mode agent carries on where it stopped.
+type fileCheckpoint struct {
+	path string
+}
+
+func (f *fileCheckpoint) Do(agentDouble *ai_agent.AgentDouble) error {
+	data, err := agentDouble.ExportMemory(ai_agent.MemoryFormatJSONL)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f.path, data)
+}
+
+// restore loads the memory saved by a previous run, if any.
+func (f *fileCheckpoint) restore(agentDouble *ai_agent.AgentDouble) error {
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	memory, err := ai_agent.DecodeMemory(data, ai_agent.MemoryFormatJSONL)
+	if err != nil {
+		return err
+	}
+	agentDouble.LoadMemory(memory)
+	return nil
+}
+
+// writeFileAtomic replaces the file at path with data, so readers never see
+// a partly written file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,881 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	ai_agent "github.com/luoxiaojun1992/ai-agent"
+	"github.com/luoxiaojun1992/ai-agent/util/auth"
+	"github.com/luoxiaojun1992/ai-agent/util/ratelimit"
+	"github.com/luoxiaojun1992/ai-agent/util/redact"
+)
+
+// maxJobEventBytes bounds a line of the events file of a job.
+const maxJobEventBytes = 4 << 20
+
+var (
+	errJobCancelled  = errors.New("job cancelled")
+	errJobTimeout    = errors.New("job timed out")
+	errJobNotFound   = errors.New("job not found")
+	errJobFinished   = errors.New("job already finished")
+	errJobNotStopped = errors.New("job is still queued or running")
+)
+
+type jobStatus string
+
+const (
+	jobQueued    jobStatus = "queued"
+	jobRunning   jobStatus = "running"
+	jobSucceeded jobStatus = "succeeded"
+	jobFailed    jobStatus = "failed"
+	jobCancelled jobStatus = "cancelled"
+)
+
+func (s jobStatus) finished() bool {
+	return s == jobSucceeded || s == jobFailed || s == jobCancelled
+}
+
+type JobRequest struct {
+	Message     string                 `json:"message"`
+	Images      []string               `json:"images,omitempty"`
+	AgentConfig map[string]interface{} `json:"agentConfig,omitempty"`
+	// AgentMode is "loop" (default) or "chat".
+	AgentMode string `json:"agentMode,omitempty"`
+}
+
+// jobRecord is the state of a job, persisted on every change.
+type jobRecord struct {
+	ID        string `json:"id"`
+	Principal string `json:"principal"`
+	// Scopes are the scopes of the principal when it submitted the job; they
+	// are only used for JWT subjects, whose scopes can't be looked up, until
+	// ScopesExpireAt, the expiry of their token.
+	Scopes         []string               `json:"scopes,omitempty"`
+	ScopesExpireAt int64                  `json:"scopesExpireAt,omitempty"`
+	Status         jobStatus              `json:"status"`
+	Message        string                 `json:"message"`
+	Images         []string               `json:"images,omitempty"`
+	AgentConfig    map[string]interface{} `json:"agentConfig,omitempty"`
+	AgentMode      ai_agent.AgentMode     `json:"agentMode"`
+	// ScheduleID is the schedule that started the job, if any.
+	ScheduleID string `json:"scheduleId,omitempty"`
+	// Steps counts the model rounds completed, over all attempts.
+	Steps int `json:"steps"`
+	// Attempts counts the runs; a job interrupted by a shutdown runs again,
+	// from its last step, on the next start.
+	Attempts   int    `json:"attempts"`
+	Result     string `json:"result,omitempty"`
+	Error      string `json:"error,omitempty"`
+	CreatedAt  int64  `json:"createdAt"`
+	StartedAt  int64  `json:"startedAt,omitempty"`
+	UpdatedAt  int64  `json:"updatedAt"`
+	FinishedAt int64  `json:"finishedAt,omitempty"`
+}
+
+// job is a background agent task.
+type job struct {
+	record jobRecord
+	// events is nil for jobs finished before the service started; their
+	// events are read from the store.
+	events *eventLog
+	// cancel is set while the job runs.
+	cancel context.CancelCauseFunc
+}
+
+// jobStore persists the jobs in a directory: per job the record, the memory
+// of its agent, so an interrupted job resumes from its last step, and its
+// events.
+type jobStore struct {
+	dir string
+}
+
+func newJobStore(dir string) (*jobStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &jobStore{dir: dir}, nil
+}
+
+func (st *jobStore) path(id, suffix string) string {
+	return filepath.Join(st.dir, id+suffix)
+}
+
+func (st *jobStore) save(record jobRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(st.path(record.ID, ".json"), data)
+}
+
+// load returns the saved jobs in the order they were created.
+func (st *jobStore) load() ([]jobRecord, error) {
+	paths, err := filepath.Glob(filepath.Join(st.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	records := make([]jobRecord, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var record jobRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			log.Printf("Skipping invalid job file %s: %v", path, err)
+			continue
+		}
+		records = append(records, record)
+	}
+	slices.SortStableFunc(records, func(a, b jobRecord) int {
+		return cmp.Compare(a.CreatedAt, b.CreatedAt)
+	})
+	return records, nil
+}
+
+func (st *jobStore) checkpoint(id string) *fileCheckpoint {
+	return &fileCheckpoint{path: st.path(id, ".memory.jsonl")}
+}
+
+// storedEvent is a line of the events file of a job.
+type storedEvent struct {
+	ID    int    `json:"id"`
+	Event string `json:"event"`
+	Data  any    `json:"data"`
+}
+
+func encodeEvent(event turnEvent) ([]byte, error) {
+	data, err := json.Marshal(storedEvent{ID: event.id, Event: event.name, Data: event.data})
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// eventWriter appends the events of a job to its events file, which stays
+// open until the writer is closed. Calls must not overlap.
+type eventWriter struct {
+	path string
+	f    *os.File
+}
+
+func (st *jobStore) eventWriter(id string) *eventWriter {
+	return &eventWriter{path: st.path(id, ".events.jsonl")}
+}
+
+func (w *eventWriter) write(event turnEvent) error {
+	data, err := encodeEvent(event)
+	if err != nil {
+		return err
+	}
+	if w.f == nil {
+		f, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return err
+		}
+		w.f = f
+	}
+	_, err = w.f.Write(data)
+	return err
+}
+
+func (w *eventWriter) close() error {
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
+
+// loadEvents returns the saved events of a job. A line cut short by a crash
+// ends the events.
+func (st *jobStore) loadEvents(id string) ([]turnEvent, error) {
+	f, err := os.Open(st.path(id, ".events.jsonl"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []turnEvent
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxJobEventBytes)
+	for scanner.Scan() {
+		var event storedEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil || event.ID != len(events)+1 {
+			break
+		}
+		events = append(events, turnEvent{id: event.ID, name: event.Event, data: event.Data})
+	}
+	return events, scanner.Err()
+}
+
+// rewriteEvents replaces the events file of a job, dropping what a crash left
+// after the last complete event.
+func (st *jobStore) rewriteEvents(id string, events []turnEvent) error {
+	var data []byte
+	for _, event := range events {
+		line, err := encodeEvent(event)
+		if err != nil {
+			return err
+		}
+		data = append(data, line...)
+	}
+	return writeFileAtomic(st.path(id, ".events.jsonl"), data)
+}
+
+func (st *jobStore) remove(id string) error {
+	for _, suffix := range []string{".json", ".memory.jsonl", ".events.jsonl"} {
+		if err := os.Remove(st.path(id, suffix)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// jobRunner runs a job and returns its result. It reports every completed
+// model round with step.
+type jobRunner func(ctx context.Context, record jobRecord, events *eventLog, step func()) (string, error)
+
+// jobManager queues the jobs, runs up to maxRunning of them at a time and
+// keeps them in the store, if any.
+type jobManager struct {
+	store      *jobStore
+	maxRunning int
+	timeout    time.Duration
+	redactor   *redact.Redactor
+	run        jobRunner
+
+	mu      sync.Mutex
+	jobs    map[string]*job
+	queue   []*job
+	running int
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+func newJobManager(store *jobStore, maxRunning int, timeout time.Duration, redactor *redact.Redactor, run jobRunner) *jobManager {
+	return &jobManager{
+		store:      store,
+		maxRunning: max(maxRunning, 1),
+		timeout:    timeout,
+		redactor:   redactor,
+		run:        run,
+		jobs:       make(map[string]*job),
+	}
+}
+
+// restore loads the saved jobs and queues again those a shutdown interrupted.
+func (m *jobManager) restore() error {
+	if m.store == nil {
+		return nil
+	}
+	records, err := m.store.load()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, record := range records {
+		j := &job{record: record}
+		if !record.Status.finished() {
+			events, err := m.store.loadEvents(record.ID)
+			if err != nil {
+				return err
+			}
+			if err := m.store.rewriteEvents(record.ID, events); err != nil {
+				return err
+			}
+			j.events = m.newEventLog(record.ID, events)
+			j.record.Status = jobQueued
+			m.queue = append(m.queue, j)
+		}
+		m.jobs[record.ID] = j
+	}
+	m.startQueuedLocked()
+	return nil
+}
+
+// newEventLog returns the event log of job id, continuing events, that saves
+// new events in the store. The events file is kept open until the log ends.
+func (m *jobManager) newEventLog(id string, events []turnEvent) *eventLog {
+	l := newEventLog()
+	l.events = events
+	if m.store != nil {
+		// The log calls both under its lock
+		writer := m.store.eventWriter(id)
+		l.onAppend = func(event turnEvent) {
+			if err := writer.write(event); err != nil {
+				log.Printf("Failed to save event of job %s: %v", id, err)
+			}
+		}
+		l.onEnd = func() {
+			if err := writer.close(); err != nil {
+				log.Printf("Failed to save events of job %s: %v", id, err)
+			}
+		}
+	}
+	return l
+}
+
+// saveLocked updates the record of j in the store.
+func (m *jobManager) saveLocked(j *job) error {
+	j.record.UpdatedAt = time.Now().Unix()
+	if m.store == nil {
+		return nil
+	}
+	return m.store.save(j.record)
+}
+
+// submit queues a job of principal, started by the schedule scheduleID if
+// set.
+func (m *jobManager) submit(principal *auth.Principal, req JobRequest, scheduleID string) (jobRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return jobRecord{}, errShuttingDown
+	}
+
+	agentMode := ai_agent.AgentMode(req.AgentMode)
+	if agentMode == "" {
+		agentMode = ai_agent.AgentModeLoop
+	}
+	j := &job{record: jobRecord{
+		ID:             uuid.NewString(),
+		Principal:      principal.ID,
+		Scopes:         principal.Scopes,
+		ScopesExpireAt: principal.ExpiresAt,
+		Status:         jobQueued,
+		Message:        req.Message,
+		Images:         req.Images,
+		AgentConfig:    req.AgentConfig,
+		AgentMode:      agentMode,
+		ScheduleID:     scheduleID,
+		CreatedAt:      time.Now().Unix(),
+	}}
+	j.events = m.newEventLog(j.record.ID, nil)
+	if err := m.saveLocked(j); err != nil {
+		return jobRecord{}, err
+	}
+	m.jobs[j.record.ID] = j
+	m.queue = append(m.queue, j)
+	m.startQueuedLocked()
+	return j.record, nil
+}
+
+func (m *jobManager) startQueuedLocked() {
+	for !m.closed && m.running < m.maxRunning && len(m.queue) > 0 {
+		j := m.queue[0]
+		m.queue = m.queue[1:]
+
+		ctx, cancel := context.WithCancelCause(context.Background())
+		j.cancel = cancel
+		j.record.Status = jobRunning
+		j.record.Attempts++
+		j.record.StartedAt = time.Now().Unix()
+		if err := m.saveLocked(j); err != nil {
+			log.Printf("Failed to save job %s: %v", j.record.ID, err)
+		}
+		j.events.append("job", map[string]interface{}{
+			"jobId":     j.record.ID,
+			"status":    j.record.Status,
+			"attempt":   j.record.Attempts,
+			"timestamp": time.Now().Unix(),
+		})
+
+		m.running++
+		m.wg.Add(1)
+		go m.execute(ctx, j, j.record)
+	}
+}
+
+func (m *jobManager) execute(ctx context.Context, j *job, record jobRecord) {
+	defer m.wg.Done()
+	if m.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, m.timeout, errJobTimeout)
+		defer cancel()
+	}
+
+	result, err := func() (result string, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic in job: %v", r)
+			}
+		}()
+		return m.run(ctx, record, j.events, func() {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			j.record.Steps++
+			if err := m.saveLocked(j); err != nil {
+				log.Printf("Failed to save job %s: %v", j.record.ID, err)
+			}
+		})
+	}()
+	cause := context.Cause(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.running--
+	j.cancel(nil)
+	j.cancel = nil
+
+	switch {
+	case err == nil:
+		j.record.Status = jobSucceeded
+		j.record.Result = result
+	case errors.Is(cause, errShuttingDown):
+		// Run it again on the next start; the log stays open for it.
+		j.record.Status = jobQueued
+		if err := m.saveLocked(j); err != nil {
+			log.Printf("Failed to save job %s: %v", j.record.ID, err)
+		}
+		return
+	case errors.Is(cause, errJobCancelled):
+		j.record.Status = jobCancelled
+	case errors.Is(cause, errJobTimeout):
+		j.record.Status = jobFailed
+		j.record.Error = errJobTimeout.Error()
+	default:
+		log.Printf("Job %s failed: %v", j.record.ID, err)
+		j.record.Status = jobFailed
+		j.record.Error = err.Error()
+	}
+	m.finishLocked(j)
+	m.startQueuedLocked()
+}
+
+// finishLocked saves the final state of j and ends its events with a
+// complete, error or cancelled event.
+func (m *jobManager) finishLocked(j *job) {
+	j.record.FinishedAt = time.Now().Unix()
+	if err := m.saveLocked(j); err != nil {
+		log.Printf("Failed to save job %s: %v", j.record.ID, err)
+	}
+	switch j.record.Status {
+	case jobSucceeded:
+		j.events.append("complete", map[string]interface{}{
+			"jobId":     j.record.ID,
+			"result":    m.redactor.Redact(j.record.Result),
+			"timestamp": time.Now().Unix(),
+		})
+	case jobFailed:
+		j.events.append("error", map[string]interface{}{
+			"jobId":     j.record.ID,
+			"error":     m.redactor.Redact(j.record.Error),
+			"timestamp": time.Now().Unix(),
+		})
+	default:
+		j.events.append("cancelled", map[string]interface{}{
+			"jobId":     j.record.ID,
+			"timestamp": time.Now().Unix(),
+		})
+	}
+	j.events.end()
+}
+
+// lookupLocked returns the job id on behalf of principal. Jobs of other
+// principals are reported as not found unless principal has every scope.
+func (m *jobManager) lookupLocked(id string, principal *auth.Principal) (*job, error) {
+	j, ok := m.jobs[id]
+	if !ok || (j.record.Principal != principal.ID && !principal.HasScope(auth.ScopeAll)) {
+		return nil, errJobNotFound
+	}
+	return j, nil
+}
+
+func (m *jobManager) get(id string, principal *auth.Principal) (jobRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, err := m.lookupLocked(id, principal)
+	if err != nil {
+		return jobRecord{}, err
+	}
+	return j.record, nil
+}
+
+// list returns the jobs of principal, or all jobs if it has every scope,
+// newest first.
+func (m *jobManager) list(principal *auth.Principal) []jobRecord {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	records := make([]jobRecord, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		if j.record.Principal == principal.ID || principal.HasScope(auth.ScopeAll) {
+			records = append(records, j.record)
+		}
+	}
+	slices.SortFunc(records, func(a, b jobRecord) int {
+		return cmp.Compare(b.CreatedAt, a.CreatedAt)
+	})
+	return records
+}
+
+// eventLog returns the events of the job id.
+func (m *jobManager) eventLog(id string, principal *auth.Principal) (*eventLog, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, err := m.lookupLocked(id, principal)
+	if err != nil {
+		return nil, err
+	}
+	if j.events != nil {
+		return j.events, nil
+	}
+	events, err := m.store.loadEvents(id)
+	if err != nil {
+		return nil, err
+	}
+	l := newEventLog()
+	l.events = events
+	l.ended = true
+	return l, nil
+}
+
+// cancel cancels the job id on behalf of principal: a queued job at once, a
+// running one once its agent stopped. It returns the resulting status.
+func (m *jobManager) cancel(id string, principal *auth.Principal) (jobStatus, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, err := m.lookupLocked(id, principal)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case j.record.Status.finished():
+		return "", errJobFinished
+	case j.cancel != nil:
+		j.cancel(errJobCancelled)
+		return jobRunning, nil
+	}
+	m.queue = slices.DeleteFunc(m.queue, func(queued *job) bool {
+		return queued == j
+	})
+	j.record.Status = jobCancelled
+	m.finishLocked(j)
+	return jobCancelled, nil
+}
+
+// remove deletes the finished job id on behalf of principal.
+func (m *jobManager) remove(id string, principal *auth.Principal) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, err := m.lookupLocked(id, principal)
+	if err != nil {
+		return err
+	}
+	if !j.record.Status.finished() {
+		return errJobNotStopped
+	}
+	if m.store != nil {
+		if err := m.store.remove(id); err != nil {
+			return err
+		}
+	}
+	delete(m.jobs, id)
+	return nil
+}
+
+// stop rejects new jobs and interrupts the running ones, which are queued
+// again on the next start, then waits up to timeout for them to stop.
+func (m *jobManager) stop(timeout time.Duration) error {
+	m.mu.Lock()
+	m.closed = true
+	for _, j := range m.jobs {
+		if j.cancel != nil {
+			j.cancel(errShuttingDown)
+		}
+	}
+	m.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		return errors.New("timed out waiting for jobs to stop")
+	}
+
+	// Release the streams of the jobs that run again after the restart
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, j := range m.jobs {
+		if !j.record.Status.finished() {
+			j.events.end()
+		}
+	}
+	return nil
+}
+
+// jobCheckpoint saves the memory of a job agent after every model round, if
+// the jobs are stored, and reports the step.
+type jobCheckpoint struct {
+	memory *fileCheckpoint
+	step   func()
+}
+
+func (c *jobCheckpoint) Do(agentDouble *ai_agent.AgentDouble) error {
+	if c.memory != nil {
+		if err := c.memory.Do(agentDouble); err != nil {
+			return err
+		}
+	}
+	c.step()
+	return nil
+}
+
+// runJob runs a job with an agent of its own, created with the current
+// configuration. A job that already completed steps continues from the
+// memory saved after the last one. The run holds a slot of the chat policy
+// of the submitting principal and charges its model tokens to the
+// principal's quota; jobs have no client IP and are only limited per
+// principal.
+// admitJob charges an attempt of a job to the rate limits of principal. An
+// accepted job waits while its principal is at its concurrency cap or rate
+// limit instead of failing; only a spent daily quota fails it.
+func (s *Server) admitJob(ctx context.Context, principal *auth.Principal) (context.Context, func(), error) {
+	for {
+		admitted, release, limitErr := s.rateLimits.admit(ctx, principal, "", "POST /chat", scopeChat)
+		if limitErr == nil {
+			return admitted, release, nil
+		}
+		if limitErr.Reason == ratelimit.ReasonQuota {
+			return nil, nil, limitErr
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil, context.Cause(ctx)
+		case <-time.After(limitErr.RetryAfter):
+		}
+	}
+}
+
+func (s *Server) runJob(ctx context.Context, record jobRecord, events *eventLog, step func()) (string, error) {
+	// The principal may have been revoked since the job was submitted, or
+	// before a restart that resumes it
+	principal, err := s.reauthorize(record.Principal, record.Scopes, record.ScopesExpireAt, scopeChat)
+	if err != nil {
+		return "", fmt.Errorf("principal is no longer authorized: %w", err)
+	}
+	ctx, err = chatTurnContext(ctx, principal, "", record.AgentConfig)
+	if err != nil {
+		return "", err
+	}
+	ctx, release, err := s.admitJob(ctx, principal)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	config := s.agent.ConfigSnapshot()
+	config.AgentMode = record.AgentMode
+	checkpoint := &jobCheckpoint{step: step}
+	if s.jobs.store != nil {
+		checkpoint.memory = s.jobs.store.checkpoint(record.ID)
+	}
+	agent, err := ai_agent.NewAgentDouble(ctx, func(option *ai_agent.AgentDoubleOption) {
+		option.SetConfig(&config)
+		// Share the model and vector store clients of the service agent
+		option.SetAgent(s.agent.Agent)
+		option.SetCharacter(s.config.AgentCharacter)
+		option.SetRole(s.config.AgentRole)
+		option.SetCheckpoint(checkpoint)
+		s.skills(option)
+	})
+	if err != nil {
+		return "", err
+	}
+	agent.InitMemory()
+	addToolSampleMemories(agent)
+	resume := record.Steps > 0 && checkpoint.memory != nil
+	if resume {
+		if err := checkpoint.memory.restore(agent); err != nil {
+			return "", fmt.Errorf("failed to restore job memory: %w", err)
+		}
+	}
+	defer agent.WaitMemoryWriter()
+
+	err = s.recordAgentEvents(ctx, events, func(ctx context.Context, callback func(string) error) error {
+		if resume {
+			return agent.Think(ctx, func(output any) error {
+				return callback(fmt.Sprint(output))
+			})
+		}
+		return agent.ListenAndWatch(ctx, record.Message, record.Images, callback)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// The result is the last answer of the model
+	memory := agent.MemorySnapshot()
+	for i := len(memory.Contexts) - 1; i >= 0; i-- {
+		if memory.Contexts[i].Source == ai_agent.MemorySourceModel {
+			return memory.Contexts[i].Content, nil
+		}
+	}
+	return "", nil
+}
+
+// jobView is the API representation of a job, with masked content.
+func (s *Server) jobView(record jobRecord) gin.H {
+	view := gin.H{
+		"id":        record.ID,
+		"principal": record.Principal,
+		"status":    record.Status,
+		"message":   s.redactor.Redact(record.Message),
+		"images":    len(record.Images),
+		"agentMode": record.AgentMode,
+		"progress": gin.H{
+			"steps":    record.Steps,
+			"attempts": record.Attempts,
+		},
+		"createdAt": record.CreatedAt,
+		"updatedAt": record.UpdatedAt,
+	}
+	if record.ScheduleID != "" {
+		view["scheduleId"] = record.ScheduleID
+	}
+	if record.StartedAt != 0 {
+		view["startedAt"] = record.StartedAt
+	}
+	if record.FinishedAt != 0 {
+		view["finishedAt"] = record.FinishedAt
+	}
+	if record.Status == jobSucceeded {
+		view["result"] = s.redactor.Redact(record.Result)
+	}
+	if record.Error != "" {
+		view["error"] = s.redactor.Redact(record.Error)
+	}
+	return view
+}
+
+func (s *Server) createJobHandler(c *gin.Context) {
+	var req JobRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if req.Message == "" && len(req.Images) == 0 {
+		c.JSON(400, gin.H{"error": "Message or images are required"})
+		return
+	}
+	switch ai_agent.AgentMode(req.AgentMode) {
+	case "", ai_agent.AgentModeLoop, ai_agent.AgentModeChat:
+	default:
+		c.JSON(400, gin.H{"error": "agentMode must be loop or chat"})
+		return
+	}
+	if _, err := chatTurnContext(c.Request.Context(), principalFromContext(c), "", req.AgentConfig); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if !canRunInBackground(principalFromContext(c)) {
+		c.JSON(403, gin.H{"error": "Jobs need a token that expires"})
+		return
+	}
+
+	record, err := s.jobs.submit(principalFromContext(c), req, "")
+	if errors.Is(err, errShuttingDown) {
+		c.JSON(503, gin.H{"error": "Server is shutting down"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to save job: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to save job"})
+		return
+	}
+	c.JSON(202, s.jobView(record))
+}
+
+func (s *Server) listJobsHandler(c *gin.Context) {
+	status := jobStatus(c.Query("status"))
+	jobs := make([]gin.H, 0)
+	for _, record := range s.jobs.list(principalFromContext(c)) {
+		if status == "" || record.Status == status {
+			jobs = append(jobs, s.jobView(record))
+		}
+	}
+	c.JSON(200, gin.H{"jobs": jobs})
+}
+
+func (s *Server) getJobHandler(c *gin.Context) {
+	record, err := s.jobs.get(c.Param("id"), principalFromContext(c))
+	if err != nil {
+		c.JSON(404, gin.H{"error": "Job not found"})
+		return
+	}
+	c.JSON(200, s.jobView(record))
+}
+
+// jobEventsHandler replays the events of a job after the Last-Event-ID
+// header (or lastEventId query) and follows it while it runs.
+func (s *Server) jobEventsHandler(c *gin.Context) {
+	events, err := s.jobs.eventLog(c.Param("id"), principalFromContext(c))
+	if errors.Is(err, errJobNotFound) {
+		c.JSON(404, gin.H{"error": "Job not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load job events: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to load job events"})
+		return
+	}
+
+	lastEventID, ok := lastEventIDParam(c)
+	if !ok {
+		c.JSON(400, gin.H{"error": "Invalid Last-Event-ID"})
+		return
+	}
+	streamEvents(c, events, lastEventID)
+}
+
+func (s *Server) cancelJobHandler(c *gin.Context) {
+	id := c.Param("id")
+	status, err := s.jobs.cancel(id, principalFromContext(c))
+	switch {
+	case errors.Is(err, errJobFinished):
+		c.JSON(409, gin.H{"error": "Job already finished"})
+	case err != nil:
+		c.JSON(404, gin.H{"error": "Job not found"})
+	case status == jobRunning:
+		c.JSON(202, gin.H{"jobId": id, "status": "cancelling"})
+	default:
+		c.JSON(200, gin.H{"jobId": id, "status": status})
+	}
+}
+
+func (s *Server) deleteJobHandler(c *gin.Context) {
+	err := s.jobs.remove(c.Param("id"), principalFromContext(c))
+	switch {
+	case errors.Is(err, errJobNotFound):
+		c.JSON(404, gin.H{"error": "Job not found"})
+	case errors.Is(err, errJobNotStopped):
+		c.JSON(409, gin.H{"error": "Job is still queued or running"})
+	case err != nil:
+		log.Printf("Failed to delete job: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to delete job"})
+	default:
+		c.JSON(200, gin.H{"message": "Job deleted"})
+	}
+}
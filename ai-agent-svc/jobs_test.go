@@ -0,0 +1,206 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luoxiaojun1992/ai-agent/util/auth"
+	"github.com/luoxiaojun1992/ai-agent/util/ratelimit"
+)
+
+// withJobsDir stores the jobs of a test server in dir.
+func withJobsDir(dir string) func(config *Config) {
+	return func(config *Config) {
+		config.JobsDir = dir
+	}
+}
+
+// submitJob creates a job through the API and returns its id.
+func submitJob(t *testing.T, ts *testServer, req JobRequest) string {
+	t.Helper()
+	status, resp := ts.do(t, "POST", "/jobs", req)
+	id, _ := resp["id"].(string)
+	if status != 202 || id == "" {
+		t.Fatalf("create job: %d %v", status, resp)
+	}
+	return id
+}
+
+// waitJob waits until the job id reaches status and returns its record.
+func waitJob(t *testing.T, ts *testServer, id string, status jobStatus) jobRecord {
+	t.Helper()
+	var record jobRecord
+	eventually(t, "job "+string(status), func() bool {
+		var err error
+		record, err = ts.jobs.get(id, testPrincipal)
+		return err == nil && record.Status == status
+	})
+	return record
+}
+
+// jobEventNames returns the names of the events of job id, checking that
+// their ids count up from 1.
+func jobEventNames(t *testing.T, ts *testServer, id string) []string {
+	t.Helper()
+	events, err := ts.jobs.eventLog(id, testPrincipal)
+	if err != nil {
+		t.Fatalf("job events: %v", err)
+	}
+	recorded, _, _ := events.since(0)
+	names := make([]string, 0, len(recorded))
+	for i, event := range recorded {
+		if event.id != i+1 {
+			t.Fatalf("event %d has id %d", i+1, event.id)
+		}
+		names = append(names, event.name)
+	}
+	return names
+}
+
+func TestJobs_PersistedAcrossRestart(t *testing.T) {
+	dir := t.TempDir()
+	ts := newTestServer(t, withJobsDir(dir))
+	id := submitJob(t, ts, JobRequest{Message: "hello", AgentMode: "chat"})
+	waitJob(t, ts, id, jobSucceeded)
+	if err := ts.jobs.stop(5 * time.Second); err != nil {
+		t.Fatalf("stop jobs: %v", err)
+	}
+
+	restarted := newTestServer(t, withJobsDir(dir))
+	record := waitJob(t, restarted, id, jobSucceeded)
+	if record.Result != fakeAnswer || record.Attempts != 1 || record.Principal != testPrincipal.ID {
+		t.Fatalf("unexpected restored job %+v", record)
+	}
+	names := jobEventNames(t, restarted, id)
+	if len(names) < 3 || names[0] != "job" || names[len(names)-1] != "complete" {
+		t.Fatalf("unexpected restored events %v", names)
+	}
+
+	if status, resp := restarted.do(t, "DELETE", "/jobs/"+id, nil); status != 200 {
+		t.Fatalf("delete job: %d %v", status, resp)
+	}
+	if again := newTestServer(t, withJobsDir(dir)); len(again.jobs.list(testPrincipal)) != 0 {
+		t.Fatalf("expected the deleted job to be gone after a restart")
+	}
+}
+
+func TestJobs_Cancel(t *testing.T) {
+	ts := newTestServer(t)
+	ts.ollama.script(nil)
+	running := submitJob(t, ts, JobRequest{Message: "first", AgentMode: "chat"})
+	eventually(t, "the job to reach the model", func() bool { return ts.ollama.held() == 1 })
+	// JobsMaxRunning is 1
+	queued := submitJob(t, ts, JobRequest{Message: "second", AgentMode: "chat"})
+
+	if status, resp := ts.do(t, "POST", "/jobs/"+queued+"/cancel", nil); status != 200 || resp["status"] != string(jobCancelled) {
+		t.Fatalf("cancel queued job: %d %v", status, resp)
+	}
+	if status, resp := ts.do(t, "POST", "/jobs/"+running+"/cancel", nil); status != 202 || resp["status"] != "cancelling" {
+		t.Fatalf("cancel running job: %d %v", status, resp)
+	}
+	waitJob(t, ts, running, jobCancelled)
+	for _, id := range []string{queued, running} {
+		if names := jobEventNames(t, ts, id); names[len(names)-1] != "cancelled" {
+			t.Fatalf("job %s: unexpected events %v", id, names)
+		}
+	}
+	if status, _ := ts.do(t, "POST", "/jobs/"+running+"/cancel", nil); status != 409 {
+		t.Fatalf("expected 409 cancelling a finished job, got %d", status)
+	}
+}
+
+func TestJobs_ResumeAfterShutdown(t *testing.T) {
+	dir := t.TempDir()
+	ts := newTestServer(t, withJobsDir(dir))
+	// the loop stops in its second round
+	ts.ollama.script([]string{"step one"}, nil)
+	id := submitJob(t, ts, JobRequest{Message: "work on it"})
+	eventually(t, "first step", func() bool {
+		record, err := ts.jobs.get(id, testPrincipal)
+		return err == nil && record.Steps == 1
+	})
+	if err := ts.jobs.stop(5 * time.Second); err != nil {
+		t.Fatalf("stop jobs: %v", err)
+	}
+	if record, _ := ts.jobs.get(id, testPrincipal); record.Status != jobQueued {
+		t.Fatalf("expected the interrupted job queued, got %+v", record)
+	}
+
+	restarted := newTestServer(t, withJobsDir(dir))
+	record := waitJob(t, restarted, id, jobSucceeded)
+	if record.Attempts != 2 || record.Steps != 2 || record.Result != fakeAnswer {
+		t.Fatalf("unexpected resumed job %+v", record)
+	}
+	var jobEvents, messages int
+	names := jobEventNames(t, restarted, id)
+	for _, name := range names {
+		switch name {
+		case "job":
+			jobEvents++
+		case "message":
+			messages++
+		}
+	}
+	if jobEvents != 2 || messages < 2 || names[len(names)-1] != "complete" {
+		t.Fatalf("expected the events of both attempts, got %v", names)
+	}
+}
+
+func TestJobs_ChargedToPrincipal(t *testing.T) {
+	ts := newTestServer(t, func(config *Config) {
+		config.RateLimits = map[string]ratelimit.Policy{"chat": {Key: ratelimit.Limit{Concurrency: 1}}}
+		config.JobsMaxRunning = 2
+	})
+	ts.ollama.script(nil)
+	id := submitJob(t, ts, JobRequest{Message: "hello", AgentMode: "chat"})
+	eventually(t, "the job to reach the model", func() bool { return ts.ollama.held() == 1 })
+	// a second job of the principal, as a schedule starts it, waits for the
+	// slot instead of failing
+	queued, err := ts.jobs.submit(testPrincipal, JobRequest{Message: "hello", AgentMode: "chat"}, "")
+	if err != nil {
+		t.Fatalf("submit job: %v", err)
+	}
+	waiting := queued.ID
+	waitJob(t, ts, waiting, jobRunning)
+
+	// the running job holds the only chat slot of its principal
+	if _, _, limitErr := ts.rateLimits.admit(t.Context(), testPrincipal, "10.0.0.1", "POST /chat", scopeChat); limitErr == nil || limitErr.Reason != ratelimit.ReasonConcurrency {
+		t.Fatalf("expected the job to hold the slot, got %v", limitErr)
+	}
+	if status, _ := ts.do(t, "POST", "/chat", map[string]any{"message": "hi"}); status != 429 {
+		t.Fatalf("expected chats rejected while the job runs, got %d", status)
+	}
+	ts.jobs.cancel(id, testPrincipal)
+	waitJob(t, ts, id, jobCancelled)
+	waitJob(t, ts, waiting, jobSucceeded)
+
+	id = submitJob(t, ts, JobRequest{Message: "hello", AgentMode: "chat"})
+	waitJob(t, ts, id, jobSucceeded)
+	if tokens := ts.rateLimits.keyUsage.Tokens(testPrincipal.ID); tokens < fakeUsage.TotalTokens() {
+		t.Fatalf("expected the job tokens charged to its principal, got %d", tokens)
+	}
+	if status, _ := ts.do(t, "POST", "/chat", map[string]any{"message": "hi"}); status != 200 {
+		t.Fatalf("expected the slot freed by the finished jobs, got %d", status)
+	}
+}
+
+func TestJobs_ReauthorizedBeforeEachAttempt(t *testing.T) {
+	dir := t.TempDir()
+	ts := newTestServer(t, withJobsDir(dir))
+	ts.ollama.script(nil)
+	id := submitJob(t, ts, JobRequest{Message: "hello", AgentMode: "chat"})
+	eventually(t, "the job to reach the model", func() bool { return ts.ollama.held() == 1 })
+	if err := ts.jobs.stop(5 * time.Second); err != nil {
+		t.Fatalf("stop jobs: %v", err)
+	}
+
+	// the key lost the chat scope before the restart that resumes the job
+	restarted := newTestServer(t, withJobsDir(dir), func(config *Config) {
+		config.Auth.APIKeys = []auth.APIKey{{ID: "test", Key: "test-key", Scopes: []string{scopeMemory}}}
+	})
+	record := waitJob(t, restarted, id, jobFailed)
+	if record.Attempts != 2 || !strings.Contains(record.Error, "no longer authorized: missing scope chat") {
+		t.Fatalf("unexpected job %+v", record)
+	}
+}
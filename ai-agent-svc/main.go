@@ -2,30 +2,52 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
+	"github.com/gin-contrib/sse"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	ai_agent "github.com/luoxiaojun1992/ai-agent"
 	mcpClient "github.com/luoxiaojun1992/ai-agent/pkg/mcp"
+	"github.com/luoxiaojun1992/ai-agent/pkg/ollama"
 	skillSet "github.com/luoxiaojun1992/ai-agent/skill/impl"
 	directory_reader "github.com/luoxiaojun1992/ai-agent/skill/impl/filesystem/directory"
 	file_reader "github.com/luoxiaojun1992/ai-agent/skill/impl/filesystem/file"
 	time_skill "github.com/luoxiaojun1992/ai-agent/skill/impl/time"
+	"github.com/luoxiaojun1992/ai-agent/util/auth"
+	"github.com/luoxiaojun1992/ai-agent/util/guardrail"
+	"github.com/luoxiaojun1992/ai-agent/util/prompt"
+	"github.com/luoxiaojun1992/ai-agent/util/ratelimit"
+	"github.com/luoxiaojun1992/ai-agent/util/redact"
+	"github.com/luoxiaojun1992/ai-agent/util/review"
+	"github.com/luoxiaojun1992/ai-agent/util/schema"
+	"github.com/luoxiaojun1992/ai-agent/util/tokenizer"
 )
 
 type Server struct {
 	agent              *ai_agent.AgentDouble
+	ollamaCli          ollama.IClient
+	modelPuller        *modelPuller
+	redactor           *redact.Redactor
+	authenticator      auth.Authenticator
+	rateLimits         *rateLimits
+	turns              *turnRegistry
+	jobs               *jobManager
+	schedules          *scheduler
+	skills             func(option *ai_agent.AgentDoubleOption)
 	router             *gin.Engine
 	config             *Config
 	ctx                context.Context
@@ -36,38 +58,60 @@ type Server struct {
 }
 
 type Config struct {
-	Port           string
-	CORSOrigins    []string
-	AgentConfig    *ai_agent.Config
-	AgentCharacter string
-	AgentRole      string
+	Port                string
+	CORSOrigins         []string
+	Auth                AuthConfig
+	RateLimits          map[string]ratelimit.Policy
+	ShutdownGracePeriod time.Duration
+	CheckpointFile      string
+	StreamRetention     time.Duration
+	ChatTimeout         time.Duration
+	JobsDir             string
+	JobsMaxRunning      int
+	JobTimeout          time.Duration
+	SchedulesFile       string
+	AgentConfig         *ai_agent.Config
+	AgentCharacter      string
+	AgentRole           string
 }
 
+// toolSampleMemoryPriority keeps the few-shot samples in the context longer
+// than regular conversation turns when compression has to evict messages.
+const toolSampleMemoryPriority = 10
+
 func addToolSampleMemories(ad *ai_agent.AgentDouble) {
-	ad.AddAssistantMemory("Beginning of sample conversation with tool calls, only for reference", nil).
-		AddUserMemory("Please tell me what's the weather like today", nil).
-		AddAssistantMemory(`<tool>{"function":"mcp_web_search","context":{"name":"search","arguments":{"query":"what's the weather like today"}}}</tool>`, nil).
-		AddUserMemory("What's the weather like today", nil).
-		AddAssistantMemory(`<tool>{"function":"mcp_web_search","context":{"name":"search","arguments":{"query":"what's the weather like today"}}}</tool>`, nil).
-		AddUserMemory("What's AI", nil).
-		AddAssistantMemory(`<tool>{"function":"mcp_web_search","context":{"name":"search","arguments":{"query":"What's AI"}}}</tool>`, nil).
-		AddUserMemory("AI", nil).
-		AddAssistantMemory(`<tool>{"function":"mcp_web_search","context":{"name":"search","arguments":{"query":"AI"}}}</tool>`, nil).
-		AddUserMemory("weather", nil).
-		AddAssistantMemory(`<tool>{"function":"mcp_web_search","context":{"name":"search","arguments":{"query":"weather"}}}</tool>`, nil).
-		AddUserMemory("search weather", nil).
-		AddAssistantMemory(`<tool>{"function":"mcp_web_search","context":{"name":"search","arguments":{"query":"weather"}}}</tool>`, nil).
-		AddUserMemory("sleep", nil).
-		AddAssistantMemory(`<tool>{"function":"sleep","context":{"duration":"1s"}}}</tool>`, nil).
-		AddUserMemory("how to use mongodb", nil).
-		AddAssistantMemory(`<tool>{"function":"mcp_code_repo_search","context":{"name":"resolve-library-id","arguments":{"libraryName":"mongodb"}}}</tool>`, nil).
-		AddToolMemory("/mongodb/docs", nil).
-		AddAssistantMemory(`<tool>{"function":"mcp_code_repo_search","context":{"name":"get-library-docs","arguments":{"context7CompatibleLibraryID":"/mongodb/docs"}}}</tool>`, nil).
-		AddUserMemory("how to use next.js", nil).
-		AddAssistantMemory(`<tool>{"function":"mcp_code_repo_search","context":{"name":"resolve-library-id","arguments":{"libraryName":"next.js"}}}</tool>`, nil).
-		AddToolMemory("/vercel/next.js", nil).
-		AddAssistantMemory(`<tool>{"function":"mcp_code_repo_search","context":{"name":"get-library-docs","arguments":{"context7CompatibleLibraryID":"/vercel/next.js"}}}</tool>`, nil).
-		AddAssistantMemory("End of sample conversation with tool calls, only for reference", nil)
+	samples := []struct {
+		role    string
+		content string
+	}{
+		{"assistant", "Beginning of sample conversation with tool calls, only for reference"},
+		{"user", "Please tell me what's the weather like today"},
+		{"assistant", `<tool>{"function":"mcp_web_search","context":{"name":"search","arguments":{"query":"what's the weather like today"}}}</tool>`},
+		{"user", "What's the weather like today"},
+		{"assistant", `<tool>{"function":"mcp_web_search","context":{"name":"search","arguments":{"query":"what's the weather like today"}}}</tool>`},
+		{"user", "What's AI"},
+		{"assistant", `<tool>{"function":"mcp_web_search","context":{"name":"search","arguments":{"query":"What's AI"}}}</tool>`},
+		{"user", "AI"},
+		{"assistant", `<tool>{"function":"mcp_web_search","context":{"name":"search","arguments":{"query":"AI"}}}</tool>`},
+		{"user", "weather"},
+		{"assistant", `<tool>{"function":"mcp_web_search","context":{"name":"search","arguments":{"query":"weather"}}}</tool>`},
+		{"user", "search weather"},
+		{"assistant", `<tool>{"function":"mcp_web_search","context":{"name":"search","arguments":{"query":"weather"}}}</tool>`},
+		{"user", "sleep"},
+		{"assistant", `<tool>{"function":"sleep","context":{"duration":"1s"}}</tool>`},
+		{"user", "how to use mongodb"},
+		{"assistant", `<tool>{"function":"mcp_code_repo_search","context":{"name":"resolve-library-id","arguments":{"libraryName":"mongodb"}}}</tool>`},
+		{"tool", "/mongodb/docs"},
+		{"assistant", `<tool>{"function":"mcp_code_repo_search","context":{"name":"get-library-docs","arguments":{"context7CompatibleLibraryID":"/mongodb/docs"}}}</tool>`},
+		{"user", "how to use next.js"},
+		{"assistant", `<tool>{"function":"mcp_code_repo_search","context":{"name":"resolve-library-id","arguments":{"libraryName":"next.js"}}}</tool>`},
+		{"tool", "/vercel/next.js"},
+		{"assistant", `<tool>{"function":"mcp_code_repo_search","context":{"name":"get-library-docs","arguments":{"context7CompatibleLibraryID":"/vercel/next.js"}}}</tool>`},
+		{"assistant", "End of sample conversation with tool calls, only for reference"},
+	}
+	for _, sample := range samples {
+		ad.AddMemoryWithAttributes(sample.role, sample.content, nil, ai_agent.MemoryAttributes{Priority: toolSampleMemoryPriority})
+	}
 }
 
 func NewServer() (*Server, error) {
@@ -76,30 +120,88 @@ func NewServer() (*Server, error) {
 	// Load configuration
 	config := &Config{
 		Port:        getEnv("PORT", "8080"),
-		CORSOrigins: []string{"*"}, // Default to allow all origins
+		CORSOrigins: getCORSOriginsEnv("CORS_ORIGINS"),
+		Auth:        loadAuthConfig(),
+		RateLimits:  getRateLimitsEnv("RATE_LIMITS", "RATE_LIMITS_FILE"),
+		// Running turns get this long to finish on shutdown before they are
+		// cancelled.
+		ShutdownGracePeriod: time.Duration(getIntEnv("SHUTDOWN_GRACE_PERIOD_SECONDS", 30)) * time.Second,
+		CheckpointFile:      getEnv("CHECKPOINT_FILE", ""),
+		// Streamed turns can be replayed for this long after they end.
+		StreamRetention: time.Duration(getIntEnv("STREAM_RETENTION_SECONDS", 300)) * time.Second,
+		// Chat turns are cancelled this long after they started.
+		ChatTimeout: time.Duration(getIntEnv("CHAT_TIMEOUT_SECONDS", 600)) * time.Second,
+		// Jobs are kept in memory only without a directory.
+		JobsDir:        getEnv("JOBS_DIR", ""),
+		JobsMaxRunning: getIntEnv("JOBS_MAX_RUNNING", 2),
+		JobTimeout:     time.Duration(getIntEnv("JOB_TIMEOUT_SECONDS", 3600)) * time.Second,
+		// Schedules are kept in memory only without a file.
+		SchedulesFile: getEnv("SCHEDULES_FILE", ""),
 		AgentConfig: &ai_agent.Config{
-			ChatModel:              getEnv("CHAT_MODEL", "qwen3:4b"),
-			EmbeddingModel:         getEnv("EMBEDDING_MODEL", "nomic-embed-text"),
-			SupervisorModel:        getEnv("SUPERVISOR_MODEL", "qwen3:4b"),
-			ModelTemperature:       getFloat32Env("MODEL_TEMPERATURE", 0.1),
-			SupervisorSwitch:       getBoolEnv("SUPERVISOR_SWITCH", false),
-			OllamaHost:             getEnv("OLLAMA_HOST", "http://ollama:11434"),
-			OllamaAPIType:          getEnv("OLLAMA_API_TYPE", "ollama"),
-			OllamaAPIKey:           getEnv("OLLAMA_API_KEY", ""),
-			MilvusHost:             getEnv("MILVUS_HOST", "milvus:19530"),
-			MilvusCollection:       getEnv("MILVUS_COLLECTION", "ai_agent_memory"),
-			HttpTimeout:            30 * time.Second,
-			HttpAllowRedirects:     true,
-			HttpMaxRedirects:       5,
-			ChatModelContextLimit:  1000000,
-			ContextReserveTokens:   getIntEnv("CONTEXT_RESERVE_TOKENS", 256),
-			NearDuplicateThreshold: getFloat64Env("NEAR_DUPLICATE_THRESHOLD", 0.90),
-			AgentMode:              ai_agent.AgentMode(getEnv("AGENT_MODE", string(ai_agent.AgentModeChat))),
-			AgentLoopDuration:      1 * time.Second,
+			ChatModel:                  getEnv("CHAT_MODEL", "qwen3:4b"),
+			EmbeddingModel:             getEnv("EMBEDDING_MODEL", "nomic-embed-text"),
+			SupervisorModel:            getEnv("SUPERVISOR_MODEL", "qwen3:4b"),
+			ModelTemperature:           getFloat32Env("MODEL_TEMPERATURE", 0.1),
+			SupervisorSwitch:           getBoolEnv("SUPERVISOR_SWITCH", false),
+			SupervisorRubrics:          getListEnv("SUPERVISOR_RUBRICS"),
+			SupervisorPolicy:           getEnv("SUPERVISOR_POLICY", ""),
+			SupervisorMaxRevisions:     getIntEnv("SUPERVISOR_MAX_REVISIONS", 1),
+			SupervisorFailSeverity:     getSeverityEnv("SUPERVISOR_FAIL_SEVERITY", review.SeverityMedium),
+			OllamaHost:                 getEnv("OLLAMA_HOST", "http://ollama:11434"),
+			OllamaAPIType:              getEnv("OLLAMA_API_TYPE", "ollama"),
+			OllamaAPIKey:               getEnv("OLLAMA_API_KEY", ""),
+			MilvusHost:                 getEnv("MILVUS_HOST", "milvus:19530"),
+			MilvusCollection:           getEnv("MILVUS_COLLECTION", "ai_agent_memory"),
+			HttpTimeout:                30 * time.Second,
+			HttpAllowRedirects:         true,
+			HttpMaxRedirects:           5,
+			ChatModelContextLimit:      getIntEnv("CHAT_MODEL_CONTEXT_LIMIT", 0),
+			ContextLimitAutoDiscovery:  getBoolEnv("CONTEXT_LIMIT_AUTO_DISCOVERY", true),
+			ContextReserveTokens:       getIntEnv("CONTEXT_RESERVE_TOKENS", 256),
+			NearDuplicateThreshold:     getFloat64Env("NEAR_DUPLICATE_THRESHOLD", 0.90),
+			TokenizerFiles:             getTokenizerFilesEnv("TOKENIZER_FILES"),
+			ImageTokenCost:             getIntEnv("IMAGE_TOKEN_COST", 576),
+			MaxToolOutputTokens:        getIntEnv("MAX_TOOL_OUTPUT_TOKENS", 1024),
+			FunctionCallRepairAttempts: getIntEnv("FUNCTION_CALL_REPAIR_ATTEMPTS", 1),
+			StructuredOutputRetries:    getIntEnv("STRUCTURED_OUTPUT_RETRIES", 2),
+			Guardrails:                 getGuardrailsEnv("GUARDRAILS_FILE", "GUARDRAIL_PII_ACTION"),
+			GuardrailModel:             getEnv("GUARDRAIL_MODEL", ""),
+			UntrustedSkills:            getListEnv("UNTRUSTED_SKILLS"),
+			DestructiveSkills:          getListEnv("DESTRUCTIVE_SKILLS"),
+			ApprovedSkills:             getListEnv("APPROVED_SKILLS"),
+			Think:                      getOptionalBoolEnv("THINK"),
+			KeepThinkingInMemory:       getBoolEnv("KEEP_THINKING_IN_MEMORY", false),
+			AgentMode:                  ai_agent.AgentMode(getEnv("AGENT_MODE", string(ai_agent.AgentModeChat))),
+			AgentLoopDuration:          1 * time.Second,
+			RecallTopK:                 getIntEnv("RECALL_TOP_K", 3),
+			RecallRRFK:                 getIntEnv("RECALL_RRF_K", 60),
+			RecallMMRLambda:            getFloat64Env("RECALL_MMR_LAMBDA", 0.7),
+			RecallDedupThreshold:       getFloat64Env("RECALL_DEDUP_THRESHOLD", 0.9),
+			RecallRerankModel:          getEnv("RECALL_RERANK_MODEL", ""),
+			SummarizerModel:            getEnv("SUMMARIZER_MODEL", ""),
+			MemoryWriterSwitch:         getBoolEnv("MEMORY_WRITER_SWITCH", false),
+			MemoryWriterModel:          getEnv("MEMORY_WRITER_MODEL", ""),
+			Sampling: ai_agent.SamplingOptions{
+				Temperature:      getOptionalFloat32Env("MODEL_TEMPERATURE"),
+				TopP:             getOptionalFloat32Env("MODEL_TOP_P"),
+				TopK:             getIntEnv("MODEL_TOP_K", 0),
+				Seed:             getOptionalIntEnv("MODEL_SEED"),
+				NumCtx:           getIntEnv("MODEL_NUM_CTX", 0),
+				NumPredict:       getIntEnv("MODEL_NUM_PREDICT", 0),
+				Stop:             getListEnv("MODEL_STOP"),
+				RepeatPenalty:    getFloat32Env("MODEL_REPEAT_PENALTY", 0),
+				PresencePenalty:  getFloat32Env("MODEL_PRESENCE_PENALTY", 0),
+				FrequencyPenalty: getFloat32Env("MODEL_FREQUENCY_PENALTY", 0),
+				KeepAlive:        getEnv("MODEL_KEEP_ALIVE", ""),
+			},
 		},
 		AgentCharacter: getEnv("AGENT_CHARACTER", "I am a helpful AI assistant."),
 		AgentRole:      getEnv("AGENT_ROLE", "AI Assistant"),
 	}
+	if _, err := review.RubricsByName(config.AgentConfig.SupervisorRubrics); err != nil {
+		cancel()
+		return nil, err
+	}
 
 	mcpWebSearchClient, err := mcpClient.NewClient(&mcpClient.Config{
 		Host:       getEnv("MCP_WEB_SEARCH_HOST", "http://mcp-web-search:3000"),
@@ -144,30 +246,25 @@ func NewServer() (*Server, error) {
 		}
 	}
 
+	var checkpoint *fileCheckpoint
+	if config.CheckpointFile != "" {
+		checkpoint = &fileCheckpoint{path: config.CheckpointFile}
+	}
+
+	skills := func(option *ai_agent.AgentDoubleOption) {
+		addSkills(option, mcpWebSearchClient, mcpContext7Client, mcpWorkspaceClient)
+	}
+
 	// Create agent with skills
 	agent, err := ai_agent.NewAgentDouble(ctx,
 		func(option *ai_agent.AgentDoubleOption) {
 			option.SetConfig(config.AgentConfig)
 			option.SetCharacter(config.AgentCharacter)
 			option.SetRole(config.AgentRole)
-
-			// Add filesystem skills
-			option.AddSkill("file_reader", &file_reader.Reader{RootDir: "/tmp/agent"})
-			option.AddSkill("file_writer", &file_reader.Writer{RootDir: "/tmp/agent"})
-			option.AddSkill("file_remover", &file_reader.Remover{RootDir: "/tmp/agent"})
-			option.AddSkill("directory_reader", &directory_reader.Reader{RootDir: "/tmp/agent"})
-			option.AddSkill("directory_writer", &directory_reader.Writer{RootDir: "/tmp/agent"})
-			option.AddSkill("directory_remover", &directory_reader.Remover{RootDir: "/tmp/agent"})
-
-			// Add MCP skills
-			option.AddSkill("mcp_web_search", &skillSet.MCP{MCPClient: mcpWebSearchClient})
-			option.AddSkill("mcp_code_repo_search", &skillSet.MCP{MCPClient: mcpContext7Client})
-			if mcpWorkspaceClient != nil {
-				option.AddSkill("mcp_workspace", &skillSet.MCP{MCPClient: mcpWorkspaceClient})
+			if checkpoint != nil {
+				option.SetCheckpoint(checkpoint)
 			}
-
-			// Add time skills
-			option.AddSkill("sleep", &time_skill.Sleep{})
+			skills(option)
 		},
 	)
 
@@ -179,22 +276,69 @@ func NewServer() (*Server, error) {
 	// Initialize memory
 	agent.InitMemory()
 	addToolSampleMemories(agent)
+	if checkpoint != nil {
+		if err := checkpoint.restore(agent); err != nil {
+			cancel()
+			return nil, fmt.Errorf("failed to restore checkpoint: %w", err)
+		}
+	}
+
+	// Mask credentials and configured secrets in all log output
+	redactor := newRedactor(config)
+	log.SetOutput(redact.Writer(os.Stderr, redactor))
+	gin.DefaultWriter = redact.Writer(os.Stdout, redactor)
+	gin.DefaultErrorWriter = redact.Writer(os.Stderr, redactor)
+
+	authenticator, err := newAuthenticator(config.Auth)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
 
 	// Setup Gin router
-	router := gin.Default()
+	router := newRouter()
+	// Match on the escaped path so model names can carry an escaped "/".
+	router.UseRawPath = true
+	// Only trust X-Forwarded-For from the configured proxies, so per-IP rate
+	// limits can't be dodged with a forged header.
+	if err := router.SetTrustedProxies(getListEnv("TRUSTED_PROXIES")); err != nil {
+		cancel()
+		return nil, err
+	}
 
-	// Configure CORS
+	// Configure CORS; credentials are only allowed for explicit origins
 	router.Use(cors.New(cors.Config{
 		AllowOrigins:     config.CORSOrigins,
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length", "X-Stream-Mode"},
-		AllowCredentials: true,
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "X-API-Key", "X-Session-ID", "Last-Event-ID"},
+		ExposeHeaders:    []string{"Content-Length", "X-Stream-Mode", "Retry-After", "X-Turn-ID"},
+		AllowCredentials: !slices.Contains(config.CORSOrigins, "*"),
 		MaxAge:           12 * time.Hour,
 	}))
 
-	return &Server{
+	ollamaCli := ollama.NewClient(&ollama.Config{
+		Host:    config.AgentConfig.OllamaHost,
+		APIType: config.AgentConfig.OllamaAPIType,
+		APIKey:  config.AgentConfig.OllamaAPIKey,
+	})
+
+	var jobStore *jobStore
+	if config.JobsDir != "" {
+		if jobStore, err = newJobStore(config.JobsDir); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+
+	server := &Server{
 		agent:              agent,
+		ollamaCli:          ollamaCli,
+		modelPuller:        newModelPuller(ollamaCli),
+		redactor:           redactor,
+		authenticator:      authenticator,
+		rateLimits:         newRateLimits(config.RateLimits),
+		turns:              newTurnRegistry(config.StreamRetention),
+		skills:             skills,
 		router:             router,
 		config:             config,
 		ctx:                ctx,
@@ -202,7 +346,47 @@ func NewServer() (*Server, error) {
 		mcpWebSearchClient: mcpWebSearchClient,
 		mcpContext7Client:  mcpContext7Client,
 		mcpWorkspaceClient: mcpWorkspaceClient,
-	}, nil
+	}
+	server.jobs = newJobManager(jobStore, config.JobsMaxRunning, config.JobTimeout, redactor, server.runJob)
+	if err := server.jobs.restore(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to restore jobs: %w", err)
+	}
+	server.schedules = newScheduler(config.SchedulesFile, server.jobs, server.authorizeSchedule)
+	if err := server.schedules.load(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to load schedules: %w", err)
+	}
+	return server, nil
+}
+
+// newRouter returns the engine with the access log and panic recovery. The
+// query credentials of WebSocket clients are dropped before they are logged.
+func newRouter() *gin.Engine {
+	router := gin.New()
+	router.Use(stripAccessToken, gin.Logger(), gin.Recovery())
+	return router
+}
+
+// addSkills registers the skills of the service agents.
+func addSkills(option *ai_agent.AgentDoubleOption, mcpWebSearchClient, mcpContext7Client, mcpWorkspaceClient *mcpClient.Client) {
+	// Add filesystem skills
+	option.AddSkill("file_reader", &file_reader.Reader{RootDir: "/tmp/agent"})
+	option.AddSkill("file_writer", &file_reader.Writer{RootDir: "/tmp/agent"})
+	option.AddSkill("file_remover", &file_reader.Remover{RootDir: "/tmp/agent"})
+	option.AddSkill("directory_reader", &directory_reader.Reader{RootDir: "/tmp/agent"})
+	option.AddSkill("directory_writer", &directory_reader.Writer{RootDir: "/tmp/agent"})
+	option.AddSkill("directory_remover", &directory_reader.Remover{RootDir: "/tmp/agent"})
+
+	// Add MCP skills
+	option.AddSkill("mcp_web_search", &skillSet.MCP{MCPClient: mcpWebSearchClient})
+	option.AddSkill("mcp_code_repo_search", &skillSet.MCP{MCPClient: mcpContext7Client})
+	if mcpWorkspaceClient != nil {
+		option.AddSkill("mcp_workspace", &skillSet.MCP{MCPClient: mcpWorkspaceClient})
+	}
+
+	// Add time skills
+	option.AddSkill("sleep", &time_skill.Sleep{})
 }
 
 func (s *Server) setupRoutes() {
@@ -212,19 +396,64 @@ func (s *Server) setupRoutes() {
 	// Agent status
 	s.router.GET("/status", s.statusHandler)
 
+	// Everything else requires an authenticated principal with the route scope
+	// and is subject to the route rate limits
+	api := s.router.Group("", s.audit, s.authenticate)
+	chat := api.Group("", s.requireScope(scopeChat), s.rateLimit(scopeChat))
+	skill := api.Group("", s.requireScope(scopeSkill), s.rateLimit(scopeSkill))
+	config := api.Group("", s.requireScope(scopeConfig), s.rateLimit(scopeConfig))
+	memory := api.Group("", s.requireScope(scopeMemory), s.rateLimit(scopeMemory))
+
 	// Chat with agent
-	s.router.POST("/chat", s.chatHandler)
+	chat.POST("/chat", s.chatHandler)
+	chat.POST("/chat/:id/cancel", s.cancelTurnHandler)
+	chat.GET("/chat/:id/events", s.turnEventsHandler)
+	// WebSocket chat; its messages are rate limited like POST /chat
+	api.GET("/ws", s.requireScope(scopeChat), s.wsHandler)
+
+	// Background jobs
+	chat.POST("/jobs", s.createJobHandler)
+	chat.GET("/jobs", s.listJobsHandler)
+	chat.GET("/jobs/:id", s.getJobHandler)
+	chat.GET("/jobs/:id/events", s.jobEventsHandler)
+	chat.POST("/jobs/:id/cancel", s.cancelJobHandler)
+	chat.DELETE("/jobs/:id", s.deleteJobHandler)
+	chat.POST("/schedules", s.createScheduleHandler)
+	chat.GET("/schedules", s.listSchedulesHandler)
+	chat.GET("/schedules/:id", s.getScheduleHandler)
+	chat.PUT("/schedules/:id", s.updateScheduleHandler)
+	chat.DELETE("/schedules/:id", s.deleteScheduleHandler)
+	chat.GET("/schedules/:id/runs", s.listScheduleRunsHandler)
+	chat.POST("/schedules/:id/run", s.runScheduleHandler)
 
 	// Execute skill
-	s.router.POST("/skill", s.skillHandler)
+	skill.POST("/skill", s.skillHandler)
 
 	// Configuration
-	s.router.GET("/config", s.getConfigHandler)
-	s.router.PUT("/config", s.updateConfigHandler)
+	config.GET("/config", s.getConfigHandler)
+	config.PUT("/config", s.updateConfigHandler)
 
 	// Memory operations
-	s.router.GET("/memory", s.getMemoryHandler)
-	s.router.DELETE("/memory", s.clearMemoryHandler)
+	memory.GET("/memory", s.getMemoryHandler)
+	memory.DELETE("/memory", s.clearMemoryHandler)
+	memory.POST("/memory", s.insertMemoryHandler)
+	memory.GET("/memory/export", s.exportMemoryHandler)
+	memory.POST("/memory/import", s.importMemoryHandler)
+	memory.GET("/memory/:id", s.getMemoryByIDHandler)
+	memory.PUT("/memory/:id", s.editMemoryHandler)
+	memory.DELETE("/memory/:id", s.deleteMemoryHandler)
+
+	// Model management
+	config.GET("/models", s.listModelsHandler)
+	config.POST("/models/pull", s.pullModelHandler)
+	config.GET("/models/pulls", s.listModelPullsHandler)
+	config.GET("/models/:name", s.showModelHandler)
+	config.DELETE("/models/:name", s.deleteModelHandler)
+
+	// Conversation branches
+	memory.GET("/branches", s.listBranchesHandler)
+	memory.POST("/branches", s.forkBranchHandler)
+	memory.PUT("/branches/active", s.switchBranchHandler)
 }
 
 func (s *Server) healthHandler(c *gin.Context) {
@@ -247,6 +476,9 @@ type ChatRequest struct {
 	Images      []string               `json:"images,omitempty"`
 	AgentConfig map[string]interface{} `json:"agentConfig,omitempty"`
 	Stream      bool                   `json:"stream,omitempty"`
+	// ResponseSchema, a JSON Schema, requests a validated JSON answer returned
+	// as "data". It is only supported in blocking mode.
+	ResponseSchema json.RawMessage `json:"responseSchema,omitempty"`
 }
 
 func (s *Server) chatHandler(c *gin.Context) {
@@ -261,9 +493,40 @@ func (s *Server) chatHandler(c *gin.Context) {
 		return
 	}
 
+	ctx, err := chatTurnContext(c.Request.Context(), principalFromContext(c), c.GetHeader("X-Session-ID"), req.AgentConfig)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	c.Request = c.Request.WithContext(ctx)
+
+	if len(req.ResponseSchema) > 0 {
+		if req.Stream {
+			c.JSON(400, gin.H{"error": "responseSchema is not supported in stream mode"})
+			return
+		}
+		if _, err := schema.Parse(req.ResponseSchema); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	// Every turn gets an id the client can cancel it with. Streamed turns keep
+	// running when the client goes away so it can resume the stream.
+	parent := c.Request.Context()
+	if req.Stream {
+		parent = context.WithoutCancel(parent)
+	}
+	t, err := s.turns.start(parent, principalFromContext(c).ID, req.Stream)
+	if err != nil {
+		c.JSON(503, gin.H{"error": "Server is shutting down"})
+		return
+	}
+	c.Header("X-Turn-ID", t.id)
+
 	// Check if stream mode is requested
 	if req.Stream {
-		s.handleStreamChat(c, req.Message, req.Images)
+		s.handleStreamChat(c, t, req.Message, req.Images)
 		return
 	}
 
@@ -271,8 +534,15 @@ func (s *Server) chatHandler(c *gin.Context) {
 	// Create a channel to collect the response
 	responseChan := make(chan string, 1)
 	errChan := make(chan error, 1)
+	var (
+		thinking strings.Builder
+		data     json.RawMessage
+		reviews  []gin.H
+		events   []guardrail.Event
+	)
 
 	go func() {
+		defer s.turns.finish(t)
 		defer func() {
 			if r := recover(); r != nil {
 				errChan <- fmt.Errorf("panic in agent response: %v", r)
@@ -280,10 +550,28 @@ func (s *Server) chatHandler(c *gin.Context) {
 		}()
 
 		var response strings.Builder
-		err := s.agent.ListenAndWatch(c.Request.Context(), req.Message, req.Images, func(resp string) error {
-			response.WriteString(resp)
+		ctx := ai_agent.WithThinkingCallback(t.ctx, func(thought string) error {
+			thinking.WriteString(thought)
+			return nil
+		})
+		ctx = ai_agent.WithReviewCallback(ctx, func(revision int, verdicts []*review.Verdict) error {
+			reviews = append(reviews, gin.H{"revision": revision, "verdicts": verdicts})
 			return nil
 		})
+		ctx = ai_agent.WithGuardrailCallback(ctx, func(event guardrail.Event) error {
+			events = append(events, event)
+			return nil
+		})
+		collect := func(resp string) error {
+			response.WriteString(resp)
+			return nil
+		}
+		var err error
+		if len(req.ResponseSchema) > 0 {
+			data, err = s.agent.ListenAndWatchWithSchema(ctx, req.Message, req.Images, req.ResponseSchema, collect)
+		} else {
+			err = s.agent.ListenAndWatch(ctx, req.Message, req.Images, collect)
+		}
 
 		if err != nil {
 			log.Println("Error during agent response", err)
@@ -293,117 +581,431 @@ func (s *Server) chatHandler(c *gin.Context) {
 		}
 	}()
 
+	var timedOut <-chan time.Time
+	if s.config.ChatTimeout > 0 {
+		timedOut = time.After(s.config.ChatTimeout)
+	}
 	select {
 	case response := <-responseChan:
-		c.JSON(200, gin.H{
-			"response":  response,
+		body := gin.H{
+			"turnId":    t.id,
+			"response":  s.redactor.Redact(response),
 			"timestamp": time.Now().Unix(),
-		})
+		}
+		if thinking.Len() > 0 {
+			body["thinking"] = s.redactor.Redact(thinking.String())
+		}
+		if data != nil {
+			body["data"] = s.redactor.JSON(data)
+		}
+		if len(reviews) > 0 {
+			body["reviews"] = s.redactor.JSON(reviews)
+		}
+		if len(events) > 0 {
+			body["guardrails"] = s.redactor.JSON(events)
+		}
+		c.JSON(200, body)
 	case err := <-errChan:
-		c.JSON(500, gin.H{"error": err.Error()})
-	case <-time.After(600 * time.Second):
+		switch t.cancelled() {
+		case errTurnCancelled:
+			c.JSON(409, gin.H{"error": "Turn cancelled", "turnId": t.id})
+			return
+		case errShuttingDown:
+			c.JSON(503, gin.H{"error": "Server is shutting down", "turnId": t.id})
+			return
+		}
+		var structuredErr *ai_agent.StructuredOutputError
+		if errors.As(err, &structuredErr) {
+			c.JSON(422, gin.H{"error": s.redactor.Redact(err.Error())})
+			return
+		}
+		var blockedErr *guardrail.BlockedError
+		if errors.As(err, &blockedErr) {
+			status := 422
+			if blockedErr.Stage == guardrail.StageInput {
+				status = 400
+			}
+			c.JSON(status, gin.H{"error": s.redactor.Redact(err.Error()), "guardrails": s.redactor.JSON(events)})
+			return
+		}
+		var reviewErr *ai_agent.ReviewError
+		if errors.As(err, &reviewErr) {
+			c.JSON(422, gin.H{"error": s.redactor.Redact(err.Error()), "verdicts": s.redactor.JSON(reviewErr.Verdicts)})
+			return
+		}
+		c.JSON(500, gin.H{"error": s.redactor.Redact(err.Error())})
+	case <-timedOut:
+		t.cancel(errTurnTimeout)
 		c.JSON(504, gin.H{"error": "Request timeout"})
 	}
 }
 
-func (s *Server) handleStreamChat(c *gin.Context, message string, images []string) {
-	// Set headers for SSE (Server-Sent Events)
-	c.Header("Content-Type", "text/event-stream")
-	c.Header("Cache-Control", "no-cache")
-	c.Header("Connection", "keep-alive")
-	c.Header("Access-Control-Allow-Origin", "*")
-	c.Header("X-Accel-Buffering", "no") // Disable proxy buffering
+// chatTurnContext applies the per-request options of agentConfig to ctx and
+// attributes the turn, and the long-term memories extracted from it, to the
+// principal and session.
+func chatTurnContext(ctx context.Context, principal *auth.Principal, sessionID string, agentConfig map[string]interface{}) (context.Context, error) {
+	sampling, err := parseSamplingOptions(agentConfig)
+	if err != nil {
+		return nil, err
+	}
+	ctx = ai_agent.WithSamplingOptions(ctx, sampling)
+	ctx = ai_agent.WithSessionInfo(ctx, ai_agent.SessionInfo{
+		SessionID: sessionID,
+		UserID:    principal.ID,
+	})
+	approvedSkills, err := parseApprovedSkills(agentConfig)
+	if err != nil {
+		return nil, err
+	}
+	if len(approvedSkills) > 0 {
+		ctx = ai_agent.WithApprovedSkills(ctx, approvedSkills...)
+	}
+	return ctx, nil
+}
 
-	// Create channels for streaming response
-	streamChan := make(chan string, 100)
-	errChan := make(chan error, 1)
-	doneChan := make(chan bool, 1)
+// parseSamplingOptions reads the per-request sampling options of a chat
+// request's agentConfig: temperature, topP, topK, seed, numCtx, numPredict (or
+// maxTokens), stop, repeatPenalty, presencePenalty, frequencyPenalty and
+// keepAlive. Other keys are ignored.
+func parseSamplingOptions(agentConfig map[string]interface{}) (ai_agent.SamplingOptions, error) {
+	var opts ai_agent.SamplingOptions
+	number := func(key string) (float64, bool, error) {
+		raw, ok := agentConfig[key]
+		if !ok || raw == nil {
+			return 0, false, nil
+		}
+		value, ok := raw.(float64)
+		if !ok {
+			return 0, false, fmt.Errorf("agentConfig.%s must be a number", key)
+		}
+		return value, true, nil
+	}
+	integer := func(key string) (int, bool, error) {
+		value, ok, err := number(key)
+		if err != nil || !ok {
+			return 0, ok, err
+		}
+		if value != float64(int(value)) {
+			return 0, false, fmt.Errorf("agentConfig.%s must be an integer", key)
+		}
+		return int(value), true, nil
+	}
 
-	// Start goroutine to handle agent response
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				errChan <- fmt.Errorf("panic in agent response: %v", r)
-			}
-			// Close channel when done
-			close(streamChan)
-		}()
+	for _, key := range []string{"temperature", "topP", "repeatPenalty", "presencePenalty", "frequencyPenalty"} {
+		value, ok, err := number(key)
+		if err != nil {
+			return opts, err
+		}
+		if !ok {
+			continue
+		}
+		v := float32(value)
+		switch key {
+		case "temperature":
+			opts.Temperature = &v
+		case "topP":
+			opts.TopP = &v
+		case "repeatPenalty":
+			opts.RepeatPenalty = v
+		case "presencePenalty":
+			opts.PresencePenalty = v
+		case "frequencyPenalty":
+			opts.FrequencyPenalty = v
+		}
+	}
+	for _, key := range []string{"topK", "seed", "numCtx", "maxTokens", "numPredict"} {
+		value, ok, err := integer(key)
+		if err != nil {
+			return opts, err
+		}
+		if !ok {
+			continue
+		}
+		switch key {
+		case "topK":
+			opts.TopK = value
+		case "seed":
+			opts.Seed = &value
+		case "numCtx":
+			opts.NumCtx = value
+		case "maxTokens", "numPredict":
+			opts.NumPredict = value
+		}
+	}
 
-		// Use a for loop to continuously process callbacks
-		// until ListenAndWatch completes
-		err := s.agent.ListenAndWatch(c.Request.Context(), message, images, func(resp string) error {
-			// Send each chunk to the stream channel
-			select {
-			case streamChan <- resp:
-				// Successfully sent chunk
-			case <-doneChan:
-				// Early termination requested
-				return nil
+	if raw, ok := agentConfig["stop"]; ok && raw != nil {
+		switch stop := raw.(type) {
+		case string:
+			opts.Stop = []string{stop}
+		case []interface{}:
+			for _, item := range stop {
+				sequence, ok := item.(string)
+				if !ok {
+					return opts, errors.New("agentConfig.stop must be a string or an array of strings")
+				}
+				opts.Stop = append(opts.Stop, sequence)
 			}
-			return nil
-		})
+		default:
+			return opts, errors.New("agentConfig.stop must be a string or an array of strings")
+		}
+	}
+	if raw, ok := agentConfig["keepAlive"]; ok && raw != nil {
+		switch keepAlive := raw.(type) {
+		case string:
+			opts.KeepAlive = keepAlive
+		case float64:
+			opts.KeepAlive = strconv.FormatFloat(keepAlive, 'f', -1, 64)
+		default:
+			return opts, errors.New("agentConfig.keepAlive must be a duration string or a number of seconds")
+		}
+	}
+	return opts, nil
+}
 
-		if err != nil {
-			log.Println("Error during agent response", err)
-			errChan <- err
+// parseApprovedSkills reads agentConfig.approvedSkills, the destructive skills
+// the user approved to run even when the turn contains untrusted content.
+func parseApprovedSkills(agentConfig map[string]interface{}) ([]string, error) {
+	raw, ok := agentConfig["approvedSkills"]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+	items, ok := raw.([]interface{})
+	if !ok {
+		return nil, errors.New("agentConfig.approvedSkills must be an array of strings")
+	}
+	skills := make([]string, 0, len(items))
+	for _, item := range items {
+		name, ok := item.(string)
+		if !ok {
+			return nil, errors.New("agentConfig.approvedSkills must be an array of strings")
 		}
+		skills = append(skills, name)
+	}
+	return skills, nil
+}
 
-		// Signal completion
-		time.Sleep(time.Second)
-		doneChan <- true
+func (s *Server) handleStreamChat(c *gin.Context, t *turn, message string, images []string) {
+	// Run the turn in the background; its events are buffered so a client
+	// that lost the stream can resume it from GET /chat/{id}/events.
+	go func() {
+		defer s.turns.finish(t)
+		// The turn outlives its request, so its deadline runs from here
+		// rather than from the streams that follow it.
+		if s.config.ChatTimeout > 0 {
+			timer := time.AfterFunc(s.config.ChatTimeout, func() { t.cancel(errTurnTimeout) })
+			defer timer.Stop()
+		}
+		s.runStreamTurn(t, message, images)
 	}()
 
-	// Stream response to client
-	c.Stream(func(w io.Writer) bool {
-		for {
-			select {
-			case chunk, ok := <-streamChan:
-				if !ok {
-					// Channel closed, send completion event
-					c.SSEvent("complete", map[string]interface{}{
-						"done":      true,
-						"timestamp": time.Now().Unix(),
-					})
-					return false
-				}
+	s.streamTurnEvents(c, t, 0)
+}
 
-				// Send chunk as SSE event
-				c.SSEvent("message", map[string]interface{}{
-					"content":   chunk,
-					"timestamp": time.Now().Unix(),
-				})
+// runStreamTurn runs a streamed turn and records its events.
+func (s *Server) runStreamTurn(t *turn, message string, images []string) {
+	events := t.events
 
-				// Flush to ensure immediate delivery
-				c.Writer.Flush()
+	// Tell the client the turn id first so it can cancel or resume the turn
+	events.append("turn", map[string]interface{}{
+		"turnId":    t.id,
+		"timestamp": time.Now().Unix(),
+	})
 
-			case err := <-errChan:
-				// Send error event
-				c.SSEvent("error", map[string]interface{}{
-					"error":     err.Error(),
-					"timestamp": time.Now().Unix(),
-				})
-				return false
+	err := s.recordAgentEvents(t.ctx, events, func(ctx context.Context, callback func(string) error) error {
+		return s.agent.ListenAndWatch(ctx, message, images, callback)
+	})
+	if err == nil {
+		events.append("complete", map[string]interface{}{
+			"done":      true,
+			"timestamp": time.Now().Unix(),
+		})
+		return
+	}
+	log.Println("Error during agent response", err)
+	switch t.cancelled() {
+	case errTurnCancelled:
+		events.append("cancelled", map[string]interface{}{
+			"turnId":    t.id,
+			"timestamp": time.Now().Unix(),
+		})
+	case errShuttingDown:
+		events.append("error", map[string]interface{}{
+			"error":     "Server is shutting down",
+			"timestamp": time.Now().Unix(),
+		})
+	case errTurnTimeout:
+		events.append("error", map[string]interface{}{
+			"error":     "Request timeout",
+			"timestamp": time.Now().Unix(),
+		})
+	default:
+		events.append("error", map[string]interface{}{
+			"error":     s.redactor.Redact(err.Error()),
+			"timestamp": time.Now().Unix(),
+		})
+	}
+}
+
+// recordAgentEvents runs an agent call and records the message, thinking,
+// tool_call, review, guardrail and queued events of its response, masked, to
+// events. run calls the agent with ctx and the response callback.
+func (s *Server) recordAgentEvents(ctx context.Context, events *eventLog, run func(ctx context.Context, callback func(string) error) error) error {
+	// Detect tool calls while the response streams so clients can show them early
+	toolCallParser := prompt.NewFunctionCallStreamParser()
+
+	// Mask secrets before they leave the service; a secret may span chunks, so
+	// the streams hold back a possibly incomplete tail until the next chunk.
+	messageStream := s.redactor.NewStream()
+	thinkingStream := s.redactor.NewStream()
+	flushPending := func() {
+		if thought := thinkingStream.Flush(); thought != "" {
+			events.append("thinking", map[string]interface{}{
+				"content":   thought,
+				"timestamp": time.Now().Unix(),
+			})
+		}
+		if content := messageStream.Flush(); content != "" {
+			events.append("message", map[string]interface{}{
+				"content":   content,
+				"timestamp": time.Now().Unix(),
+			})
+		}
+	}
+
+	ctx = ai_agent.WithThinkingCallback(ctx, func(thought string) error {
+		if thought := thinkingStream.Write(thought); thought != "" {
+			events.append("thinking", map[string]interface{}{
+				"content":   thought,
+				"timestamp": time.Now().Unix(),
+			})
+		}
+		return nil
+	})
+	ctx = ai_agent.WithReviewCallback(ctx, func(revision int, verdicts []*review.Verdict) error {
+		events.append("review", map[string]interface{}{
+			"revision":  revision,
+			"verdicts":  s.redactor.JSON(verdicts),
+			"timestamp": time.Now().Unix(),
+		})
+		return nil
+	})
+	ctx = ai_agent.WithGuardrailCallback(ctx, func(event guardrail.Event) error {
+		events.append("guardrail", map[string]interface{}{
+			"event":     s.redactor.JSON(event),
+			"timestamp": time.Now().Unix(),
+		})
+		return nil
+	})
+	ctx = ai_agent.WithTurnQueueCallback(ctx, func(position int) error {
+		events.append("queued", map[string]interface{}{
+			"position":  position,
+			"timestamp": time.Now().Unix(),
+		})
+		return nil
+	})
 
-			case <-doneChan:
-				// Send completion event
-				c.SSEvent("complete", map[string]interface{}{
-					"done":      true,
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic in agent response: %v", r)
+			}
+		}()
+		return run(ctx, func(resp string) error {
+			if content := messageStream.Write(resp); content != "" {
+				events.append("message", map[string]interface{}{
+					"content":   content,
 					"timestamp": time.Now().Unix(),
 				})
-				return false
-
-			case <-time.After(600 * time.Second):
-				// Send timeout event
-				c.SSEvent("error", map[string]interface{}{
-					"error":     "Request timeout",
+			}
+			toolCalls, _ := toolCallParser.Feed(resp)
+			for _, toolCall := range toolCalls {
+				events.append("tool_call", map[string]interface{}{
+					"function":  toolCall.Function,
 					"timestamp": time.Now().Unix(),
 				})
-				return false
 			}
+			return nil
+		})
+	}()
+	flushPending()
+	return err
+}
+
+// streamTurnEvents writes the events of a turn after lastEventID as SSE, with
+// their ids, and follows the turn until it ends or the client goes away.
+// Ending the stream leaves the turn running; only its own deadline or a
+// cancellation ends it.
+func (s *Server) streamTurnEvents(c *gin.Context, t *turn, lastEventID int) {
+	streamEvents(c, t.events, lastEventID)
+}
+
+// streamEvents writes the events of log after lastEventID as SSE, with their
+// ids, and follows the log until it ends or the client goes away.
+func streamEvents(c *gin.Context, events *eventLog, lastEventID int) {
+	// Set headers for SSE (Server-Sent Events)
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no") // Disable proxy buffering
+
+	c.Stream(func(w io.Writer) bool {
+		newEvents, more, ended := events.since(lastEventID)
+		for _, event := range newEvents {
+			c.Render(-1, sse.Event{
+				Id:    strconv.Itoa(event.id),
+				Event: event.name,
+				Data:  event.data,
+			})
+			lastEventID = event.id
+		}
+		if len(newEvents) > 0 {
+			return true
+		}
+		if ended {
+			return false
+		}
+
+		select {
+		case <-more:
+			return true
+		case <-c.Request.Context().Done():
+			return false
 		}
 	})
 }
 
+// turnEventsHandler replays the events of a streamed turn after the
+// Last-Event-ID header (or lastEventId query) and follows it while it runs.
+func (s *Server) turnEventsHandler(c *gin.Context) {
+	t, err := s.turns.lookup(c.Param("id"), principalFromContext(c))
+	if err != nil || t.events == nil {
+		c.JSON(404, gin.H{"error": "Turn not found"})
+		return
+	}
+
+	lastEventID, ok := lastEventIDParam(c)
+	if !ok {
+		c.JSON(400, gin.H{"error": "Invalid Last-Event-ID"})
+		return
+	}
+	c.Header("X-Turn-ID", t.id)
+	s.streamTurnEvents(c, t, lastEventID)
+}
+
+// lastEventIDParam reads the id of the last event a client received from the
+// Last-Event-ID header or the lastEventId query; 0 when neither is set.
+func lastEventIDParam(c *gin.Context) (int, bool) {
+	value := c.GetHeader("Last-Event-ID")
+	if value == "" {
+		value = c.DefaultQuery("lastEventId", "0")
+	}
+	lastEventID, err := strconv.Atoi(value)
+	if err != nil || lastEventID < 0 {
+		return 0, false
+	}
+	return lastEventID, true
+}
+
 type SkillRequest struct {
 	SkillName  string                 `json:"skillName"`
 	Parameters map[string]interface{} `json:"parameters"`
@@ -420,6 +1022,7 @@ func (s *Server) skillHandler(c *gin.Context) {
 		c.JSON(400, gin.H{"error": "Skill name is required"})
 		return
 	}
+	log.Printf("audit principal=%s skill=%s", principalFromContext(c).ID, req.SkillName)
 
 	// Execute skill
 	resultChan := make(chan interface{}, 1)
@@ -443,18 +1046,19 @@ func (s *Server) skillHandler(c *gin.Context) {
 			"skill":  req.SkillName,
 		})
 	case err := <-errChan:
-		c.JSON(500, gin.H{"error": err.Error()})
+		c.JSON(500, gin.H{"error": s.redactor.Redact(err.Error())})
 	case <-time.After(600 * time.Second):
 		c.JSON(504, gin.H{"error": "Request timeout"})
 	}
 }
 
 func (s *Server) getConfigHandler(c *gin.Context) {
+	agentConfig := s.agent.ConfigSnapshot()
 	c.JSON(200, gin.H{
-		"chatModel":       s.config.AgentConfig.ChatModel,
-		"embeddingModel":  s.config.AgentConfig.EmbeddingModel,
-		"supervisorModel": s.config.AgentConfig.SupervisorModel,
-		"agentMode":       s.config.AgentConfig.AgentMode,
+		"chatModel":       agentConfig.ChatModel,
+		"embeddingModel":  agentConfig.EmbeddingModel,
+		"supervisorModel": agentConfig.SupervisorModel,
+		"agentMode":       agentConfig.AgentMode,
 		"character":       s.config.AgentCharacter,
 		"role":            s.config.AgentRole,
 	})
@@ -467,15 +1071,60 @@ func (s *Server) updateConfigHandler(c *gin.Context) {
 		return
 	}
 
-	// Update configuration (simplified for demo)
-	if chatModel, ok := config["chatModel"].(string); ok {
-		s.config.AgentConfig.ChatModel = chatModel
+	// Model changes must name installed models; with "pullMissing" missing
+	// models are pulled in the background and the change can be retried once
+	// they are ready.
+	modelChanges := make(map[string]string)
+	for key := range s.configuredModels() {
+		if model, ok := config[key].(string); ok {
+			modelChanges[key] = strings.TrimSpace(model)
+		}
 	}
-	if embeddingModel, ok := config["embeddingModel"].(string); ok {
-		s.config.AgentConfig.EmbeddingModel = embeddingModel
+	missing, err := s.validateModelChanges(modelChanges)
+	if err != nil {
+		status := 400
+		if errors.Is(err, errModelsUnavailable) {
+			status = 502
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
 	}
-	if agentMode, ok := config["agentMode"].(string); ok {
-		s.config.AgentConfig.AgentMode = ai_agent.AgentMode(agentMode)
+	if len(missing) > 0 {
+		if pullMissing, _ := config["pullMissing"].(bool); pullMissing {
+			pulls := make([]modelPull, 0, len(missing))
+			for _, model := range missing {
+				pulls = append(pulls, s.modelPuller.start(model))
+			}
+			c.JSON(202, gin.H{
+				"message": "Models are being pulled; retry the update once they are installed",
+				"pulls":   pulls,
+			})
+			return
+		}
+		c.JSON(400, gin.H{
+			"error":   "Models are not installed: " + strings.Join(missing, ", "),
+			"missing": missing,
+		})
+		return
+	}
+
+	// Update configuration between turns (simplified for demo)
+	if err := s.agent.UpdateConfig(c.Request.Context(), func(agentConfig *ai_agent.Config) {
+		if chatModel, ok := modelChanges["chatModel"]; ok {
+			agentConfig.ChatModel = chatModel
+		}
+		if embeddingModel, ok := modelChanges["embeddingModel"]; ok {
+			agentConfig.EmbeddingModel = embeddingModel
+		}
+		if supervisorModel, ok := modelChanges["supervisorModel"]; ok {
+			agentConfig.SupervisorModel = supervisorModel
+		}
+		if agentMode, ok := config["agentMode"].(string); ok {
+			agentConfig.AgentMode = ai_agent.AgentMode(agentMode)
+		}
+	}); err != nil {
+		c.JSON(503, gin.H{"error": err.Error()})
+		return
 	}
 
 	c.JSON(200, gin.H{
@@ -496,7 +1145,7 @@ func (s *Server) getMemoryHandler(c *gin.Context) {
 		limit = parsedLimit
 	}
 
-	memory := s.agent.MemorySnapshotWithLimit(limit)
+	memory := s.agent.MemorySnapshotWithLimit(limit).Redacted(s.redactor)
 	c.JSON(200, gin.H{
 		"contexts": memory.Contexts,
 		"length":   len(memory.Contexts),
@@ -504,15 +1153,312 @@ func (s *Server) getMemoryHandler(c *gin.Context) {
 }
 
 func (s *Server) clearMemoryHandler(c *gin.Context) {
-	s.agent.ResetMemory()
-	addToolSampleMemories(s.agent)
+	if err := s.agent.BetweenTurns(c.Request.Context(), func() {
+		s.agent.ResetMemory()
+		addToolSampleMemories(s.agent)
+	}); err != nil {
+		c.JSON(503, gin.H{"error": err.Error()})
+		return
+	}
 	c.JSON(200, gin.H{
 		"message": "Memory cleared successfully",
 	})
 }
 
+type MemoryInsertRequest struct {
+	AfterID    string   `json:"afterId,omitempty"`
+	Role       string   `json:"role"`
+	Content    string   `json:"content"`
+	Images     []string `json:"images,omitempty"`
+	Name       string   `json:"name,omitempty"`
+	ToolCallID string   `json:"toolCallId,omitempty"`
+	Pinned     bool     `json:"pinned,omitempty"`
+	Priority   int      `json:"priority,omitempty"`
+}
+
+type MemoryEditRequest struct {
+	Content string   `json:"content"`
+	Images  []string `json:"images,omitempty"`
+}
+
+var memoryRoles = map[string]struct{}{
+	"system":    {},
+	"user":      {},
+	"assistant": {},
+	"tool":      {},
+}
+
+func memoryErrorStatus(err error) int {
+	if errors.Is(err, ai_agent.ErrMemoryNotFound) {
+		return 404
+	}
+	return 500
+}
+
+func (s *Server) insertMemoryHandler(c *gin.Context) {
+	var req MemoryInsertRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if _, ok := memoryRoles[req.Role]; !ok {
+		c.JSON(400, gin.H{"error": "role must be one of system, user, assistant, tool"})
+		return
+	}
+
+	memCtx, err := s.agent.InsertMemory(req.AfterID, req.Role, req.Content, req.Images, ai_agent.MemoryAttributes{
+		Name:       req.Name,
+		ToolCallID: req.ToolCallID,
+		Source:     ai_agent.MemorySourceAPI,
+		Pinned:     req.Pinned,
+		Priority:   req.Priority,
+	})
+	if err != nil {
+		c.JSON(memoryErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(201, gin.H{"context": memCtx.Redacted(s.redactor)})
+}
+
+func (s *Server) getMemoryByIDHandler(c *gin.Context) {
+	memCtx, err := s.agent.GetMemory(c.Param("id"))
+	if err != nil {
+		c.JSON(memoryErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"context": memCtx.Redacted(s.redactor)})
+}
+
+func (s *Server) editMemoryHandler(c *gin.Context) {
+	var req MemoryEditRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	memCtx, err := s.agent.EditMemory(c.Param("id"), req.Content, req.Images)
+	if err != nil {
+		c.JSON(memoryErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"context": memCtx.Redacted(s.redactor)})
+}
+
+func (s *Server) deleteMemoryHandler(c *gin.Context) {
+	if err := s.agent.DeleteMemory(c.Param("id")); err != nil {
+		c.JSON(memoryErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"message": "Memory context deleted successfully"})
+}
+
+// maxMemoryImportBytes bounds the transcript size accepted by /memory/import.
+const maxMemoryImportBytes = 32 << 20
+
+var memoryFormatFiles = map[ai_agent.MemoryFormat]struct {
+	contentType string
+	fileName    string
+}{
+	ai_agent.MemoryFormatJSONL:    {"application/x-ndjson", "memory.jsonl"},
+	ai_agent.MemoryFormatOpenAI:   {"application/json", "memory.json"},
+	ai_agent.MemoryFormatMarkdown: {"text/markdown; charset=utf-8", "memory.md"},
+}
+
+func memoryFormatQuery(c *gin.Context) (ai_agent.MemoryFormat, bool) {
+	format := ai_agent.MemoryFormat(c.DefaultQuery("format", string(ai_agent.MemoryFormatJSONL)))
+	if _, ok := memoryFormatFiles[format]; !ok {
+		c.JSON(400, gin.H{"error": "format must be one of jsonl, openai, markdown"})
+		return "", false
+	}
+	return format, true
+}
+
+func (s *Server) exportMemoryHandler(c *gin.Context) {
+	format, ok := memoryFormatQuery(c)
+	if !ok {
+		return
+	}
+
+	data, err := ai_agent.EncodeMemory(s.agent.MemorySnapshot().Redacted(s.redactor), format)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	file := memoryFormatFiles[format]
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", file.fileName))
+	c.Data(200, file.contentType, data)
+}
+
+func (s *Server) importMemoryHandler(c *gin.Context) {
+	format, ok := memoryFormatQuery(c)
+	if !ok {
+		return
+	}
+	mode := c.DefaultQuery("mode", "replace")
+	if mode != "replace" && mode != "append" {
+		c.JSON(400, gin.H{"error": "mode must be replace or append"})
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxMemoryImportBytes))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request body"})
+		return
+	}
+	imported, err := s.agent.ImportMemory(c.Request.Context(), data, format, mode == "append")
+	if err != nil {
+		status := 400
+		if c.Request.Context().Err() != nil {
+			status = 503
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{
+		"message":  "Memory imported successfully",
+		"imported": imported,
+	})
+}
+
+func (s *Server) listBranchesHandler(c *gin.Context) {
+	c.JSON(200, gin.H{
+		"branches": s.agent.Branches(),
+		"active":   s.agent.ActiveBranchID(),
+	})
+}
+
+type ForkBranchRequest struct {
+	FromMessageID string `json:"fromMessageId"`
+	// Content, when set, replaces the message in the new branch.
+	Content    *string  `json:"content,omitempty"`
+	Images     []string `json:"images,omitempty"`
+	Regenerate bool     `json:"regenerate,omitempty"`
+}
+
+func (s *Server) forkBranchHandler(c *gin.Context) {
+	var req ForkBranchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if req.FromMessageID == "" {
+		c.JSON(400, gin.H{"error": "fromMessageId is required"})
+		return
+	}
+
+	// Regenerating runs a chat turn; admit it before the branch is created.
+	ctx := c.Request.Context()
+	release := func() {}
+	if req.Regenerate {
+		var (
+			err      error
+			limitErr *ratelimit.LimitError
+		)
+		ctx, err = chatTurnContext(ctx, principalFromContext(c), c.GetHeader("X-Session-ID"), nil)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		ctx, release, limitErr = s.admitChatTurn(c, ctx)
+		if limitErr != nil {
+			abortRateLimited(c, limitErr)
+			return
+		}
+	}
+	defer release()
+
+	var (
+		branchID string
+		err      error
+	)
+	if req.Content != nil {
+		branchID, err = s.agent.EditAndFork(ctx, req.FromMessageID, *req.Content, req.Images)
+	} else {
+		branchID, err = s.agent.Rewind(ctx, req.FromMessageID)
+	}
+	if err != nil {
+		c.JSON(memoryErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	if !req.Regenerate {
+		c.JSON(201, gin.H{"branch": branchID})
+		return
+	}
+
+	// The regenerated turn can be cancelled by id like a chat turn; its
+	// events are recorded, masked, and folded into the response.
+	t, err := s.turns.start(ctx, principalFromContext(c).ID, false)
+	if err != nil {
+		c.JSON(503, gin.H{"branch": branchID, "error": "Server is shutting down"})
+		return
+	}
+	c.Header("X-Turn-ID", t.id)
+	events := newEventLog()
+	err = s.recordAgentEvents(t.ctx, events, func(ctx context.Context, callback func(string) error) error {
+		return s.agent.Regenerate(ctx, callback)
+	})
+	s.turns.finish(t)
+	if err != nil {
+		log.Println("Error during agent regeneration", err)
+		switch t.cancelled() {
+		case errTurnCancelled:
+			c.JSON(409, gin.H{"branch": branchID, "error": "Turn cancelled", "turnId": t.id})
+		case errShuttingDown:
+			c.JSON(503, gin.H{"branch": branchID, "error": "Server is shutting down", "turnId": t.id})
+		default:
+			c.JSON(500, gin.H{"branch": branchID, "error": s.redactor.Redact(err.Error()), "turnId": t.id})
+		}
+		return
+	}
+
+	var response, thinking strings.Builder
+	recorded, _, _ := events.since(0)
+	for _, event := range recorded {
+		content, _ := event.data.(map[string]interface{})["content"].(string)
+		switch event.name {
+		case "message":
+			response.WriteString(content)
+		case "thinking":
+			thinking.WriteString(content)
+		}
+	}
+	body := gin.H{
+		"branch":    branchID,
+		"turnId":    t.id,
+		"response":  response.String(),
+		"timestamp": time.Now().Unix(),
+	}
+	if thinking.Len() > 0 {
+		body["thinking"] = thinking.String()
+	}
+	c.JSON(201, body)
+}
+
+type SwitchBranchRequest struct {
+	ID string `json:"id"`
+}
+
+func (s *Server) switchBranchHandler(c *gin.Context) {
+	var req SwitchBranchRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.ID == "" {
+		c.JSON(400, gin.H{"error": "id is required"})
+		return
+	}
+	if err := s.agent.SwitchBranch(c.Request.Context(), req.ID); err != nil {
+		status := 500
+		if errors.Is(err, ai_agent.ErrBranchNotFound) {
+			status = 404
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"active": req.ID})
+}
+
 func (s *Server) Start() error {
 	s.setupRoutes()
+	s.schedules.start()
 
 	// Start server
 	server := &http.Server{
@@ -533,23 +1479,39 @@ func (s *Server) Start() error {
 	<-quit
 	log.Println("Shutting down server...")
 
+	// Stop starting scheduled jobs before the jobs are interrupted
+	s.schedules.stop()
+
+	// Interrupt the jobs; they run again from their last step on the next
+	// start.
+	if err := s.jobs.stop(5 * time.Second); err != nil {
+		log.Printf("Failed to stop jobs: %v", err)
+	}
+
+	// Abort the model downloads; they can be pulled again after the restart
+	s.modelPuller.stop()
+
+	// Refuse new turns and let the running ones finish within the grace
+	// period; the rest are cancelled. Cancel requests are still served.
+	if err := s.turns.drain(s.config.ShutdownGracePeriod); err != nil {
+		log.Printf("%d turns did not stop in time", s.turns.active())
+	}
+
 	// Graceful shutdown with timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	if err := server.Shutdown(ctx); err != nil {
-		log.Fatal("Server forced to shutdown:", err)
-	}
-
-	select {
-	case <-ctx.Done():
-		log.Println("Server shutdown successfully")
-	case <-time.After(30 * time.Second):
-		log.Println("Timed out during stopping server")
+		log.Println("Server forced to shutdown:", err)
 	}
 
 	log.Println("Server exited")
 
+	s.agent.WaitMemoryWriter()
+	// Save the memory so a restarted loop-mode agent carries on from here
+	if err := s.agent.Checkpoint(ctx); err != nil {
+		log.Printf("Failed to checkpoint agent: %v", err)
+	}
 	s.agent.Agent.Close()
 	s.mcpWebSearchClient.Close()
 	s.mcpContext7Client.Close()
@@ -612,6 +1574,118 @@ func getBoolEnv(key string, defaultValue bool) bool {
 	return defaultValue
 }
 
+// getOptionalBoolEnv returns nil when key is unset so the default of the
+// consumer applies.
+func getOptionalBoolEnv(key string) *bool {
+	if os.Getenv(key) == "" {
+		return nil
+	}
+	value := getBoolEnv(key, false)
+	return &value
+}
+
+// getOptionalFloat32Env returns nil when key is unset so that an explicit zero
+// can be told apart from the default.
+func getOptionalFloat32Env(key string) *float32 {
+	if os.Getenv(key) == "" {
+		return nil
+	}
+	value := getFloat32Env(key, 0)
+	return &value
+}
+
+func getOptionalIntEnv(key string) *int {
+	if os.Getenv(key) == "" {
+		return nil
+	}
+	value := getIntEnv(key, 0)
+	return &value
+}
+
+// getGuardrailsEnv loads the guardrail rules of the JSON file named by
+// fileKey and adds a PII rule on all stages when piiActionKey names an action.
+func getGuardrailsEnv(fileKey, piiActionKey string) []guardrail.RuleConfig {
+	var rules []guardrail.RuleConfig
+	if path := os.Getenv(fileKey); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatal("Error reading guardrail rules", path, ":", err)
+		}
+		if rules, err = guardrail.ParseRuleConfigs(data); err != nil {
+			log.Fatal("Error parsing environment variable", fileKey, ":", err)
+		}
+	}
+	if action := os.Getenv(piiActionKey); action != "" {
+		rules = append(rules, guardrail.RuleConfig{
+			Name:   "pii",
+			Type:   "pii",
+			Action: guardrail.Action(action),
+		})
+	}
+	return rules
+}
+
+// getRateLimitsEnv reads the route policies from the JSON in inlineKey or the
+// file named by fileKey.
+func getRateLimitsEnv(inlineKey, fileKey string) map[string]ratelimit.Policy {
+	data := []byte(os.Getenv(inlineKey))
+	key := inlineKey
+	if path := os.Getenv(fileKey); path != "" && len(data) == 0 {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			log.Fatal("Error reading rate limits", path, ":", err)
+		}
+		key = fileKey
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	policies, err := ratelimit.ParsePolicies(data)
+	if err != nil {
+		log.Fatal("Error parsing environment variable", key, ":", err)
+	}
+	return policies
+}
+
+func getSeverityEnv(key string, defaultValue review.Severity) review.Severity {
+	if value := os.Getenv(key); value != "" {
+		severity, err := review.ParseSeverity(value)
+		if err != nil {
+			log.Fatal("Error parsing environment variable", key, ":", err)
+		}
+		return severity
+	}
+	return defaultValue
+}
+
+// getListEnv splits a comma separated value, dropping empty items.
+func getListEnv(key string) []string {
+	var items []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// getCORSOriginsEnv reads a comma separated origin list and defaults to all
+// origins.
+func getCORSOriginsEnv(key string) []string {
+	if origins := getListEnv(key); len(origins) > 0 {
+		return origins
+	}
+	return []string{"*"}
+}
+
+func getTokenizerFilesEnv(key string) map[string]string {
+	files, err := tokenizer.ParseFileList(os.Getenv(key))
+	if err != nil {
+		log.Fatal("Error parsing environment variable", key, ":", err)
+	}
+	return files
+}
+
 func main() {
 	log.Println("Initializing AI Agent Service...")
 
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luoxiaojun1992/ai-agent/pkg/ollama"
+)
+
+// modelPull is the state of a background model download.
+type modelPull struct {
+	Model      string     `json:"model"`
+	Status     string     `json:"status"`
+	Digest     string     `json:"digest,omitempty"`
+	Total      int64      `json:"total,omitempty"`
+	Completed  int64      `json:"completed,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Done       bool       `json:"done"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+// modelPuller runs model downloads in the background, at most one per model.
+type modelPuller struct {
+	ollamaCli ollama.IClient
+	// ctx is cancelled by stop to abort the downloads.
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+
+	mu    sync.Mutex
+	pulls map[string]*modelPull
+}
+
+func newModelPuller(ollamaCli ollama.IClient) *modelPuller {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &modelPuller{
+		ollamaCli: ollamaCli,
+		ctx:       ctx,
+		cancel:    cancel,
+		pulls:     make(map[string]*modelPull),
+	}
+}
+
+// stop aborts the running downloads and waits for them to end; pulls
+// started afterwards fail at once.
+func (mp *modelPuller) stop() {
+	mp.cancel()
+	mp.running.Wait()
+}
+
+// start begins pulling model unless a pull of it is already running and
+// returns the current state.
+func (mp *modelPuller) start(model string) modelPull {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	if pull, ok := mp.pulls[model]; ok && !pull.Done {
+		return *pull
+	}
+	pull := &modelPull{Model: model, Status: "starting", StartedAt: time.Now()}
+	mp.pulls[model] = pull
+
+	mp.running.Add(1)
+	go func() {
+		defer mp.running.Done()
+		err := mp.ollamaCli.PullModel(mp.ctx, &ollama.PullRequest{Model: model}, func(progress *ollama.PullProgress) error {
+			mp.mu.Lock()
+			defer mp.mu.Unlock()
+			pull.Status = progress.Status
+			if progress.Total > 0 {
+				pull.Digest = progress.Digest
+				pull.Total = progress.Total
+				pull.Completed = progress.Completed
+			}
+			return nil
+		})
+
+		mp.mu.Lock()
+		defer mp.mu.Unlock()
+		now := time.Now()
+		pull.Done = true
+		pull.FinishedAt = &now
+		switch {
+		case err == nil:
+		case mp.ctx.Err() != nil:
+			pull.Status = "cancelled"
+		default:
+			log.Printf("Pulling model %s failed: %v", model, err)
+			pull.Status = "failed"
+			pull.Error = err.Error()
+		}
+	}()
+	return *pull
+}
+
+func (mp *modelPuller) list() []modelPull {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	pulls := make([]modelPull, 0, len(mp.pulls))
+	for _, pull := range mp.pulls {
+		pulls = append(pulls, *pull)
+	}
+	sort.Slice(pulls, func(i, j int) bool {
+		return pulls[i].StartedAt.Before(pulls[j].StartedAt)
+	})
+	return pulls
+}
+
+// configuredModels maps the config keys of the models the agent uses to their
+// current values.
+func (s *Server) configuredModels() map[string]string {
+	agentConfig := s.agent.ConfigSnapshot()
+	return map[string]string{
+		"chatModel":       agentConfig.ChatModel,
+		"embeddingModel":  agentConfig.EmbeddingModel,
+		"supervisorModel": agentConfig.SupervisorModel,
+	}
+}
+
+var errModelsUnavailable = errors.New("unable to list installed models")
+
+// requiredCapability is the capability a model needs to serve a config key.
+var requiredCapability = map[string]string{
+	"chatModel":       "completion",
+	"embeddingModel":  "embedding",
+	"supervisorModel": "completion",
+}
+
+// validateModelChanges checks that the models named in a config update are
+// installed and able to serve their role. It returns the models that are not
+// installed.
+func (s *Server) validateModelChanges(changes map[string]string) ([]string, error) {
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	installed, err := s.ollamaCli.ListModels()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errModelsUnavailable, err)
+	}
+
+	var missing []string
+	for _, key := range sortedKeys(changes) {
+		model := changes[key]
+		if !installed.Has(model) {
+			missing = append(missing, model)
+			continue
+		}
+		details, err := s.ollamaCli.ShowModel(&ollama.ShowRequest{Model: model})
+		if err != nil {
+			// OpenAI compatible endpoints cannot describe models.
+			continue
+		}
+		capability := requiredCapability[key]
+		if len(details.Capabilities) > 0 && !details.HasCapability(capability) {
+			return nil, fmt.Errorf("model %s cannot be used as %s: it lacks the %q capability", model, key, capability)
+		}
+	}
+	return missing, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func modelErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ollama.ErrModelNotFound):
+		return 404
+	case errors.Is(err, ollama.ErrUnsupportedOperation):
+		return 501
+	default:
+		return 502
+	}
+}
+
+func (s *Server) listModelsHandler(c *gin.Context) {
+	installed, err := s.ollamaCli.ListModels()
+	if err != nil {
+		c.JSON(502, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{
+		"models":     installed.Models,
+		"configured": s.configuredModels(),
+	})
+}
+
+func (s *Server) showModelHandler(c *gin.Context) {
+	details, err := s.ollamaCli.ShowModel(&ollama.ShowRequest{Model: c.Param("name")})
+	if err != nil {
+		c.JSON(modelErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{
+		"model":         c.Param("name"),
+		"contextLength": details.ContextLength(),
+		"capabilities":  details.Capabilities,
+		"template":      details.Template,
+		"parameters":    details.Parameters,
+		"details":       details.Details,
+	})
+}
+
+type PullModelRequest struct {
+	Model string `json:"model" binding:"required"`
+}
+
+func (s *Server) pullModelHandler(c *gin.Context) {
+	var req PullModelRequest
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Model) == "" {
+		c.JSON(400, gin.H{"error": "model is required"})
+		return
+	}
+	c.JSON(202, s.modelPuller.start(strings.TrimSpace(req.Model)))
+}
+
+func (s *Server) listModelPullsHandler(c *gin.Context) {
+	c.JSON(200, gin.H{"pulls": s.modelPuller.list()})
+}
+
+func (s *Server) deleteModelHandler(c *gin.Context) {
+	name := c.Param("name")
+	for key, model := range s.configuredModels() {
+		if ollama.SameModel(model, name) {
+			c.JSON(409, gin.H{"error": fmt.Sprintf("model %s is in use as %s", name, key)})
+			return
+		}
+	}
+	if err := s.ollamaCli.DeleteModel(c.Request.Context(), &ollama.DeleteRequest{Model: name}); err != nil {
+		c.JSON(modelErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"message": "Model deleted"})
+}
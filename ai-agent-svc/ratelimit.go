@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	ai_agent "github.com/luoxiaojun1992/ai-agent"
+	"github.com/luoxiaojun1992/ai-agent/pkg/ollama"
+	"github.com/luoxiaojun1992/ai-agent/util/auth"
+	"github.com/luoxiaojun1992/ai-agent/util/ratelimit"
+)
+
+// defaultRateLimitRoute names the policy of routes without one of their own.
+const defaultRateLimitRoute = "*"
+
+// routeLimiters enforce one policy; a nil limiter is unlimited.
+type routeLimiters struct {
+	key *ratelimit.Limiter
+	ip  *ratelimit.Limiter
+}
+
+// rateLimits maps route names, either "METHOD /path" or a scope, to their
+// limiters. Routes without a policy share the limiters of "*". The model
+// tokens of each principal and client IP are counted once across all routes,
+// so every policy checks its daily quota against the same count.
+type rateLimits struct {
+	routes   map[string]*routeLimiters
+	keyUsage *ratelimit.Usage
+	ipUsage  *ratelimit.Usage
+}
+
+func newRateLimits(policies map[string]ratelimit.Policy) *rateLimits {
+	limits := &rateLimits{
+		routes:   make(map[string]*routeLimiters, len(policies)),
+		keyUsage: ratelimit.NewUsage(),
+		ipUsage:  ratelimit.NewUsage(),
+	}
+	for route, policy := range policies {
+		limiters := &routeLimiters{}
+		if !policy.Key.Zero() {
+			limiters.key = ratelimit.NewWithUsage(policy.Key, limits.keyUsage)
+		}
+		if !policy.IP.Zero() {
+			limiters.ip = ratelimit.NewWithUsage(policy.IP, limits.ipUsage)
+		}
+		limits.routes[route] = limiters
+	}
+	return limits
+}
+
+func (l *rateLimits) lookup(routes ...string) *routeLimiters {
+	for _, route := range append(routes, defaultRateLimitRoute) {
+		if limiters, ok := l.routes[route]; ok {
+			return limiters
+		}
+	}
+	return nil
+}
+
+// rateLimit applies the policy of the route, per principal and per client IP,
+// and charges the model tokens used by the request to the daily quotas.
+func (s *Server) rateLimit(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, release, limitErr := s.rateLimits.admit(c.Request.Context(), principalFromContext(c), c.ClientIP(), c.Request.Method+" "+c.FullPath(), scope)
+		if limitErr != nil {
+			abortRateLimited(c, limitErr)
+			return
+		}
+		defer release()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// abortRateLimited rejects a request with the limit it exceeded.
+func abortRateLimited(c *gin.Context, limitErr *ratelimit.LimitError) {
+	retryAfter := retryAfterSeconds(limitErr.RetryAfter)
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.AbortWithStatusJSON(429, gin.H{
+		"error":      limitErr.Error(),
+		"reason":     limitErr.Reason,
+		"retryAfter": retryAfter,
+	})
+}
+
+// admitChatTurn applies the chat policy to a model turn started outside
+// POST /chat, so it is limited and charged like a chat turn. The returned
+// release func ends the turn.
+func (s *Server) admitChatTurn(c *gin.Context, ctx context.Context) (context.Context, func(), *ratelimit.LimitError) {
+	return s.rateLimits.admit(ctx, principalFromContext(c), c.ClientIP(), "POST /chat", scopeChat)
+}
+
+// admit applies the policy of the first of routes that has one to a request
+// of principal from ip. It returns a ctx charging the model tokens used to
+// the daily quotas and the func that ends the request, unless a turn took
+// over its slot. Anonymous callers are only limited per IP, and requests
+// without an ip, i.e. background jobs, only per principal.
+func (l *rateLimits) admit(ctx context.Context, principal *auth.Principal, ip string, routes ...string) (context.Context, func(), *ratelimit.LimitError) {
+	if len(l.routes) == 0 {
+		return ctx, func() {}, nil
+	}
+
+	type charge struct {
+		limiter *ratelimit.Limiter
+		key     string
+	}
+	var charges []charge
+	if limiters := l.lookup(routes...); limiters != nil {
+		if limiters.key != nil && principal != anonymousPrincipal {
+			charges = append(charges, charge{limiter: limiters.key, key: principal.ID})
+		}
+		if limiters.ip != nil && ip != "" {
+			charges = append(charges, charge{limiter: limiters.ip, key: ip})
+		}
+	}
+
+	var releases []func()
+	release := func() {
+		for _, release := range releases {
+			release()
+		}
+	}
+	for _, ch := range charges {
+		releaseCharge, err := ch.limiter.Acquire(ch.key)
+		if err != nil {
+			release()
+			return nil, nil, err.(*ratelimit.LimitError)
+		}
+		releases = append(releases, releaseCharge)
+	}
+
+	held := &slot{release: release}
+	ctx = context.WithValue(ctx, slotCtxKey{}, held)
+	return ai_agent.WithUsageCallback(ctx, func(_ string, usage ollama.Usage) {
+		if principal != anonymousPrincipal {
+			l.keyUsage.Add(principal.ID, usage.TotalTokens())
+		}
+		if ip != "" {
+			l.ipUsage.Add(ip, usage.TotalTokens())
+		}
+	}), held.releaseUnlessTaken, nil
+}
+
+type slotCtxKey struct{}
+
+// slot is what an admitted request holds against the concurrency caps. A turn
+// started for the request takes it over and frees it when the turn finishes,
+// so a streamed turn that outlives its request keeps counting.
+type slot struct {
+	mu      sync.Mutex
+	release func()
+	taken   bool
+}
+
+// releaseUnlessTaken frees the slot unless a turn took it over.
+func (s *slot) releaseUnlessTaken() {
+	s.mu.Lock()
+	taken := s.taken
+	s.taken = true
+	s.mu.Unlock()
+	if !taken {
+		s.release()
+	}
+}
+
+// takeSlot takes over the slot of the request ctx belongs to and returns the
+// func that frees it, a no-op when there is none.
+func takeSlot(ctx context.Context) func() {
+	held, ok := ctx.Value(slotCtxKey{}).(*slot)
+	if !ok {
+		return func() {}
+	}
+	held.mu.Lock()
+	defer held.mu.Unlock()
+	if held.taken {
+		return func() {}
+	}
+	held.taken = true
+	return held.release
+}
+
+// retryAfterSeconds is the Retry-After value for d.
+func retryAfterSeconds(d time.Duration) int {
+	return max(1, int(math.Ceil(d.Seconds())))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/luoxiaojun1992/ai-agent/util/auth"
+	"github.com/luoxiaojun1992/ai-agent/util/ratelimit"
+)
+
+func TestRateLimits_TurnHoldsSlotUntilFinished(t *testing.T) {
+	limits := newRateLimits(map[string]ratelimit.Policy{"chat": {Key: ratelimit.Limit{Concurrency: 1}}})
+	principal := &auth.Principal{ID: "key:ui"}
+	turns := newTurnRegistry(0)
+
+	ctx, release, limitErr := limits.admit(context.Background(), principal, "10.0.0.1", "POST /chat", "chat")
+	if limitErr != nil {
+		t.Fatalf("first request rejected: %v", limitErr)
+	}
+	// a streamed turn outlives the request that started it
+	turn, err := turns.start(context.WithoutCancel(ctx), principal.ID, true)
+	if err != nil {
+		t.Fatalf("start turn: %v", err)
+	}
+	release()
+
+	if _, _, limitErr := limits.admit(context.Background(), principal, "10.0.0.1", "POST /chat", "chat"); limitErr == nil || limitErr.Reason != ratelimit.ReasonConcurrency {
+		t.Fatalf("expected the running turn to hold the slot, got %v", limitErr)
+	}
+	turns.finish(turn)
+	_, release, limitErr = limits.admit(context.Background(), principal, "10.0.0.1", "POST /chat", "chat")
+	if limitErr != nil {
+		t.Fatalf("expected the slot freed by the finished turn: %v", limitErr)
+	}
+	release()
+}
+
+func TestRateLimits_QuotaCountedOncePerPrincipal(t *testing.T) {
+	limits := newRateLimits(map[string]ratelimit.Policy{
+		"chat":   {Key: ratelimit.Limit{DailyTokens: 100}},
+		"memory": {Key: ratelimit.Limit{DailyTokens: 100}},
+	})
+	principal := &auth.Principal{ID: "key:ui"}
+
+	// a chat turn used the whole quota
+	limits.keyUsage.Add(principal.ID, 100)
+
+	for _, route := range []string{"chat", "memory"} {
+		if _, _, limitErr := limits.admit(context.Background(), principal, "10.0.0.1", route); limitErr == nil || limitErr.Reason != ratelimit.ReasonQuota {
+			t.Fatalf("%s: expected the shared quota exhausted, got %v", route, limitErr)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"os"
+
+	"github.com/luoxiaojun1992/ai-agent/util/redact"
+)
+
+// newRedactor masks the common credential formats and the values of the
+// configured secrets: the Ollama API key, the service's own API keys and JWT
+// secret and the environment variables named in REDACT_SECRET_ENVS. Values in
+// REDACT_ALLOWLIST stay visible.
+func newRedactor(config *Config) *redact.Redactor {
+	secrets := append([]string{config.AgentConfig.OllamaAPIKey}, config.Auth.secrets()...)
+	for _, key := range getListEnv("REDACT_SECRET_ENVS") {
+		secrets = append(secrets, os.Getenv(key))
+	}
+	return redact.New(secrets, getListEnv("REDACT_ALLOWLIST"))
+}
@@ -0,0 +1,612 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+	// Time zones of schedules must resolve in images without zoneinfo
+	_ "time/tzdata"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	ai_agent "github.com/luoxiaojun1992/ai-agent"
+	"github.com/luoxiaojun1992/ai-agent/util/auth"
+	"github.com/luoxiaojun1992/ai-agent/util/cron"
+)
+
+const (
+	// maxScheduleRuns bounds the run history kept per schedule.
+	maxScheduleRuns = 100
+	// maxSchedulerWait bounds how long the scheduler sleeps, so it notices
+	// wall clock changes.
+	maxSchedulerWait = time.Minute
+)
+
+var (
+	errScheduleNotFound = errors.New("schedule not found")
+	errRunAtPast        = errors.New("runAt must be in the future")
+)
+
+// overlapPolicy decides what a schedule does when its previous job is still
+// queued or running at the next run.
+type overlapPolicy string
+
+const (
+	// overlapSkip skips the run.
+	overlapSkip overlapPolicy = "skip"
+	// overlapAllow starts another job next to the previous one.
+	overlapAllow overlapPolicy = "allow"
+	// overlapReplace cancels the previous job and starts a new one.
+	overlapReplace overlapPolicy = "replace"
+)
+
+type ScheduleRequest struct {
+	Name string `json:"name,omitempty"`
+	// Cron, a cron expression, makes a recurring schedule and RunAt a one-shot
+	// timer; exactly one of them is required.
+	Cron  string     `json:"cron,omitempty"`
+	RunAt *time.Time `json:"runAt,omitempty"`
+	// Timezone is the IANA time zone of Cron, UTC by default.
+	Timezone    string                 `json:"timezone,omitempty"`
+	Message     string                 `json:"message"`
+	Images      []string               `json:"images,omitempty"`
+	AgentConfig map[string]interface{} `json:"agentConfig,omitempty"`
+	// AgentMode is "loop" (default) or "chat".
+	AgentMode string `json:"agentMode,omitempty"`
+	// Overlap is "skip" (default), "allow" or "replace".
+	Overlap string `json:"overlap,omitempty"`
+	// Enabled defaults to true.
+	Enabled *bool `json:"enabled,omitempty"`
+}
+
+// scheduleRecord is the state of a schedule, persisted on every change.
+type scheduleRecord struct {
+	ID        string `json:"id"`
+	Principal string `json:"principal"`
+	// Scopes are the scopes of the principal when it last saved the
+	// schedule; they are only used for JWT subjects, whose scopes can't be
+	// looked up, until ScopesExpireAt, the expiry of their token.
+	Scopes         []string               `json:"scopes,omitempty"`
+	ScopesExpireAt int64                  `json:"scopesExpireAt,omitempty"`
+	Name           string                 `json:"name,omitempty"`
+	Cron           string                 `json:"cron,omitempty"`
+	RunAt          int64                  `json:"runAt,omitempty"`
+	Timezone       string                 `json:"timezone,omitempty"`
+	Message        string                 `json:"message"`
+	Images         []string               `json:"images,omitempty"`
+	AgentConfig    map[string]interface{} `json:"agentConfig,omitempty"`
+	AgentMode      ai_agent.AgentMode     `json:"agentMode"`
+	Overlap        overlapPolicy          `json:"overlap"`
+	Enabled        bool                   `json:"enabled"`
+	// NextRunAt is 0 once a one-shot timer fired or a cron expression has no
+	// further activation.
+	NextRunAt int64         `json:"nextRunAt,omitempty"`
+	Runs      []scheduleRun `json:"runs,omitempty"`
+	CreatedAt int64         `json:"createdAt"`
+	UpdatedAt int64         `json:"updatedAt"`
+}
+
+// scheduleRun is an entry of the run history of a schedule.
+type scheduleRun struct {
+	ScheduledAt int64 `json:"scheduledAt"`
+	TriggeredAt int64 `json:"triggeredAt"`
+	// Manual runs were requested through the API.
+	Manual bool   `json:"manual,omitempty"`
+	JobID  string `json:"jobId,omitempty"`
+	// Skipped tells why no job was started.
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// next returns the activation of the schedule after now, or 0 if there is
+// none.
+func (r *scheduleRecord) next(now time.Time) int64 {
+	if r.Cron == "" {
+		if r.RunAt > now.Unix() {
+			return r.RunAt
+		}
+		return 0
+	}
+	expr, err := cron.Parse(r.Cron)
+	if err != nil {
+		return 0
+	}
+	loc, err := time.LoadLocation(r.Timezone)
+	if err != nil {
+		return 0
+	}
+	next := expr.Next(now.In(loc))
+	if next.IsZero() {
+		return 0
+	}
+	return next.Unix()
+}
+
+// scheduler starts the jobs of the schedules when they are due. The
+// schedules are saved to a file, if set.
+type scheduler struct {
+	path string
+	jobs *jobManager
+	// authorize checks before every run that the principal of a schedule may
+	// still start its jobs.
+	authorize func(record *scheduleRecord) error
+
+	mu        sync.Mutex
+	schedules map[string]*scheduleRecord
+	wake      chan struct{}
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+func newScheduler(path string, jobs *jobManager, authorize func(record *scheduleRecord) error) *scheduler {
+	return &scheduler{
+		path:      path,
+		jobs:      jobs,
+		authorize: authorize,
+		schedules: make(map[string]*scheduleRecord),
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+}
+
+// load reads the saved schedules. Runs missed while the service was down
+// happen once when the scheduler starts.
+func (sc *scheduler) load() error {
+	if sc.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(sc.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var records []*scheduleRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return err
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, record := range records {
+		sc.schedules[record.ID] = record
+	}
+	return nil
+}
+
+func (sc *scheduler) saveLocked() {
+	if sc.path == "" {
+		return
+	}
+	records := make([]*scheduleRecord, 0, len(sc.schedules))
+	for _, record := range sc.schedules {
+		records = append(records, record)
+	}
+	slices.SortFunc(records, func(a, b *scheduleRecord) int {
+		return cmp.Compare(a.CreatedAt, b.CreatedAt)
+	})
+	data, err := json.Marshal(records)
+	if err == nil {
+		err = writeFileAtomic(sc.path, data)
+	}
+	if err != nil {
+		log.Printf("Failed to save schedules: %v", err)
+	}
+}
+
+func (sc *scheduler) notify() {
+	select {
+	case sc.wake <- struct{}{}:
+	default:
+	}
+}
+
+// start runs the due schedules until stop is called.
+func (sc *scheduler) start() {
+	go func() {
+		defer close(sc.stopped)
+		for {
+			wait := sc.runDue(time.Now())
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-sc.wake:
+				timer.Stop()
+			case <-sc.done:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func (sc *scheduler) stop() {
+	close(sc.done)
+	<-sc.stopped
+}
+
+// runDue runs the enabled schedules due at now and returns how long to wait
+// for the next one.
+func (sc *scheduler) runDue(now time.Time) time.Duration {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	wait := maxSchedulerWait
+	changed := false
+	for _, record := range sc.schedules {
+		if !record.Enabled || record.NextRunAt == 0 {
+			continue
+		}
+		if record.NextRunAt <= now.Unix() {
+			sc.runLocked(record, time.Unix(record.NextRunAt, 0), false)
+			record.NextRunAt = record.next(now)
+			changed = true
+		}
+		if record.NextRunAt != 0 {
+			wait = min(wait, time.Until(time.Unix(record.NextRunAt, 0)))
+		}
+	}
+	if changed {
+		sc.saveLocked()
+	}
+	return max(wait, 0)
+}
+
+// runLocked starts a job for the run of record scheduled at scheduledAt,
+// unless its principal is no longer authorized or its overlap policy skips
+// it, and records the run.
+func (sc *scheduler) runLocked(record *scheduleRecord, scheduledAt time.Time, manual bool) scheduleRun {
+	run := scheduleRun{
+		ScheduledAt: scheduledAt.Unix(),
+		TriggeredAt: time.Now().Unix(),
+		Manual:      manual,
+	}
+	defer func() {
+		record.Runs = append(record.Runs, run)
+		if len(record.Runs) > maxScheduleRuns {
+			record.Runs = slices.Delete(record.Runs, 0, len(record.Runs)-maxScheduleRuns)
+		}
+		record.UpdatedAt = time.Now().Unix()
+	}()
+
+	if err := sc.authorize(record); err != nil {
+		log.Printf("Skipping run of schedule %s: principal %s is no longer authorized: %v", record.ID, record.Principal, err)
+		run.Skipped = "principal is no longer authorized: " + err.Error()
+		return run
+	}
+
+	principal := &auth.Principal{ID: record.Principal}
+	if previous := lastJobID(record); previous != "" && record.Overlap != overlapAllow {
+		if job, err := sc.jobs.get(previous, principal); err == nil && !job.Status.finished() {
+			if record.Overlap == overlapSkip {
+				run.Skipped = "previous job " + previous + " is still " + string(job.Status)
+				return run
+			}
+			if _, err := sc.jobs.cancel(previous, principal); err != nil {
+				log.Printf("Failed to cancel job %s of schedule %s: %v", previous, record.ID, err)
+			}
+		}
+	}
+
+	job, err := sc.jobs.submit(&auth.Principal{ID: record.Principal, Scopes: record.Scopes, ExpiresAt: record.ScopesExpireAt}, JobRequest{
+		Message:     record.Message,
+		Images:      record.Images,
+		AgentConfig: record.AgentConfig,
+		AgentMode:   string(record.AgentMode),
+	}, record.ID)
+	if err != nil {
+		log.Printf("Failed to start job of schedule %s: %v", record.ID, err)
+		run.Skipped = err.Error()
+		return run
+	}
+	run.JobID = job.ID
+	return run
+}
+
+// lastJobID returns the job of the latest run that started one.
+func lastJobID(record *scheduleRecord) string {
+	for i := len(record.Runs) - 1; i >= 0; i-- {
+		if record.Runs[i].JobID != "" {
+			return record.Runs[i].JobID
+		}
+	}
+	return ""
+}
+
+// lookupLocked returns the schedule id on behalf of principal. Schedules of
+// other principals are reported as not found unless principal has every
+// scope.
+func (sc *scheduler) lookupLocked(id string, principal *auth.Principal) (*scheduleRecord, error) {
+	record, ok := sc.schedules[id]
+	if !ok || (record.Principal != principal.ID && !principal.HasScope(auth.ScopeAll)) {
+		return nil, errScheduleNotFound
+	}
+	return record, nil
+}
+
+// apply validates req, except its agentConfig, and sets the definition of
+// record from it.
+func (req ScheduleRequest) apply(record *scheduleRecord, now time.Time) error {
+	if req.Message == "" && len(req.Images) == 0 {
+		return errors.New("message or images are required")
+	}
+	if (req.Cron == "") == (req.RunAt == nil) {
+		return errors.New("exactly one of cron and runAt is required")
+	}
+	if req.Cron != "" {
+		if _, err := cron.Parse(req.Cron); err != nil {
+			return err
+		}
+	} else if !req.RunAt.After(now) {
+		return errRunAtPast
+	}
+	timezone := req.Timezone
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(timezone); err != nil {
+		return fmt.Errorf("invalid timezone: %s", timezone)
+	}
+	agentMode := ai_agent.AgentMode(req.AgentMode)
+	switch agentMode {
+	case "":
+		agentMode = ai_agent.AgentModeLoop
+	case ai_agent.AgentModeLoop, ai_agent.AgentModeChat:
+	default:
+		return errors.New("agentMode must be loop or chat")
+	}
+	overlap := overlapPolicy(req.Overlap)
+	switch overlap {
+	case "":
+		overlap = overlapSkip
+	case overlapSkip, overlapAllow, overlapReplace:
+	default:
+		return errors.New("overlap must be skip, allow or replace")
+	}
+
+	record.Name = req.Name
+	record.Cron = req.Cron
+	record.RunAt = 0
+	if req.RunAt != nil {
+		record.RunAt = req.RunAt.Unix()
+	}
+	record.Timezone = timezone
+	record.Message = req.Message
+	record.Images = req.Images
+	record.AgentConfig = req.AgentConfig
+	record.AgentMode = agentMode
+	record.Overlap = overlap
+	record.Enabled = req.Enabled == nil || *req.Enabled
+	record.NextRunAt = record.next(now)
+	record.UpdatedAt = now.Unix()
+	return nil
+}
+
+// authorizeSchedule checks that the principal of a schedule still exists and
+// still has the chat scope.
+func (s *Server) authorizeSchedule(record *scheduleRecord) error {
+	_, err := s.reauthorize(record.Principal, record.Scopes, record.ScopesExpireAt, scopeChat)
+	return err
+}
+
+// scheduleView is the API representation of a schedule, with masked
+// content and without the run history.
+func (s *Server) scheduleView(record *scheduleRecord) gin.H {
+	status := "scheduled"
+	switch {
+	case !record.Enabled:
+		status = "disabled"
+	case record.NextRunAt == 0:
+		status = "completed"
+	}
+	view := gin.H{
+		"id":        record.ID,
+		"principal": record.Principal,
+		"name":      record.Name,
+		"status":    status,
+		"timezone":  record.Timezone,
+		"message":   s.redactor.Redact(record.Message),
+		"images":    len(record.Images),
+		"agentMode": record.AgentMode,
+		"overlap":   record.Overlap,
+		"enabled":   record.Enabled,
+		"runs":      len(record.Runs),
+		"createdAt": record.CreatedAt,
+		"updatedAt": record.UpdatedAt,
+	}
+	if record.Cron != "" {
+		view["cron"] = record.Cron
+	} else {
+		view["runAt"] = record.RunAt
+	}
+	if record.Enabled && record.NextRunAt != 0 {
+		view["nextRunAt"] = record.NextRunAt
+	}
+	if len(record.Runs) > 0 {
+		view["lastRun"] = s.scheduleRunView(record, record.Runs[len(record.Runs)-1])
+	}
+	return view
+}
+
+// scheduleRunView adds the status of the job of a run, while it exists.
+func (s *Server) scheduleRunView(record *scheduleRecord, run scheduleRun) gin.H {
+	view := gin.H{
+		"scheduledAt": run.ScheduledAt,
+		"triggeredAt": run.TriggeredAt,
+		"manual":      run.Manual,
+	}
+	if run.Skipped != "" {
+		view["status"] = "skipped"
+		view["skipped"] = run.Skipped
+		return view
+	}
+	view["jobId"] = run.JobID
+	if job, err := s.jobs.get(run.JobID, &auth.Principal{ID: record.Principal}); err == nil {
+		view["status"] = job.Status
+	}
+	return view
+}
+
+func (s *Server) createScheduleHandler(c *gin.Context) {
+	var req ScheduleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if _, err := chatTurnContext(c.Request.Context(), principalFromContext(c), "", req.AgentConfig); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	principal := principalFromContext(c)
+	if !canRunInBackground(principal) {
+		c.JSON(403, gin.H{"error": "Schedules need a token that expires"})
+		return
+	}
+
+	now := time.Now()
+	record := &scheduleRecord{
+		ID:             uuid.NewString(),
+		Principal:      principal.ID,
+		Scopes:         principal.Scopes,
+		ScopesExpireAt: principal.ExpiresAt,
+		CreatedAt:      now.Unix(),
+	}
+	if err := req.apply(record, now); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	sc := s.schedules
+	sc.mu.Lock()
+	sc.schedules[record.ID] = record
+	sc.saveLocked()
+	view := s.scheduleView(record)
+	sc.mu.Unlock()
+	sc.notify()
+	c.JSON(201, view)
+}
+
+func (s *Server) listSchedulesHandler(c *gin.Context) {
+	principal := principalFromContext(c)
+	sc := s.schedules
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	records := make([]*scheduleRecord, 0, len(sc.schedules))
+	for _, record := range sc.schedules {
+		if record.Principal == principal.ID || principal.HasScope(auth.ScopeAll) {
+			records = append(records, record)
+		}
+	}
+	slices.SortFunc(records, func(a, b *scheduleRecord) int {
+		return cmp.Compare(b.CreatedAt, a.CreatedAt)
+	})
+	schedules := make([]gin.H, 0, len(records))
+	for _, record := range records {
+		schedules = append(schedules, s.scheduleView(record))
+	}
+	c.JSON(200, gin.H{"schedules": schedules})
+}
+
+func (s *Server) getScheduleHandler(c *gin.Context) {
+	sc := s.schedules
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	record, err := sc.lookupLocked(c.Param("id"), principalFromContext(c))
+	if err != nil {
+		c.JSON(404, gin.H{"error": "Schedule not found"})
+		return
+	}
+	c.JSON(200, s.scheduleView(record))
+}
+
+// updateScheduleHandler replaces the definition of a schedule; its run
+// history is kept.
+func (s *Server) updateScheduleHandler(c *gin.Context) {
+	var req ScheduleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if _, err := chatTurnContext(c.Request.Context(), principalFromContext(c), "", req.AgentConfig); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	sc := s.schedules
+	sc.mu.Lock()
+	record, err := sc.lookupLocked(c.Param("id"), principalFromContext(c))
+	if err != nil {
+		sc.mu.Unlock()
+		c.JSON(404, gin.H{"error": "Schedule not found"})
+		return
+	}
+	updated := *record
+	if principal := principalFromContext(c); principal.ID == record.Principal && canRunInBackground(principal) {
+		updated.Scopes = principal.Scopes
+		updated.ScopesExpireAt = principal.ExpiresAt
+	}
+	if err := req.apply(&updated, time.Now()); err != nil {
+		sc.mu.Unlock()
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	*record = updated
+	sc.saveLocked()
+	view := s.scheduleView(record)
+	sc.mu.Unlock()
+	sc.notify()
+	c.JSON(200, view)
+}
+
+// deleteScheduleHandler deletes a schedule; jobs it started keep running.
+func (s *Server) deleteScheduleHandler(c *gin.Context) {
+	sc := s.schedules
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	record, err := sc.lookupLocked(c.Param("id"), principalFromContext(c))
+	if err != nil {
+		c.JSON(404, gin.H{"error": "Schedule not found"})
+		return
+	}
+	delete(sc.schedules, record.ID)
+	sc.saveLocked()
+	c.JSON(200, gin.H{"message": "Schedule deleted"})
+}
+
+func (s *Server) listScheduleRunsHandler(c *gin.Context) {
+	sc := s.schedules
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	record, err := sc.lookupLocked(c.Param("id"), principalFromContext(c))
+	if err != nil {
+		c.JSON(404, gin.H{"error": "Schedule not found"})
+		return
+	}
+	runs := make([]gin.H, 0, len(record.Runs))
+	for i := len(record.Runs) - 1; i >= 0; i-- {
+		runs = append(runs, s.scheduleRunView(record, record.Runs[i]))
+	}
+	c.JSON(200, gin.H{"runs": runs})
+}
+
+// runScheduleHandler runs a schedule now, subject to its overlap policy,
+// without changing its next run.
+func (s *Server) runScheduleHandler(c *gin.Context) {
+	sc := s.schedules
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	record, err := sc.lookupLocked(c.Param("id"), principalFromContext(c))
+	if err != nil {
+		c.JSON(404, gin.H{"error": "Schedule not found"})
+		return
+	}
+	run := sc.runLocked(record, time.Now(), true)
+	sc.saveLocked()
+	c.JSON(202, s.scheduleRunView(record, run))
+}
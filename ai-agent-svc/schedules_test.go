@@ -0,0 +1,192 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luoxiaojun1992/ai-agent/util/auth"
+)
+
+// createSchedule creates a schedule through the API with the credentials
+// token and returns its id.
+func createSchedule(t *testing.T, ts *testServer, token string, req ScheduleRequest) string {
+	t.Helper()
+	status, resp := ts.doWithToken(t, token, "POST", "/schedules", req)
+	id, _ := resp["id"].(string)
+	if status != 201 || id == "" {
+		t.Fatalf("create schedule: %d %v", status, resp)
+	}
+	return id
+}
+
+// runDue makes the schedule id due, runs the scheduler and returns the run.
+func runDue(t *testing.T, ts *testServer, id string) scheduleRun {
+	t.Helper()
+	sc := ts.schedules
+	sc.mu.Lock()
+	record, ok := sc.schedules[id]
+	if !ok {
+		sc.mu.Unlock()
+		t.Fatalf("schedule %s not found", id)
+	}
+	record.NextRunAt = time.Now().Unix() - 1
+	sc.mu.Unlock()
+
+	sc.runDue(time.Now())
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if record.NextRunAt <= time.Now().Unix() {
+		t.Fatalf("expected the next run in the future, got %d", record.NextRunAt)
+	}
+	return record.Runs[len(record.Runs)-1]
+}
+
+func TestScheduleRequest_Apply(t *testing.T) {
+	now := time.Now()
+	runAt := now.Add(time.Hour)
+	invalid := map[string]struct {
+		req  ScheduleRequest
+		want string
+	}{
+		"no message":    {ScheduleRequest{Cron: "* * * * *"}, "message or images are required"},
+		"no trigger":    {ScheduleRequest{Message: "hi"}, "exactly one of cron and runAt is required"},
+		"both triggers": {ScheduleRequest{Message: "hi", Cron: "* * * * *", RunAt: &runAt}, "exactly one of cron and runAt is required"},
+		"timezone":      {ScheduleRequest{Message: "hi", Cron: "* * * * *", Timezone: "Mars/Olympus"}, "invalid timezone: Mars/Olympus"},
+		"overlap":       {ScheduleRequest{Message: "hi", Cron: "* * * * *", Overlap: "queue"}, "overlap must be skip, allow or replace"},
+	}
+	for name, tc := range invalid {
+		if err := tc.req.apply(&scheduleRecord{}, now); err == nil || err.Error() != tc.want {
+			t.Fatalf("%s: expected %q, got %v", name, tc.want, err)
+		}
+	}
+	past := now.Add(-time.Minute)
+	if err := (ScheduleRequest{Message: "hi", RunAt: &past}).apply(&scheduleRecord{}, now); err != errRunAtPast {
+		t.Fatalf("expected %v, got %v", errRunAtPast, err)
+	}
+
+	record := &scheduleRecord{}
+	if err := (ScheduleRequest{Message: "hi", RunAt: &runAt}).apply(record, now); err != nil {
+		t.Fatalf("apply one-shot: %v", err)
+	}
+	if record.NextRunAt != runAt.Unix() || record.Overlap != overlapSkip || !record.Enabled || record.Timezone != "UTC" {
+		t.Fatalf("unexpected one-shot schedule %+v", record)
+	}
+}
+
+func TestSchedules_RunAndOverlap(t *testing.T) {
+	ts := newTestServer(t)
+	id := createSchedule(t, ts, "test-key", ScheduleRequest{Message: "report", Cron: "0 9 * * *", AgentMode: "chat"})
+
+	run := runDue(t, ts, id)
+	if run.JobID == "" || run.Skipped != "" || run.Manual {
+		t.Fatalf("unexpected run %+v", run)
+	}
+	record := waitJob(t, ts, run.JobID, jobSucceeded)
+	if record.ScheduleID != id || record.Message != "report" {
+		t.Fatalf("unexpected job %+v", record)
+	}
+
+	// the next job keeps running, so the following run is skipped
+	ts.ollama.script(nil)
+	status, resp := ts.do(t, "POST", "/schedules/"+id+"/run", nil)
+	running, _ := resp["jobId"].(string)
+	if status != 202 || running == "" {
+		t.Fatalf("manual run: %d %v", status, resp)
+	}
+	eventually(t, "the job to reach the model", func() bool { return ts.ollama.held() == 1 })
+	if run := runDue(t, ts, id); run.JobID != "" || !strings.Contains(run.Skipped, "still running") {
+		t.Fatalf("expected the overlapping run skipped, got %+v", run)
+	}
+
+	status, resp = ts.do(t, "PUT", "/schedules/"+id, ScheduleRequest{Message: "report", Cron: "0 9 * * *", AgentMode: "chat", Overlap: "replace"})
+	if status != 200 {
+		t.Fatalf("update schedule: %d %v", status, resp)
+	}
+	run = runDue(t, ts, id)
+	if run.JobID == "" || run.JobID == running {
+		t.Fatalf("expected a new job replacing %s, got %+v", running, run)
+	}
+	waitJob(t, ts, running, jobCancelled)
+	waitJob(t, ts, run.JobID, jobSucceeded)
+
+	status, resp = ts.do(t, "GET", "/schedules/"+id+"/runs", nil)
+	if runs, _ := resp["runs"].([]any); status != 200 || len(runs) != 4 {
+		t.Fatalf("expected 4 runs in the history, got %d %v", status, resp)
+	}
+}
+
+func TestSchedules_ReauthorizedBeforeEachRun(t *testing.T) {
+	schedulesFile := filepath.Join(t.TempDir(), "schedules.json")
+	jwtSecret := []byte("jwt-test-secret")
+	withAuth := func(keys []auth.APIKey, jwt bool) func(config *Config) {
+		return func(config *Config) {
+			config.SchedulesFile = schedulesFile
+			config.Auth.APIKeys = keys
+			if jwt {
+				config.Auth.JWT = &auth.JWTConfig{Secret: jwtSecret}
+			}
+		}
+	}
+	reporter := auth.APIKey{ID: "reporter", Key: "reporter-key", Scopes: []string{scopeChat}}
+	token, err := auth.SignJWT(map[string]any{"sub": "alice", "scope": scopeChat, "exp": time.Now().Add(time.Hour).Unix()}, jwtSecret)
+	if err != nil {
+		t.Fatalf("sign jwt: %v", err)
+	}
+
+	ts := newTestServer(t, withAuth([]auth.APIKey{reporter}, true))
+	byKey := createSchedule(t, ts, "reporter-key", ScheduleRequest{Message: "report", Cron: "0 9 * * *", AgentMode: "chat"})
+	byJWT := createSchedule(t, ts, token, ScheduleRequest{Message: "report", Cron: "0 9 * * *", AgentMode: "chat"})
+	for _, id := range []string{byKey, byJWT} {
+		if run := runDue(t, ts, id); run.JobID == "" {
+			t.Fatalf("expected the schedule %s to run, got %+v", id, run)
+		}
+	}
+
+	cases := []struct {
+		name    string
+		keys    []auth.APIKey
+		jwt     bool
+		skipped map[string]string
+	}{
+		{"key revoked", nil, true, map[string]string{byKey: "unknown principal"}},
+		{"scope removed", []auth.APIKey{{ID: "reporter", Key: "reporter-key", Scopes: []string{scopeMemory}}}, true, map[string]string{byKey: "missing scope chat"}},
+		{"jwt disabled", []auth.APIKey{reporter}, false, map[string]string{byJWT: "unknown principal"}},
+	}
+	for _, tc := range cases {
+		restarted := newTestServer(t, withAuth(tc.keys, tc.jwt))
+		for _, id := range []string{byKey, byJWT} {
+			run := runDue(t, restarted, id)
+			if reason, ok := tc.skipped[id]; ok {
+				if run.JobID != "" || !strings.Contains(run.Skipped, "no longer authorized: "+reason) {
+					t.Fatalf("%s: expected the run of %s skipped for %q, got %+v", tc.name, id, reason, run)
+				}
+			} else if run.JobID == "" {
+				t.Fatalf("%s: expected the schedule %s to run, got %+v", tc.name, id, run)
+			}
+		}
+	}
+
+	// The saved scopes of a JWT subject end with the token that saved them
+	ts.schedules.mu.Lock()
+	ts.schedules.schedules[byJWT].ScopesExpireAt = time.Now().Unix() - 1
+	ts.schedules.mu.Unlock()
+	if run := runDue(t, ts, byJWT); run.JobID != "" || !strings.Contains(run.Skipped, "no longer authorized: "+errScopesExpired.Error()) {
+		t.Fatalf("expected the run skipped after the token expired, got %+v", run)
+	}
+
+	// Tokens without exp would keep their scopes forever
+	lenient := newTestServer(t, func(config *Config) {
+		config.Auth.APIKeys = nil
+		config.Auth.JWT = &auth.JWTConfig{Secret: jwtSecret, AllowMissingExp: true}
+	})
+	forever, err := auth.SignJWT(map[string]any{"sub": "alice", "scope": scopeChat}, jwtSecret)
+	if err != nil {
+		t.Fatalf("sign jwt: %v", err)
+	}
+	if status, resp := lenient.doWithToken(t, forever, "POST", "/schedules", ScheduleRequest{Message: "report", Cron: "0 9 * * *", AgentMode: "chat"}); status != 403 {
+		t.Fatalf("expected a schedule without token expiry refused, got %d %v", status, resp)
+	}
+}
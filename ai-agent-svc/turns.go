@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/luoxiaojun1992/ai-agent/util/auth"
+)
+
+var (
+	errTurnCancelled = errors.New("turn cancelled")
+	errShuttingDown  = errors.New("server is shutting down")
+	errTurnTimeout   = errors.New("turn timed out")
+	errTurnNotFound  = errors.New("turn not found")
+)
+
+// turnEvent is an SSE event of a streamed turn. Ids increase from 1.
+type turnEvent struct {
+	id   int
+	name string
+	data any
+}
+
+// eventLog buffers the events of a streamed turn or a job so clients can
+// replay them.
+type eventLog struct {
+	mu     sync.Mutex
+	events []turnEvent
+	ended  bool
+	more   chan struct{}
+	// onAppend, if set, is called with every new event, in order.
+	onAppend func(event turnEvent)
+	// onEnd, if set, is called when the log is marked complete.
+	onEnd func()
+}
+
+func newEventLog() *eventLog {
+	return &eventLog{more: make(chan struct{})}
+}
+
+func (l *eventLog) append(name string, data any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	event := turnEvent{id: len(l.events) + 1, name: name, data: data}
+	l.events = append(l.events, event)
+	if l.onAppend != nil {
+		l.onAppend(event)
+	}
+	close(l.more)
+	l.more = make(chan struct{})
+}
+
+// end marks the log complete.
+func (l *eventLog) end() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ended = true
+	if l.onEnd != nil {
+		l.onEnd()
+	}
+	close(l.more)
+	l.more = make(chan struct{})
+}
+
+// since returns the events after id, a channel closed when the log changes
+// and whether the log is complete.
+func (l *eventLog) since(id int) ([]turnEvent, <-chan struct{}, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	id = min(max(id, 0), len(l.events))
+	return slices.Clone(l.events[id:]), l.more, l.ended
+}
+
+// turn is a chat turn, in flight or, for streamed turns, kept for replay.
+type turn struct {
+	id        string
+	principal string
+	ctx       context.Context
+	cancel    context.CancelCauseFunc
+	// events is nil for blocking turns.
+	events *eventLog
+	// finishedAt is set, under the registry lock, when the turn ended.
+	finishedAt time.Time
+	// release frees the rate limit slot the turn took over from its request.
+	release func()
+}
+
+// cancelled reports why the turn was cancelled, or nil while it runs or when
+// only the client went away.
+func (t *turn) cancelled() error {
+	cause := context.Cause(t.ctx)
+	if errors.Is(cause, errTurnCancelled) || errors.Is(cause, errShuttingDown) || errors.Is(cause, errTurnTimeout) {
+		return cause
+	}
+	return nil
+}
+
+// turnRegistry tracks the chat turns in flight so they can be cancelled by
+// id and drained on shutdown, and keeps the events of streamed turns for
+// the retention period after they end.
+type turnRegistry struct {
+	retention time.Duration
+
+	mu      sync.Mutex
+	turns   map[string]*turn
+	closed  bool
+	running sync.WaitGroup
+}
+
+func newTurnRegistry(retention time.Duration) *turnRegistry {
+	return &turnRegistry{retention: retention, turns: make(map[string]*turn)}
+}
+
+// start registers a turn of principal whose context is derived from parent.
+// Streamed turns buffer their events. The turn takes over the rate limit
+// slot of the request parent belongs to. finish must be called when the turn
+// ends.
+func (r *turnRegistry) start(parent context.Context, principal string, stream bool) (*turn, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, errShuttingDown
+	}
+	r.pruneLocked()
+	ctx, cancel := context.WithCancelCause(parent)
+	t := &turn{id: uuid.NewString(), principal: principal, ctx: ctx, cancel: cancel, release: takeSlot(parent)}
+	if stream {
+		t.events = newEventLog()
+	}
+	r.turns[t.id] = t
+	r.running.Add(1)
+	return t, nil
+}
+
+func (r *turnRegistry) finish(t *turn) {
+	r.mu.Lock()
+	t.finishedAt = time.Now()
+	if t.events == nil {
+		delete(r.turns, t.id)
+	}
+	r.mu.Unlock()
+	if t.events != nil {
+		t.events.end()
+	}
+	t.cancel(nil)
+	t.release()
+	r.running.Done()
+}
+
+// pruneLocked drops the finished turns past the retention period.
+func (r *turnRegistry) pruneLocked() {
+	for id, t := range r.turns {
+		if !t.finishedAt.IsZero() && time.Since(t.finishedAt) > r.retention {
+			delete(r.turns, id)
+		}
+	}
+}
+
+// lookup returns the turn id on behalf of principal. Turns of other
+// principals are reported as not found unless principal has every scope.
+func (r *turnRegistry) lookup(id string, principal *auth.Principal) (*turn, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pruneLocked()
+	t, ok := r.turns[id]
+	if !ok || (t.principal != principal.ID && !principal.HasScope(auth.ScopeAll)) {
+		return nil, errTurnNotFound
+	}
+	return t, nil
+}
+
+// cancel cancels the running turn id on behalf of principal.
+func (r *turnRegistry) cancel(id string, principal *auth.Principal) error {
+	t, err := r.lookup(id, principal)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	finished := !t.finishedAt.IsZero()
+	r.mu.Unlock()
+	if finished {
+		return errTurnNotFound
+	}
+	t.cancel(errTurnCancelled)
+	return nil
+}
+
+// active returns the number of turns in flight.
+func (r *turnRegistry) active() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	active := 0
+	for _, t := range r.turns {
+		if t.finishedAt.IsZero() {
+			active++
+		}
+	}
+	return active
+}
+
+// close rejects new turns.
+func (r *turnRegistry) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+}
+
+// cancelAll cancels every turn in flight with cause.
+func (r *turnRegistry) cancelAll(cause error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, t := range r.turns {
+		t.cancel(cause)
+	}
+}
+
+// wait waits for the turns in flight to finish, until ctx is done.
+func (r *turnRegistry) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		r.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// drain stops new turns and waits up to grace for the running ones, then
+// cancels the rest and gives them a moment to unwind.
+func (r *turnRegistry) drain(grace time.Duration) error {
+	r.close()
+	graceCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := r.wait(graceCtx); err == nil {
+		return nil
+	}
+
+	r.cancelAll(errShuttingDown)
+	unwindCtx, cancelUnwind := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelUnwind()
+	return r.wait(unwindCtx)
+}
+
+func (s *Server) cancelTurnHandler(c *gin.Context) {
+	id := c.Param("id")
+	if err := s.turns.cancel(id, principalFromContext(c)); err != nil {
+		c.JSON(404, gin.H{"error": "Turn not found"})
+		return
+	}
+	c.JSON(202, gin.H{"turnId": id, "status": "cancelling"})
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	ai_agent "github.com/luoxiaojun1992/ai-agent"
+	"github.com/luoxiaojun1992/ai-agent/util/auth"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// wsIdleTimeout closes connections the client sent nothing on, not even
+	// a ping, for this long.
+	wsIdleTimeout = 90 * time.Second
+	// wsPingInterval is how often the server pings to keep the connection
+	// open through proxies.
+	wsPingInterval = 30 * time.Second
+	// wsApprovalTimeout declines approval requests left unanswered.
+	wsApprovalTimeout = 5 * time.Minute
+	// wsMaxMessageBytes bounds client messages, which may carry images.
+	wsMaxMessageBytes = 32 << 20
+)
+
+// wsClientMessage is a message of the /ws protocol sent by the client.
+type wsClientMessage struct {
+	// Type is "message", "cancel", "approval", "ping" or "pong".
+	Type string `json:"type"`
+
+	// message: a user message starting a turn, with the options of POST /chat.
+	// With interrupt the running turns of the connection are cancelled first.
+	Message     string                 `json:"message,omitempty"`
+	Images      []string               `json:"images,omitempty"`
+	AgentConfig map[string]interface{} `json:"agentConfig,omitempty"`
+	Interrupt   bool                   `json:"interrupt,omitempty"`
+
+	// cancel: the turn to cancel, or every running turn of the connection.
+	TurnID string `json:"turnId,omitempty"`
+
+	// approval: the answer to an approval_request.
+	RequestID string `json:"requestId,omitempty"`
+	Approved  bool   `json:"approved,omitempty"`
+}
+
+// wsServerMessage is a message of the /ws protocol sent by the server: the
+// events of the turns, with the names and data of the SSE events, and
+// "error", "ping" and "pong".
+type wsServerMessage struct {
+	Type    string `json:"type"`
+	TurnID  string `json:"turnId,omitempty"`
+	EventID int    `json:"eventId,omitempty"`
+	Data    any    `json:"data,omitempty"`
+	// Error, Reason and RetryAfter describe rejected client messages.
+	Error      string `json:"error,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+	RetryAfter int    `json:"retryAfter,omitempty"`
+	Timestamp  int64  `json:"timestamp"`
+}
+
+// wsSession is a /ws connection. Its turns are registered like the turns of
+// POST /chat, so they can also be cancelled and resumed over HTTP, and they
+// keep running when the connection closes.
+type wsSession struct {
+	server    *Server
+	conn      *websocket.Conn
+	base      context.Context
+	principal *auth.Principal
+	sessionID string
+	ip        string
+
+	writeMu sync.Mutex
+
+	mu        sync.Mutex
+	turns     map[string]*turn
+	approvals map[string]chan bool
+	closed    bool
+}
+
+func (s *Server) wsHandler(c *gin.Context) {
+	session := &wsSession{
+		server: s,
+		// Turns outlive the connection; the context keeps the request values.
+		base:      context.WithoutCancel(c.Request.Context()),
+		principal: principalFromContext(c),
+		sessionID: c.GetHeader("X-Session-ID"),
+		ip:        c.ClientIP(),
+		turns:     make(map[string]*turn),
+		approvals: make(map[string]chan bool),
+	}
+	websocket.Server{
+		Handshake: s.webSocketHandshake,
+		Handler: func(conn *websocket.Conn) {
+			conn.MaxPayloadBytes = wsMaxMessageBytes
+			session.conn = conn
+			session.serve()
+		},
+	}.ServeHTTP(c.Writer, c.Request)
+}
+
+// webSocketHandshake selects wsProtocol when offered, so the bearer
+// subprotocol is never echoed, and applies the CORS origins to browser
+// connections; clients that send no Origin header are not browsers and are
+// accepted.
+func (s *Server) webSocketHandshake(config *websocket.Config, req *http.Request) error {
+	if slices.Contains(config.Protocol, wsProtocol) {
+		config.Protocol = []string{wsProtocol}
+	} else {
+		config.Protocol = nil
+	}
+	if req.Header.Get("Origin") == "" || slices.Contains(s.config.CORSOrigins, "*") {
+		return nil
+	}
+	origin, err := websocket.Origin(config, req)
+	if err != nil {
+		return err
+	}
+	if origin == nil || !slices.Contains(s.config.CORSOrigins, origin.String()) {
+		return errors.New("origin not allowed")
+	}
+	config.Origin = origin
+	return nil
+}
+
+func (ws *wsSession) send(msg wsServerMessage) error {
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+	msg.Timestamp = time.Now().Unix()
+	return websocket.JSON.Send(ws.conn, msg)
+}
+
+func (ws *wsSession) sendError(turnID, message string) {
+	ws.send(wsServerMessage{Type: "error", TurnID: turnID, Error: message})
+}
+
+func (ws *wsSession) serve() {
+	done := make(chan struct{})
+	defer close(done)
+	defer ws.declinePendingApprovals()
+
+	go func() {
+		ticker := time.NewTicker(wsPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := ws.send(wsServerMessage{Type: "ping"}); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		ws.conn.SetReadDeadline(time.Now().Add(wsIdleTimeout))
+		var msg wsClientMessage
+		if err := websocket.JSON.Receive(ws.conn, &msg); err != nil {
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+				ws.sendError("", "Invalid message format")
+				continue
+			}
+			return
+		}
+
+		switch msg.Type {
+		case "message":
+			ws.startTurn(msg)
+		case "cancel":
+			ws.cancel(msg.TurnID)
+		case "approval":
+			ws.answerApproval(msg.RequestID, msg.Approved)
+		case "ping":
+			ws.send(wsServerMessage{Type: "pong"})
+		case "pong":
+		default:
+			ws.sendError("", "Unknown message type")
+		}
+	}
+}
+
+// startTurn runs a user message as a streamed turn and forwards its events.
+func (ws *wsSession) startTurn(msg wsClientMessage) {
+	if msg.Message == "" && len(msg.Images) == 0 {
+		ws.sendError("", "Message or images are required")
+		return
+	}
+	ctx, err := chatTurnContext(ws.base, ws.principal, ws.sessionID, msg.AgentConfig)
+	if err != nil {
+		ws.sendError("", err.Error())
+		return
+	}
+
+	if msg.Interrupt {
+		ws.cancel("")
+	}
+
+	// Every message counts against the limits of POST /chat; the turn holds
+	// its slot until it finishes
+	ctx, release, limitErr := ws.server.rateLimits.admit(ctx, ws.principal, ws.ip, "POST /chat", scopeChat)
+	if limitErr != nil {
+		ws.send(wsServerMessage{
+			Type:       "error",
+			Error:      limitErr.Error(),
+			Reason:     limitErr.Reason,
+			RetryAfter: retryAfterSeconds(limitErr.RetryAfter),
+		})
+		return
+	}
+
+	var t *turn
+	ctx = ai_agent.WithApprovalCallback(ctx, func(ctx context.Context, request ai_agent.ApprovalRequest) (bool, error) {
+		return ws.requestApproval(ctx, t, request)
+	})
+	t, err = ws.server.turns.start(ctx, ws.principal.ID, true)
+	if err != nil {
+		release()
+		ws.sendError("", "Server is shutting down")
+		return
+	}
+
+	ws.mu.Lock()
+	ws.turns[t.id] = t
+	ws.mu.Unlock()
+
+	go func() {
+		defer ws.server.turns.finish(t)
+		ws.server.runStreamTurn(t, msg.Message, msg.Images)
+	}()
+	go ws.forward(t)
+}
+
+// forward sends the events of t until it ends or the connection fails.
+func (ws *wsSession) forward(t *turn) {
+	defer func() {
+		ws.mu.Lock()
+		delete(ws.turns, t.id)
+		ws.mu.Unlock()
+	}()
+
+	lastEventID := 0
+	for {
+		events, more, ended := t.events.since(lastEventID)
+		for _, event := range events {
+			if err := ws.send(wsServerMessage{
+				Type:    event.name,
+				TurnID:  t.id,
+				EventID: event.id,
+				Data:    event.data,
+			}); err != nil {
+				return
+			}
+			lastEventID = event.id
+		}
+		if len(events) > 0 {
+			continue
+		}
+		if ended {
+			return
+		}
+		<-more
+	}
+}
+
+// cancel cancels the turn id, or every running turn of the connection.
+func (ws *wsSession) cancel(id string) {
+	if id != "" {
+		if err := ws.server.turns.cancel(id, ws.principal); err != nil {
+			ws.sendError(id, "Turn not found")
+		}
+		return
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	for _, t := range ws.turns {
+		t.cancel(errTurnCancelled)
+	}
+}
+
+// requestApproval asks the client to approve a destructive call of t and
+// waits for the answer. Unanswered requests are declined.
+func (ws *wsSession) requestApproval(ctx context.Context, t *turn, request ai_agent.ApprovalRequest) (bool, error) {
+	requestID := uuid.NewString()
+	answer := make(chan bool, 1)
+	ws.mu.Lock()
+	if ws.closed {
+		ws.mu.Unlock()
+		return false, nil
+	}
+	ws.approvals[requestID] = answer
+	ws.mu.Unlock()
+	defer func() {
+		ws.mu.Lock()
+		delete(ws.approvals, requestID)
+		ws.mu.Unlock()
+	}()
+
+	args := ws.server.redactor.JSON(request.Context)
+	t.events.append("approval_request", map[string]interface{}{
+		"requestId": requestID,
+		"function":  request.Function,
+		"context":   args,
+		"sources":   request.Sources,
+		"timestamp": time.Now().Unix(),
+	})
+
+	select {
+	case approved := <-answer:
+		log.Printf("audit principal=%s approval function=%s approved=%t", ws.principal.ID, request.Function, approved)
+		return approved, nil
+	case <-ctx.Done():
+		return false, context.Cause(ctx)
+	case <-time.After(wsApprovalTimeout):
+		return false, nil
+	}
+}
+
+func (ws *wsSession) answerApproval(requestID string, approved bool) {
+	ws.mu.Lock()
+	answer, ok := ws.approvals[requestID]
+	ws.mu.Unlock()
+	if !ok {
+		ws.sendError("", "Approval request not found")
+		return
+	}
+	select {
+	case answer <- approved:
+	default:
+	}
+}
+
+// declinePendingApprovals declines the requests nobody can answer once the
+// connection is gone, and the requests to come.
+func (ws *wsSession) declinePendingApprovals() {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.closed = true
+	for _, answer := range ws.approvals {
+		select {
+		case answer <- false:
+		default:
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+// syncBuffer is a bytes.Buffer safe for the concurrent writes of handlers.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// dialWS opens /ws with query appended to the URL, offering protocols.
+func dialWS(ts *testServer, query string, protocols ...string) (*websocket.Conn, error) {
+	config, err := websocket.NewConfig("ws"+strings.TrimPrefix(ts.http.URL, "http")+"/ws"+query, ts.http.URL)
+	if err != nil {
+		return nil, err
+	}
+	config.Protocol = protocols
+	return websocket.DialConfig(config)
+}
+
+// receiveUntil reads server messages until one of type typ arrives.
+func receiveUntil(t *testing.T, conn *websocket.Conn, typ string) wsServerMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg wsServerMessage
+		if err := websocket.JSON.Receive(conn, &msg); err != nil {
+			t.Fatalf("waiting for %s: %v", typ, err)
+		}
+		if msg.Type == typ {
+			return msg
+		}
+		if msg.Type == "error" {
+			t.Fatalf("waiting for %s: %+v", typ, msg)
+		}
+	}
+}
+
+func TestWS_Handshake(t *testing.T) {
+	var accessLog syncBuffer
+	defaultWriter := gin.DefaultWriter
+	gin.DefaultWriter = &accessLog
+	t.Cleanup(func() { gin.DefaultWriter = defaultWriter })
+	ts := newTestServer(t)
+
+	resp, err := http.Get(ts.http.URL + "/ws")
+	if err != nil {
+		t.Fatalf("get /ws: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without credentials, got %d", resp.StatusCode)
+	}
+	if _, err := dialWS(ts, "?access_token=wrong-key"); err == nil {
+		t.Fatalf("expected a wrong token to be rejected")
+	}
+
+	conn, err := dialWS(ts, "?access_token=test-key&lang=en")
+	if err != nil {
+		t.Fatalf("dial with access_token: %v", err)
+	}
+	conn.Close()
+
+	conn, err = dialWS(ts, "", wsProtocol, wsTokenProtocolPrefix+"test-key")
+	if err != nil {
+		t.Fatalf("dial with bearer subprotocol: %v", err)
+	}
+	if protocols := conn.Config().Protocol; len(protocols) != 1 || protocols[0] != wsProtocol {
+		t.Fatalf("expected the server to select %s only, got %v", wsProtocol, protocols)
+	}
+	conn.Close()
+
+	// the access log line is written once the connection is closed
+	deadline := time.Now().Add(5 * time.Second)
+	for strings.Count(accessLog.String(), "/ws") < 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	logged := accessLog.String()
+	if !strings.Contains(logged, "/ws?lang=en") {
+		t.Fatalf("expected the other query parameters to be logged:\n%s", logged)
+	}
+	if strings.Contains(logged, "test-key") || strings.Contains(logged, "wrong-key") {
+		t.Fatalf("access log leaks the token:\n%s", logged)
+	}
+}
+
+func TestWS_ApprovalRequest(t *testing.T) {
+	ts := newTestServer(t)
+	ts.ollama.script(
+		[]string{`<tool>{"function":"search","context":{}}</tool><tool>{"function":"file_remover","context":{"path":"/tmp/a"}}</tool>`},
+		[]string{"done"},
+	)
+	conn, err := dialWS(ts, "?access_token=test-key")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	if err := websocket.JSON.Send(conn, wsClientMessage{Type: "message", Message: "search and clean up"}); err != nil {
+		t.Fatalf("send message: %v", err)
+	}
+	request := receiveUntil(t, conn, "approval_request")
+	data, _ := request.Data.(map[string]any)
+	if data["function"] != "file_remover" || ts.remover.called() != 0 {
+		t.Fatalf("unexpected approval request %+v", request)
+	}
+	requestID, _ := data["requestId"].(string)
+	if err := websocket.JSON.Send(conn, wsClientMessage{Type: "approval", RequestID: requestID, Approved: true}); err != nil {
+		t.Fatalf("send approval: %v", err)
+	}
+	receiveUntil(t, conn, "complete")
+	if ts.remover.called() != 1 {
+		t.Fatalf("expected the approved call to run, got %d calls", ts.remover.called())
+	}
+}
+
+func TestWS_CancelTurn(t *testing.T) {
+	ts := newTestServer(t)
+	ts.ollama.script(nil)
+	conn, err := dialWS(ts, "?access_token=test-key")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	if err := websocket.JSON.Send(conn, wsClientMessage{Type: "message", Message: "hello"}); err != nil {
+		t.Fatalf("send message: %v", err)
+	}
+	turnID := receiveUntil(t, conn, "turn").TurnID
+	if err := websocket.JSON.Send(conn, wsClientMessage{Type: "cancel", TurnID: turnID}); err != nil {
+		t.Fatalf("send cancel: %v", err)
+	}
+	if msg := receiveUntil(t, conn, "cancelled"); msg.TurnID != turnID {
+		t.Fatalf("expected turn %s cancelled, got %+v", turnID, msg)
+	}
+}
+
+func TestWS_Heartbeat(t *testing.T) {
+	ts := newTestServer(t)
+	conn, err := dialWS(ts, "?access_token=test-key")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	if err := websocket.JSON.Send(conn, wsClientMessage{Type: "ping"}); err != nil {
+		t.Fatalf("send ping: %v", err)
+	}
+	receiveUntil(t, conn, "pong")
+
+	// pongs answering the server pings are accepted silently
+	if err := websocket.JSON.Send(conn, wsClientMessage{Type: "pong"}); err != nil {
+		t.Fatalf("send pong: %v", err)
+	}
+	if err := websocket.JSON.Send(conn, wsClientMessage{Type: "ping"}); err != nil {
+		t.Fatalf("send ping: %v", err)
+	}
+	if msg := receiveUntil(t, conn, "pong"); msg.Timestamp == 0 {
+		t.Fatalf("unexpected pong %+v", msg)
+	}
+}
@@ -0,0 +1,224 @@
+package ai_agent
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MainBranchID is the branch every agent double starts on.
+const MainBranchID = "main"
+
+// maxBranches caps the branches an agent double keeps; forking beyond it
+// drops the oldest inactive branch other than main.
+const maxBranches = 64
+
+var ErrBranchNotFound = errors.New("conversation branch not found")
+
+// ConversationBranch describes one line of conversation history. Branches form
+// a tree: each branch except main forks from ParentID after the message
+// ForkPointID (empty when forked before the first message).
+type ConversationBranch struct {
+	ID          string    `json:"id"`
+	ParentID    string    `json:"parentId,omitempty"`
+	ForkPointID string    `json:"forkPointId,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	Length      int       `json:"length"`
+	Active      bool      `json:"active"`
+}
+
+type conversationBranch struct {
+	id          string
+	parentID    string
+	forkPointID string
+	createdAt   time.Time
+	// contexts holds the history of inactive branches; the active branch lives
+	// in AgentDouble.memory.
+	contexts []*MemoryCtx
+}
+
+func (ad *AgentDouble) activeBranch() *conversationBranch {
+	if ad.branches == nil {
+		ad.branches = map[string]*conversationBranch{
+			MainBranchID: {id: MainBranchID, createdAt: time.Now()},
+		}
+		ad.activeBranchID = MainBranchID
+	}
+	return ad.branches[ad.activeBranchID]
+}
+
+// Branches lists all conversation branches, oldest first.
+func (ad *AgentDouble) Branches() []ConversationBranch {
+	ad.memoryMu.Lock()
+	defer ad.memoryMu.Unlock()
+
+	ad.activeBranch()
+	branches := make([]ConversationBranch, 0, len(ad.branches))
+	for _, branch := range ad.branches {
+		length := len(branch.contexts)
+		if branch.id == ad.activeBranchID {
+			length = len(ad.memory.Contexts)
+		}
+		branches = append(branches, ConversationBranch{
+			ID:          branch.id,
+			ParentID:    branch.parentID,
+			ForkPointID: branch.forkPointID,
+			CreatedAt:   branch.createdAt,
+			Length:      length,
+			Active:      branch.id == ad.activeBranchID,
+		})
+	}
+	sort.Slice(branches, func(i, j int) bool {
+		return branches[i].CreatedAt.Before(branches[j].CreatedAt)
+	})
+	return branches
+}
+
+// ActiveBranchID returns the ID of the branch the agent currently talks on.
+func (ad *AgentDouble) ActiveBranchID() string {
+	ad.memoryMu.Lock()
+	defer ad.memoryMu.Unlock()
+
+	return ad.activeBranch().id
+}
+
+// SwitchBranch makes the branch with the given ID active, keeping the current
+// history addressable as its own branch. It waits for the running and queued
+// turns, so none of them writes into the wrong branch.
+func (ad *AgentDouble) SwitchBranch(ctx context.Context, id string) error {
+	endTurn, err := ad.turns.enterExclusive(ctx)
+	if err != nil {
+		return err
+	}
+	defer endTurn()
+
+	ad.memoryMu.Lock()
+	defer ad.memoryMu.Unlock()
+
+	current := ad.activeBranch()
+	target, ok := ad.branches[id]
+	if !ok {
+		return ErrBranchNotFound
+	}
+	if target == current {
+		return nil
+	}
+
+	current.contexts = ad.memory.Contexts
+	ad.memory = &Memory{Contexts: target.contexts}
+	ad.memoryVersion++
+	target.contexts = nil
+	ad.activeBranchID = target.id
+	return nil
+}
+
+// Rewind forks a new branch that ends with the message messageID and switches
+// to it. The previous history stays addressable as the parent branch.
+func (ad *AgentDouble) Rewind(ctx context.Context, messageID string) (string, error) {
+	return ad.fork(ctx, messageID, nil)
+}
+
+// EditAndFork forks a new branch in which the message messageID is replaced by
+// an edited copy and everything after it is dropped, then switches to it. Call
+// Regenerate to get a new answer on the branch.
+func (ad *AgentDouble) EditAndFork(ctx context.Context, messageID, content string, images []string) (string, error) {
+	return ad.fork(ctx, messageID, func(target *MemoryCtx) *MemoryCtx {
+		return ad.newMemoryCtx(target.Role, content, append(make([]string, 0, len(images)), images...), MemoryAttributes{
+			Name:       target.Name,
+			ToolCallID: target.ToolCallID,
+			Source:     target.Source,
+			Pinned:     target.Pinned,
+			Priority:   target.Priority,
+			ExpiresAt:  target.ExpiresAt,
+		})
+	})
+}
+
+// fork copies the active history up to messageID into a new branch and
+// switches to it. When edit is set the message is replaced by its result and
+// the branch diverges right before it. Like SwitchBranch it waits for the
+// running and queued turns.
+func (ad *AgentDouble) fork(ctx context.Context, messageID string, edit func(target *MemoryCtx) *MemoryCtx) (string, error) {
+	endTurn, err := ad.turns.enterExclusive(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer endTurn()
+
+	ad.memoryMu.Lock()
+	defer ad.memoryMu.Unlock()
+
+	current := ad.activeBranch()
+	idx := ad.memoryIndex(messageID)
+	if idx < 0 {
+		return "", ErrMemoryNotFound
+	}
+
+	contexts := make([]*MemoryCtx, 0, idx+1)
+	for _, memCtx := range ad.memory.Contexts[:idx+1] {
+		contexts = append(contexts, memCtx.clone())
+	}
+	forkPointID := messageID
+	if edit != nil {
+		contexts[idx] = edit(contexts[idx])
+		forkPointID = ""
+		if idx > 0 {
+			forkPointID = contexts[idx-1].ID
+		}
+	}
+	branch := &conversationBranch{
+		id:          uuid.NewString(),
+		parentID:    current.id,
+		forkPointID: forkPointID,
+		createdAt:   time.Now(),
+	}
+	ad.branches[branch.id] = branch
+	ad.pruneBranchesLocked(current.id, branch.id)
+
+	current.contexts = ad.memory.Contexts
+	ad.memory = &Memory{Contexts: contexts}
+	ad.memoryVersion++
+	ad.activeBranchID = branch.id
+	return branch.id, nil
+}
+
+// pruneBranchesLocked drops the oldest branches beyond maxBranches, keeping
+// main and the branches in keep.
+func (ad *AgentDouble) pruneBranchesLocked(keep ...string) {
+	for len(ad.branches) > maxBranches {
+		var oldest *conversationBranch
+		for _, branch := range ad.branches {
+			if branch.id == MainBranchID || slices.Contains(keep, branch.id) {
+				continue
+			}
+			if oldest == nil || branch.createdAt.Before(oldest.createdAt) {
+				oldest = branch
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		delete(ad.branches, oldest.id)
+	}
+}
+
+// resetBranchesLocked drops all branches; the memory becomes main.
+func (ad *AgentDouble) resetBranchesLocked() {
+	ad.branches = nil
+	ad.activeBranch()
+}
+
+// Regenerate asks the model to answer again on the active branch, typically
+// after Rewind or EditAndFork.
+func (ad *AgentDouble) Regenerate(ctx context.Context, callback func(response string) error) error {
+	endTurn, err := ad.beginTurn(ctx)
+	if err != nil {
+		return err
+	}
+	defer endTurn()
+	return ad.talkToOllamaWithMemory(ctx, callback)
+}
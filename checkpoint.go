@@ -1,5 +1,21 @@
 package ai_agent
 
+import "context"
+
 type Checkpoint interface {
 	Do(agentDouble *AgentDouble) error
 }
+
+// Checkpoint runs the configured checkpoint between turns, e.g. before the
+// agent shuts down. It is a no-op without a checkpoint.
+func (ad *AgentDouble) Checkpoint(ctx context.Context) error {
+	if ad.checkpoint == nil {
+		return nil
+	}
+	endTurn, err := ad.turns.enterExclusive(ctx)
+	if err != nil {
+		return err
+	}
+	defer endTurn()
+	return ad.checkpoint.Do(ad)
+}
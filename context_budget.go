@@ -0,0 +1,106 @@
+package ai_agent
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/luoxiaojun1992/ai-agent/pkg/ollama"
+	"github.com/luoxiaojun1992/ai-agent/util/contextcompress"
+)
+
+const (
+	// defaultOllamaNumCtx is the context window Ollama runs a model with when
+	// neither the request nor the model parameters set num_ctx.
+	defaultOllamaNumCtx = 4096
+	// contextDiscoveryRetry is how long a failed discovery is remembered
+	// before Ollama is asked again.
+	contextDiscoveryRetry = 5 * time.Minute
+)
+
+// modelContext is what `/api/show` reported about the context of a model.
+type modelContext struct {
+	// trained is the trained context length, 0 when unknown.
+	trained int
+	// numCtx is the num_ctx of the model parameters, 0 when unset.
+	numCtx int
+	// retryAt is set when the discovery failed.
+	retryAt time.Time
+}
+
+// contextLimit returns the context window the chat model runs with for ctx:
+// the configured limit or, when it is not configured and auto discovery is
+// enabled, the trained context length reported by Ollama `/api/show`, both
+// capped by the effective num_ctx. Prompts beyond num_ctx are silently
+// truncated by Ollama.
+func (ad *AgentDouble) contextLimit(ctx context.Context) int {
+	numCtx := ad.config.Sampling.merge(samplingOptionsFromContext(ctx)).NumCtx
+	if ad.config.ChatModelContextLimit > 0 {
+		return minContextLimit(ad.config.ChatModelContextLimit, numCtx)
+	}
+	if !ad.config.ContextLimitAutoDiscovery {
+		return numCtx
+	}
+
+	discovered := ad.discoverModelContext(ad.config.ChatModel)
+	if numCtx <= 0 {
+		numCtx = discovered.numCtx
+	}
+	// num_ctx only applies to Ollama
+	if numCtx <= 0 && !strings.EqualFold(strings.TrimSpace(ad.config.OllamaAPIType), "openai") {
+		numCtx = defaultOllamaNumCtx
+	}
+	return minContextLimit(discovered.trained, numCtx)
+}
+
+// discoverModelContext asks Ollama about the context of model, caching the
+// answer per model and failures for contextDiscoveryRetry.
+func (ad *AgentDouble) discoverModelContext(model string) modelContext {
+	ad.contextLimitMu.Lock()
+	defer ad.contextLimitMu.Unlock()
+	if discovered, ok := ad.contextLimits[model]; ok && (discovered.retryAt.IsZero() || time.Now().Before(discovered.retryAt)) {
+		return discovered
+	}
+
+	showResp, err := ad.Agent.ollamaCli.ShowModel(&ollama.ShowRequest{Model: model})
+	if err != nil {
+		log.Printf("discover context length of model [%s] failed: %v", model, err)
+		discovered := modelContext{retryAt: time.Now().Add(contextDiscoveryRetry)}
+		ad.contextLimits[model] = discovered
+		return discovered
+	}
+	discovered := modelContext{trained: showResp.ContextLength(), numCtx: showResp.NumCtx()}
+	ad.contextLimits[model] = discovered
+	return discovered
+}
+
+// minContextLimit returns the smaller of the known limits a and b, 0 when
+// both are unknown.
+func minContextLimit(a, b int) int {
+	switch {
+	case a <= 0:
+		return max(b, 0)
+	case b <= 0:
+		return a
+	default:
+		return min(a, b)
+	}
+}
+
+// tokenCounter returns the configured tokenizer of the chat model, or nil to
+// let the compressor fall back to its heuristic estimator. A tokenizer that
+// failed to load is reported once.
+func (ad *AgentDouble) tokenCounter(model string) contextcompress.TokenCounter {
+	tok, err := ad.tokenizers.ForModel(model)
+	if err != nil {
+		if _, logged := ad.tokenizerFailures.LoadOrStore(model, struct{}{}); !logged {
+			log.Printf("tokenizer unavailable, falling back to estimation: %v", err)
+		}
+		return nil
+	}
+	if tok == nil {
+		return nil
+	}
+	return tok
+}
@@ -34,6 +34,8 @@ let pendingTaskPreparations = new Map();
 const enqueueScheduledTaskExecution = createTaskExecutionQueue(console);
 const TASK_PREPARATION_TIMEOUT_MS = 5000;
 const CHAT_MEMORY_LIMIT = 100;
+const STREAM_RESUME_ATTEMPTS = 3;
+const STREAM_RESUME_DELAY_MS = 1000;
 
 // Load configuration
 function loadConfig() {
@@ -204,15 +206,12 @@ async function executeScheduledTask(task, options = {}) {
     let result = '';
     let isError = false;
     if (response.ok) {
-      if (!response.body || typeof response.body.getReader !== 'function') {
-        throw new Error('Streaming response body is unavailable');
-      }
-
-      const reader = response.body.getReader();
-      const decoder = new TextDecoder();
-      let chunkBuffer = '';
       let hasContent = false;
-      let streamClosed = false;
+      // The turn id and the id of the last event received let a dropped
+      // stream resume where it stopped.
+      let turnId = response.headers.get('X-Turn-ID');
+      let lastEventId = '';
+      let finished = false;
       const parseOptions = {
         onParseError: (error) => {
           console.debug('Failed to parse scheduled task SSE data:', error);
@@ -228,35 +227,82 @@ async function executeScheduledTask(task, options = {}) {
 
       const processParsedEvents = (events) => {
         for (const evt of events) {
-          if (!isError && evt.eventType === 'message' && evt.data && evt.data.content) {
+          if (evt.id !== undefined) {
+            lastEventId = evt.id;
+          }
+          if (evt.eventType === 'turn' && evt.data && evt.data.turnId) {
+            turnId = evt.data.turnId;
+          } else if (!isError && evt.eventType === 'message' && evt.data && evt.data.content) {
             result += evt.data.content;
             hasContent = true;
           } else if (evt.eventType === 'error') {
             isError = true;
+            finished = true;
             result = buildErrorResult(evt.data && evt.data.error ? evt.data.error : 'Unknown error');
+          } else if (evt.eventType === 'complete' || evt.eventType === 'cancelled') {
+            finished = true;
           }
         }
       };
 
-      const parseAndProcessChunk = (content) => {
-        const parsed = parseSSEEvents(content, parseOptions);
-        chunkBuffer = parsed.remainder;
-        processParsedEvents(parsed.events);
+      const readStream = async (streamResponse) => {
+        if (!streamResponse.body || typeof streamResponse.body.getReader !== 'function') {
+          throw new Error('Streaming response body is unavailable');
+        }
+
+        const reader = streamResponse.body.getReader();
+        const decoder = new TextDecoder();
+        let chunkBuffer = '';
+        const parseAndProcessChunk = (content) => {
+          const parsed = parseSSEEvents(content, parseOptions);
+          chunkBuffer = parsed.remainder;
+          processParsedEvents(parsed.events);
+        };
+
+        while (true) {
+          const { done, value } = await reader.read();
+          if (done) {
+            break;
+          }
+
+          chunkBuffer += decoder.decode(value, { stream: true });
+          parseAndProcessChunk(chunkBuffer);
+        }
+
+        if (chunkBuffer) {
+          parseAndProcessChunk(`${chunkBuffer}\n\n`);
+        }
       };
 
-      while (!streamClosed) {
-        const { done, value } = await reader.read();
-        if (done) {
-          streamClosed = true;
+      let streamResponse = response;
+      for (let attempt = 0; ; attempt++) {
+        if (streamResponse) {
+          try {
+            await readStream(streamResponse);
+          } catch (error) {
+            if (!turnId) {
+              throw error;
+            }
+            console.debug('Scheduled task stream interrupted:', error);
+          }
+        }
+        if (finished || !turnId || attempt >= STREAM_RESUME_ATTEMPTS) {
           break;
         }
 
-        chunkBuffer += decoder.decode(value, { stream: true });
-        parseAndProcessChunk(chunkBuffer);
-      }
-
-      if (chunkBuffer) {
-        parseAndProcessChunk(`${chunkBuffer}\n\n`);
+        await new Promise((resolve) => setTimeout(resolve, STREAM_RESUME_DELAY_MS));
+        try {
+          streamResponse = await fetch(`${apiBase}/agent/chat/${encodeURIComponent(turnId)}/events`, {
+            headers: lastEventId ? { 'Last-Event-ID': lastEventId } : {}
+          });
+        } catch (error) {
+          console.debug('Failed to resume scheduled task stream:', error);
+          streamResponse = null;
+          continue;
+        }
+        if (!streamResponse.ok) {
+          break;
+        }
       }
 
       if (!isError && !hasContent) {
@@ -2,7 +2,9 @@
  * Parse Server-Sent Events text chunks into JSON events.
  * @param {string} chunkBuffer Concatenated SSE text data separated by "\n\n".
  * @param {{onParseError?: (error: Error) => void}} [options]
- * @returns {{events: Array<{eventType: string, data: any}>, remainder: string}}
+ * @returns {{events: Array<{eventType: string, data: any, id?: string}>, remainder: string}}
+ * Events carry the SSE `id` when the server sent one, so a dropped stream can
+ * be resumed with `Last-Event-ID`.
  */
 function parseSSEEvents(chunkBuffer, options = {}) {
   const { onParseError } = options;
@@ -13,6 +15,7 @@ function parseSSEEvents(chunkBuffer, options = {}) {
   for (const frame of frames) {
     const lines = frame.split('\n');
     let eventType = 'message';
+    let id;
     const dataLines = [];
 
     for (const rawLine of lines) {
@@ -24,6 +27,10 @@ function parseSSEEvents(chunkBuffer, options = {}) {
         eventType = line.slice(6).trim();
         continue;
       }
+      if (line.startsWith('id:')) {
+        id = line.slice(3).trim();
+        continue;
+      }
       if (line.startsWith('data:')) {
         dataLines.push(line.slice(5).trim());
       }
@@ -34,10 +41,14 @@ function parseSSEEvents(chunkBuffer, options = {}) {
     }
 
     try {
-      events.push({
+      const event = {
         eventType,
         data: JSON.parse(dataLines.join('\n'))
-      });
+      };
+      if (id !== undefined) {
+        event.id = id;
+      }
+      events.push(event);
     } catch (error) {
       if (typeof onParseError === 'function') {
         onParseError(error);
@@ -48,3 +48,24 @@ test('parseSSEEvents ignores malformed JSON payloads', () => {
   });
   assert.equal(parsed.remainder, '');
 });
+
+test('parseSSEEvents keeps event ids for resuming', () => {
+  const chunk = [
+    'id:1',
+    'event:turn',
+    'data:{"turnId":"t1"}',
+    '',
+    'id: 2',
+    'event: message',
+    'data: {"content":"hi"}',
+    '',
+    ''
+  ].join('\n');
+
+  const parsed = parseSSEEvents(chunk);
+
+  assert.deepEqual(parsed.events, [
+    { eventType: 'turn', data: { turnId: 't1' }, id: '1' },
+    { eventType: 'message', data: { content: 'hi' }, id: '2' }
+  ]);
+});
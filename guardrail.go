@@ -0,0 +1,111 @@
+package ai_agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/luoxiaojun1992/ai-agent/pkg/ollama"
+	"github.com/luoxiaojun1992/ai-agent/util/guardrail"
+	"github.com/luoxiaojun1992/ai-agent/util/prompt"
+)
+
+type guardrailCallbackCtxKey struct{}
+
+// WithGuardrailCallback attaches a callback that receives an event for every
+// guardrail rule that fires during a call.
+func WithGuardrailCallback(ctx context.Context, callback func(event guardrail.Event) error) context.Context {
+	return context.WithValue(ctx, guardrailCallbackCtxKey{}, callback)
+}
+
+func guardrailCallbackFromContext(ctx context.Context) func(event guardrail.Event) error {
+	callback, _ := ctx.Value(guardrailCallbackCtxKey{}).(func(event guardrail.Event) error)
+	return callback
+}
+
+const classifierVerdictSchema = `{"type":"object","properties":{"violation":{"type":"boolean"},"reason":{"type":"string"}},"required":["violation"]}`
+
+// modelClassifier asks a chat model whether text violates a criteria.
+type modelClassifier struct {
+	agent *Agent
+	model string
+}
+
+func (mc *modelClassifier) Classify(ctx context.Context, criteria, text string) (bool, string, error) {
+	output, _, err := mc.agent.talkToOllamaWithThinking(ctx, mc.model, []*ollama.Message{
+		{
+			Role: "system",
+			Content: "You are a content classifier. Decide whether the text violates this rule: " + criteria +
+				"\nAnswer with JSON only, in the form {\"violation\":true|false,\"reason\":\"...\"}. Do not quote the text in the reason.",
+		},
+		{
+			Role:    "user",
+			Content: text,
+		},
+	}, chatOptions{
+		think:    mc.agent.config.Think,
+		format:   json.RawMessage(classifierVerdictSchema),
+		sampling: mc.agent.config.Sampling,
+		usage:    usageCallbackFromContext(ctx),
+	}, func(_ string) error {
+		return nil
+	}, nil)
+	if err != nil {
+		return false, "", err
+	}
+
+	content, _ := prompt.SplitThinking(output)
+	content = strings.TrimSpace(content)
+	if !json.Valid([]byte(content)) {
+		content = prompt.RepairJSON(content)
+	}
+	var verdict struct {
+		Violation bool   `json:"violation"`
+		Reason    string `json:"reason"`
+	}
+	if err := json.Unmarshal([]byte(content), &verdict); err != nil {
+		return false, "", fmt.Errorf("invalid classifier output: %w", err)
+	}
+	return verdict.Violation, verdict.Reason, nil
+}
+
+func (a *Agent) guardrailModel() string {
+	if a.config.GuardrailModel != "" {
+		return a.config.GuardrailModel
+	}
+	return a.config.ChatModel
+}
+
+// newGuard builds the guard of the configured guardrail rules, if any.
+func newGuard(agent *Agent, configs []guardrail.RuleConfig) (*guardrail.Guard, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+	rules, err := guardrail.BuildRules(configs, &modelClassifier{agent: agent, model: agent.guardrailModel()})
+	if err != nil {
+		return nil, err
+	}
+	return guardrail.NewGuard(rules...)
+}
+
+// checkGuardrails runs the guard over text at stage and reports the events to
+// the context callback. It returns the text to use, or an error when a rule
+// blocked it.
+func (ad *AgentDouble) checkGuardrails(ctx context.Context, stage guardrail.Stage, text string) (string, error) {
+	result, err := ad.guard.Check(ctx, stage, text)
+	if err != nil {
+		return "", err
+	}
+	if callback := guardrailCallbackFromContext(ctx); callback != nil {
+		for _, event := range result.Events {
+			if err := callback(event); err != nil {
+				return "", err
+			}
+		}
+	}
+	if blocked := result.BlockedBy(); blocked != nil {
+		return "", blocked
+	}
+	return result.Text, nil
+}
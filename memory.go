@@ -0,0 +1,203 @@
+package ai_agent
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/luoxiaojun1992/ai-agent/util/contextcompress"
+	"github.com/luoxiaojun1992/ai-agent/util/redact"
+)
+
+const (
+	MemorySourceInit    = "init"
+	MemorySourceUser    = "user"
+	MemorySourceModel   = "model"
+	MemorySourceTool    = "tool"
+	MemorySourceRecall  = "recall"
+	MemorySourceSummary = "summary"
+	MemorySourceAPI     = "api"
+	MemorySourceReview  = "review"
+	MemorySourceImport  = "import"
+)
+
+var ErrMemoryNotFound = errors.New("memory context not found")
+
+func newMemoryID() string {
+	return uuid.NewString()
+}
+
+// invalidFunctionCallName names the calls of `<tool>` blocks that could not
+// be parsed.
+const invalidFunctionCallName = "invalid_function_call"
+
+func newToolCallID() string {
+	return "call_" + strings.ReplaceAll(uuid.NewString(), "-", "")[:24]
+}
+
+func newToolCall(name string, arguments any) ToolCall {
+	encoded, err := json.Marshal(arguments)
+	if err != nil {
+		encoded = []byte("{}")
+	}
+	return ToolCall{ID: newToolCallID(), Name: name, Arguments: string(encoded)}
+}
+
+func (ad *AgentDouble) newMemoryCtx(role, content string, images []string, attrs MemoryAttributes) *MemoryCtx {
+	now := time.Now()
+	memCtx := &MemoryCtx{
+		ID:         newMemoryID(),
+		Role:       role,
+		Content:    content,
+		Images:     images,
+		Name:       attrs.Name,
+		ToolCallID: attrs.ToolCallID,
+		ToolCalls:  attrs.ToolCalls,
+		Source:     attrs.Source,
+		Trust:      attrs.Trust,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		Pinned:     attrs.Pinned,
+		Priority:   attrs.Priority,
+		ExpiresAt:  attrs.ExpiresAt,
+	}
+	memCtx.Tokens = ad.countMemoryTokens(memCtx)
+	return memCtx
+}
+
+// countMemoryTokens counts the tokens a context occupies in the prompt with the
+// same tokenizer the context compressor uses. It is also called outside turns,
+// so it reads a snapshot of the configuration.
+func (ad *AgentDouble) countMemoryTokens(memCtx *MemoryCtx) int {
+	config := ad.ConfigSnapshot()
+	compressor := contextcompress.NewCompressor(contextcompress.Config{
+		Model:          config.ChatModel,
+		TokenCounter:   ad.tokenCounter(config.ChatModel),
+		ImageTokenCost: config.ImageTokenCost,
+	})
+	return compressor.TokenCount([]contextcompress.Message{{
+		Role:    memCtx.Role,
+		Content: memCtx.Content,
+		Images:  memCtx.Images,
+	}})
+}
+
+func (ad *AgentDouble) memoryIndex(id string) int {
+	for i, memCtx := range ad.memory.Contexts {
+		if memCtx.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// GetMemory returns a copy of the memory context with the given ID.
+func (ad *AgentDouble) GetMemory(id string) (*MemoryCtx, error) {
+	ad.memoryMu.RLock()
+	defer ad.memoryMu.RUnlock()
+
+	idx := ad.memoryIndex(id)
+	if idx < 0 {
+		return nil, ErrMemoryNotFound
+	}
+	return ad.memory.Contexts[idx].clone(), nil
+}
+
+// EditMemory replaces the content and images of the memory context with the
+// given ID and returns the updated copy.
+func (ad *AgentDouble) EditMemory(id, content string, images []string) (*MemoryCtx, error) {
+	ad.memoryMu.Lock()
+	defer ad.memoryMu.Unlock()
+
+	idx := ad.memoryIndex(id)
+	if idx < 0 {
+		return nil, ErrMemoryNotFound
+	}
+	memCtx := ad.memory.Contexts[idx].clone()
+	memCtx.Content = content
+	memCtx.Images = append(make([]string, 0, len(images)), images...)
+	memCtx.Tokens = ad.countMemoryTokens(memCtx)
+	memCtx.UpdatedAt = time.Now()
+	ad.memory.Contexts[idx] = memCtx
+	ad.memoryVersion++
+	return memCtx.clone(), nil
+}
+
+// DeleteMemory removes the memory context with the given ID.
+func (ad *AgentDouble) DeleteMemory(id string) error {
+	ad.memoryMu.Lock()
+	defer ad.memoryMu.Unlock()
+
+	idx := ad.memoryIndex(id)
+	if idx < 0 {
+		return ErrMemoryNotFound
+	}
+	ad.memory.Contexts = append(ad.memory.Contexts[:idx], ad.memory.Contexts[idx+1:]...)
+	ad.memoryVersion++
+	return nil
+}
+
+// forgetMemories removes the memory contexts with the given IDs that are
+// still in memory.
+func (ad *AgentDouble) forgetMemories(ids ...string) {
+	if len(ids) == 0 {
+		return
+	}
+	ad.memoryMu.Lock()
+	defer ad.memoryMu.Unlock()
+
+	remaining := slices.DeleteFunc(ad.memory.Contexts, func(memCtx *MemoryCtx) bool {
+		return slices.Contains(ids, memCtx.ID)
+	})
+	if len(remaining) != len(ad.memory.Contexts) {
+		ad.memoryVersion++
+	}
+	ad.memory.Contexts = remaining
+}
+
+// InsertMemory inserts a memory context right after the context with ID
+// afterID, or at the beginning when afterID is empty, and returns a copy of it.
+func (ad *AgentDouble) InsertMemory(afterID, role, content string, images []string, attrs MemoryAttributes) (*MemoryCtx, error) {
+	memCtx := ad.newMemoryCtx(role, content, append(make([]string, 0, len(images)), images...), attrs)
+
+	ad.memoryMu.Lock()
+	defer ad.memoryMu.Unlock()
+
+	pos := 0
+	if afterID != "" {
+		idx := ad.memoryIndex(afterID)
+		if idx < 0 {
+			return nil, ErrMemoryNotFound
+		}
+		pos = idx + 1
+	}
+	ad.memory.Contexts = append(ad.memory.Contexts, nil)
+	copy(ad.memory.Contexts[pos+1:], ad.memory.Contexts[pos:])
+	ad.memory.Contexts[pos] = memCtx
+	ad.memoryVersion++
+	return memCtx.clone(), nil
+}
+
+// Redacted returns a copy of the memory context with credentials and secrets
+// masked by r, in the content and in the arguments of its tool calls.
+func (mc *MemoryCtx) Redacted(r *redact.Redactor) *MemoryCtx {
+	cloned := mc.clone()
+	cloned.Content = r.Redact(cloned.Content)
+	for i := range cloned.ToolCalls {
+		cloned.ToolCalls[i].Arguments = r.Redact(cloned.ToolCalls[i].Arguments)
+	}
+	return cloned
+}
+
+// Redacted returns a copy of the memory with credentials and secrets masked
+// by r, for showing or exporting it.
+func (m *Memory) Redacted(r *redact.Redactor) *Memory {
+	redacted := &Memory{Contexts: make([]*MemoryCtx, 0, len(m.Contexts))}
+	for _, memCtx := range m.Contexts {
+		redacted.Contexts = append(redacted.Contexts, memCtx.Redacted(r))
+	}
+	return redacted
+}
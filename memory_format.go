@@ -0,0 +1,436 @@
+package ai_agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/luoxiaojun1992/ai-agent/skill"
+)
+
+// MemoryFormat is a serialization format for conversation memory.
+type MemoryFormat string
+
+const (
+	// MemoryFormatJSONL writes one memory context per line with all fields.
+	MemoryFormatJSONL MemoryFormat = "jsonl"
+	// MemoryFormatOpenAI writes an OpenAI chat completions `messages` array.
+	MemoryFormatOpenAI MemoryFormat = "openai"
+	// MemoryFormatMarkdown writes a human readable transcript.
+	MemoryFormatMarkdown MemoryFormat = "markdown"
+)
+
+var ErrUnsupportedMemoryFormat = errors.New("unsupported memory format")
+
+const markdownRoleHeading = "### "
+
+var transcriptRoles = map[string]struct{}{
+	"system":    {},
+	"user":      {},
+	"assistant": {},
+	"tool":      {},
+}
+
+// EncodeMemory serializes memory in the given format.
+func EncodeMemory(memory *Memory, format MemoryFormat) ([]byte, error) {
+	switch format {
+	case MemoryFormatJSONL:
+		return encodeMemoryJSONL(memory)
+	case MemoryFormatOpenAI:
+		return encodeMemoryOpenAI(memory)
+	case MemoryFormatMarkdown:
+		return encodeMemoryMarkdown(memory), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedMemoryFormat, format)
+	}
+}
+
+// DecodeMemory parses memory serialized in the given format. Fields the format
+// cannot carry are left empty and filled in by LoadMemory.
+func DecodeMemory(data []byte, format MemoryFormat) (*Memory, error) {
+	switch format {
+	case MemoryFormatJSONL:
+		return decodeMemoryJSONL(data)
+	case MemoryFormatOpenAI:
+		return decodeMemoryOpenAI(data)
+	case MemoryFormatMarkdown:
+		return decodeMemoryMarkdown(data)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedMemoryFormat, format)
+	}
+}
+
+// ExportMemory serializes the current memory in the given format.
+func (ad *AgentDouble) ExportMemory(format MemoryFormat) ([]byte, error) {
+	return EncodeMemory(ad.MemorySnapshot(), format)
+}
+
+// ImportMemory parses data in the given format and replaces the current memory
+// and its branches with it, or appends it to the current memory when
+// appendMode is set. It waits for the running and queued turns. The imported
+// contexts are attributed to MemorySourceImport: IDs already in use get new
+// ones, tool outputs are untrusted and no context is pinned or prioritized,
+// so an uploaded transcript cannot pass for user input or escape compression.
+// Use DecodeMemory and LoadMemory to restore memory saved by the agent.
+func (ad *AgentDouble) ImportMemory(ctx context.Context, data []byte, format MemoryFormat, appendMode bool) (int, error) {
+	imported, err := DecodeMemory(data, format)
+	if err != nil {
+		return 0, err
+	}
+	endTurn, err := ad.turns.enterExclusive(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer endTurn()
+
+	var current *Memory
+	if appendMode {
+		current = ad.MemorySnapshot()
+	} else {
+		current = NewMemory()
+	}
+	usedIDs := make(map[string]bool, len(current.Contexts)+len(imported.Contexts))
+	for _, memCtx := range current.Contexts {
+		usedIDs[memCtx.ID] = true
+	}
+	for _, memCtx := range imported.Contexts {
+		if memCtx.ID == "" || usedIDs[memCtx.ID] {
+			memCtx.ID = newMemoryID()
+		}
+		usedIDs[memCtx.ID] = true
+		memCtx.Source = MemorySourceImport
+		memCtx.Trust = ""
+		if memCtx.Role == "tool" {
+			memCtx.Trust = skill.TrustLevelUntrusted
+		}
+		memCtx.Pinned = false
+		memCtx.Priority = 0
+	}
+	if appendMode {
+		imported.Contexts = append(current.Contexts, imported.Contexts...)
+		ad.LoadMemory(imported)
+		return len(imported.Contexts) - len(current.Contexts), nil
+	}
+	ad.memoryMu.Lock()
+	ad.resetBranchesLocked()
+	ad.memoryMu.Unlock()
+	ad.LoadMemory(imported)
+	return len(imported.Contexts), nil
+}
+
+func encodeMemoryJSONL(memory *Memory) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, memCtx := range memory.Contexts {
+		if err := encoder.Encode(memCtx); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeMemoryJSONL(data []byte) (*Memory, error) {
+	memory := NewMemory()
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		memCtx := &MemoryCtx{}
+		if err := json.Unmarshal(line, memCtx); err != nil {
+			return nil, fmt.Errorf("invalid memory jsonl line %d: %w", lineNo, err)
+		}
+		if err := validateTranscriptRole(memCtx.Role); err != nil {
+			return nil, fmt.Errorf("invalid memory jsonl line %d: %w", lineNo, err)
+		}
+		memory.Contexts = append(memory.Contexts, memCtx)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return memory, nil
+}
+
+type openAIMessage struct {
+	Role       string           `json:"role"`
+	Content    json.RawMessage  `json:"content"`
+	Name       string           `json:"name,omitempty"`
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+type openAIToolCall struct {
+	ID       string             `json:"id"`
+	Type     string             `json:"type"`
+	Function openAIFunctionCall `json:"function"`
+}
+
+type openAIFunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+type openAIContentPart struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *openAIImageURL `json:"image_url,omitempty"`
+}
+
+type openAIImageURL struct {
+	URL string `json:"url"`
+}
+
+func encodeMemoryOpenAI(memory *Memory) ([]byte, error) {
+	// Calls whose outputs were compressed away are left out, as every call
+	// needs a tool message answering it.
+	answered := make(map[string]bool)
+	for _, memCtx := range memory.Contexts {
+		if memCtx.Role == "tool" && memCtx.ToolCallID != "" {
+			answered[memCtx.ToolCallID] = true
+		}
+	}
+
+	messages := make([]openAIMessage, 0, len(memory.Contexts))
+	for _, memCtx := range memory.Contexts {
+		var content any = memCtx.Content
+		if len(memCtx.Images) > 0 {
+			parts := []openAIContentPart{{Type: "text", Text: memCtx.Content}}
+			for _, image := range memCtx.Images {
+				parts = append(parts, openAIContentPart{
+					Type:     "image_url",
+					ImageURL: &openAIImageURL{URL: imageDataURL(image)},
+				})
+			}
+			content = parts
+		}
+		rawContent, err := json.Marshal(content)
+		if err != nil {
+			return nil, err
+		}
+		var toolCalls []openAIToolCall
+		for _, toolCall := range memCtx.ToolCalls {
+			if !answered[toolCall.ID] {
+				continue
+			}
+			arguments := toolCall.Arguments
+			if arguments == "" {
+				arguments = "{}"
+			}
+			toolCalls = append(toolCalls, openAIToolCall{
+				ID:       toolCall.ID,
+				Type:     "function",
+				Function: openAIFunctionCall{Name: toolCall.Name, Arguments: arguments},
+			})
+		}
+		messages = append(messages, openAIMessage{
+			Role:       memCtx.Role,
+			Content:    rawContent,
+			Name:       memCtx.Name,
+			ToolCalls:  toolCalls,
+			ToolCallID: memCtx.ToolCallID,
+		})
+	}
+	return json.MarshalIndent(messages, "", "  ")
+}
+
+func decodeMemoryOpenAI(data []byte) (*Memory, error) {
+	var messages []openAIMessage
+	if err := json.Unmarshal(data, &messages); err != nil {
+		// Accept a whole chat completions request body as well.
+		var request struct {
+			Messages []openAIMessage `json:"messages"`
+		}
+		if err := json.Unmarshal(data, &request); err != nil {
+			return nil, fmt.Errorf("invalid openai messages: %w", err)
+		}
+		messages = request.Messages
+	}
+
+	memory := NewMemory()
+	for i, message := range messages {
+		if err := validateTranscriptRole(message.Role); err != nil {
+			return nil, fmt.Errorf("invalid openai message %d: %w", i, err)
+		}
+		memCtx := &MemoryCtx{
+			Role:       message.Role,
+			Name:       message.Name,
+			ToolCallID: message.ToolCallID,
+		}
+		for _, toolCall := range message.ToolCalls {
+			memCtx.ToolCalls = append(memCtx.ToolCalls, ToolCall{
+				ID:        toolCall.ID,
+				Name:      toolCall.Function.Name,
+				Arguments: toolCall.Function.Arguments,
+			})
+		}
+		if err := decodeOpenAIContent(message.Content, memCtx); err != nil {
+			return nil, fmt.Errorf("invalid openai message %d: %w", i, err)
+		}
+		memory.Contexts = append(memory.Contexts, memCtx)
+	}
+	return memory, nil
+}
+
+func decodeOpenAIContent(raw json.RawMessage, memCtx *MemoryCtx) error {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(raw, &memCtx.Content); err == nil {
+		return nil
+	}
+
+	var parts []openAIContentPart
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return errors.New("content must be a string or an array of content parts")
+	}
+	texts := make([]string, 0, len(parts))
+	for _, part := range parts {
+		switch part.Type {
+		case "text":
+			texts = append(texts, part.Text)
+		case "image_url":
+			if part.ImageURL == nil {
+				continue
+			}
+			image, err := imageFromDataURL(part.ImageURL.URL)
+			if err != nil {
+				return err
+			}
+			memCtx.Images = append(memCtx.Images, image)
+		}
+	}
+	memCtx.Content = strings.Join(texts, "\n")
+	return nil
+}
+
+// imageDataURL wraps a base64 image as used by Ollama into a data URL.
+func imageDataURL(image string) string {
+	mimeType := "image/png"
+	if decoded, err := base64.StdEncoding.DecodeString(image); err == nil {
+		if detected := http.DetectContentType(decoded); strings.HasPrefix(detected, "image/") {
+			mimeType = detected
+		}
+	}
+	return "data:" + mimeType + ";base64," + image
+}
+
+func imageFromDataURL(url string) (string, error) {
+	header, payload, found := strings.Cut(url, ",")
+	if !found || !strings.HasPrefix(header, "data:") || !strings.HasSuffix(header, ";base64") {
+		return "", errors.New("only base64 data URLs are supported for images")
+	}
+	return payload, nil
+}
+
+func encodeMemoryMarkdown(memory *Memory) []byte {
+	var buf bytes.Buffer
+	for i, memCtx := range memory.Contexts {
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		buf.WriteString(markdownRoleHeading)
+		buf.WriteString(memCtx.Role)
+		if memCtx.Name != "" {
+			buf.WriteString(" (")
+			buf.WriteString(memCtx.Name)
+			buf.WriteString(")")
+		}
+		buf.WriteString("\n\n")
+		buf.WriteString(memCtx.Content)
+		buf.WriteString("\n")
+		for j, image := range memCtx.Images {
+			fmt.Fprintf(&buf, "\n![image %d](%s)\n", j+1, imageDataURL(image))
+		}
+	}
+	return buf.Bytes()
+}
+
+// decodeMemoryMarkdown parses transcripts written by encodeMemoryMarkdown: each
+// message starts with a "### role" or "### role (name)" heading line.
+func decodeMemoryMarkdown(data []byte) (*Memory, error) {
+	memory := NewMemory()
+	var (
+		current *MemoryCtx
+		body    []string
+	)
+	flush := func() {
+		if current == nil {
+			return
+		}
+		current.Content = strings.TrimSpace(strings.Join(body, "\n"))
+		memory.Contexts = append(memory.Contexts, current)
+	}
+
+	for _, line := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		if memCtx, ok := parseMarkdownHeading(line); ok {
+			flush()
+			current, body = memCtx, nil
+			continue
+		}
+		if current == nil {
+			if strings.TrimSpace(line) != "" {
+				return nil, errors.New("markdown transcript must start with a role heading")
+			}
+			continue
+		}
+		if image, ok := parseMarkdownImage(line); ok {
+			current.Images = append(current.Images, image)
+			continue
+		}
+		body = append(body, line)
+	}
+	flush()
+	return memory, nil
+}
+
+func parseMarkdownHeading(line string) (*MemoryCtx, bool) {
+	heading, found := strings.CutPrefix(line, markdownRoleHeading)
+	if !found {
+		return nil, false
+	}
+	role, name, _ := strings.Cut(strings.TrimSpace(heading), " ")
+	if validateTranscriptRole(role) != nil {
+		return nil, false
+	}
+	name = strings.TrimSpace(name)
+	if name != "" {
+		if !strings.HasPrefix(name, "(") || !strings.HasSuffix(name, ")") {
+			return nil, false
+		}
+		name = strings.TrimSuffix(strings.TrimPrefix(name, "("), ")")
+	}
+	return &MemoryCtx{Role: role, Name: name}, true
+}
+
+func parseMarkdownImage(line string) (string, bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "![image ") || !strings.HasSuffix(line, ")") {
+		return "", false
+	}
+	_, url, found := strings.Cut(line, "](")
+	if !found {
+		return "", false
+	}
+	image, err := imageFromDataURL(strings.TrimSuffix(url, ")"))
+	if err != nil {
+		return "", false
+	}
+	return image, true
+}
+
+func validateTranscriptRole(role string) error {
+	if _, ok := transcriptRoles[role]; !ok {
+		return fmt.Errorf("unknown role %q", role)
+	}
+	return nil
+}
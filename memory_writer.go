@@ -0,0 +1,203 @@
+package ai_agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/luoxiaojun1992/ai-agent/pkg/ollama"
+)
+
+const (
+	defaultMemoryWriterDedupDistance = 0.25
+	memoryWriterSource               = "memory_writer"
+)
+
+type sessionInfoCtxKey struct{}
+
+// SessionInfo identifies who a conversation turn belongs to. It is attached to
+// the request context and recorded as metadata on extracted long-term memories.
+type SessionInfo struct {
+	SessionID string
+	UserID    string
+}
+
+func WithSessionInfo(ctx context.Context, info SessionInfo) context.Context {
+	return context.WithValue(ctx, sessionInfoCtxKey{}, info)
+}
+
+func SessionInfoFromContext(ctx context.Context) SessionInfo {
+	info, _ := ctx.Value(sessionInfoCtxKey{}).(SessionInfo)
+	return info
+}
+
+func (ad *AgentDouble) memoryWriterModel() string {
+	if ad.config.MemoryWriterModel != "" {
+		return ad.config.MemoryWriterModel
+	}
+	return ad.config.ChatModel
+}
+
+// turnTranscript renders the user and assistant messages of a turn, from the
+// user message with id userMemoryID through the message with id lastMemoryID,
+// so messages of later turns are left out. It is empty when either message is
+// no longer in memory.
+func (ad *AgentDouble) turnTranscript(userMemoryID, lastMemoryID string) string {
+	memorySnapshot := ad.MemorySnapshot()
+	start := slices.IndexFunc(memorySnapshot.Contexts, func(memCtx *MemoryCtx) bool {
+		return memCtx.ID == userMemoryID
+	})
+	end := slices.IndexFunc(memorySnapshot.Contexts, func(memCtx *MemoryCtx) bool {
+		return memCtx.ID == lastMemoryID
+	})
+	if start < 0 || end < start {
+		return ""
+	}
+
+	var transcript strings.Builder
+	for _, memCtx := range memorySnapshot.Contexts[start : end+1] {
+		if memCtx.Role != "user" && memCtx.Role != "assistant" {
+			continue
+		}
+		transcript.WriteString(memCtx.Role)
+		transcript.WriteString(": ")
+		transcript.WriteString(memCtx.Content)
+		transcript.WriteString("\n")
+	}
+	return transcript.String()
+}
+
+func (ad *AgentDouble) extractMemories(ctx context.Context, transcript string) ([]string, error) {
+	extraction, err := ad.Agent.talkToOllama(ctx, ad.memoryWriterModel(), []*ollama.Message{
+		{
+			Role: "system",
+			Content: `Extract durable facts about the user and their preferences, goals or environment from the following conversation.
+Ignore small talk, transient requests and anything only relevant to this turn.
+Output strictly a JSON array of short self-contained statements, or [] if there is nothing worth remembering.
+Conversation:` + "\n" + transcript,
+		},
+	}, func(_ string) error {
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return parseExtractedMemories(extraction)
+}
+
+func parseExtractedMemories(extraction string) ([]string, error) {
+	start := strings.Index(extraction, "[")
+	end := strings.LastIndex(extraction, "]")
+	if start < 0 || end < start {
+		return nil, nil
+	}
+
+	var facts []string
+	if err := json.Unmarshal([]byte(extraction[start:end+1]), &facts); err != nil {
+		return nil, fmt.Errorf("parse extracted memories: %w", err)
+	}
+
+	result := make([]string, 0, len(facts))
+	for _, fact := range facts {
+		fact = strings.TrimSpace(fact)
+		if fact != "" {
+			result = append(result, fact)
+		}
+	}
+	return result, nil
+}
+
+// rememberIfNovel stores fact unless the nearest existing vector is within the
+// configured L2 distance. It reports whether the fact was stored.
+func (ad *AgentDouble) rememberIfNovel(ctx context.Context, fact string, info SessionInfo) (bool, error) {
+	embeddingResponse, err := ad.Agent.ollamaCli.EmbeddingPrompt(&ollama.EmbedRequest{
+		Model: ad.config.EmbeddingModel,
+		Input: fact,
+	})
+	if err != nil {
+		return false, err
+	}
+	if len(embeddingResponse.Embeddings) <= 0 || len(embeddingResponse.Embeddings[0]) <= 0 {
+		return false, nil
+	}
+	vector := embeddingResponse.Embeddings[0]
+
+	dedupDistance := ad.config.MemoryWriterDedupDistance
+	if dedupDistance <= 0 {
+		dedupDistance = defaultMemoryWriterDedupDistance
+	}
+	nearest, err := ad.Agent.milvusCli.SearchVectorWithScores(ctx, ad.config.MilvusCollection, vector, 1)
+	if err != nil {
+		return false, err
+	}
+	if len(nearest) > 0 && float64(nearest[0].Distance) <= dedupDistance {
+		return false, nil
+	}
+
+	if err := ad.Agent.milvusCli.InsertVectorWithMetadata(ctx, ad.config.MilvusCollection, fact, vector, map[string]string{
+		"session_id": info.SessionID,
+		"user_id":    info.UserID,
+		"source":     memoryWriterSource,
+		"created_at": time.Now().UTC().Format(time.RFC3339),
+	}); err != nil {
+		return false, err
+	}
+	ad.keywordIndex(ctx).Add(fact)
+	return true, nil
+}
+
+func (ad *AgentDouble) writeLongTermMemory(ctx context.Context, userMemoryID, lastMemoryID string) error {
+	transcript := ad.turnTranscript(userMemoryID, lastMemoryID)
+	if transcript == "" {
+		return nil
+	}
+
+	facts, err := ad.extractMemories(ctx, transcript)
+	if err != nil {
+		return err
+	}
+
+	info := SessionInfoFromContext(ctx)
+	for _, fact := range facts {
+		if _, err := ad.rememberIfNovel(ctx, fact, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scheduleMemoryWriter runs long-term memory extraction for the finished turn,
+// started by the user message with id userMemoryID, in the background. It is
+// called before the turn ends, so the last message in memory is the turn's
+// own; later turns may add messages before the extraction reads them. The
+// request context may already be cancelled by then, so only its values are
+// carried over.
+func (ad *AgentDouble) scheduleMemoryWriter(ctx context.Context, userMemoryID string) {
+	if !ad.config.MemoryWriterSwitch {
+		return
+	}
+	ad.memoryMu.Lock()
+	lastMemoryID := ""
+	if n := len(ad.memory.Contexts); n > 0 {
+		lastMemoryID = ad.memory.Contexts[n-1].ID
+	}
+	ad.memoryMu.Unlock()
+
+	writerCtx := context.WithoutCancel(ctx)
+	ad.memoryWriterWG.Add(1)
+	go func() {
+		defer ad.memoryWriterWG.Done()
+		if err := ad.writeLongTermMemory(writerCtx, userMemoryID, lastMemoryID); err != nil {
+			log.Printf("long-term memory extraction failed: %v", err)
+		}
+	}()
+}
+
+// WaitMemoryWriter blocks until all scheduled long-term memory extractions finish.
+func (ad *AgentDouble) WaitMemoryWriter() {
+	ad.memoryWriterWG.Wait()
+}
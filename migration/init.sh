@@ -36,15 +36,35 @@ try:
     # Define collection name
     collection_name = "ai_agent_memory"
     
-    # Drop collection if exists
+    # Keep an existing collection and its data, only add missing fields
     if utility.has_collection(collection_name):
-        print(f"⚠️ Collection {collection_name} already exists, dropping it...")
-        utility.drop_collection(collection_name)
+        collection = Collection(name=collection_name)
+        field_names = [field.name for field in collection.schema.fields]
+        if "metadata" not in field_names:
+            print(f"⚠️ Collection {collection_name} has no metadata field, adding it...")
+            try:
+                from pymilvus import MilvusClient
+                client = MilvusClient(uri="http://milvus:19530")
+                client.add_collection_field(
+                    collection_name=collection_name,
+                    field_name="metadata",
+                    data_type=DataType.VARCHAR,
+                    max_length=1024,
+                    nullable=True,
+                )
+                print("✅ Metadata field added successfully")
+            except Exception as e:
+                # The service stores documents without metadata meanwhile
+                print(f"⚠️ Adding the metadata field failed, memories are stored without metadata: {e}")
+        collection.load()
+        print(f"✅ Collection '{collection_name}' already exists, kept its data")
+        exit(0)
     
     # Define fields
     fields = [
         FieldSchema(name="id", dtype=DataType.INT64, is_primary=True, auto_id=False),
-        FieldSchema(name="content", dtype=DataType.VARCHAR, max_length=128),
+        FieldSchema(name="content", dtype=DataType.VARCHAR, max_length=2048),
+        FieldSchema(name="metadata", dtype=DataType.VARCHAR, max_length=1024),
         FieldSchema(name="content_embedding", dtype=DataType.FLOAT_VECTOR, dim=128)
     ]
     
@@ -73,5 +93,5 @@ finally:
     connections.disconnect("default")
 EOF
 
-echo "✅ Milvus collection created and loaded successfully"
+echo "✅ Milvus collection is ready"
 echo "🎉 Migration is finished!"
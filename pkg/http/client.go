@@ -2,6 +2,7 @@ package http
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -27,6 +28,7 @@ type IClient interface {
 	Patch(path string, body any, queryParams url.Values, headers http.Header) (*Response, error)
 	Delete(path string, body any, queryParams url.Values, headers http.Header) (*Response, error)
 	SendRequest(method, path string, body any, queryParams url.Values, headers http.Header) (*Response, error)
+	SendRequestWithContext(ctx context.Context, method, path string, body any, queryParams url.Values, headers http.Header) (*Response, error)
 }
 
 type Response struct {
@@ -98,6 +100,11 @@ func (c *Client) Delete(path string, body any, queryParams url.Values, headers h
 }
 
 func (c *Client) SendRequest(method, path string, body any, queryParams url.Values, headers http.Header) (*Response, error) {
+	return c.SendRequestWithContext(context.Background(), method, path, body, queryParams, headers)
+}
+
+// SendRequestWithContext sends a request that is aborted when ctx is done.
+func (c *Client) SendRequestWithContext(ctx context.Context, method, path string, body any, queryParams url.Values, headers http.Header) (*Response, error) {
 	var fullURL string
 	if c.baseURL != "" {
 		fullURL = c.baseURL + path
@@ -133,7 +140,7 @@ func (c *Client) SendRequest(method, path string, body any, queryParams url.Valu
 		fullURL = u.String()
 	}
 
-	req, err := http.NewRequest(method, fullURL, nil)
+	req, err := http.NewRequestWithContext(ctx, method, fullURL, nil)
 	if err != nil {
 		return nil, err
 	}
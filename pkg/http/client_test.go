@@ -2,7 +2,9 @@ package http
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -197,3 +199,20 @@ func TestClient_SendRequest_AllowlistPermitsLocalTargets(t *testing.T) {
 		t.Fatalf("unexpected response body: %s", string(res.Body))
 	}
 }
+
+func TestClient_SendRequestWithContext_Cancelled(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	cli := NewHTTPClient(5*time.Second, false, 0)
+	cli.SetBaseURL(server.URL)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := cli.SendRequestWithContext(ctx, http.MethodGet, "/slow", nil, nil, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the request aborted with ctx, got %v", err)
+	}
+}
@@ -2,17 +2,30 @@ package milvus
 
 import (
 	"context"
+	"encoding/json"
+	"sync"
 
 	milvusClient "github.com/milvus-io/milvus-sdk-go/v2/client"
 	"github.com/milvus-io/milvus-sdk-go/v2/entity"
 )
 
+const defaultSearchTopK = 3
+
 type IClient interface {
 	InsertVector(ctx context.Context, collectionName, content string, vector []float32) error
+	InsertVectorWithMetadata(ctx context.Context, collectionName, content string, vector []float32, metadata map[string]string) error
 	SearchVector(ctx context.Context, collectionName string, vector []float32) ([]string, error)
+	SearchVectorWithScores(ctx context.Context, collectionName string, vector []float32, topK int) ([]*SearchResult, error)
+	ListContents(ctx context.Context, collectionName string, limit int) ([]string, error)
 	Close() error
 }
 
+// SearchResult is a search hit with its L2 distance to the query vector.
+type SearchResult struct {
+	Content  string
+	Distance float32
+}
+
 type Config struct {
 	Host string
 }
@@ -21,6 +34,11 @@ type Client struct {
 	config *Config
 
 	milvusCli milvusClient.Client
+
+	// metadataFields caches per collection whether it has the metadata field,
+	// which collections created before it was introduced lack.
+	metadataFields   map[string]bool
+	metadataFieldsMu sync.Mutex
 }
 
 func NewClient(ctx context.Context, config *Config) (*Client, error) {
@@ -32,24 +50,83 @@ func NewClient(ctx context.Context, config *Config) (*Client, error) {
 	}
 
 	return &Client{
-		config:    config,
-		milvusCli: milvusCli,
+		config:         config,
+		milvusCli:      milvusCli,
+		metadataFields: make(map[string]bool),
 	}, nil
 }
 
 func (c *Client) InsertVector(ctx context.Context, collectionName, content string, vector []float32) error {
-	_, err := c.milvusCli.Insert(
-		ctx,
-		collectionName,
-		"",
+	return c.InsertVectorWithMetadata(ctx, collectionName, content, vector, nil)
+}
+
+// InsertVectorWithMetadata stores content with metadata. Metadata is dropped
+// for collections without the metadata field.
+func (c *Client) InsertVectorWithMetadata(ctx context.Context, collectionName, content string, vector []float32, metadata map[string]string) error {
+	columns := []entity.Column{
 		entity.NewColumnString("content", []string{content}),
 		entity.NewColumnFloatVector("content_embedding", len(vector), [][]float32{vector}),
-	)
+	}
+
+	hasMetadata, err := c.hasMetadataField(ctx, collectionName)
+	if err != nil {
+		return err
+	}
+	if hasMetadata {
+		if metadata == nil {
+			metadata = map[string]string{}
+		}
+		metadataJson, err := json.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+		columns = append(columns, entity.NewColumnString("metadata", []string{string(metadataJson)}))
+	}
+
+	_, err = c.milvusCli.Insert(ctx, collectionName, "", columns...)
 	return err
 }
 
+func (c *Client) hasMetadataField(ctx context.Context, collectionName string) (bool, error) {
+	c.metadataFieldsMu.Lock()
+	defer c.metadataFieldsMu.Unlock()
+	if hasMetadata, ok := c.metadataFields[collectionName]; ok {
+		return hasMetadata, nil
+	}
+
+	collection, err := c.milvusCli.DescribeCollection(ctx, collectionName)
+	if err != nil {
+		return false, err
+	}
+	hasMetadata := false
+	if collection.Schema != nil {
+		for _, field := range collection.Schema.Fields {
+			if field.Name == "metadata" {
+				hasMetadata = true
+				break
+			}
+		}
+	}
+	c.metadataFields[collectionName] = hasMetadata
+	return hasMetadata, nil
+}
+
 func (c *Client) SearchVector(ctx context.Context, collectionName string, vector []float32) ([]string, error) {
+	results, err := c.SearchVectorWithScores(ctx, collectionName, vector, defaultSearchTopK)
+	if err != nil {
+		return nil, err
+	}
 	var contents []string
+	for _, result := range results {
+		contents = append(contents, result.Content)
+	}
+	return contents, nil
+}
+
+func (c *Client) SearchVectorWithScores(ctx context.Context, collectionName string, vector []float32, topK int) ([]*SearchResult, error) {
+	if topK <= 0 {
+		topK = defaultSearchTopK
+	}
 
 	sp, err := entity.NewIndexFlatSearchParam()
 	if err != nil {
@@ -64,12 +141,14 @@ func (c *Client) SearchVector(ctx context.Context, collectionName string, vector
 		[]entity.Vector{entity.FloatVector(vector)},
 		"content_embedding",
 		entity.L2,
-		3,
+		topK,
 		sp,
 	)
 	if err != nil {
 		return nil, err
 	}
+
+	var results []*SearchResult
 	for _, res := range resList {
 		contentColumn := res.Fields.GetColumn("content")
 		for i := range res.ResultCount {
@@ -77,10 +156,43 @@ func (c *Client) SearchVector(ctx context.Context, collectionName string, vector
 			if err != nil {
 				return nil, err
 			}
-			contents = append(contents, content)
+			result := &SearchResult{Content: content}
+			if i < len(res.Scores) {
+				result.Distance = res.Scores[i]
+			}
+			results = append(results, result)
 		}
 	}
 
+	return results, nil
+}
+
+// ListContents returns the content of up to limit stored entities.
+func (c *Client) ListContents(ctx context.Context, collectionName string, limit int) ([]string, error) {
+	resultSet, err := c.milvusCli.Query(
+		ctx,
+		collectionName,
+		[]string{},
+		"",
+		[]string{"content"},
+		milvusClient.WithLimit(int64(limit)),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	contentColumn := resultSet.GetColumn("content")
+	if contentColumn == nil {
+		return nil, nil
+	}
+	contents := make([]string, 0, contentColumn.Len())
+	for i := range contentColumn.Len() {
+		content, err := contentColumn.GetAsString(i)
+		if err != nil {
+			return nil, err
+		}
+		contents = append(contents, content)
+	}
 	return contents, nil
 }
 
@@ -3,11 +3,13 @@ package ollama
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -28,16 +30,55 @@ type ChatRequest struct {
 	Model    string              `json:"model"`
 	Messages []*Message          `json:"messages"`
 	Options  *ChatRequestOptions `json:"options"`
+	// Think enables or disables reasoning output of thinking models; nil keeps
+	// the model default.
+	Think *bool `json:"think,omitempty"`
+	// Format constrains the answer: the string "json" or a JSON Schema object.
+	Format json.RawMessage `json:"format,omitempty"`
+	// KeepAlive controls how long Ollama keeps the model loaded after the
+	// request, e.g. "5m" or "-1"; OpenAI compatible servers ignore it.
+	KeepAlive string `json:"keep_alive,omitempty"`
 }
 
 type Message struct {
-	Role    string   `json:"role"`
-	Content string   `json:"content"`
-	Images  []string `json:"images"`
+	Role     string   `json:"role"`
+	Content  string   `json:"content"`
+	Images   []string `json:"images"`
+	Thinking string   `json:"thinking,omitempty"`
 }
 
+// ChatDelta is one streamed piece of a chat response. Thinking carries the
+// reasoning reported separately by the server, Content the answer. Usage is
+// set on the last delta when the server reports token counts.
+type ChatDelta struct {
+	Content  string
+	Thinking string
+	Usage    *Usage
+}
+
+// Usage is the token count of a chat request.
+type Usage struct {
+	PromptTokens     int `json:"promptTokens"`
+	CompletionTokens int `json:"completionTokens"`
+}
+
+func (u Usage) TotalTokens() int {
+	return u.PromptTokens + u.CompletionTokens
+}
+
+// ChatRequestOptions are Ollama's model options. Pointers distinguish unset
+// options from meaningful zero values.
 type ChatRequestOptions struct {
-	Temperature float32 `json:"temperature"`
+	Temperature      float32  `json:"temperature"`
+	TopP             *float32 `json:"top_p,omitempty"`
+	TopK             int      `json:"top_k,omitempty"`
+	Seed             *int     `json:"seed,omitempty"`
+	NumCtx           int      `json:"num_ctx,omitempty"`
+	NumPredict       int      `json:"num_predict,omitempty"`
+	Stop             []string `json:"stop,omitempty"`
+	RepeatPenalty    float32  `json:"repeat_penalty,omitempty"`
+	PresencePenalty  float32  `json:"presence_penalty,omitempty"`
+	FrequencyPenalty float32  `json:"frequency_penalty,omitempty"`
 }
 
 type StreamResponse struct {
@@ -46,11 +87,80 @@ type StreamResponse struct {
 	Message       *Message `json:"message"`
 	Done          bool     `json:"done"`
 	TotalDuration int64    `json:"total_duration"`
+	// PromptEvalCount and EvalCount are reported with the final response.
+	PromptEvalCount int `json:"prompt_eval_count"`
+	EvalCount       int `json:"eval_count"`
+}
+
+type ShowRequest struct {
+	Model string `json:"model"`
+}
+
+type ModelDetails struct {
+	Format            string   `json:"format"`
+	Family            string   `json:"family"`
+	Families          []string `json:"families"`
+	ParameterSize     string   `json:"parameter_size"`
+	QuantizationLevel string   `json:"quantization_level"`
+}
+
+type ShowResponse struct {
+	Modelfile    string         `json:"modelfile"`
+	Parameters   string         `json:"parameters"`
+	Template     string         `json:"template"`
+	Details      *ModelDetails  `json:"details"`
+	ModelInfo    map[string]any `json:"model_info"`
+	Capabilities []string       `json:"capabilities"`
+}
+
+// ContextLength returns the trained context length reported in model_info
+// under "<architecture>.context_length", or 0 when it is unknown.
+func (sr *ShowResponse) ContextLength() int {
+	if sr == nil || sr.ModelInfo == nil {
+		return 0
+	}
+	if arch, ok := sr.ModelInfo["general.architecture"].(string); ok {
+		if length, ok := sr.ModelInfo[arch+".context_length"].(float64); ok {
+			return int(length)
+		}
+	}
+	for key, value := range sr.ModelInfo {
+		if !strings.HasSuffix(key, ".context_length") {
+			continue
+		}
+		if length, ok := value.(float64); ok {
+			return int(length)
+		}
+	}
+	return 0
+}
+
+// NumCtx returns the num_ctx the model runs with according to its parameters,
+// or 0 when the model does not set it.
+func (sr *ShowResponse) NumCtx() int {
+	if sr == nil {
+		return 0
+	}
+	for _, line := range strings.Split(sr.Parameters, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != "num_ctx" {
+			continue
+		}
+		if numCtx, err := strconv.Atoi(fields[1]); err == nil {
+			return numCtx
+		}
+	}
+	return 0
 }
 
 type IClient interface {
 	EmbeddingPrompt(embedReq *EmbedRequest) (*EmbedResponse, error)
 	Talk(chatReq *ChatRequest, callback func(response string) error) error
+	TalkWithThinking(ctx context.Context, chatReq *ChatRequest, callback func(delta *ChatDelta) error) error
+	ShowModel(showReq *ShowRequest) (*ShowResponse, error)
+	ListModels() (*ListModelsResponse, error)
+	PullModel(ctx context.Context, pullReq *PullRequest, callback func(progress *PullProgress) error) error
+	DeleteModel(ctx context.Context, deleteReq *DeleteRequest) error
 }
 
 type Config struct {
@@ -83,13 +193,34 @@ func (c *Client) EmbeddingPrompt(embedReq *EmbedRequest) (*EmbedResponse, error)
 	return c.strategy.EmbeddingPrompt(c.config, embedReq)
 }
 
+// Talk streams the answer content only; reasoning reported separately by the
+// server is dropped.
 func (c *Client) Talk(chatReq *ChatRequest, callback func(response string) error) error {
-	return c.strategy.Talk(c.config, chatReq, callback)
+	return c.strategy.Talk(context.Background(), c.config, chatReq, func(delta *ChatDelta) error {
+		if delta.Content == "" {
+			return nil
+		}
+		return callback(delta.Content)
+	})
+}
+
+// TalkWithThinking streams the answer and the reasoning as deltas. The
+// request is aborted when ctx is done.
+func (c *Client) TalkWithThinking(ctx context.Context, chatReq *ChatRequest, callback func(delta *ChatDelta) error) error {
+	return c.strategy.Talk(ctx, c.config, chatReq, callback)
+}
+
+func (c *Client) ShowModel(showReq *ShowRequest) (*ShowResponse, error) {
+	return c.strategy.ShowModel(c.config, showReq)
 }
 
 type apiStrategy interface {
 	EmbeddingPrompt(config *Config, embedReq *EmbedRequest) (*EmbedResponse, error)
-	Talk(config *Config, chatReq *ChatRequest, callback func(response string) error) error
+	Talk(ctx context.Context, config *Config, chatReq *ChatRequest, callback func(delta *ChatDelta) error) error
+	ShowModel(config *Config, showReq *ShowRequest) (*ShowResponse, error)
+	ListModels(config *Config) (*ListModelsResponse, error)
+	PullModel(ctx context.Context, config *Config, pullReq *PullRequest, callback func(progress *PullProgress) error) error
+	DeleteModel(ctx context.Context, config *Config, deleteReq *DeleteRequest) error
 }
 
 type ollamaAPIStrategy struct{}
@@ -133,10 +264,10 @@ func (s *ollamaAPIStrategy) EmbeddingPrompt(config *Config, embedReq *EmbedReque
 	return embedResponse, nil
 }
 
-func (s *ollamaAPIStrategy) Talk(config *Config, chatReq *ChatRequest, callback func(response string) error) error {
+func (s *ollamaAPIStrategy) Talk(ctx context.Context, config *Config, chatReq *ChatRequest, callback func(delta *ChatDelta) error) error {
 	jsonReq, _ := json.Marshal(chatReq)
 
-	req, err := http.NewRequest("POST", strings.TrimRight(config.Host, "/")+"/api/chat", bytes.NewBuffer(jsonReq))
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimRight(config.Host, "/")+"/api/chat", bytes.NewBuffer(jsonReq))
 	if err != nil {
 		return err
 	}
@@ -167,15 +298,22 @@ func (s *ollamaAPIStrategy) Talk(config *Config, chatReq *ChatRequest, callback
 		if err := json.Unmarshal([]byte(line), &streamResp); err != nil {
 			continue
 		}
-		if streamResp.Message == nil {
+		delta := &ChatDelta{}
+		if streamResp.Message != nil {
+			delta.Content = streamResp.Message.Content
+			delta.Thinking = streamResp.Message.Thinking
+		}
+		if streamResp.Done && (streamResp.PromptEvalCount > 0 || streamResp.EvalCount > 0) {
+			delta.Usage = &Usage{PromptTokens: streamResp.PromptEvalCount, CompletionTokens: streamResp.EvalCount}
+		}
+		if streamResp.Message == nil && delta.Usage == nil {
 			if streamResp.Done {
 				break
 			}
 			continue
 		}
 
-		content := streamResp.Message.Content
-		if err := callback(content); err != nil {
+		if err := callback(delta); err != nil {
 			return err
 		}
 
@@ -187,17 +325,86 @@ func (s *ollamaAPIStrategy) Talk(config *Config, chatReq *ChatRequest, callback
 	return scanner.Err()
 }
 
+func (s *ollamaAPIStrategy) ShowModel(config *Config, showReq *ShowRequest) (*ShowResponse, error) {
+	jsonReq, _ := json.Marshal(showReq)
+
+	req, err := http.NewRequest("POST", strings.TrimRight(config.Host, "/")+"/api/show", bytes.NewBuffer(jsonReq))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setAuthHeaderIfNeeded(req, config)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		resp.Body.Close()
+	}()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s", ErrModelNotFound, showReq.Model)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error showing model, status code %d", resp.StatusCode)
+	}
+
+	showResponseBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	showResponse := &ShowResponse{}
+	if err := json.Unmarshal(showResponseBytes, showResponse); err != nil {
+		return nil, err
+	}
+
+	return showResponse, nil
+}
+
 type openAICompatibleStrategy struct{}
 
 type openAIChatRequest struct {
-	Model       string     `json:"model"`
-	Messages    []*Message `json:"messages"`
-	Temperature float32    `json:"temperature,omitempty"`
-	Stream      bool       `json:"stream"`
+	Model            string     `json:"model"`
+	Messages         []*Message `json:"messages"`
+	Temperature      *float32   `json:"temperature,omitempty"`
+	TopP             *float32   `json:"top_p,omitempty"`
+	Seed             *int       `json:"seed,omitempty"`
+	MaxTokens        int        `json:"max_tokens,omitempty"`
+	Stop             []string   `json:"stop,omitempty"`
+	PresencePenalty  float32    `json:"presence_penalty,omitempty"`
+	FrequencyPenalty float32    `json:"frequency_penalty,omitempty"`
+	// TopK and RepetitionPenalty are extensions honored by vLLM and llama.cpp.
+	TopK              int     `json:"top_k,omitempty"`
+	RepetitionPenalty float32 `json:"repetition_penalty,omitempty"`
+	Stream            bool    `json:"stream"`
+	// StreamOptions asks for the token usage in a last stream chunk.
+	StreamOptions *openAIStreamOptions `json:"stream_options,omitempty"`
+	// ResponseFormat is the OpenAI counterpart of ChatRequest.Format.
+	ResponseFormat *openAIResponseFormat `json:"response_format,omitempty"`
+}
+
+type openAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type openAIResponseFormat struct {
+	Type       string                `json:"type"`
+	JSONSchema *openAIJSONSchemaSpec `json:"json_schema,omitempty"`
+}
+
+type openAIJSONSchemaSpec struct {
+	Name   string          `json:"name"`
+	Schema json.RawMessage `json:"schema"`
 }
 
 type openAIChatStreamDelta struct {
 	Content string `json:"content"`
+	// ReasoningContent and Reasoning carry thinking output of servers such as
+	// vLLM, DeepSeek and Ollama's compatible endpoint.
+	ReasoningContent string `json:"reasoning_content"`
+	Reasoning        string `json:"reasoning"`
 }
 
 type openAIChatStreamChoice struct {
@@ -205,8 +412,14 @@ type openAIChatStreamChoice struct {
 	FinishReason string                 `json:"finish_reason"`
 }
 
+type openAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
 type openAIChatStreamResponse struct {
 	Choices []*openAIChatStreamChoice `json:"choices"`
+	Usage   *openAIUsage              `json:"usage"`
 }
 
 type openAIEmbeddingRequest struct {
@@ -223,6 +436,22 @@ type openAIEmbeddingResponse struct {
 	Data  []*openAIEmbeddingData `json:"data"`
 }
 
+// newOpenAIResponseFormat translates an Ollama format into an OpenAI
+// response_format: "json" selects JSON mode and an object selects a schema.
+func newOpenAIResponseFormat(format json.RawMessage) *openAIResponseFormat {
+	trimmed := bytes.TrimSpace(format)
+	if len(trimmed) == 0 || string(trimmed) == "null" {
+		return nil
+	}
+	if trimmed[0] != '{' {
+		return &openAIResponseFormat{Type: "json_object"}
+	}
+	return &openAIResponseFormat{
+		Type:       "json_schema",
+		JSONSchema: &openAIJSONSchemaSpec{Name: "response", Schema: trimmed},
+	}
+}
+
 func newOpenAICompatibleStrategy() *openAICompatibleStrategy {
 	return &openAICompatibleStrategy{}
 }
@@ -276,18 +505,30 @@ func (s *openAICompatibleStrategy) EmbeddingPrompt(config *Config, embedReq *Emb
 	return result, nil
 }
 
-func (s *openAICompatibleStrategy) Talk(config *Config, chatReq *ChatRequest, callback func(response string) error) error {
+func (s *openAICompatibleStrategy) Talk(ctx context.Context, config *Config, chatReq *ChatRequest, callback func(delta *ChatDelta) error) error {
 	reqBody := &openAIChatRequest{
-		Model:    chatReq.Model,
-		Messages: chatReq.Messages,
-		Stream:   true,
+		Model:         chatReq.Model,
+		Messages:      chatReq.Messages,
+		Stream:        true,
+		StreamOptions: &openAIStreamOptions{IncludeUsage: true},
 	}
-	if chatReq.Options != nil {
-		reqBody.Temperature = chatReq.Options.Temperature
+	if options := chatReq.Options; options != nil {
+		temperature := options.Temperature
+		reqBody.Temperature = &temperature
+		reqBody.TopP = options.TopP
+		reqBody.Seed = options.Seed
+		// A negative num_predict means unlimited in Ollama.
+		reqBody.MaxTokens = max(options.NumPredict, 0)
+		reqBody.Stop = options.Stop
+		reqBody.PresencePenalty = options.PresencePenalty
+		reqBody.FrequencyPenalty = options.FrequencyPenalty
+		reqBody.TopK = options.TopK
+		reqBody.RepetitionPenalty = options.RepeatPenalty
 	}
+	reqBody.ResponseFormat = newOpenAIResponseFormat(chatReq.Format)
 	jsonReq, _ := json.Marshal(reqBody)
 
-	req, err := http.NewRequest("POST", strings.TrimRight(config.Host, "/")+"/v1/chat/completions", bytes.NewBuffer(jsonReq))
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimRight(config.Host, "/")+"/v1/chat/completions", bytes.NewBuffer(jsonReq))
 	if err != nil {
 		return err
 	}
@@ -307,6 +548,7 @@ func (s *openAICompatibleStrategy) Talk(config *Config, chatReq *ChatRequest, ca
 	}
 
 	scanner := bufio.NewScanner(resp.Body)
+	finished := false
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
 		if line == "" {
@@ -328,12 +570,31 @@ func (s *openAICompatibleStrategy) Talk(config *Config, chatReq *ChatRequest, ca
 			if choice == nil {
 				continue
 			}
-			if choice.Delta != nil && choice.Delta.Content != "" {
-				if err := callback(choice.Delta.Content); err != nil {
-					return err
+			if choice.Delta != nil {
+				delta := &ChatDelta{
+					Content:  choice.Delta.Content,
+					Thinking: choice.Delta.ReasoningContent + choice.Delta.Reasoning,
+				}
+				if delta.Content != "" || delta.Thinking != "" {
+					if err := callback(delta); err != nil {
+						return err
+					}
 				}
 			}
 			if choice.FinishReason != "" {
+				finished = true
+			}
+		}
+		// The usage arrives with the last choice or in a chunk of its own
+		// after it.
+		if streamResp.Usage != nil {
+			if err := callback(&ChatDelta{Usage: &Usage{
+				PromptTokens:     streamResp.Usage.PromptTokens,
+				CompletionTokens: streamResp.Usage.CompletionTokens,
+			}}); err != nil {
+				return err
+			}
+			if finished {
 				return nil
 			}
 		}
@@ -342,6 +603,10 @@ func (s *openAICompatibleStrategy) Talk(config *Config, chatReq *ChatRequest, ca
 	return scanner.Err()
 }
 
+func (s *openAICompatibleStrategy) ShowModel(_ *Config, _ *ShowRequest) (*ShowResponse, error) {
+	return nil, fmt.Errorf("show model is %w", ErrUnsupportedOperation)
+}
+
 func setAuthHeaderIfNeeded(req *http.Request, config *Config) {
 	if config == nil {
 		return
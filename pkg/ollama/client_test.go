@@ -1,6 +1,7 @@
 package ollama
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
@@ -168,6 +169,249 @@ func TestClient_OpenAICompatible_Talk_StreamSuccess(t *testing.T) {
 	}
 }
 
+func TestClient_TalkWithThinking_SeparatesReasoning(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !strings.Contains(string(body), `"think":true`) {
+			t.Fatalf("expected think option in request: %s", body)
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("{\"message\":{\"content\":\"\",\"thinking\":\"hmm\"},\"done\":false}\n"))
+		_, _ = w.Write([]byte("{\"message\":{\"content\":\"answer\"},\"done\":true}\n"))
+	}))
+	defer server.Close()
+
+	think := true
+	cli := NewClient(&Config{Host: server.URL})
+	var content, thinking strings.Builder
+	err := cli.TalkWithThinking(context.Background(), &ChatRequest{Model: "m", Think: &think}, func(delta *ChatDelta) error {
+		content.WriteString(delta.Content)
+		thinking.WriteString(delta.Thinking)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content.String() != "answer" || thinking.String() != "hmm" {
+		t.Fatalf("unexpected split: content=%q thinking=%q", content.String(), thinking.String())
+	}
+
+	var chunks []string
+	if err := cli.Talk(&ChatRequest{Model: "m", Think: &think}, func(response string) error {
+		chunks = append(chunks, response)
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(chunks) != 1 || chunks[0] != "answer" {
+		t.Fatalf("expected Talk to stream answer only, got %v", chunks)
+	}
+}
+
+func TestClient_OpenAICompatible_TalkWithThinking_Reasoning(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("data: {\"choices\":[{\"delta\":{\"reasoning_content\":\"step\"}}]}\n"))
+		_, _ = w.Write([]byte("data: {\"choices\":[{\"delta\":{\"reasoning\":\"s\"}}]}\n"))
+		_, _ = w.Write([]byte("data: {\"choices\":[{\"delta\":{\"content\":\"done\"},\"finish_reason\":\"stop\"}]}\n"))
+	}))
+	defer server.Close()
+
+	cli := NewClient(&Config{Host: server.URL, APIType: "openai"})
+	var content, thinking strings.Builder
+	if err := cli.TalkWithThinking(context.Background(), &ChatRequest{Model: "m"}, func(delta *ChatDelta) error {
+		content.WriteString(delta.Content)
+		thinking.WriteString(delta.Thinking)
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content.String() != "done" || thinking.String() != "steps" {
+		t.Fatalf("unexpected split: content=%q thinking=%q", content.String(), thinking.String())
+	}
+}
+
+func TestClient_TalkWithThinking_ReportsUsage(t *testing.T) {
+	ollamaServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("{\"message\":{\"content\":\"hi\"},\"done\":false}\n"))
+		_, _ = w.Write([]byte("{\"message\":{\"content\":\"\"},\"done\":true,\"prompt_eval_count\":12,\"eval_count\":3}\n"))
+	}))
+	defer ollamaServer.Close()
+
+	openAIServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !strings.Contains(string(body), `"stream_options":{"include_usage":true}`) {
+			t.Fatalf("expected usage to be requested: %s", body)
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("data: {\"choices\":[{\"delta\":{\"content\":\"hi\"},\"finish_reason\":\"stop\"}]}\n"))
+		_, _ = w.Write([]byte("data: {\"choices\":[],\"usage\":{\"prompt_tokens\":12,\"completion_tokens\":3}}\n"))
+		_, _ = w.Write([]byte("data: [DONE]\n"))
+	}))
+	defer openAIServer.Close()
+
+	for _, cli := range []*Client{
+		NewClient(&Config{Host: ollamaServer.URL}),
+		NewClient(&Config{Host: openAIServer.URL, APIType: "openai"}),
+	} {
+		var usage *Usage
+		var content strings.Builder
+		if err := cli.TalkWithThinking(context.Background(), &ChatRequest{Model: "m"}, func(delta *ChatDelta) error {
+			content.WriteString(delta.Content)
+			if delta.Usage != nil {
+				usage = delta.Usage
+			}
+			return nil
+		}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if content.String() != "hi" {
+			t.Fatalf("unexpected content: %q", content.String())
+		}
+		if usage == nil || usage.PromptTokens != 12 || usage.CompletionTokens != 3 || usage.TotalTokens() != 15 {
+			t.Fatalf("unexpected usage: %+v", usage)
+		}
+	}
+}
+
+func TestClient_TalkWithThinking_CancelAbortsStream(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("{\"message\":{\"content\":\"hi\"},\"done\":false}\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err := NewClient(&Config{Host: server.URL}).TalkWithThinking(ctx, &ChatRequest{Model: "m"}, func(delta *ChatDelta) error {
+		if delta.Content == "hi" {
+			cancel()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the stream to be cancelled, got %v", err)
+	}
+}
+
+func TestClient_Talk_FormatIsForwarded(t *testing.T) {
+	schema := json.RawMessage(`{"type":"object","properties":{"ok":{"type":"boolean"}}}`)
+	var gotOllama, gotOpenAI map[string]json.RawMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.URL.Path == "/v1/chat/completions" {
+			_ = json.Unmarshal(body, &gotOpenAI)
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte("data: [DONE]\n"))
+			return
+		}
+		_ = json.Unmarshal(body, &gotOllama)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("{\"message\":{\"content\":\"{}\"},\"done\":true}\n"))
+	}))
+	defer server.Close()
+
+	noop := func(string) error { return nil }
+	if err := NewClient(&Config{Host: server.URL}).Talk(&ChatRequest{Model: "m", Format: schema}, noop); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(gotOllama["format"]) != string(schema) {
+		t.Fatalf("expected schema as ollama format, got %s", gotOllama["format"])
+	}
+
+	openAI := NewClient(&Config{Host: server.URL, APIType: "openai"})
+	if err := openAI.Talk(&ChatRequest{Model: "m", Format: schema}, noop); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := `{"type":"json_schema","json_schema":{"name":"response","schema":` + string(schema) + `}}`
+	if string(gotOpenAI["response_format"]) != want {
+		t.Fatalf("unexpected response_format: %s", gotOpenAI["response_format"])
+	}
+
+	if err := openAI.Talk(&ChatRequest{Model: "m", Format: json.RawMessage(`"json"`)}, noop); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(gotOpenAI["response_format"]) != `{"type":"json_object"}` {
+		t.Fatalf("unexpected response_format for json mode: %s", gotOpenAI["response_format"])
+	}
+
+	gotOpenAI = nil
+	if err := openAI.Talk(&ChatRequest{Model: "m"}, noop); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := gotOpenAI["response_format"]; ok {
+		t.Fatalf("expected no response_format without format")
+	}
+}
+
+func TestClient_Talk_SamplingOptions(t *testing.T) {
+	var gotOllama, gotOpenAI map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+		if r.URL.Path == "/v1/chat/completions" {
+			_ = json.Unmarshal(body, &gotOpenAI)
+			_, _ = w.Write([]byte("data: [DONE]\n"))
+			return
+		}
+		_ = json.Unmarshal(body, &gotOllama)
+		_, _ = w.Write([]byte("{\"message\":{\"content\":\"ok\"},\"done\":true}\n"))
+	}))
+	defer server.Close()
+
+	topP := float32(0.5)
+	seed := 0
+	req := &ChatRequest{
+		Model:     "m",
+		KeepAlive: "10m",
+		Options: &ChatRequestOptions{
+			Temperature:      0,
+			TopP:             &topP,
+			TopK:             40,
+			Seed:             &seed,
+			NumCtx:           8192,
+			NumPredict:       128,
+			Stop:             []string{"END"},
+			RepeatPenalty:    1.1,
+			PresencePenalty:  0.2,
+			FrequencyPenalty: 0.3,
+		},
+	}
+	noop := func(string) error { return nil }
+	if err := NewClient(&Config{Host: server.URL}).Talk(req, noop); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	options, _ := gotOllama["options"].(map[string]any)
+	if gotOllama["keep_alive"] != "10m" || options["temperature"] != float64(0) || options["seed"] != float64(0) ||
+		options["top_k"] != float64(40) || options["num_ctx"] != float64(8192) || options["num_predict"] != float64(128) {
+		t.Fatalf("unexpected ollama request: %v", gotOllama)
+	}
+
+	if err := NewClient(&Config{Host: server.URL, APIType: "openai"}).Talk(req, noop); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if gotOpenAI["temperature"] != float64(0) || gotOpenAI["top_p"] != float64(0.5) || gotOpenAI["seed"] != float64(0) ||
+		gotOpenAI["max_tokens"] != float64(128) || gotOpenAI["top_k"] != float64(40) {
+		t.Fatalf("unexpected openai request: %v", gotOpenAI)
+	}
+	if stop, _ := gotOpenAI["stop"].([]any); len(stop) != 1 || stop[0] != "END" {
+		t.Fatalf("unexpected openai stop: %v", gotOpenAI["stop"])
+	}
+	if _, ok := gotOpenAI["keep_alive"]; ok {
+		t.Fatalf("expected keep_alive to be omitted for openai")
+	}
+	if _, ok := gotOpenAI["num_ctx"]; ok {
+		t.Fatalf("expected num_ctx to be omitted for openai")
+	}
+}
+
 func TestClient_Talk_CallbackError(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -232,3 +476,65 @@ func TestClient_EmbeddingPrompt_InvalidResponseJSON(t *testing.T) {
 		t.Fatalf("expected unmarshal error")
 	}
 }
+
+func TestClient_ShowModel_ContextLength(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/show" {
+			t.Fatalf("unexpected path: %s", r.URL.Path)
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"template":"{{ .Prompt }}","details":{"family":"qwen3"},"model_info":{"general.architecture":"qwen3","qwen3.context_length":40960},"capabilities":["completion","tools"]}`))
+	}))
+	defer server.Close()
+
+	cli := NewClient(&Config{Host: server.URL})
+	resp, err := cli.ShowModel(&ShowRequest{Model: "qwen3:4b"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.ContextLength() != 40960 {
+		t.Fatalf("expected context length 40960, got %d", resp.ContextLength())
+	}
+	if resp.Details == nil || resp.Details.Family != "qwen3" || len(resp.Capabilities) != 2 {
+		t.Fatalf("unexpected show response: %+v", resp)
+	}
+}
+
+func TestShowResponse_NumCtx(t *testing.T) {
+	resp := &ShowResponse{Parameters: "stop                           \"<|im_end|>\"\nnum_ctx                        8192\ntemperature                    0.6"}
+	if resp.NumCtx() != 8192 {
+		t.Fatalf("expected num_ctx 8192, got %d", resp.NumCtx())
+	}
+	if (&ShowResponse{Parameters: "temperature 0.6"}).NumCtx() != 0 {
+		t.Fatalf("expected 0 without num_ctx")
+	}
+	var nilResp *ShowResponse
+	if nilResp.NumCtx() != 0 {
+		t.Fatalf("expected 0 for nil response")
+	}
+}
+
+func TestShowResponse_ContextLengthFallbacks(t *testing.T) {
+	var nilResp *ShowResponse
+	if nilResp.ContextLength() != 0 {
+		t.Fatalf("expected 0 for nil response")
+	}
+	resp := &ShowResponse{ModelInfo: map[string]any{"llama.context_length": float64(8192)}}
+	if resp.ContextLength() != 8192 {
+		t.Fatalf("expected suffix match fallback, got %d", resp.ContextLength())
+	}
+}
+
+func TestClient_ShowModel_Errors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	if _, err := NewClient(&Config{Host: server.URL}).ShowModel(&ShowRequest{Model: "missing"}); err == nil {
+		t.Fatalf("expected non-200 error")
+	}
+	if _, err := NewClient(&Config{Host: server.URL, APIType: "openai"}).ShowModel(&ShowRequest{Model: "m"}); err == nil {
+		t.Fatalf("expected unsupported error for openai compatible strategy")
+	}
+}
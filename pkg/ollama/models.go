@@ -0,0 +1,280 @@
+package ollama
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	ErrModelNotFound = errors.New("model not found")
+	// ErrUnsupportedOperation is returned by OpenAI compatible endpoints for
+	// the Ollama specific model management operations.
+	ErrUnsupportedOperation = errors.New("not supported by openai compatible endpoint")
+)
+
+type ModelInfo struct {
+	Name       string        `json:"name"`
+	Model      string        `json:"model"`
+	ModifiedAt time.Time     `json:"modified_at"`
+	Size       int64         `json:"size"`
+	Digest     string        `json:"digest"`
+	Details    *ModelDetails `json:"details,omitempty"`
+}
+
+type ListModelsResponse struct {
+	Models []*ModelInfo `json:"models"`
+}
+
+// Has reports whether a model named name is installed. Names without a tag
+// match the "latest" tag.
+func (lr *ListModelsResponse) Has(name string) bool {
+	if lr == nil {
+		return false
+	}
+	for _, model := range lr.Models {
+		if SameModel(model.Name, name) || SameModel(model.Model, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// SameModel reports whether two model names refer to the same model, treating
+// a missing tag as "latest".
+func SameModel(a, b string) bool {
+	return normalizeModelName(a) == normalizeModelName(b)
+}
+
+func normalizeModelName(name string) string {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return ""
+	}
+	if !strings.Contains(name[strings.LastIndex(name, "/")+1:], ":") {
+		name += ":latest"
+	}
+	return name
+}
+
+type PullRequest struct {
+	Model    string `json:"model"`
+	Insecure bool   `json:"insecure,omitempty"`
+	Stream   bool   `json:"stream"`
+}
+
+// PullProgress is one status update of a pull. Total and Completed are set
+// while a layer is downloading.
+type PullProgress struct {
+	Status    string `json:"status"`
+	Digest    string `json:"digest,omitempty"`
+	Total     int64  `json:"total,omitempty"`
+	Completed int64  `json:"completed,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type DeleteRequest struct {
+	Model string `json:"model"`
+}
+
+// HasCapability reports whether the model declares capability, e.g.
+// "completion", "embedding", "tools", "vision" or "thinking".
+func (sr *ShowResponse) HasCapability(capability string) bool {
+	if sr == nil {
+		return false
+	}
+	for _, c := range sr.Capabilities {
+		if strings.EqualFold(c, capability) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) ListModels() (*ListModelsResponse, error) {
+	return c.strategy.ListModels(c.config)
+}
+
+// PullModel downloads a model and streams its progress to callback. The
+// download is aborted when ctx is done.
+func (c *Client) PullModel(ctx context.Context, pullReq *PullRequest, callback func(progress *PullProgress) error) error {
+	return c.strategy.PullModel(ctx, c.config, pullReq, callback)
+}
+
+func (c *Client) DeleteModel(ctx context.Context, deleteReq *DeleteRequest) error {
+	return c.strategy.DeleteModel(ctx, c.config, deleteReq)
+}
+
+func (s *ollamaAPIStrategy) ListModels(config *Config) (*ListModelsResponse, error) {
+	req, err := http.NewRequest("GET", strings.TrimRight(config.Host, "/")+"/api/tags", nil)
+	if err != nil {
+		return nil, err
+	}
+	setAuthHeaderIfNeeded(req, config)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error listing models, status code %d", resp.StatusCode)
+	}
+
+	listResponse := &ListModelsResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(listResponse); err != nil {
+		return nil, err
+	}
+	return listResponse, nil
+}
+
+func (s *ollamaAPIStrategy) PullModel(ctx context.Context, config *Config, pullReq *PullRequest, callback func(progress *PullProgress) error) error {
+	reqBody := *pullReq
+	reqBody.Stream = true
+	jsonReq, _ := json.Marshal(&reqBody)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimRight(config.Host, "/")+"/api/pull", bytes.NewBuffer(jsonReq))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setAuthHeaderIfNeeded(req, config)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error pulling model, status code %d: %s", resp.StatusCode, readErrorMessage(resp.Body))
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		progress := &PullProgress{}
+		if err := json.Unmarshal(line, progress); err != nil {
+			continue
+		}
+		if progress.Error != "" {
+			return fmt.Errorf("error pulling model: %s", progress.Error)
+		}
+		if callback != nil {
+			if err := callback(progress); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+func (s *ollamaAPIStrategy) DeleteModel(ctx context.Context, config *Config, deleteReq *DeleteRequest) error {
+	jsonReq, _ := json.Marshal(deleteReq)
+
+	req, err := http.NewRequestWithContext(ctx, "DELETE", strings.TrimRight(config.Host, "/")+"/api/delete", bytes.NewBuffer(jsonReq))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setAuthHeaderIfNeeded(req, config)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		resp.Body.Close()
+	}()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return fmt.Errorf("%w: %s", ErrModelNotFound, deleteReq.Model)
+	default:
+		return fmt.Errorf("error deleting model, status code %d", resp.StatusCode)
+	}
+}
+
+type openAIModel struct {
+	ID      string `json:"id"`
+	Created int64  `json:"created"`
+}
+
+type openAIModelsResponse struct {
+	Data []*openAIModel `json:"data"`
+}
+
+func (s *openAICompatibleStrategy) ListModels(config *Config) (*ListModelsResponse, error) {
+	req, err := http.NewRequest("GET", strings.TrimRight(config.Host, "/")+"/v1/models", nil)
+	if err != nil {
+		return nil, err
+	}
+	setAuthHeaderIfNeeded(req, config)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error listing models, status code %d", resp.StatusCode)
+	}
+
+	var openAIResp openAIModelsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&openAIResp); err != nil {
+		return nil, err
+	}
+	listResponse := &ListModelsResponse{Models: make([]*ModelInfo, 0, len(openAIResp.Data))}
+	for _, model := range openAIResp.Data {
+		if model == nil {
+			continue
+		}
+		info := &ModelInfo{Name: model.ID, Model: model.ID}
+		if model.Created > 0 {
+			info.ModifiedAt = time.Unix(model.Created, 0)
+		}
+		listResponse.Models = append(listResponse.Models, info)
+	}
+	return listResponse, nil
+}
+
+func (s *openAICompatibleStrategy) PullModel(_ context.Context, _ *Config, _ *PullRequest, _ func(progress *PullProgress) error) error {
+	return fmt.Errorf("pull model is %w", ErrUnsupportedOperation)
+}
+
+func (s *openAICompatibleStrategy) DeleteModel(_ context.Context, _ *Config, _ *DeleteRequest) error {
+	return fmt.Errorf("delete model is %w", ErrUnsupportedOperation)
+}
+
+// readErrorMessage extracts the "error" field Ollama puts in failed responses.
+func readErrorMessage(body io.Reader) string {
+	var errResp struct {
+		Error string `json:"error"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(body, 64*1024))
+	if json.Unmarshal(data, &errResp) == nil && errResp.Error != "" {
+		return errResp.Error
+	}
+	return strings.TrimSpace(string(data))
+}
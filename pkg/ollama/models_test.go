@@ -0,0 +1,129 @@
+package ollama
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClient_ListModels(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/tags":
+			_, _ = w.Write([]byte(`{"models":[{"name":"qwen3:4b","model":"qwen3:4b","size":10,"details":{"family":"qwen3"}},{"name":"nomic-embed-text:latest","model":"nomic-embed-text:latest"}]}`))
+		case "/v1/models":
+			_, _ = w.Write([]byte(`{"data":[{"id":"gpt-x","created":1700000000}]}`))
+		default:
+			t.Fatalf("unexpected path: %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	list, err := NewClient(&Config{Host: server.URL}).ListModels()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(list.Models) != 2 || list.Models[0].Details.Family != "qwen3" {
+		t.Fatalf("unexpected models: %+v", list.Models)
+	}
+	if !list.Has("qwen3:4b") || !list.Has("nomic-embed-text") || list.Has("qwen3") || list.Has("llama3:8b") {
+		t.Fatalf("unexpected Has results")
+	}
+
+	list, err = NewClient(&Config{Host: server.URL, APIType: "openai"}).ListModels()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(list.Models) != 1 || list.Models[0].Name != "gpt-x" || list.Models[0].ModifiedAt.IsZero() {
+		t.Fatalf("unexpected openai models: %+v", list.Models[0])
+	}
+}
+
+func TestClient_PullModel_StreamsProgress(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var req PullRequest
+		_ = json.Unmarshal(body, &req)
+		if r.URL.Path != "/api/pull" || req.Model == "" || !req.Stream {
+			t.Fatalf("unexpected pull request %s: %s", r.URL.Path, body)
+		}
+		if req.Model == "broken" {
+			_, _ = w.Write([]byte("{\"status\":\"pulling manifest\"}\n{\"error\":\"pull model manifest: file does not exist\"}\n"))
+			return
+		}
+		_, _ = w.Write([]byte("{\"status\":\"pulling manifest\"}\n{\"status\":\"downloading\",\"digest\":\"sha256:1\",\"total\":100,\"completed\":50}\n{\"status\":\"success\"}\n"))
+	}))
+	defer server.Close()
+
+	cli := NewClient(&Config{Host: server.URL})
+	var statuses []string
+	if err := cli.PullModel(context.Background(), &PullRequest{Model: "qwen3:4b"}, func(progress *PullProgress) error {
+		statuses = append(statuses, progress.Status)
+		if progress.Status == "downloading" && (progress.Total != 100 || progress.Completed != 50) {
+			t.Fatalf("unexpected progress: %+v", progress)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(statuses) != 3 || statuses[2] != "success" {
+		t.Fatalf("unexpected statuses: %v", statuses)
+	}
+
+	if err := cli.PullModel(context.Background(), &PullRequest{Model: "broken"}, nil); err == nil {
+		t.Fatalf("expected pull error")
+	}
+	if err := NewClient(&Config{Host: server.URL, APIType: "openai"}).PullModel(context.Background(), &PullRequest{Model: "m"}, nil); !errors.Is(err, ErrUnsupportedOperation) {
+		t.Fatalf("expected unsupported error, got %v", err)
+	}
+}
+
+func TestClient_PullModel_Cancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("{\"status\":\"pulling manifest\"}\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err := NewClient(&Config{Host: server.URL}).PullModel(ctx, &PullRequest{Model: "qwen3:4b"}, func(progress *PullProgress) error {
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the pull cancelled, got %v", err)
+	}
+}
+
+func TestClient_DeleteModel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req DeleteRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if r.URL.Path != "/api/show" && (r.Method != http.MethodDelete || r.URL.Path != "/api/delete") {
+			t.Fatalf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if req.Model == "missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	cli := NewClient(&Config{Host: server.URL})
+	if err := cli.DeleteModel(context.Background(), &DeleteRequest{Model: "qwen3:4b"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := cli.DeleteModel(context.Background(), &DeleteRequest{Model: "missing"}); !errors.Is(err, ErrModelNotFound) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+	if _, err := cli.ShowModel(&ShowRequest{Model: "missing"}); !errors.Is(err, ErrModelNotFound) {
+		t.Fatalf("expected show to report not found, got %v", err)
+	}
+	if err := NewClient(&Config{Host: server.URL, APIType: "openai"}).DeleteModel(context.Background(), &DeleteRequest{Model: "m"}); !errors.Is(err, ErrUnsupportedOperation) {
+		t.Fatalf("expected unsupported error, got %v", err)
+	}
+}
@@ -0,0 +1,213 @@
+package ai_agent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/luoxiaojun1992/ai-agent/pkg/ollama"
+	"github.com/luoxiaojun1992/ai-agent/util/retrieval"
+)
+
+const (
+	defaultRecallTopK           = 3
+	defaultRecallMMRLambda      = 0.7
+	defaultRecallDedupThreshold = 0.90
+	recallCandidateMultiplier   = 3
+	// keywordIndexLoadLimit bounds the stored documents loaded into the
+	// keyword index, the largest result window of a Milvus query.
+	keywordIndexLoadLimit = 16384
+)
+
+var judgeScoreRegexp = regexp.MustCompile(`\d+(\.\d+)?`)
+
+// llmJudgeReranker scores documents by asking a model to grade their relevance.
+type llmJudgeReranker struct {
+	agent *Agent
+	model string
+}
+
+func (r *llmJudgeReranker) Rerank(ctx context.Context, query string, docs []string) ([]float64, error) {
+	scores := make([]float64, 0, len(docs))
+	for _, doc := range docs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		judgement, err := r.agent.talkToOllama(ctx, r.model, []*ollama.Message{
+			{
+				Role: "system",
+				Content: `Grade how relevant the document is to the query on a scale from 0 to 10.
+Output only the number.
+Query:` + "\n" + query + "\n" + `Document:` + "\n" + doc,
+			},
+		}, func(_ string) error {
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		scores = append(scores, parseJudgeScore(judgement))
+	}
+	return scores, nil
+}
+
+func parseJudgeScore(judgement string) float64 {
+	match := judgeScoreRegexp.FindString(judgement)
+	if match == "" {
+		return 0
+	}
+	score, err := strconv.ParseFloat(match, 64)
+	if err != nil {
+		return 0
+	}
+	return score
+}
+
+func (ad *AgentDouble) recallReranker() retrieval.Reranker {
+	if ad.reranker != nil {
+		return ad.reranker
+	}
+	if ad.config.RecallRerankModel != "" {
+		return &llmJudgeReranker{agent: ad.Agent, model: ad.config.RecallRerankModel}
+	}
+	return nil
+}
+
+// denseSearch returns the topK documents nearest to prompt, nearest first.
+func (ad *AgentDouble) denseSearch(ctx context.Context, prompt string, topK int) ([]string, error) {
+	embeddingResponse, err := ad.Agent.ollamaCli.EmbeddingPrompt(&ollama.EmbedRequest{
+		Model: ad.config.EmbeddingModel,
+		Input: prompt,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(embeddingResponse.Embeddings) == 0 || len(embeddingResponse.Embeddings[0]) == 0 {
+		return nil, nil
+	}
+	results, err := ad.Agent.milvusCli.SearchVectorWithScores(ctx, ad.config.MilvusCollection, embeddingResponse.Embeddings[0], topK)
+	if err != nil {
+		return nil, err
+	}
+	hits := make([]string, 0, len(results))
+	for _, result := range results {
+		hits = append(hits, result.Content)
+	}
+	return hits, nil
+}
+
+// keywordIndex is the BM25 index of the documents of a collection, shared by
+// the agent doubles of an agent.
+type keywordIndex struct {
+	*retrieval.BM25Index
+
+	mu sync.Mutex
+	// loaded tells whether the stored documents were added to the index.
+	loaded bool
+}
+
+// keywordIndex returns the keyword index of collection, loading the documents
+// stored in it once, so keyword retrieval finds what dense search misses also
+// after a restart. A failed load is retried on the next call.
+func (a *Agent) keywordIndex(ctx context.Context, collection string) *retrieval.BM25Index {
+	a.keywordIndexesMu.Lock()
+	if a.keywordIndexes == nil {
+		a.keywordIndexes = make(map[string]*keywordIndex)
+	}
+	index, ok := a.keywordIndexes[collection]
+	if !ok {
+		index = &keywordIndex{BM25Index: retrieval.NewBM25Index()}
+		a.keywordIndexes[collection] = index
+	}
+	a.keywordIndexesMu.Unlock()
+
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	if !index.loaded {
+		contents, err := a.milvusCli.ListContents(ctx, collection, keywordIndexLoadLimit)
+		if err != nil {
+			log.Printf("load keyword index from collection [%s] failed: %v", collection, err)
+			return index.BM25Index
+		}
+		for _, content := range contents {
+			index.Add(content)
+		}
+		index.loaded = true
+	}
+	return index.BM25Index
+}
+
+// keywordIndex returns the keyword index of the configured collection.
+func (ad *AgentDouble) keywordIndex(ctx context.Context) *retrieval.BM25Index {
+	return ad.Agent.keywordIndex(ctx, ad.config.MilvusCollection)
+}
+
+// hybridSearch fuses dense vector hits with BM25 keyword hits, drops what is
+// already present in memory, optionally reranks, and diversifies with MMR.
+func (ad *AgentDouble) hybridSearch(ctx context.Context, prompt string) ([]string, error) {
+	topK := ad.config.RecallTopK
+	if topK <= 0 {
+		topK = defaultRecallTopK
+	}
+
+	keywordIndex := ad.keywordIndex(ctx)
+	denseHits, err := ad.denseSearch(ctx, prompt, topK*recallCandidateMultiplier)
+	if err != nil {
+		return nil, err
+	}
+	for _, hit := range denseHits {
+		keywordIndex.Add(hit)
+	}
+
+	keywordHits := keywordIndex.Search(prompt, topK*recallCandidateMultiplier)
+	keywordRanking := make([]string, 0, len(keywordHits))
+	for _, hit := range keywordHits {
+		keywordRanking = append(keywordRanking, hit.Content)
+	}
+
+	candidates := retrieval.ReciprocalRankFusion(ad.config.RecallRRFK, denseHits, keywordRanking)
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	dedupThreshold := ad.config.RecallDedupThreshold
+	if dedupThreshold <= 0 {
+		dedupThreshold = defaultRecallDedupThreshold
+	}
+	memorySnapshot := ad.MemorySnapshot()
+	existing := make([]string, 0, len(memorySnapshot.Contexts))
+	for _, memCtx := range memorySnapshot.Contexts {
+		existing = append(existing, memCtx.Content)
+	}
+	candidates = retrieval.Deduplicate(candidates, existing, dedupThreshold)
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	candidates, err = retrieval.ApplyReranker(ctx, ad.recallReranker(), prompt, candidates)
+	if err != nil {
+		return nil, fmt.Errorf("rerank recalled context: %w", err)
+	}
+
+	mmrLambda := ad.config.RecallMMRLambda
+	if mmrLambda <= 0 {
+		mmrLambda = defaultRecallMMRLambda
+	}
+	selected := retrieval.MMR(candidates, mmrLambda, topK)
+
+	contents := make([]string, 0, len(selected))
+	for _, doc := range selected {
+		if strings.TrimSpace(doc.Content) == "" {
+			continue
+		}
+		contents = append(contents, doc.Content)
+	}
+	if len(contents) == 0 {
+		return nil, nil
+	}
+	return contents, nil
+}
@@ -0,0 +1,148 @@
+package ai_agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/luoxiaojun1992/ai-agent/pkg/ollama"
+	"github.com/luoxiaojun1992/ai-agent/util/review"
+)
+
+const (
+	defaultSupervisorMaxRevisions = 1
+	defaultSupervisorFailSeverity = review.SeverityMedium
+)
+
+// ReviewError reports a response the supervisor still rejected after all
+// revisions.
+type ReviewError struct {
+	Revisions int
+	Verdicts  []*review.Verdict
+}
+
+func (e *ReviewError) Error() string {
+	return fmt.Sprintf("response from model is non-compliant after %d revisions:\n%s", e.Revisions, review.Critique(e.Verdicts))
+}
+
+type reviewCallbackCtxKey struct{}
+
+// WithReviewCallback attaches a callback that receives the supervisor verdicts
+// of every reviewed response, along with the revision they belong to.
+func WithReviewCallback(ctx context.Context, callback func(revision int, verdicts []*review.Verdict) error) context.Context {
+	return context.WithValue(ctx, reviewCallbackCtxKey{}, callback)
+}
+
+func reviewCallbackFromContext(ctx context.Context) func(revision int, verdicts []*review.Verdict) error {
+	callback, _ := ctx.Value(reviewCallbackCtxKey{}).(func(revision int, verdicts []*review.Verdict) error)
+	return callback
+}
+
+// modelReviewer asks a chat model for structured verdicts.
+type modelReviewer struct {
+	agent *Agent
+	model string
+}
+
+func (mr *modelReviewer) Review(ctx context.Context, req *review.Request) ([]*review.Verdict, error) {
+	output, _, err := mr.agent.talkToOllamaWithThinking(ctx, mr.model, []*ollama.Message{
+		{
+			Role:    "user",
+			Content: review.Prompt(req),
+		},
+	}, chatOptions{
+		think:    mr.agent.config.Think,
+		format:   json.RawMessage(review.VerdictSchema),
+		sampling: mr.agent.config.Sampling,
+		usage:    usageCallbackFromContext(ctx),
+	}, func(_ string) error {
+		return nil
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return review.ParseVerdicts(output, req.Rubrics)
+}
+
+func (ad *AgentDouble) supervisor() review.Reviewer {
+	if ad.reviewer != nil {
+		return ad.reviewer
+	}
+	return &modelReviewer{agent: ad.Agent, model: ad.config.SupervisorModel}
+}
+
+func (ad *AgentDouble) supervisorRubrics() ([]review.Rubric, error) {
+	rubrics := review.DefaultRubrics()
+	if len(ad.config.SupervisorRubrics) > 0 {
+		var err error
+		if rubrics, err = review.RubricsByName(ad.config.SupervisorRubrics); err != nil {
+			return nil, err
+		}
+	}
+	if ad.config.SupervisorPolicy != "" {
+		for i := range rubrics {
+			if rubrics[i].Name == review.RubricPolicy.Name {
+				rubrics[i].Criteria = "The response complies with this policy: " + ad.config.SupervisorPolicy
+			}
+		}
+	}
+	return rubrics, nil
+}
+
+func (ad *AgentDouble) supervisorMaxRevisions() int {
+	if ad.config.SupervisorMaxRevisions > 0 {
+		return ad.config.SupervisorMaxRevisions
+	}
+	return defaultSupervisorMaxRevisions
+}
+
+func (ad *AgentDouble) supervisorFailSeverity() review.Severity {
+	if ad.config.SupervisorFailSeverity != "" {
+		return ad.config.SupervisorFailSeverity
+	}
+	return defaultSupervisorFailSeverity
+}
+
+// reviewResponse judges response against the latest user message and the tool
+// outputs gathered since, and returns the verdicts that block it.
+func (ad *AgentDouble) reviewResponse(ctx context.Context, response string, revision int) ([]*review.Verdict, error) {
+	rubrics, err := ad.supervisorRubrics()
+	if err != nil {
+		return nil, err
+	}
+
+	req := &review.Request{Response: response, Rubrics: rubrics}
+	contexts := ad.MemorySnapshot().Contexts
+	for i := len(contexts) - 1; i >= 0; i-- {
+		if contexts[i].Role == "user" && contexts[i].Source != MemorySourceReview {
+			req.Prompt = contexts[i].Content
+			for _, memCtx := range contexts[i+1:] {
+				if memCtx.Role == "tool" {
+					req.Context = append(req.Context, memCtx.Content)
+				}
+			}
+			break
+		}
+	}
+
+	verdicts, err := ad.supervisor().Review(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("review response: %w", err)
+	}
+	if callback := reviewCallbackFromContext(ctx); callback != nil {
+		if err := callback(revision, verdicts); err != nil {
+			return nil, err
+		}
+	}
+	return review.Blocking(verdicts, ad.supervisorFailSeverity()), nil
+}
+
+// critiqueMemory asks the model to revise a rejected response.
+func critiqueMemory(blocking []*review.Verdict) string {
+	var b strings.Builder
+	b.WriteString("A reviewer rejected your previous response:\n")
+	b.WriteString(review.Critique(blocking))
+	b.WriteString("\nRevise the response to address every point and output it again in full.")
+	return b.String()
+}
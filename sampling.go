@@ -0,0 +1,103 @@
+package ai_agent
+
+import (
+	"context"
+
+	"github.com/luoxiaojun1992/ai-agent/pkg/ollama"
+)
+
+const defaultModelTemperature float32 = 0.1
+
+// SamplingOptions tune how chat models generate answers. Zero values and nil
+// pointers keep the server default.
+type SamplingOptions struct {
+	// Temperature overrides Config.ModelTemperature and, unlike it, may be zero.
+	Temperature *float32
+	TopP        *float32
+	TopK        int
+	Seed        *int
+	NumCtx      int
+	// NumPredict caps the answer length and is sent as max_tokens to OpenAI
+	// compatible servers; -1 means unlimited.
+	NumPredict       int
+	Stop             []string
+	RepeatPenalty    float32
+	PresencePenalty  float32
+	FrequencyPenalty float32
+	// KeepAlive is how long Ollama keeps the model loaded, e.g. "5m".
+	KeepAlive string
+}
+
+// merge returns o with every option set in override replaced.
+func (o SamplingOptions) merge(override SamplingOptions) SamplingOptions {
+	if override.Temperature != nil {
+		o.Temperature = override.Temperature
+	}
+	if override.TopP != nil {
+		o.TopP = override.TopP
+	}
+	if override.TopK != 0 {
+		o.TopK = override.TopK
+	}
+	if override.Seed != nil {
+		o.Seed = override.Seed
+	}
+	if override.NumCtx != 0 {
+		o.NumCtx = override.NumCtx
+	}
+	if override.NumPredict != 0 {
+		o.NumPredict = override.NumPredict
+	}
+	if override.Stop != nil {
+		o.Stop = override.Stop
+	}
+	if override.RepeatPenalty != 0 {
+		o.RepeatPenalty = override.RepeatPenalty
+	}
+	if override.PresencePenalty != 0 {
+		o.PresencePenalty = override.PresencePenalty
+	}
+	if override.FrequencyPenalty != 0 {
+		o.FrequencyPenalty = override.FrequencyPenalty
+	}
+	if override.KeepAlive != "" {
+		o.KeepAlive = override.KeepAlive
+	}
+	return o
+}
+
+type samplingOptionsCtxKey struct{}
+
+// WithSamplingOptions overrides the configured sampling options of the chat
+// model for the calls made with ctx. Options left unset in opts keep their
+// configured values.
+func WithSamplingOptions(ctx context.Context, opts SamplingOptions) context.Context {
+	return context.WithValue(ctx, samplingOptionsCtxKey{}, opts)
+}
+
+func samplingOptionsFromContext(ctx context.Context) SamplingOptions {
+	opts, _ := ctx.Value(samplingOptionsCtxKey{}).(SamplingOptions)
+	return opts
+}
+
+func (a *Agent) chatRequestOptions(sampling SamplingOptions) *ollama.ChatRequestOptions {
+	temperature := defaultModelTemperature
+	if a.config.ModelTemperature > 0.0 {
+		temperature = a.config.ModelTemperature
+	}
+	if sampling.Temperature != nil {
+		temperature = *sampling.Temperature
+	}
+	return &ollama.ChatRequestOptions{
+		Temperature:      temperature,
+		TopP:             sampling.TopP,
+		TopK:             sampling.TopK,
+		Seed:             sampling.Seed,
+		NumCtx:           sampling.NumCtx,
+		NumPredict:       sampling.NumPredict,
+		Stop:             sampling.Stop,
+		RepeatPenalty:    sampling.RepeatPenalty,
+		PresencePenalty:  sampling.PresencePenalty,
+		FrequencyPenalty: sampling.FrequencyPenalty,
+	}
+}
@@ -23,6 +23,10 @@ func (r *Remover) ShortDescription() string {
 	return "Remove file or directory from disk"
 }
 
+func (r *Remover) Destructive() bool {
+	return true
+}
+
 func (r *Remover) Do(_ context.Context, cmdCtx any, _ func(output any) (any, error)) error {
 	params, isValidParams := cmdCtx.(map[string]any)
 	if !isValidParams {
@@ -23,6 +23,11 @@ func (w *Writer) ShortDescription() string {
 	return "Write content to file on disk"
 }
 
+// Destructive reports true as writing overwrites existing files.
+func (w *Writer) Destructive() bool {
+	return true
+}
+
 func (w *Writer) Do(_ context.Context, cmdCtx any, _ func(output any) (any, error)) error {
 	params, isValidParams := cmdCtx.(map[string]any)
 	if !isValidParams {
@@ -8,6 +8,7 @@ import (
 	"slices"
 
 	httpPKG "github.com/luoxiaojun1992/ai-agent/pkg/http"
+	"github.com/luoxiaojun1992/ai-agent/skill"
 )
 
 type Http struct {
@@ -31,6 +32,10 @@ func (h *Http) ShortDescription() string {
 	return "Make HTTP requests to external APIs"
 }
 
+func (h *Http) TrustLevel() skill.TrustLevel {
+	return skill.TrustLevelUntrusted
+}
+
 func (h *Http) Do(ctx context.Context, cmdCtx any, callback func(output any) (any, error)) error {
 	params, isValidParams := cmdCtx.(map[string]any)
 	if !isValidParams {
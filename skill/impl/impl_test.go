@@ -37,6 +37,10 @@ func (m *mockHTTPClient) Patch(path string, body any, queryParams url.Values, he
 func (m *mockHTTPClient) Delete(path string, body any, queryParams url.Values, headers http.Header) (*httpPKG.Response, error) {
 	return m.SendRequest("DELETE", path, body, queryParams, headers)
 }
+func (m *mockHTTPClient) SendRequestWithContext(ctx context.Context, method, path string, body any, queryParams url.Values, headers http.Header) (*httpPKG.Response, error) {
+	_ = ctx
+	return m.SendRequest(method, path, body, queryParams, headers)
+}
 func (m *mockHTTPClient) SendRequest(method, path string, body any, queryParams url.Values, headers http.Header) (*httpPKG.Response, error) {
 	_, _, _ = body, queryParams, headers
 	m.method = method
@@ -360,6 +364,31 @@ func (m *mockTeamOllamaClient) Talk(chatReq *ollama.ChatRequest, callback func(r
 	return nil
 }
 
+func (m *mockTeamOllamaClient) TalkWithThinking(_ context.Context, chatReq *ollama.ChatRequest, callback func(delta *ollama.ChatDelta) error) error {
+	return m.Talk(chatReq, func(response string) error {
+		return callback(&ollama.ChatDelta{Content: response})
+	})
+}
+
+func (m *mockTeamOllamaClient) ShowModel(showReq *ollama.ShowRequest) (*ollama.ShowResponse, error) {
+	_ = showReq
+	return &ollama.ShowResponse{}, nil
+}
+
+func (m *mockTeamOllamaClient) ListModels() (*ollama.ListModelsResponse, error) {
+	return &ollama.ListModelsResponse{}, nil
+}
+
+func (m *mockTeamOllamaClient) PullModel(_ context.Context, pullReq *ollama.PullRequest, callback func(progress *ollama.PullProgress) error) error {
+	_, _ = pullReq, callback
+	return nil
+}
+
+func (m *mockTeamOllamaClient) DeleteModel(_ context.Context, deleteReq *ollama.DeleteRequest) error {
+	_ = deleteReq
+	return nil
+}
+
 type mockTeamMilvusClient struct{}
 
 func (m *mockTeamMilvusClient) InsertVector(ctx context.Context, collectionName, content string, vector []float32) error {
@@ -372,6 +401,21 @@ func (m *mockTeamMilvusClient) SearchVector(ctx context.Context, collectionName
 	return nil, nil
 }
 
+func (m *mockTeamMilvusClient) InsertVectorWithMetadata(ctx context.Context, collectionName, content string, vector []float32, metadata map[string]string) error {
+	_, _, _, _, _ = ctx, collectionName, content, vector, metadata
+	return nil
+}
+
+func (m *mockTeamMilvusClient) SearchVectorWithScores(ctx context.Context, collectionName string, vector []float32, topK int) ([]*milvus.SearchResult, error) {
+	_, _, _, _ = ctx, collectionName, vector, topK
+	return nil, nil
+}
+
+func (m *mockTeamMilvusClient) ListContents(ctx context.Context, collectionName string, limit int) ([]string, error) {
+	_, _, _ = ctx, collectionName, limit
+	return nil, nil
+}
+
 func (m *mockTeamMilvusClient) Close() error { return nil }
 
 func TestTeam_Do_Success(t *testing.T) {
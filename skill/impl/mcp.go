@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/luoxiaojun1992/ai-agent/pkg/mcp"
+	"github.com/luoxiaojun1992/ai-agent/skill"
 )
 
 type MCP struct {
@@ -36,6 +37,12 @@ func (m *MCP) ShortDescription() string {
 	return "Call MCP tools and services"
 }
 
+// TrustLevel reports untrusted as MCP tools return third party content such
+// as search results.
+func (m *MCP) TrustLevel() skill.TrustLevel {
+	return skill.TrustLevelUntrusted
+}
+
 func (m *MCP) Do(ctx context.Context, cmdCtx any, callback func(output any) (any, error)) error {
 	params, isValidParams := cmdCtx.(map[string]any)
 	if !isValidParams {
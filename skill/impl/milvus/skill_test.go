@@ -5,6 +5,8 @@ import (
 	"errors"
 	"strings"
 	"testing"
+
+	milvusPKG "github.com/luoxiaojun1992/ai-agent/pkg/milvus"
 )
 
 type mockMilvusClient struct {
@@ -43,6 +45,29 @@ func (m *mockMilvusClient) SearchVector(ctx context.Context, collectionName stri
 	return m.searchResult, nil
 }
 
+func (m *mockMilvusClient) InsertVectorWithMetadata(ctx context.Context, collectionName, content string, vector []float32, metadata map[string]string) error {
+	_ = metadata
+	return m.InsertVector(ctx, collectionName, content, vector)
+}
+
+func (m *mockMilvusClient) ListContents(ctx context.Context, collectionName string, limit int) ([]string, error) {
+	_, _, _ = ctx, collectionName, limit
+	return nil, nil
+}
+
+func (m *mockMilvusClient) SearchVectorWithScores(ctx context.Context, collectionName string, vector []float32, topK int) ([]*milvusPKG.SearchResult, error) {
+	_ = topK
+	contents, err := m.SearchVector(ctx, collectionName, vector)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*milvusPKG.SearchResult, 0, len(contents))
+	for _, content := range contents {
+		results = append(results, &milvusPKG.SearchResult{Content: content})
+	}
+	return results, nil
+}
+
 func (m *mockMilvusClient) Close() error { return nil }
 
 func TestInsert_Do_SuccessWithInterfaceVector(t *testing.T) {
@@ -29,6 +29,30 @@ func (m *mockOllamaClient) Talk(chatReq *ollamaPKG.ChatRequest, callback func(re
 	return nil
 }
 
+func (m *mockOllamaClient) TalkWithThinking(_ context.Context, chatReq *ollamaPKG.ChatRequest, callback func(delta *ollamaPKG.ChatDelta) error) error {
+	_, _ = chatReq, callback
+	return nil
+}
+
+func (m *mockOllamaClient) ShowModel(showReq *ollamaPKG.ShowRequest) (*ollamaPKG.ShowResponse, error) {
+	_ = showReq
+	return &ollamaPKG.ShowResponse{}, nil
+}
+
+func (m *mockOllamaClient) ListModels() (*ollamaPKG.ListModelsResponse, error) {
+	return &ollamaPKG.ListModelsResponse{}, nil
+}
+
+func (m *mockOllamaClient) PullModel(_ context.Context, pullReq *ollamaPKG.PullRequest, callback func(progress *ollamaPKG.PullProgress) error) error {
+	_, _ = pullReq, callback
+	return nil
+}
+
+func (m *mockOllamaClient) DeleteModel(_ context.Context, deleteReq *ollamaPKG.DeleteRequest) error {
+	_ = deleteReq
+	return nil
+}
+
 func TestEmbedding_Do_Success(t *testing.T) {
 	cli := &mockOllamaClient{resp: &ollamaPKG.EmbedResponse{Embeddings: [][]float32{{0.1}}}}
 	s := &Embedding{OllamaCli: cli}
@@ -6,3 +6,39 @@ type Skill interface {
 	GetDescription() (string, error)
 	Do(ctx context.Context, cmdCtx any, callback func(output any) (any, error)) error
 }
+
+// TrustLevel tells how far the output of a skill can be trusted.
+type TrustLevel string
+
+const (
+	TrustLevelTrusted TrustLevel = "trusted"
+	// TrustLevelUntrusted output comes from outside the deployment, e.g. web
+	// pages or third party APIs, and may carry injected instructions.
+	TrustLevelUntrusted TrustLevel = "untrusted"
+)
+
+// TrustReporter is implemented by skills that declare the trust level of
+// their output. Skills that don't are trusted.
+type TrustReporter interface {
+	TrustLevel() TrustLevel
+}
+
+// DestructiveReporter is implemented by skills that may change or delete
+// data.
+type DestructiveReporter interface {
+	Destructive() bool
+}
+
+// TrustLevelOf returns the trust level of the output of s.
+func TrustLevelOf(s Skill) TrustLevel {
+	if reporter, ok := s.(TrustReporter); ok {
+		return reporter.TrustLevel()
+	}
+	return TrustLevelTrusted
+}
+
+// IsDestructive reports whether s may change or delete data.
+func IsDestructive(s Skill) bool {
+	reporter, ok := s.(DestructiveReporter)
+	return ok && reporter.Destructive()
+}
@@ -0,0 +1,142 @@
+package ai_agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/luoxiaojun1992/ai-agent/util/prompt"
+	"github.com/luoxiaojun1992/ai-agent/util/schema"
+)
+
+// StructuredOutputError reports an answer that still failed schema validation
+// after all retries.
+type StructuredOutputError struct {
+	Attempts int
+	Answer   string
+	Err      error
+}
+
+func (e *StructuredOutputError) Error() string {
+	return fmt.Sprintf("structured output invalid after %d attempts: %v", e.Attempts, e.Err)
+}
+
+func (e *StructuredOutputError) Unwrap() error {
+	return e.Err
+}
+
+type responseFormatCtxKey struct{}
+
+// WithResponseFormat constrains the answers of the model to format, the string
+// "json" or a JSON Schema. Servers enforce it through Ollama's `format` or the
+// OpenAI `response_format` parameter, so the model cannot emit `<tool>` blocks
+// while it is set.
+func WithResponseFormat(ctx context.Context, format json.RawMessage) context.Context {
+	return context.WithValue(ctx, responseFormatCtxKey{}, format)
+}
+
+func responseFormatFromContext(ctx context.Context) json.RawMessage {
+	format, _ := ctx.Value(responseFormatCtxKey{}).(json.RawMessage)
+	return format
+}
+
+// ListenAndWatchInto is ListenAndWatchWithSchema with the schema derived from
+// out, a pointer to a struct, into which the validated answer is decoded.
+func (ad *AgentDouble) ListenAndWatchInto(ctx context.Context, message string, images []string, out any, callback func(response string) error) error {
+	rawSchema, err := schema.FromValue(out)
+	if err != nil {
+		return err
+	}
+	answer, err := ad.ListenAndWatchWithSchema(ctx, message, images, rawSchema, callback)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(answer, out)
+}
+
+// ListenAndWatchWithSchema answers message like ListenAndWatch with the answer
+// constrained to the JSON Schema rawSchema. An answer that fails validation is
+// reported back to the model, which gets Config.StructuredOutputRetries more
+// attempts. It returns the validated JSON answer. The schema instructions,
+// the corrections and the rejected answers only live for the call.
+func (ad *AgentDouble) ListenAndWatchWithSchema(ctx context.Context, message string, images []string, rawSchema json.RawMessage, callback func(response string) error) (json.RawMessage, error) {
+	s, err := schema.Parse(rawSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	endTurn, err := ad.beginTurn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer endTurn()
+
+	// Later turns must not be held to the schema
+	var scoped []string
+	defer func() {
+		ad.forgetMemories(scoped...)
+	}()
+	addScoped := func(role, content string) {
+		memCtx := ad.newMemoryCtx(role, content, nil, MemoryAttributes{Source: MemorySourceAPI})
+		ad.appendMemory(memCtx)
+		scoped = append(scoped, memCtx.ID)
+	}
+
+	ctx = WithResponseFormat(ctx, rawSchema)
+	addScoped("system", "Respond with a single JSON value that matches this JSON Schema:\n"+string(rawSchema))
+	if err := ad.listenAndWatch(ctx, message, images, callback); err != nil {
+		return nil, err
+	}
+
+	retries := ad.structuredOutputRetries()
+	for attempt := 1; ; attempt++ {
+		answerID, answer, err := ad.lastStructuredAnswer()
+		if err == nil {
+			err = s.Validate([]byte(answer))
+			if err == nil {
+				return json.RawMessage(answer), nil
+			}
+		}
+		if attempt > retries {
+			return nil, &StructuredOutputError{Attempts: attempt, Answer: answer, Err: err}
+		}
+
+		if answerID != "" {
+			scoped = append(scoped, answerID)
+		}
+		addScoped("user", fmt.Sprintf("Your answer is not valid against the required JSON Schema: %v. Reply again with only the corrected JSON value.", err))
+		if err := ad.talkToOllamaWithMemory(ctx, callback); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (ad *AgentDouble) structuredOutputRetries() int {
+	if ad.config.StructuredOutputRetries > 0 {
+		return ad.config.StructuredOutputRetries
+	}
+	return defaultStructuredOutputRetries
+}
+
+// lastStructuredAnswer returns the memory ID and the latest model answer
+// without reasoning and code fences, repaired when it is not valid JSON as is.
+func (ad *AgentDouble) lastStructuredAnswer() (string, string, error) {
+	ad.memoryMu.Lock()
+	defer ad.memoryMu.Unlock()
+
+	for i := len(ad.memory.Contexts) - 1; i >= 0; i-- {
+		memCtx := ad.memory.Contexts[i]
+		if memCtx.Role != "assistant" || memCtx.Source != MemorySourceModel {
+			continue
+		}
+		content, _ := prompt.SplitThinking(memCtx.Content)
+		answer := strings.TrimSpace(content)
+		if !json.Valid([]byte(answer)) {
+			answer = prompt.RepairJSON(answer)
+		}
+		return memCtx.ID, answer, nil
+	}
+	return "", "", errors.New("the model gave no answer")
+}
@@ -0,0 +1,16 @@
+package ai_agent
+
+import "context"
+
+type thinkingCallbackCtxKey struct{}
+
+// WithThinkingCallback attaches a callback that receives the reasoning of
+// thinking models separately from the answer streamed to ListenAndWatch.
+func WithThinkingCallback(ctx context.Context, callback func(thinking string) error) context.Context {
+	return context.WithValue(ctx, thinkingCallbackCtxKey{}, callback)
+}
+
+func thinkingCallbackFromContext(ctx context.Context) func(thinking string) error {
+	callback, _ := ctx.Value(thinkingCallbackCtxKey{}).(func(thinking string) error)
+	return callback
+}
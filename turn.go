@@ -0,0 +1,266 @@
+package ai_agent
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+type turnQueueCallbackCtxKey struct{}
+
+// WithTurnQueueCallback attaches a callback that receives the number of turns
+// ahead of a call while it waits for its turn, each time the number changes.
+// It is not called when the call starts right away.
+func WithTurnQueueCallback(ctx context.Context, callback func(position int) error) context.Context {
+	return context.WithValue(ctx, turnQueueCallbackCtxKey{}, callback)
+}
+
+func turnQueueCallbackFromContext(ctx context.Context) func(position int) error {
+	callback, _ := ctx.Value(turnQueueCallbackCtxKey{}).(func(position int) error)
+	return callback
+}
+
+type turnTicket struct {
+	ready chan struct{}
+	moved chan struct{}
+}
+
+// turnQueue admits one conversation turn at a time, in arrival order, so
+// concurrent calls never interleave their messages in memory.
+type turnQueue struct {
+	mu      sync.Mutex
+	tickets []*turnTicket
+}
+
+func (q *turnQueue) position(ticket *turnTicket) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return slices.Index(q.tickets, ticket)
+}
+
+// enter waits until the call is at the head of the queue and returns the func
+// that hands the turn on. It gives up when ctx is done or onPosition fails.
+func (q *turnQueue) enter(ctx context.Context, onPosition func(position int) error) (func(), error) {
+	ticket := &turnTicket{ready: make(chan struct{}), moved: make(chan struct{}, 1)}
+	q.mu.Lock()
+	q.tickets = append(q.tickets, ticket)
+	if len(q.tickets) == 1 {
+		close(ticket.ready)
+	}
+	q.mu.Unlock()
+
+	reported := 0
+	for {
+		select {
+		case <-ticket.ready:
+			var once sync.Once
+			return func() {
+				once.Do(func() {
+					q.leave(ticket)
+				})
+			}, nil
+		default:
+		}
+
+		if position := q.position(ticket); onPosition != nil && position > 0 && position != reported {
+			reported = position
+			if err := onPosition(position); err != nil {
+				q.leave(ticket)
+				return nil, err
+			}
+		}
+
+		select {
+		case <-ticket.ready:
+		case <-ticket.moved:
+		case <-ctx.Done():
+			q.leave(ticket)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// leave removes ticket from the queue, handing the turn to the next call when
+// ticket held it, and tells the waiting calls they moved up.
+func (q *turnQueue) leave(ticket *turnTicket) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	idx := slices.Index(q.tickets, ticket)
+	if idx < 0 {
+		return
+	}
+	q.tickets = slices.Delete(q.tickets, idx, idx+1)
+	if idx == 0 && len(q.tickets) > 0 {
+		close(q.tickets[0].ready)
+	}
+	for _, waiting := range q.tickets[idx:] {
+		select {
+		case waiting.moved <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// waiting returns the number of calls holding or waiting for a turn.
+func (q *turnQueue) waiting() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.tickets)
+}
+
+// memoryTurns queues the turns of all sessions in one turn queue, since
+// sessions share the memory of the agent. Exclusive calls, like config
+// updates, wait for the running and queued turns and hold back new ones.
+type memoryTurns struct {
+	queue turnQueue
+
+	mu sync.Mutex
+	// turns counts the calls holding or waiting for a turn.
+	turns     int
+	exclusive bool
+	// changed is closed when turns or exclusive change.
+	changed chan struct{}
+}
+
+// changedLocked returns the channel closed on the next change.
+func (q *memoryTurns) changedLocked() <-chan struct{} {
+	if q.changed == nil {
+		q.changed = make(chan struct{})
+	}
+	return q.changed
+}
+
+func (q *memoryTurns) notifyLocked() {
+	if q.changed != nil {
+		close(q.changed)
+		q.changed = nil
+	}
+}
+
+// waitLocked waits, with q.mu held, until cond is false or ctx is done.
+func (q *memoryTurns) waitLocked(ctx context.Context, cond func() bool) error {
+	for cond() {
+		changed := q.changedLocked()
+		q.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			q.mu.Lock()
+			return ctx.Err()
+		}
+		q.mu.Lock()
+	}
+	return nil
+}
+
+// enter waits until the call is at the head of the queue and returns the func
+// that hands the turn on. It gives up when ctx is done or onPosition fails.
+func (q *memoryTurns) enter(ctx context.Context, onPosition func(position int) error) (func(), error) {
+	q.mu.Lock()
+	if err := q.waitLocked(ctx, func() bool { return q.exclusive }); err != nil {
+		q.mu.Unlock()
+		return nil, err
+	}
+	q.turns++
+	q.mu.Unlock()
+
+	leave := func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.turns--
+		q.notifyLocked()
+	}
+	endTurn, err := q.queue.enter(ctx, onPosition)
+	if err != nil {
+		leave()
+		return nil, err
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			endTurn()
+			leave()
+		})
+	}, nil
+}
+
+// enterExclusive waits until no turn runs or waits and returns the func that
+// lets turns start again.
+func (q *memoryTurns) enterExclusive(ctx context.Context) (func(), error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.waitLocked(ctx, func() bool { return q.exclusive }); err != nil {
+		return nil, err
+	}
+	q.exclusive = true
+	if err := q.waitLocked(ctx, func() bool { return q.turns > 0 }); err != nil {
+		q.exclusive = false
+		q.notifyLocked()
+		return nil, err
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			q.exclusive = false
+			q.notifyLocked()
+		})
+	}, nil
+}
+
+// waiting returns the number of calls holding or waiting for a turn.
+func (q *memoryTurns) waiting() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.turns
+}
+
+// beginTurn waits for the turn of a call that reads and writes memory. The
+// turns of all sessions share one queue, as they share memory.
+func (ad *AgentDouble) beginTurn(ctx context.Context) (func(), error) {
+	return ad.turns.enter(ctx, turnQueueCallbackFromContext(ctx))
+}
+
+// QueuedTurns returns the number of calls holding or waiting for a turn.
+func (ad *AgentDouble) QueuedTurns() int {
+	return ad.turns.waiting()
+}
+
+// BetweenTurns runs fn after the running and queued turns finished, holding
+// back new ones until it returns, e.g. to reset memory.
+func (ad *AgentDouble) BetweenTurns(ctx context.Context, fn func()) error {
+	endTurn, err := ad.turns.enterExclusive(ctx)
+	if err != nil {
+		return err
+	}
+	defer endTurn()
+	fn()
+	return nil
+}
+
+// UpdateConfig applies update to the configuration between turns: it waits
+// for the running and queued turns and the long-term memory extractions they
+// scheduled to finish, so no turn sees a half-updated configuration.
+func (ad *AgentDouble) UpdateConfig(ctx context.Context, update func(config *Config)) error {
+	endTurn, err := ad.turns.enterExclusive(ctx)
+	if err != nil {
+		return err
+	}
+	defer endTurn()
+	ad.WaitMemoryWriter()
+
+	ad.configMu.Lock()
+	defer ad.configMu.Unlock()
+	update(ad.config)
+	return nil
+}
+
+// ConfigSnapshot returns a copy of the configuration, safe to read while
+// turns run.
+func (ad *AgentDouble) ConfigSnapshot() Config {
+	ad.configMu.RLock()
+	defer ad.configMu.RUnlock()
+	return *ad.config
+}
@@ -24,6 +24,11 @@ app.use(morgan('combined'));
 // AI Agent Service configuration
 const AI_AGENT_SVC_URL = process.env.AI_AGENT_SVC_URL || 'http://localhost:8080';
 
+// Credentials for ai-agent-svc when it requires authentication
+if (process.env.AI_AGENT_SVC_API_KEY) {
+  axios.defaults.headers.common.Authorization = `Bearer ${process.env.AI_AGENT_SVC_API_KEY}`;
+}
+
 // Health check endpoint
 app.get('/health', (req, res) => {
   res.json({ status: 'OK', timestamp: new Date().toISOString() });
@@ -82,6 +87,13 @@ app.post('/api/agent/chat', async (req, res) => {
         response.data.on('end', () => {
           res.end();
         });
+
+        // Stop the upstream turn when the client goes away
+        res.on('close', () => {
+          if (!res.writableEnded) {
+            response.data.destroy();
+          }
+        });
         
         response.data.on('error', (error) => {
           console.error('Streaming error:', error.message);
@@ -117,6 +129,64 @@ app.post('/api/agent/chat', async (req, res) => {
   }
 });
 
+// Replay and follow the events of a streamed chat turn
+app.get('/api/agent/chat/:id/events', async (req, res) => {
+  const headers = { 'Accept': 'text/event-stream' };
+  const lastEventId = req.get('Last-Event-ID') || req.query.lastEventId;
+  if (typeof lastEventId === 'string' && lastEventId) {
+    headers['Last-Event-ID'] = lastEventId;
+  }
+
+  try {
+    const response = await axios.get(`${AI_AGENT_SVC_URL}/chat/${encodeURIComponent(req.params.id)}/events`, {
+      responseType: 'stream',
+      headers
+    });
+
+    res.header('Content-Type', 'text/event-stream');
+    res.header('Cache-Control', 'no-cache');
+    res.header('Connection', 'keep-alive');
+    res.header('X-Accel-Buffering', 'no');
+    response.data.on('data', (chunk) => {
+      res.write(chunk);
+    });
+    response.data.on('end', () => {
+      res.end();
+    });
+    response.data.on('error', (error) => {
+      console.error('Streaming error:', error.message);
+      res.end();
+    });
+    res.on('close', () => {
+      if (!res.writableEnded) {
+        response.data.destroy();
+      }
+    });
+  } catch (error) {
+    console.error('Error resuming chat stream:', error.message);
+    if (error.response && error.response.status === 404) {
+      res.status(404).json({ error: 'Turn not found' });
+      return;
+    }
+    res.status(500).json({ error: 'Failed to resume chat stream' });
+  }
+});
+
+// Cancel a running chat turn
+app.post('/api/agent/chat/:id/cancel', async (req, res) => {
+  try {
+    const response = await axios.post(`${AI_AGENT_SVC_URL}/chat/${encodeURIComponent(req.params.id)}/cancel`);
+    res.status(response.status).json(response.data);
+  } catch (error) {
+    console.error('Error cancelling chat turn:', error.message);
+    if (error.response && error.response.status === 404) {
+      res.status(404).json({ error: 'Turn not found' });
+      return;
+    }
+    res.status(500).json({ error: 'Failed to cancel chat turn' });
+  }
+});
+
 // Execute skill
 app.post('/api/agent/skill', async (req, res) => {
   try {
@@ -137,6 +137,52 @@ describe('UI Backend API tests (按测试场景组织)', () => {
     });
   });
 
+  describe('场景二补充：取消聊天回合', () => {
+    test('POST /api/agent/chat/:id/cancel 转发取消请求', async () => {
+      axios.post.mockResolvedValueOnce({
+        status: 202,
+        data: { turnId: 'turn-1', status: 'cancelling' }
+      });
+
+      const response = await request(app).post('/api/agent/chat/turn-1/cancel');
+
+      expect(response.status).toBe(202);
+      expect(response.body).toEqual({ turnId: 'turn-1', status: 'cancelling' });
+      expect(axios.post).toHaveBeenCalledWith('http://localhost:8080/chat/turn-1/cancel');
+    });
+
+    test('GET /api/agent/chat/:id/events 携带 Last-Event-ID 续传流', async () => {
+      const stream = new PassThrough();
+      axios.get.mockResolvedValueOnce({ data: stream });
+
+      const responsePromise = request(app)
+        .get('/api/agent/chat/turn-1/events')
+        .set('Last-Event-ID', '3');
+
+      await new Promise((resolve) => setImmediate(resolve));
+      stream.end('id:4\nevent:complete\ndata:{"done":true}\n\n');
+
+      const response = await responsePromise;
+
+      expect(response.status).toBe(200);
+      expect(response.headers['content-type']).toContain('text/event-stream');
+      expect(response.text).toContain('event:complete');
+      expect(axios.get).toHaveBeenCalledWith('http://localhost:8080/chat/turn-1/events', {
+        responseType: 'stream',
+        headers: { Accept: 'text/event-stream', 'Last-Event-ID': '3' }
+      });
+    });
+
+    test('POST /api/agent/chat/:id/cancel 回合不存在时返回 404', async () => {
+      axios.post.mockRejectedValueOnce({ message: 'not found', response: { status: 404 } });
+
+      const response = await request(app).post('/api/agent/chat/missing/cancel');
+
+      expect(response.status).toBe(404);
+      expect(response.body).toEqual({ error: 'Turn not found' });
+    });
+  });
+
   describe('场景三：技能调用与配置管理', () => {
     test('POST /api/agent/skill 成功执行技能', async () => {
       axios.post.mockResolvedValueOnce({
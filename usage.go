@@ -0,0 +1,21 @@
+package ai_agent
+
+import (
+	"context"
+
+	"github.com/luoxiaojun1992/ai-agent/pkg/ollama"
+)
+
+type usageCallbackCtxKey struct{}
+
+// WithUsageCallback attaches a callback that receives the token usage of each
+// model request made for a call, including supervisor reviews and guardrail
+// classifiers, when the server reports it.
+func WithUsageCallback(ctx context.Context, callback func(model string, usage ollama.Usage)) context.Context {
+	return context.WithValue(ctx, usageCallbackCtxKey{}, callback)
+}
+
+func usageCallbackFromContext(ctx context.Context) func(model string, usage ollama.Usage) {
+	callback, _ := ctx.Value(usageCallbackCtxKey{}).(func(model string, usage ollama.Usage))
+	return callback
+}
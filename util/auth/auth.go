@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+var (
+	ErrNoCredentials      = errors.New("no credentials")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrUnknownPrincipal   = errors.New("unknown principal")
+)
+
+// ScopeAll grants every scope.
+const ScopeAll = "*"
+
+// Principal IDs are prefixed by the kind of credential, so an API key id and
+// a JWT subject never name the same principal.
+const (
+	PrincipalPrefixAPIKey = "key:"
+	PrincipalPrefixJWT    = "jwt:"
+)
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	ID     string   `json:"id"`
+	Method string   `json:"method"`
+	Scopes []string `json:"scopes"`
+	// ExpiresAt is the Unix time the credentials expire at, 0 if they
+	// don't.
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+}
+
+// HasScope reports whether the principal was granted scope.
+func (p *Principal) HasScope(scope string) bool {
+	return p != nil && (slices.Contains(p.Scopes, ScopeAll) || slices.Contains(p.Scopes, scope))
+}
+
+// Authenticator resolves the credentials presented with a request to a
+// principal.
+type Authenticator interface {
+	Authenticate(token string) (*Principal, error)
+}
+
+// Resolver is implemented by authenticators that can look up a principal by
+// id, so principals stored with background work can be checked again before
+// the work runs.
+type Resolver interface {
+	// Resolve returns the principal id as currently configured, or
+	// ErrUnknownPrincipal if the authenticator no longer accepts it.
+	Resolve(id string) (*Principal, error)
+}
+
+// TokenFromRequest returns the bearer token of the Authorization header, or
+// the X-API-Key header.
+func TokenFromRequest(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, token, ok := strings.Cut(header, " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+	return strings.TrimSpace(r.Header.Get("X-API-Key"))
+}
+
+// Chain tries each authenticator in turn.
+type Chain []Authenticator
+
+func (c Chain) Authenticate(token string) (*Principal, error) {
+	if token == "" {
+		return nil, ErrNoCredentials
+	}
+	for _, authenticator := range c {
+		if principal, err := authenticator.Authenticate(token); err == nil {
+			return principal, nil
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// Resolve asks each authenticator that is a Resolver in turn.
+func (c Chain) Resolve(id string) (*Principal, error) {
+	for _, authenticator := range c {
+		if resolver, ok := authenticator.(Resolver); ok {
+			if principal, err := resolver.Resolve(id); err == nil {
+				return principal, nil
+			}
+		}
+	}
+	return nil, ErrUnknownPrincipal
+}
+
+// APIKey is a static key and the principal it stands for.
+type APIKey struct {
+	ID     string
+	Key    string
+	Scopes []string
+}
+
+// ParseAPIKeys parses a comma separated list of `id:key[:scopes]` entries,
+// where scopes are separated by `|`. Entries without scopes get all scopes.
+func ParseAPIKeys(spec string) ([]APIKey, error) {
+	var keys []APIKey
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) < 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid api key entry, expected id:key[:scopes]")
+		}
+		key := APIKey{ID: strings.TrimSpace(parts[0]), Key: strings.TrimSpace(parts[1]), Scopes: []string{ScopeAll}}
+		if len(parts) == 3 && strings.TrimSpace(parts[2]) != "" {
+			key.Scopes = nil
+			for _, scope := range strings.Split(parts[2], "|") {
+				if scope = strings.TrimSpace(scope); scope != "" {
+					key.Scopes = append(key.Scopes, scope)
+				}
+			}
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+type apiKeyAuthenticator struct {
+	// keys are indexed by digest so lookups don't compare secrets directly.
+	keys map[[sha256.Size]byte]APIKey
+}
+
+// NewAPIKeyAuthenticator accepts the given static keys.
+func NewAPIKeyAuthenticator(keys []APIKey) Authenticator {
+	a := &apiKeyAuthenticator{keys: make(map[[sha256.Size]byte]APIKey, len(keys))}
+	for _, key := range keys {
+		a.keys[sha256.Sum256([]byte(key.Key))] = key
+	}
+	return a
+}
+
+func (a *apiKeyAuthenticator) Authenticate(token string) (*Principal, error) {
+	key, ok := a.keys[sha256.Sum256([]byte(token))]
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	return &Principal{ID: PrincipalPrefixAPIKey + key.ID, Method: "api_key", Scopes: append([]string(nil), key.Scopes...)}, nil
+}
+
+// Resolve returns the principal of the key named by id with its current
+// scopes.
+func (a *apiKeyAuthenticator) Resolve(id string) (*Principal, error) {
+	keyID, ok := strings.CutPrefix(id, PrincipalPrefixAPIKey)
+	if !ok {
+		return nil, ErrUnknownPrincipal
+	}
+	for _, key := range a.keys {
+		if key.ID == keyID {
+			return &Principal{ID: id, Method: "api_key", Scopes: append([]string(nil), key.Scopes...)}, nil
+		}
+	}
+	return nil, ErrUnknownPrincipal
+}
@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseAPIKeys(t *testing.T) {
+	keys, err := ParseAPIKeys("ui:key-one:chat|memory, admin:key-two")
+	if err != nil {
+		t.Fatalf("parse api keys: %v", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(keys))
+	}
+	if keys[0].ID != "ui" || keys[0].Key != "key-one" || len(keys[0].Scopes) != 2 || keys[0].Scopes[1] != "memory" {
+		t.Fatalf("unexpected first key: %+v", keys[0])
+	}
+	if len(keys[1].Scopes) != 1 || keys[1].Scopes[0] != ScopeAll {
+		t.Fatalf("key without scopes should get all scopes: %+v", keys[1])
+	}
+	if _, err := ParseAPIKeys("missing-key"); err == nil {
+		t.Fatalf("expected error for entry without key")
+	}
+}
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+	a := NewAPIKeyAuthenticator([]APIKey{{ID: "ui", Key: "key-one", Scopes: []string{"chat"}}})
+
+	principal, err := a.Authenticate("key-one")
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	if principal.ID != "key:ui" || principal.Method != "api_key" {
+		t.Fatalf("unexpected principal: %+v", principal)
+	}
+	if !principal.HasScope("chat") || principal.HasScope("config") {
+		t.Fatalf("unexpected scopes: %+v", principal.Scopes)
+	}
+	if _, err := a.Authenticate("key-two"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected invalid credentials, got %v", err)
+	}
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	secret := []byte("jwt-test-secret")
+	now := time.Unix(1_700_000_000, 0)
+	a, err := NewJWTAuthenticator(JWTConfig{Secret: secret, Issuer: "idp", Audience: "ai-agent", Now: func() time.Time { return now }})
+	if err != nil {
+		t.Fatalf("new jwt authenticator: %v", err)
+	}
+
+	sign := func(claims map[string]any, secret []byte) string {
+		token, err := SignJWT(claims, secret)
+		if err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+		return token
+	}
+	valid := map[string]any{"sub": "alice", "iss": "idp", "aud": []string{"ai-agent"}, "exp": now.Add(time.Minute).Unix(), "scope": "chat memory"}
+
+	principal, err := a.Authenticate(sign(valid, secret))
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	if principal.ID != "jwt:alice" || principal.Method != "jwt" || !principal.HasScope("memory") || principal.HasScope("skill") || principal.ExpiresAt != now.Add(time.Minute).Unix() {
+		t.Fatalf("unexpected principal: %+v", principal)
+	}
+
+	invalid := map[string]map[string]any{
+		"expired":     {"sub": "alice", "iss": "idp", "aud": "ai-agent", "exp": now.Add(-time.Minute).Unix()},
+		"not before":  {"sub": "alice", "iss": "idp", "aud": "ai-agent", "nbf": now.Add(time.Minute).Unix()},
+		"issuer":      {"sub": "alice", "iss": "other", "aud": "ai-agent", "exp": now.Add(time.Minute).Unix()},
+		"audience":    {"sub": "alice", "iss": "idp", "aud": "other", "exp": now.Add(time.Minute).Unix()},
+		"missing sub": {"iss": "idp", "aud": "ai-agent", "exp": now.Add(time.Minute).Unix()},
+		"missing exp": {"sub": "alice", "iss": "idp", "aud": "ai-agent"},
+	}
+	for name, claims := range invalid {
+		if _, err := a.Authenticate(sign(claims, secret)); !errors.Is(err, ErrInvalidCredentials) {
+			t.Fatalf("%s: expected invalid credentials, got %v", name, err)
+		}
+	}
+	if _, err := a.Authenticate(sign(valid, []byte("wrong-secret"))); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("wrong secret: expected invalid credentials, got %v", err)
+	}
+	lenient, err := NewJWTAuthenticator(JWTConfig{Secret: secret, AllowMissingExp: true, Now: func() time.Time { return now }})
+	if err != nil {
+		t.Fatalf("new jwt authenticator: %v", err)
+	}
+	if _, err := lenient.Authenticate(sign(invalid["missing exp"], secret)); err != nil {
+		t.Fatalf("missing exp allowed: %v", err)
+	}
+	// alg none must never be accepted.
+	if _, err := a.Authenticate("eyJhbGciOiJub25lIn0.eyJzdWIiOiJhbGljZSJ9."); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("alg none: expected invalid credentials, got %v", err)
+	}
+}
+
+func TestChainAndTokenFromRequest(t *testing.T) {
+	jwt, err := NewJWTAuthenticator(JWTConfig{Secret: []byte("jwt-test-secret")})
+	if err != nil {
+		t.Fatalf("new jwt authenticator: %v", err)
+	}
+	chain := Chain{NewAPIKeyAuthenticator([]APIKey{{ID: "ui", Key: "key-one", Scopes: []string{ScopeAll}}}), jwt}
+
+	if _, err := chain.Authenticate(""); !errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("expected no credentials, got %v", err)
+	}
+	if principal, err := chain.Authenticate("key-one"); err != nil || principal.ID != "key:ui" {
+		t.Fatalf("api key through chain: %+v, %v", principal, err)
+	}
+	// a JWT subject does not collide with an API key id
+	token, _ := SignJWT(map[string]any{"sub": "ui", "exp": time.Now().Add(time.Minute).Unix()}, []byte("jwt-test-secret"))
+	if principal, err := chain.Authenticate(token); err != nil || principal.ID != "jwt:ui" {
+		t.Fatalf("jwt through chain: %+v, %v", principal, err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer key-one")
+	if got := TokenFromRequest(req); got != "key-one" {
+		t.Fatalf("bearer token: %q", got)
+	}
+	req.Header.Del("Authorization")
+	req.Header.Set("X-API-Key", "key-two")
+	if got := TokenFromRequest(req); got != "key-two" {
+		t.Fatalf("x-api-key token: %q", got)
+	}
+	req.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	if got := TokenFromRequest(req); got != "" {
+		t.Fatalf("basic auth should not yield a token: %q", got)
+	}
+}
+
+func TestChainResolve(t *testing.T) {
+	jwt, err := NewJWTAuthenticator(JWTConfig{Secret: []byte("jwt-test-secret")})
+	if err != nil {
+		t.Fatalf("new jwt authenticator: %v", err)
+	}
+	chain := Chain{NewAPIKeyAuthenticator([]APIKey{{ID: "ui", Key: "key-one", Scopes: []string{"chat"}}}), jwt}
+
+	if principal, err := chain.Resolve("key:ui"); err != nil || principal.Method != "api_key" || !principal.HasScope("chat") {
+		t.Fatalf("resolve api key: %+v, %v", principal, err)
+	}
+	if principal, err := chain.Resolve("jwt:alice"); err != nil || principal.Method != "jwt" || len(principal.Scopes) != 0 {
+		t.Fatalf("resolve jwt subject: %+v, %v", principal, err)
+	}
+	for _, id := range []string{"key:revoked", "ui", "jwt:", "anonymous"} {
+		if _, err := chain.Resolve(id); !errors.Is(err, ErrUnknownPrincipal) {
+			t.Fatalf("%s: expected unknown principal, got %v", id, err)
+		}
+	}
+	if _, err := (Chain{NewAPIKeyAuthenticator(nil)}).Resolve("jwt:alice"); !errors.Is(err, ErrUnknownPrincipal) {
+		t.Fatalf("expected jwt subjects unknown without a jwt authenticator, got %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"slices"
+	"strings"
+	"time"
+)
+
+// JWTConfig configures the verification of HMAC-signed JWTs.
+type JWTConfig struct {
+	Secret []byte
+	// Issuer and Audience are checked when set.
+	Issuer   string
+	Audience string
+	// Leeway tolerates clock skew when checking exp and nbf.
+	Leeway time.Duration
+	// AllowMissingExp accepts tokens without an exp claim, which never
+	// expire; they are rejected by default.
+	AllowMissingExp bool
+	// Now defaults to time.Now.
+	Now func() time.Time
+}
+
+type jwtAuthenticator struct {
+	config JWTConfig
+}
+
+// NewJWTAuthenticator verifies HS256, HS384 and HS512 tokens locally. The
+// principal is the sub claim, prefixed with PrincipalPrefixJWT; scopes come from the space separated scope claim
+// or the scopes array claim.
+func NewJWTAuthenticator(config JWTConfig) (Authenticator, error) {
+	if len(config.Secret) == 0 {
+		return nil, fmt.Errorf("jwt secret is required")
+	}
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+	return &jwtAuthenticator{config: config}, nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+}
+
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+	Scope     string          `json:"scope"`
+	Scopes    []string        `json:"scopes"`
+}
+
+func hashForAlg(alg string) (func() hash.Hash, bool) {
+	switch alg {
+	case "HS256":
+		return sha256.New, true
+	case "HS384":
+		return sha512.New384, true
+	case "HS512":
+		return sha512.New, true
+	}
+	return nil, false
+}
+
+func (a *jwtAuthenticator) Authenticate(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidCredentials
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	newHash, ok := hashForAlg(header.Alg)
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	mac := hmac.New(newHash, a.config.Secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, ErrInvalidCredentials
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	if err := a.validate(&claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+
+	principal := &Principal{ID: PrincipalPrefixJWT + claims.Subject, Method: "jwt", Scopes: claims.Scopes}
+	if claims.ExpiresAt != nil {
+		principal.ExpiresAt = int64(*claims.ExpiresAt)
+	}
+	if claims.Scope != "" {
+		principal.Scopes = append(principal.Scopes, strings.Fields(claims.Scope)...)
+	}
+	return principal, nil
+}
+
+// Resolve returns the principal of a JWT subject. Subjects are not
+// registered anywhere and their scopes travel in the tokens, so any subject is
+// known and the principal carries no scopes.
+func (a *jwtAuthenticator) Resolve(id string) (*Principal, error) {
+	if subject, ok := strings.CutPrefix(id, PrincipalPrefixJWT); !ok || subject == "" {
+		return nil, ErrUnknownPrincipal
+	}
+	return &Principal{ID: id, Method: "jwt"}, nil
+}
+
+func (a *jwtAuthenticator) validate(claims *jwtClaims) error {
+	now := a.config.Now()
+	if claims.Subject == "" {
+		return fmt.Errorf("missing sub")
+	}
+	if claims.ExpiresAt == nil && !a.config.AllowMissingExp {
+		return fmt.Errorf("missing exp")
+	}
+	if claims.ExpiresAt != nil && !now.Before(unixTime(*claims.ExpiresAt).Add(a.config.Leeway)) {
+		return fmt.Errorf("token expired")
+	}
+	if claims.NotBefore != nil && now.Add(a.config.Leeway).Before(unixTime(*claims.NotBefore)) {
+		return fmt.Errorf("token not yet valid")
+	}
+	if a.config.Issuer != "" && claims.Issuer != a.config.Issuer {
+		return fmt.Errorf("unexpected issuer")
+	}
+	if a.config.Audience != "" && !slices.Contains(audiences(claims.Audience), a.config.Audience) {
+		return fmt.Errorf("unexpected audience")
+	}
+	return nil
+}
+
+func audiences(raw json.RawMessage) []string {
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return []string{single}
+	}
+	var list []string
+	_ = json.Unmarshal(raw, &list)
+	return list
+}
+
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// SignJWT returns an HS256 token carrying claims.
+func SignJWT(claims map[string]any, secret []byte) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
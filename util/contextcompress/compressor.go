@@ -3,14 +3,38 @@ package contextcompress
 import (
 	"regexp"
 	"strings"
+	"time"
 )
 
 // Message represents a generic context item for compression.
 type Message struct {
+	// ID is an opaque caller identifier carried through compression.
+	ID        string
 	Role      string
 	Content   string
 	Images    []string
 	Protected bool
+	// Priority orders eviction: lower priority messages are dropped first.
+	Priority int
+	// ExpiresAt removes the message once passed, regardless of budget.
+	ExpiresAt time.Time
+
+	// origin is the 1-based index of the input message this one derives
+	// from; zero marks messages created during compression.
+	origin int
+}
+
+// Report describes what a compression run changed.
+type Report struct {
+	TokensBefore int
+	TokensAfter  int
+	// Removed holds input messages absent from the output (expired, folded,
+	// summarized or dropped).
+	Removed []Message
+	// Truncated holds the original input messages whose content was shortened.
+	Truncated []Message
+	// Added holds messages created during compression, such as summaries.
+	Added []Message
 }
 
 type Config struct {
@@ -18,11 +42,36 @@ type Config struct {
 	ReserveTokens          int
 	Model                  string
 	NearDuplicateThreshold float64
+
+	// Summarizer enables the summarization stage of the default pipeline.
+	Summarizer         Summarizer
+	SummaryPrompt      string
+	SummaryKeepRecent  int
+	SummaryMinMessages int
+
+	// Stages replaces the default pipeline when non-empty.
+	Stages []Stage
+
+	// TokenCounter counts text tokens with the model's real tokenizer.
+	// The built-in heuristic estimator is used when it is nil.
+	TokenCounter TokenCounter
+	// ImageTokenCost is the number of tokens charged per attached image.
+	ImageTokenCost int
+
+	// MaxToolOutputTokens caps unprotected tool messages; longer ones are cut
+	// to a head/tail excerpt by the truncation stage.
+	MaxToolOutputTokens int
+}
+
+const DefaultImageTokenCost = 576
+
+type TokenCounter interface {
+	Count(text string) int
 }
 
 type Compressor struct {
-	cfg       Config
-	estimator *tokenEstimator
+	cfg     Config
+	counter TokenCounter
 }
 
 func NewCompressor(cfg Config) *Compressor {
@@ -32,18 +81,54 @@ func NewCompressor(cfg Config) *Compressor {
 	if cfg.ReserveTokens < 0 {
 		cfg.ReserveTokens = 0
 	}
+	if cfg.SummaryPrompt == "" {
+		cfg.SummaryPrompt = DefaultSummaryPrompt
+	}
+	if cfg.SummaryKeepRecent <= 0 {
+		cfg.SummaryKeepRecent = defaultSummaryKeepRecent
+	}
+	if cfg.SummaryMinMessages <= 1 {
+		cfg.SummaryMinMessages = defaultSummaryMinMessages
+	}
+	if cfg.ImageTokenCost <= 0 {
+		cfg.ImageTokenCost = DefaultImageTokenCost
+	}
+	if cfg.MaxToolOutputTokens <= 0 {
+		cfg.MaxToolOutputTokens = DefaultMaxToolOutputTokens
+	}
+	var counter TokenCounter = newTokenEstimator(cfg.Model)
+	if cfg.TokenCounter != nil {
+		counter = cfg.TokenCounter
+	}
 	return &Compressor{
-		cfg:       cfg,
-		estimator: newTokenEstimator(cfg.Model),
+		cfg:     cfg,
+		counter: counter,
 	}
 }
 
 func (c *Compressor) Compress(input []Message) []Message {
-	if len(input) <= 1 {
-		return cloneMessages(input)
+	output, _ := c.CompressWithReport(input)
+	return output
+}
+
+// CompressWithReport compresses input and reports which messages were removed,
+// truncated or added.
+func (c *Compressor) CompressWithReport(input []Message) ([]Message, *Report) {
+	tagged := cloneMessages(input)
+	for i := range tagged {
+		tagged[i].origin = i + 1
+	}
+
+	output := c.compress(tagged)
+	return output, c.report(tagged, output)
+}
+
+func (c *Compressor) compress(input []Message) []Message {
+	output := dropExpired(cloneMessages(input), time.Now())
+	if len(output) <= 1 {
+		return output
 	}
 
-	output := cloneMessages(input)
 	targetBudget := c.cfg.BudgetTokens - c.cfg.ReserveTokens
 	if targetBudget <= 0 {
 		targetBudget = c.cfg.BudgetTokens
@@ -53,18 +138,83 @@ func (c *Compressor) Compress(input []Message) []Message {
 		return output
 	}
 
-	output = c.foldExactDuplicates(output)
-	if c.tokenCount(output) <= targetBudget {
-		return output
+	for _, stage := range c.stages() {
+		staged, err := stage.Apply(c, output, targetBudget)
+		if err != nil {
+			// A failing stage leaves messages untouched so later stages can still fit the budget.
+			continue
+		}
+		output = staged
+		if c.tokenCount(output) <= targetBudget {
+			return output
+		}
 	}
+	return output
+}
 
-	output = c.foldNearDuplicates(output)
-	if c.tokenCount(output) <= targetBudget {
-		return output
+func (c *Compressor) report(input, output []Message) *Report {
+	report := &Report{
+		TokensBefore: c.tokenCount(input),
+		TokensAfter:  c.tokenCount(output),
 	}
 
-	output = c.dropOldestRemovable(output, targetBudget)
-	return output
+	kept := make(map[int]Message, len(output))
+	for _, msg := range output {
+		if msg.origin == 0 {
+			report.Added = append(report.Added, stripOrigin(msg))
+			continue
+		}
+		kept[msg.origin] = msg
+	}
+	for _, msg := range input {
+		keptMsg, ok := kept[msg.origin]
+		if !ok {
+			report.Removed = append(report.Removed, stripOrigin(msg))
+			continue
+		}
+		if keptMsg.Content != msg.Content {
+			report.Truncated = append(report.Truncated, stripOrigin(msg))
+		}
+	}
+	return report
+}
+
+func stripOrigin(msg Message) Message {
+	msg.origin = 0
+	msg.Images = append(make([]string, 0, len(msg.Images)), msg.Images...)
+	return msg
+}
+
+func dropExpired(messages []Message, now time.Time) []Message {
+	kept := messages[:0]
+	for _, msg := range messages {
+		if !msg.Protected && !msg.ExpiresAt.IsZero() && !msg.ExpiresAt.After(now) {
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	return kept
+}
+
+func (c *Compressor) stages() []Stage {
+	if len(c.cfg.Stages) > 0 {
+		return c.cfg.Stages
+	}
+	stages := []Stage{ExactDuplicateStage{}, NearDuplicateStage{}, TruncateToolOutputStage{}}
+	if c.cfg.Summarizer != nil {
+		stages = append(stages, SummarizeStage{})
+	}
+	return append(stages, DropOldestStage{})
+}
+
+// Config returns the normalized configuration of the compressor.
+func (c *Compressor) Config() Config {
+	return c.cfg
+}
+
+// TokenCount estimates the number of tokens messages occupy in the prompt.
+func (c *Compressor) TokenCount(messages []Message) int {
+	return c.tokenCount(messages)
 }
 
 func (c *Compressor) foldExactDuplicates(messages []Message) []Message {
@@ -125,6 +275,8 @@ func (c *Compressor) foldNearDuplicates(messages []Message) []Message {
 	return kept
 }
 
+// dropOldestRemovable evicts unprotected messages until the budget fits,
+// lowest priority first and oldest first among equal priorities.
 func (c *Compressor) dropOldestRemovable(messages []Message, targetBudget int) []Message {
 	if targetBudget <= 0 {
 		return messages
@@ -132,18 +284,19 @@ func (c *Compressor) dropOldestRemovable(messages []Message, targetBudget int) [
 
 	output := cloneMessages(messages)
 	for len(output) > 1 && c.tokenCount(output) > targetBudget {
-		removed := false
+		victim := -1
 		for i := 0; i < len(output); i++ {
 			if output[i].Protected {
 				continue
 			}
-			output = append(output[:i], output[i+1:]...)
-			removed = true
-			break
+			if victim < 0 || output[i].Priority < output[victim].Priority {
+				victim = i
+			}
 		}
-		if !removed {
+		if victim < 0 {
 			break
 		}
+		output = append(output[:victim], output[victim+1:]...)
 	}
 	return output
 }
@@ -151,7 +304,7 @@ func (c *Compressor) dropOldestRemovable(messages []Message, targetBudget int) [
 func (c *Compressor) tokenCount(messages []Message) int {
 	total := 0
 	for _, msg := range messages {
-		total += c.estimator.count(msg.Role + "\n" + msg.Content)
+		total += c.counter.Count(msg.Role+"\n"+msg.Content) + len(msg.Images)*c.cfg.ImageTokenCost
 	}
 	return total
 }
@@ -160,10 +313,14 @@ func cloneMessages(input []Message) []Message {
 	output := make([]Message, 0, len(input))
 	for _, msg := range input {
 		output = append(output, Message{
+			ID:        msg.ID,
 			Role:      msg.Role,
 			Content:   msg.Content,
 			Images:    append(make([]string, 0, len(msg.Images)), msg.Images...),
 			Protected: msg.Protected,
+			Priority:  msg.Priority,
+			ExpiresAt: msg.ExpiresAt,
+			origin:    msg.origin,
 		})
 	}
 	return output
@@ -235,7 +392,7 @@ func newTokenEstimator(model string) *tokenEstimator {
 	}
 }
 
-func (e *tokenEstimator) count(text string) int {
+func (e *tokenEstimator) Count(text string) int {
 	if text == "" {
 		return 0
 	}
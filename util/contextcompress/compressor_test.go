@@ -1,6 +1,11 @@
 package contextcompress
 
-import "testing"
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestCompressor_FoldExactAndNearDuplicates(t *testing.T) {
 	compressor := NewCompressor(Config{
@@ -137,7 +142,7 @@ func TestNormalizeAndCountBranches(t *testing.T) {
 		t.Fatalf("expected whitespace-only input to normalize to empty")
 	}
 	estimator := newTokenEstimator("qwen3:4b")
-	if n := estimator.count("verylongtoken123456 another"); n <= 0 {
+	if n := estimator.Count("verylongtoken123456 another"); n <= 0 {
 		t.Fatalf("expected positive token count")
 	}
 }
@@ -145,11 +150,11 @@ func TestNormalizeAndCountBranches(t *testing.T) {
 func TestTokenEstimator_Count_EmptyAndNoMatch(t *testing.T) {
 	e := newTokenEstimator("")
 	// empty text → return 0
-	if n := e.count(""); n != 0 {
+	if n := e.Count(""); n != 0 {
 		t.Fatalf("expected 0 for empty text, got %d", n)
 	}
 	// whitespace-only: regex finds no tokens → len([]rune)/4+1
-	if n := e.count("   "); n <= 0 {
+	if n := e.Count("   "); n <= 0 {
 		t.Fatalf("expected positive count for whitespace-only text (no token matches), got %d", n)
 	}
 }
@@ -185,3 +190,208 @@ func TestDropOldestRemovable_AllProtected(t *testing.T) {
 		t.Fatalf("expected all protected messages kept, got len=%d", len(result))
 	}
 }
+
+type mockSummarizer struct {
+	summary  string
+	err      error
+	received []Message
+	prompt   string
+}
+
+func (m *mockSummarizer) Summarize(messages []Message, prompt string) (string, error) {
+	m.received = messages
+	m.prompt = prompt
+	return m.summary, m.err
+}
+
+func TestCompressor_SummarizesOldestBeforeDropping(t *testing.T) {
+	summarizer := &mockSummarizer{summary: "user asked about weather and databases"}
+	compressor := NewCompressor(Config{
+		BudgetTokens:      48,
+		Summarizer:        summarizer,
+		SummaryKeepRecent: 1,
+	})
+
+	input := []Message{
+		{Role: "system", Content: "fixed instruction", Protected: true},
+		{Role: "user", Content: "what is the weather like in beijing today please tell me"},
+		{Role: "assistant", Content: "it is sunny in beijing with a light breeze in the afternoon"},
+		{Role: "user", Content: "and which database should i use for vectors in production"},
+		{Role: "assistant", Content: "milvus is a good fit for vector search workloads at scale"},
+		{Role: "user", Content: "thanks", Protected: true},
+	}
+
+	output := compressor.Compress(input)
+
+	if len(summarizer.received) < 2 {
+		t.Fatalf("expected at least 2 messages summarized, got %d", len(summarizer.received))
+	}
+	if summarizer.received[0].Content != input[1].Content {
+		t.Fatalf("expected oldest unprotected message summarized first, got %q", summarizer.received[0].Content)
+	}
+	if summarizer.prompt != DefaultSummaryPrompt {
+		t.Fatalf("expected default summary prompt")
+	}
+	if output[0].Content != "fixed instruction" {
+		t.Fatalf("expected protected message to stay first, got %q", output[0].Content)
+	}
+	if output[1].Role != SummaryRole || output[1].Content != SummaryContentPrefix+"user asked about weather and databases" {
+		t.Fatalf("expected summary to replace the summarized span, got %#v", output[1])
+	}
+	if output[len(output)-1].Content != "thanks" {
+		t.Fatalf("expected latest protected message kept")
+	}
+}
+
+func TestCompressor_SummarizerErrorFallsBackToDropping(t *testing.T) {
+	compressor := NewCompressor(Config{
+		BudgetTokens:      12,
+		Summarizer:        &mockSummarizer{err: errors.New("model down")},
+		SummaryKeepRecent: 1,
+	})
+
+	input := []Message{
+		{Role: "assistant", Content: "first removable chunk of text here"},
+		{Role: "assistant", Content: "second removable chunk of text here"},
+		{Role: "assistant", Content: "third removable chunk of text here"},
+		{Role: "user", Content: "keep", Protected: true},
+	}
+
+	output := compressor.Compress(input)
+	for _, msg := range output {
+		if strings.HasPrefix(msg.Content, SummaryContentPrefix) {
+			t.Fatalf("did not expect summary when summarizer fails")
+		}
+	}
+	if compressor.TokenCount(output) > 12 {
+		t.Fatalf("expected drop stage to fit budget, got %d tokens", compressor.TokenCount(output))
+	}
+}
+
+type truncateStage struct{ called bool }
+
+func (s *truncateStage) Apply(c *Compressor, messages []Message, targetBudget int) ([]Message, error) {
+	_, _ = c, targetBudget
+	s.called = true
+	output := make([]Message, 0, len(messages))
+	for _, msg := range messages {
+		if !msg.Protected && len(msg.Content) > 5 {
+			msg.Content = msg.Content[:5]
+		}
+		output = append(output, msg)
+	}
+	return output, nil
+}
+
+func TestCompressor_CustomStages(t *testing.T) {
+	stage := &truncateStage{}
+	compressor := NewCompressor(Config{
+		BudgetTokens: 6,
+		Stages:       []Stage{stage},
+	})
+
+	input := []Message{
+		{Role: "assistant", Content: "averyveryverylongword and more words"},
+		{Role: "user", Content: "ok", Protected: true},
+	}
+	output := compressor.Compress(input)
+	if !stage.called {
+		t.Fatalf("expected custom stage to run")
+	}
+	if len(output) != 2 || output[0].Content != "avery" {
+		t.Fatalf("expected only custom stage to apply, got %#v", output)
+	}
+}
+
+func TestSummarizeStage_NotEnoughCandidates(t *testing.T) {
+	summarizer := &mockSummarizer{summary: "s"}
+	c := NewCompressor(Config{BudgetTokens: 1, Summarizer: summarizer})
+	msgs := []Message{{Role: "assistant", Content: "only one"}}
+	output, err := SummarizeStage{}.Apply(c, msgs, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(output) != 1 || summarizer.received != nil {
+		t.Fatalf("expected messages unchanged without enough candidates")
+	}
+
+	if _, err := (SummarizeStage{}).Apply(NewCompressor(Config{}), msgs, 1); err == nil {
+		t.Fatalf("expected error without summarizer")
+	}
+}
+
+func TestCompressor_DropsLowestPriorityFirst(t *testing.T) {
+	compressor := NewCompressor(Config{BudgetTokens: 30})
+
+	input := []Message{
+		{Role: "system", Content: "fixed instruction", Protected: true},
+		{Role: "assistant", Content: "sample answer that should survive eviction", Priority: 10},
+		{Role: "assistant", Content: "old chatter that is the first to go away"},
+		{Role: "assistant", Content: "recent chatter about something different"},
+		{Role: "user", Content: "latest question", Protected: true},
+	}
+
+	output, report := compressor.CompressWithReport(input)
+	for _, msg := range output {
+		if msg.Content == "old chatter that is the first to go away" {
+			t.Fatalf("expected low priority old message to be dropped, got %#v", output)
+		}
+	}
+	if output[1].Content != "sample answer that should survive eviction" {
+		t.Fatalf("expected high priority message to be kept, got %#v", output)
+	}
+	if len(report.Removed) == 0 || report.Removed[0].Content != "old chatter that is the first to go away" {
+		t.Fatalf("expected report to list the dropped message first, got %#v", report.Removed)
+	}
+	if report.TokensAfter >= report.TokensBefore {
+		t.Fatalf("expected report tokens to shrink, got before=%d after=%d", report.TokensBefore, report.TokensAfter)
+	}
+}
+
+func TestCompressor_DropsExpiredMessages(t *testing.T) {
+	compressor := NewCompressor(Config{BudgetTokens: 1000})
+
+	input := []Message{
+		{Role: "system", Content: "fixed instruction", Protected: true, ExpiresAt: time.Now().Add(-time.Minute)},
+		{Role: "assistant", Content: "stale", ExpiresAt: time.Now().Add(-time.Minute)},
+		{Role: "assistant", Content: "fresh", ExpiresAt: time.Now().Add(time.Hour)},
+		{Role: "user", Content: "question", Protected: true},
+	}
+
+	output, report := compressor.CompressWithReport(input)
+	if len(output) != 3 || output[1].Content != "fresh" {
+		t.Fatalf("expected only the expired unprotected message to be removed, got %#v", output)
+	}
+	if len(report.Removed) != 1 || report.Removed[0].Content != "stale" {
+		t.Fatalf("unexpected removed messages: %#v", report.Removed)
+	}
+}
+
+func TestCompressor_TruncatesOversizedToolOutput(t *testing.T) {
+	compressor := NewCompressor(Config{BudgetTokens: 60, MaxToolOutputTokens: 20})
+
+	output := strings.Repeat("line of tool output ", 40)
+	input := []Message{
+		{Role: "system", Content: "fixed instruction", Protected: true},
+		{Role: "tool", Content: "HEAD " + output + " TAIL"},
+		{Role: "user", Content: "summarize it", Protected: true},
+	}
+
+	compressed, report := compressor.CompressWithReport(input)
+	if len(compressed) != 3 {
+		t.Fatalf("expected tool message to be truncated instead of dropped, got %#v", compressed)
+	}
+	tool := compressed[1].Content
+	if !strings.HasPrefix(tool, "HEAD") || !strings.HasSuffix(tool, "TAIL") || !strings.Contains(tool, TruncationMarker) {
+		t.Fatalf("expected head/tail excerpt, got %q", tool)
+	}
+	if n := compressor.TokenCount(compressed[1:2]); n > 20 {
+		t.Fatalf("expected truncated tool message within 20 tokens, got %d", n)
+	}
+	if len(report.Truncated) != 1 || report.Truncated[0].Content != input[1].Content {
+		t.Fatalf("expected report to hold the original tool output, got %#v", report.Truncated)
+	}
+	if len(report.Removed) != 0 || len(report.Added) != 0 {
+		t.Fatalf("unexpected removed/added: %#v %#v", report.Removed, report.Added)
+	}
+}
@@ -0,0 +1,145 @@
+package contextcompress
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	defaultSummaryKeepRecent  = 4
+	defaultSummaryMinMessages = 2
+
+	DefaultMaxToolOutputTokens = 1024
+	ToolRole                   = "tool"
+	TruncationMarker           = "\n...[truncated]...\n"
+
+	SummaryRole          = "system"
+	SummaryContentPrefix = "Summary of earlier conversation:\n"
+
+	DefaultSummaryPrompt = `Summarize the following conversation excerpt so it can replace the original messages in the context.
+Keep facts, decisions, user preferences, tool results and open tasks. Drop greetings and repetition.
+Output only the summary.`
+)
+
+// Stage is one step of the compression pipeline. Stages run in order until the
+// messages fit targetBudget; a stage returning an error is skipped.
+type Stage interface {
+	Apply(c *Compressor, messages []Message, targetBudget int) ([]Message, error)
+}
+
+// Summarizer condenses messages into a short text following prompt.
+type Summarizer interface {
+	Summarize(messages []Message, prompt string) (string, error)
+}
+
+type ExactDuplicateStage struct{}
+
+func (ExactDuplicateStage) Apply(c *Compressor, messages []Message, _ int) ([]Message, error) {
+	return c.foldExactDuplicates(messages), nil
+}
+
+type NearDuplicateStage struct{}
+
+func (NearDuplicateStage) Apply(c *Compressor, messages []Message, _ int) ([]Message, error) {
+	return c.foldNearDuplicates(messages), nil
+}
+
+type DropOldestStage struct{}
+
+func (DropOldestStage) Apply(c *Compressor, messages []Message, targetBudget int) ([]Message, error) {
+	return c.dropOldestRemovable(messages, targetBudget), nil
+}
+
+// TruncateToolOutputStage shortens unprotected tool messages longer than
+// MaxToolOutputTokens to a head/tail excerpt joined by TruncationMarker.
+type TruncateToolOutputStage struct{}
+
+func (TruncateToolOutputStage) Apply(c *Compressor, messages []Message, _ int) ([]Message, error) {
+	output := cloneMessages(messages)
+	for i := range output {
+		if output[i].Protected || output[i].Role != ToolRole {
+			continue
+		}
+		output[i].Content = c.truncateContent(output[i], c.cfg.MaxToolOutputTokens)
+	}
+	return output, nil
+}
+
+func (c *Compressor) truncateContent(msg Message, maxTokens int) string {
+	tokens := c.tokenCount([]Message{msg})
+	if tokens <= maxTokens {
+		return msg.Content
+	}
+
+	runes := []rune(msg.Content)
+	keep := len(runes) * maxTokens / tokens
+	for keep > 0 {
+		head := keep / 2
+		tail := keep - head
+		excerpt := string(runes[:head]) + TruncationMarker + string(runes[len(runes)-tail:])
+		msg.Content = excerpt
+		if c.tokenCount([]Message{msg}) <= maxTokens {
+			return excerpt
+		}
+		keep = keep * 9 / 10
+	}
+	return strings.TrimSpace(TruncationMarker)
+}
+
+// SummarizeStage replaces the oldest unprotected messages with a single
+// summary message produced by the configured Summarizer. The most recent
+// SummaryKeepRecent unprotected messages are never summarized.
+type SummarizeStage struct{}
+
+func (SummarizeStage) Apply(c *Compressor, messages []Message, targetBudget int) ([]Message, error) {
+	if c.cfg.Summarizer == nil {
+		return nil, errors.New("summarizer is not configured")
+	}
+
+	unprotected := make([]int, 0, len(messages))
+	for i, msg := range messages {
+		if !msg.Protected {
+			unprotected = append(unprotected, i)
+		}
+	}
+	candidateCount := len(unprotected) - c.cfg.SummaryKeepRecent
+	if candidateCount < c.cfg.SummaryMinMessages {
+		return messages, nil
+	}
+
+	excess := c.tokenCount(messages) - targetBudget
+	span := make(map[int]struct{}, candidateCount)
+	spanMessages := make([]Message, 0, candidateCount)
+	removedTokens := 0
+	for _, idx := range unprotected[:candidateCount] {
+		if removedTokens > excess && len(spanMessages) >= c.cfg.SummaryMinMessages {
+			break
+		}
+		span[idx] = struct{}{}
+		spanMessages = append(spanMessages, messages[idx])
+		removedTokens += c.tokenCount(messages[idx : idx+1])
+	}
+
+	summary, err := c.cfg.Summarizer.Summarize(cloneMessages(spanMessages), c.cfg.SummaryPrompt)
+	if err != nil {
+		return nil, err
+	}
+	summary = strings.TrimSpace(summary)
+	if summary == "" {
+		return nil, errors.New("summarizer returned empty summary")
+	}
+
+	output := make([]Message, 0, len(messages)-len(spanMessages)+1)
+	inserted := false
+	for i, msg := range messages {
+		if _, summarized := span[i]; summarized {
+			if !inserted {
+				output = append(output, Message{Role: SummaryRole, Content: SummaryContentPrefix + summary})
+				inserted = true
+			}
+			continue
+		}
+		output = append(output, msg)
+	}
+	return cloneMessages(output), nil
+}
@@ -0,0 +1,112 @@
+package cron
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSchedule_Next(t *testing.T) {
+	// A Wednesday
+	from := time.Date(2026, 1, 14, 10, 30, 0, 0, time.UTC)
+	cases := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2026, 1, 14, 10, 31, 0, 0, time.UTC)},
+		{"0 8 * * *", time.Date(2026, 1, 15, 8, 0, 0, 0, time.UTC)},
+		{"45 10 * * *", time.Date(2026, 1, 14, 10, 45, 0, 0, time.UTC)},
+		{"*/20 * * * *", time.Date(2026, 1, 14, 10, 40, 0, 0, time.UTC)},
+		{"15/20 * * * *", time.Date(2026, 1, 14, 10, 35, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2026, 1, 14, 13, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 * *", time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * mon-fri", time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * SUN", time.Date(2026, 1, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2026, 1, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 mar *", time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)},
+		// Both day fields restricted: either matches
+		{"0 0 20 * 5", time.Date(2026, 1, 16, 0, 0, 0, 0, time.UTC)},
+		// A starred day field defers to the other
+		{"0 0 */2 * 5", time.Date(2026, 1, 23, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2026, 1, 14, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2026, 1, 18, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, c := range cases {
+		s, err := Parse(c.expr)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", c.expr, err)
+		}
+		if got := s.Next(from); !got.Equal(c.want) {
+			t.Fatalf("Next of %q = %v, want %v", c.expr, got, c.want)
+		}
+	}
+}
+
+func TestSchedule_NextIsAfter(t *testing.T) {
+	s, err := Parse("30 10 * * *")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	at := time.Date(2026, 1, 14, 10, 30, 0, 0, time.UTC)
+	if got := s.Next(at); !got.Equal(at.AddDate(0, 0, 1)) {
+		t.Fatalf("expected the next day, got %v", got)
+	}
+	if got := s.Next(at.Add(-time.Second)); !got.Equal(at) {
+		t.Fatalf("expected %v, got %v", at, got)
+	}
+}
+
+func TestSchedule_NextLocation(t *testing.T) {
+	loc := time.FixedZone("UTC+8", 8*60*60)
+	s, err := Parse("0 8 * * *")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	got := s.Next(time.Date(2026, 1, 13, 23, 0, 0, 0, time.UTC).In(loc))
+	if want := time.Date(2026, 1, 14, 8, 0, 0, 0, loc); !got.Equal(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestSchedule_NextDaylightSaving(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("time zone data unavailable: %v", err)
+	}
+	s, err := Parse("30 2 * * *")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	// 02:30 does not exist on 2026-03-08
+	got := s.Next(time.Date(2026, 3, 8, 0, 0, 0, 0, loc))
+	if want := time.Date(2026, 3, 9, 2, 30, 0, 0, loc); !got.Equal(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"* * * foo *",
+		"@often",
+	} {
+		if _, err := Parse(expr); err == nil || !strings.HasPrefix(err.Error(), "cron: ") {
+			t.Fatalf("Parse(%q) = %v, want an error", expr, err)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package guardrail
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/luoxiaojun1992/ai-agent/util/injection"
+	"github.com/luoxiaojun1992/ai-agent/util/redact"
+)
+
+type regexDetector struct {
+	re    *regexp.Regexp
+	label string
+}
+
+// Regex flags every match of pattern with label.
+func Regex(pattern, label string) (Detector, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid guardrail pattern: %w", err)
+	}
+	return &regexDetector{re: re, label: label}, nil
+}
+
+func (d *regexDetector) Detect(_ context.Context, text string) ([]Finding, error) {
+	var findings []Finding
+	for _, loc := range d.re.FindAllStringIndex(text, -1) {
+		if loc[1] > loc[0] {
+			findings = append(findings, Finding{Start: loc[0], End: loc[1], Label: d.label})
+		}
+	}
+	return findings, nil
+}
+
+// Keywords flags whole-word, case-insensitive occurrences of the given words
+// or phrases.
+func Keywords(words []string) (Detector, error) {
+	var alternatives []string
+	for _, word := range words {
+		word = strings.TrimSpace(word)
+		if word == "" {
+			continue
+		}
+		alternative := regexp.QuoteMeta(word)
+		if isWordChar(rune(word[0])) {
+			alternative = `\b` + alternative
+		}
+		if isWordChar(rune(word[len(word)-1])) {
+			alternative += `\b`
+		}
+		alternatives = append(alternatives, alternative)
+	}
+	if len(alternatives) == 0 {
+		return nil, fmt.Errorf("no keywords given")
+	}
+	return Regex(`(?i)(?:`+strings.Join(alternatives, "|")+`)`, "keyword")
+}
+
+func isWordChar(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// PII kinds detected by PII.
+const (
+	PIIEmail = "email"
+	PIIPhone = "phone"
+	PIIKey   = "key"
+)
+
+var (
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(?:\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,}`)
+	phonePattern = regexp.MustCompile(`\+?\(?\d[\d ().\-]{5,}\d`)
+	datePattern  = regexp.MustCompile(`^\d{4}[\-./]\d{1,2}[\-./]\d{1,2}$`)
+)
+
+type piiDetector struct {
+	kinds []string
+}
+
+// PII flags email addresses, phone numbers and API keys, tokens or private
+// keys. No kinds selects all of them.
+func PII(kinds ...string) (Detector, error) {
+	if len(kinds) == 0 {
+		kinds = []string{PIIEmail, PIIPhone, PIIKey}
+	}
+	for _, kind := range kinds {
+		switch kind {
+		case PIIEmail, PIIPhone, PIIKey:
+		default:
+			return nil, fmt.Errorf("unknown pii kind %q", kind)
+		}
+	}
+	return &piiDetector{kinds: kinds}, nil
+}
+
+func (d *piiDetector) Detect(_ context.Context, text string) ([]Finding, error) {
+	var findings []Finding
+	for _, kind := range d.kinds {
+		switch kind {
+		case PIIEmail:
+			for _, loc := range emailPattern.FindAllStringIndex(text, -1) {
+				findings = append(findings, Finding{Start: loc[0], End: loc[1], Label: PIIEmail})
+			}
+		case PIIPhone:
+			for _, loc := range phonePattern.FindAllStringIndex(text, -1) {
+				if isPhoneNumber(text, loc[0], loc[1]) {
+					findings = append(findings, Finding{Start: loc[0], End: loc[1], Label: PIIPhone})
+				}
+			}
+		case PIIKey:
+			for _, match := range redact.FindCredentials(text) {
+				findings = append(findings, Finding{Start: match.Start, End: match.End, Label: PIIKey})
+			}
+		}
+	}
+	return findings, nil
+}
+
+// isPhoneNumber filters phone pattern matches that are dates, parts of
+// identifiers or too short or long to be phone numbers.
+func isPhoneNumber(text string, start, end int) bool {
+	candidate := text[start:end]
+	if datePattern.MatchString(candidate) {
+		return false
+	}
+	if start > 0 && isWordChar(rune(text[start-1])) {
+		return false
+	}
+	if end < len(text) && isWordChar(rune(text[end])) {
+		return false
+	}
+	digits := 0
+	for _, r := range candidate {
+		if r >= '0' && r <= '9' {
+			digits++
+		}
+	}
+	return digits >= 7 && digits <= 15
+}
+
+type injectionDetector struct{}
+
+// Injection flags text that looks like a prompt injection attempt.
+func Injection() Detector {
+	return injectionDetector{}
+}
+
+func (injectionDetector) Detect(_ context.Context, text string) ([]Finding, error) {
+	var findings []Finding
+	for _, match := range injection.Detect(text) {
+		findings = append(findings, Finding{Start: match.Start, End: match.End, Label: "injection", Reason: match.Pattern})
+	}
+	return findings, nil
+}
+
+// Classifier judges whether text violates the given criteria, typically by
+// asking a model.
+type Classifier interface {
+	Classify(ctx context.Context, criteria, text string) (violation bool, reason string, err error)
+}
+
+type classifierDetector struct {
+	classifier Classifier
+	criteria   string
+	label      string
+}
+
+// Classified flags the whole text when classifier finds it violates
+// criteria.
+func Classified(classifier Classifier, criteria, label string) Detector {
+	return &classifierDetector{classifier: classifier, criteria: criteria, label: label}
+}
+
+func (d *classifierDetector) Detect(ctx context.Context, text string) ([]Finding, error) {
+	violation, reason, err := d.classifier.Classify(ctx, d.criteria, text)
+	if err != nil || !violation {
+		return nil, err
+	}
+	return []Finding{{Label: d.label, Reason: reason}}, nil
+}
+
+// RuleConfig is the declarative form of a rule, as read from configuration.
+type RuleConfig struct {
+	Name string `json:"name"`
+	// Type is one of regex, keywords, pii, injection and classifier.
+	Type     string   `json:"type"`
+	Pattern  string   `json:"pattern,omitempty"`
+	Keywords []string `json:"keywords,omitempty"`
+	PII      []string `json:"pii,omitempty"`
+	Criteria string   `json:"criteria,omitempty"`
+	// Stages defaults to all stages.
+	Stages []Stage `json:"stages,omitempty"`
+	Action Action  `json:"action"`
+}
+
+// ParseRuleConfigs decodes a JSON array of rule configs.
+func ParseRuleConfigs(data []byte) ([]RuleConfig, error) {
+	var configs []RuleConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("invalid guardrail rules: %w", err)
+	}
+	return configs, nil
+}
+
+// BuildRules turns rule configs into rules. classifier serves the classifier
+// rules and may be nil when there are none.
+func BuildRules(configs []RuleConfig, classifier Classifier) ([]Rule, error) {
+	rules := make([]Rule, 0, len(configs))
+	for _, config := range configs {
+		var (
+			detector Detector
+			err      error
+		)
+		switch config.Type {
+		case "regex":
+			detector, err = Regex(config.Pattern, config.Name)
+		case "keywords":
+			detector, err = Keywords(config.Keywords)
+		case "pii":
+			detector, err = PII(config.PII...)
+		case "injection":
+			detector = Injection()
+		case "classifier":
+			if classifier == nil {
+				err = fmt.Errorf("no classifier available")
+			} else if strings.TrimSpace(config.Criteria) == "" {
+				err = fmt.Errorf("criteria is required")
+			} else {
+				detector = Classified(classifier, config.Criteria, config.Name)
+			}
+		default:
+			err = fmt.Errorf("unknown type %q", config.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("guardrail rule %q: %w", config.Name, err)
+		}
+		rules = append(rules, Rule{
+			Name:     config.Name,
+			Stages:   config.Stages,
+			Action:   config.Action,
+			Detector: detector,
+		})
+	}
+	return rules, nil
+}
@@ -0,0 +1,249 @@
+package guardrail
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Stage is the point of a chat turn where content is checked.
+type Stage string
+
+const (
+	StageInput  Stage = "input"
+	StageTool   Stage = "tool"
+	StageOutput Stage = "output"
+)
+
+// AllStages returns every stage.
+func AllStages() []Stage {
+	return []Stage{StageInput, StageTool, StageOutput}
+}
+
+// Action is what happens to content a rule flags.
+type Action string
+
+const (
+	ActionBlock  Action = "block"
+	ActionRedact Action = "redact"
+	ActionWarn   Action = "warn"
+)
+
+// Finding is a span of text a detector flagged. A finding with Start and End
+// both zero flags the whole text.
+type Finding struct {
+	Start  int
+	End    int
+	Label  string
+	Reason string
+}
+
+func (f Finding) wholeText() bool {
+	return f.Start == 0 && f.End == 0
+}
+
+// Detector finds the content a rule is about.
+type Detector interface {
+	Detect(ctx context.Context, text string) ([]Finding, error)
+}
+
+// Rule applies an action to the content a detector finds at the given stages.
+type Rule struct {
+	Name     string
+	Stages   []Stage
+	Action   Action
+	Detector Detector
+}
+
+func (r *Rule) appliesTo(stage Stage) bool {
+	if len(r.Stages) == 0 {
+		return true
+	}
+	for _, s := range r.Stages {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// Event reports a rule that fired. It never carries the flagged text.
+type Event struct {
+	Rule   string   `json:"rule"`
+	Stage  Stage    `json:"stage"`
+	Action Action   `json:"action"`
+	Labels []string `json:"labels,omitempty"`
+	Count  int      `json:"count"`
+	Reason string   `json:"reason,omitempty"`
+}
+
+// Result is the outcome of a check. Text holds the content with redactions
+// applied.
+type Result struct {
+	Text    string
+	Blocked bool
+	Events  []Event
+}
+
+// BlockedError reports content a block rule rejected.
+type BlockedError struct {
+	Stage  Stage
+	Rule   string
+	Reason string
+}
+
+func (e *BlockedError) Error() string {
+	msg := fmt.Sprintf("%s blocked by guardrail %s", e.Stage, e.Rule)
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	return msg
+}
+
+// Guard checks content against a set of rules.
+type Guard struct {
+	rules []Rule
+}
+
+// NewGuard validates rules and returns a guard applying them in order.
+func NewGuard(rules ...Rule) (*Guard, error) {
+	names := make(map[string]bool, len(rules))
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Name == "" {
+			return nil, fmt.Errorf("guardrail rule %d has no name", i)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("duplicate guardrail rule %q", rule.Name)
+		}
+		names[rule.Name] = true
+		switch rule.Action {
+		case ActionBlock, ActionRedact, ActionWarn:
+		default:
+			return nil, fmt.Errorf("guardrail rule %q has unknown action %q", rule.Name, rule.Action)
+		}
+		for _, stage := range rule.Stages {
+			switch stage {
+			case StageInput, StageTool, StageOutput:
+			default:
+				return nil, fmt.Errorf("guardrail rule %q has unknown stage %q", rule.Name, stage)
+			}
+		}
+		if rule.Detector == nil {
+			return nil, fmt.Errorf("guardrail rule %q has no detector", rule.Name)
+		}
+	}
+	return &Guard{rules: rules}, nil
+}
+
+// Rewrites reports whether a check at stage may block or change content, in
+// which case the content must be held back until it is checked.
+func (g *Guard) Rewrites(stage Stage) bool {
+	if g == nil {
+		return false
+	}
+	for i := range g.rules {
+		if g.rules[i].appliesTo(stage) && g.rules[i].Action != ActionWarn {
+			return true
+		}
+	}
+	return false
+}
+
+// Check runs the rules of stage over text. It stops at the first block rule
+// that fires. A nil guard passes everything.
+func (g *Guard) Check(ctx context.Context, stage Stage, text string) (*Result, error) {
+	result := &Result{Text: text}
+	if g == nil || text == "" {
+		return result, nil
+	}
+
+	var redactions []Finding
+	for i := range g.rules {
+		rule := &g.rules[i]
+		if !rule.appliesTo(stage) {
+			continue
+		}
+		findings, err := rule.Detector.Detect(ctx, text)
+		if err != nil {
+			return nil, fmt.Errorf("guardrail %s: %w", rule.Name, err)
+		}
+		if len(findings) == 0 {
+			continue
+		}
+
+		event := Event{Rule: rule.Name, Stage: stage, Action: rule.Action, Count: len(findings)}
+		labels := make(map[string]bool)
+		for _, finding := range findings {
+			if finding.Label != "" && !labels[finding.Label] {
+				labels[finding.Label] = true
+				event.Labels = append(event.Labels, finding.Label)
+			}
+			if event.Reason == "" {
+				event.Reason = finding.Reason
+			}
+		}
+		result.Events = append(result.Events, event)
+
+		switch rule.Action {
+		case ActionBlock:
+			result.Blocked = true
+			return result, nil
+		case ActionRedact:
+			redactions = append(redactions, findings...)
+		}
+	}
+	result.Text = applyRedactions(text, redactions)
+	return result, nil
+}
+
+// BlockedBy returns the error describing a blocked result.
+func (r *Result) BlockedBy() *BlockedError {
+	if r == nil || !r.Blocked || len(r.Events) == 0 {
+		return nil
+	}
+	last := r.Events[len(r.Events)-1]
+	return &BlockedError{Stage: last.Stage, Rule: last.Rule, Reason: last.Reason}
+}
+
+// applyRedactions replaces the flagged spans with a placeholder naming their
+// label. Overlapping spans are merged.
+func applyRedactions(text string, findings []Finding) string {
+	if len(findings) == 0 {
+		return text
+	}
+	for _, finding := range findings {
+		if finding.wholeText() {
+			return placeholder(finding.Label)
+		}
+	}
+	sort.Slice(findings, func(i, j int) bool {
+		return findings[i].Start < findings[j].Start
+	})
+
+	var b strings.Builder
+	pos := 0
+	for i := 0; i < len(findings); i++ {
+		start, end, label := findings[i].Start, findings[i].End, findings[i].Label
+		for i+1 < len(findings) && findings[i+1].Start < end {
+			i++
+			end = max(end, findings[i].End)
+		}
+		if start < pos {
+			start = pos
+		}
+		b.WriteString(text[pos:start])
+		b.WriteString(placeholder(label))
+		pos = end
+	}
+	b.WriteString(text[pos:])
+	return b.String()
+}
+
+func placeholder(label string) string {
+	if label == "" {
+		return "[REDACTED]"
+	}
+	return "[REDACTED:" + label + "]"
+}
@@ -0,0 +1,76 @@
+package injection
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Match is a span of text that looks like an attempt to instruct the model.
+type Match struct {
+	Pattern string
+	Start   int
+	End     int
+}
+
+type pattern struct {
+	name string
+	re   *regexp.Regexp
+}
+
+var patterns = []pattern{
+	{"override", regexp.MustCompile(`(?i)\b(?:ignore|disregard|forget|override|bypass)\s+(?:all\s+|any\s+|the\s+|your\s+|these\s+|every\s+)*(?:previous|prior|above|earlier|preceding|system|original)?\s*(?:instructions?|prompts?|rules|directions|guidelines|context)\b`)},
+	{"new_instructions", regexp.MustCompile(`(?i)\b(?:new|updated|real|actual|hidden)\s+(?:instructions?|system\s+prompt|task)\s*:`)},
+	{"role_change", regexp.MustCompile(`(?i)\b(?:you\s+are\s+now|from\s+now\s+on,?\s+you|act\s+as\s+(?:a|an|the)\s+(?:unrestricted|jailbroken|developer)|pretend\s+(?:to\s+be|you\s+are))\b`)},
+	{"prompt_leak", regexp.MustCompile(`(?i)\b(?:reveal|print|show|repeat|output)\s+(?:your|the)\s+(?:system\s+prompt|instructions|initial\s+prompt)\b`)},
+	{"role_marker", regexp.MustCompile(`(?im)(?:<\|im_start\|>|<\|start_header_id\|>|\[/?INST\]|<</?SYS>>|^\s*(?:system|assistant)\s*:)`)},
+	{"tool_call", regexp.MustCompile(`(?i)</?tool>|"function"\s*:\s*"[a-z0-9_]+"`)},
+	{"secrecy", regexp.MustCompile(`(?i)\b(?:do\s+not|don't|never)\s+(?:tell|inform|mention\s+(?:this\s+)?to|reveal\s+(?:this\s+)?to)\s+the\s+user\b`)},
+	{"destructive_command", regexp.MustCompile(`(?i)\b(?:call|invoke|run|execute|use)\s+(?:the\s+)?(?:function|tool|skill)?\s*[a-z_]*(?:remove|remover|delete|writer|rm)\b|\brm\s+-rf\b`)},
+}
+
+// Detect returns the spans of text that match known prompt injection
+// patterns, in order of appearance per pattern.
+func Detect(text string) []Match {
+	var matches []Match
+	for _, p := range patterns {
+		for _, loc := range p.re.FindAllStringIndex(text, -1) {
+			matches = append(matches, Match{Pattern: p.name, Start: loc[0], End: loc[1]})
+		}
+	}
+	return matches
+}
+
+// Suspicious reports whether text matches any injection pattern.
+func Suspicious(text string) bool {
+	for _, p := range patterns {
+		if p.re.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// Patterns returns the names of the patterns that matched.
+func Patterns(matches []Match) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, match := range matches {
+		if !seen[match.Pattern] {
+			seen[match.Pattern] = true
+			names = append(names, match.Pattern)
+		}
+	}
+	return names
+}
+
+// Neutralize escapes the closing tag of the wrapper an untrusted text is
+// placed in, so the text cannot end the wrapper early and pose as trusted
+// content.
+func Neutralize(text, tag string) string {
+	closing := "</" + tag
+	if !strings.Contains(strings.ToLower(text), closing) {
+		return text
+	}
+	re := regexp.MustCompile(`(?i)</` + regexp.QuoteMeta(tag))
+	return re.ReplaceAllString(text, "&lt;/"+tag)
+}
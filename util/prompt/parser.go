@@ -2,33 +2,296 @@ package prompt
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"regexp"
 	"strings"
 )
 
+const (
+	toolOpenTag  = "<tool>"
+	toolCloseTag = "</tool>"
+)
+
+var (
+	toolBlockRegexp = regexp.MustCompile(`(?s)<tool>(.+?)</tool>`)
+	loopEndRegexp   = regexp.MustCompile(`(?s)<loop_end/>`)
+	codeFenceRegexp = regexp.MustCompile("(?s)^```[a-zA-Z]*\\s*(.*?)\\s*```$")
+)
+
 type FunctionCall struct {
 	Function     string `json:"function"`
 	Context      any    `json:"context"`
 	AbortOnError bool   `json:"abort_on_error"`
 }
 
+// FunctionCallParseError reports a `<tool>` block that could not be parsed
+// even after repair. Index is the position of the block in the response.
+type FunctionCallParseError struct {
+	Index int
+	Raw   string
+	Err   error
+}
+
+func (e *FunctionCallParseError) Error() string {
+	return fmt.Sprintf("invalid function call #%d %s: %v", e.Index+1, e.Raw, e.Err)
+}
+
+func (e *FunctionCallParseError) Unwrap() error {
+	return e.Err
+}
+
+// ParseFunctionCalling parses every `<tool>` block of prompt and fails on the
+// first block that cannot be parsed.
 func ParseFunctionCalling(prompt string) ([]*FunctionCall, error) {
-	regExp := regexp.MustCompile(`(?s)<tool>(.+?)</tool>`)
-	matches := regExp.FindAllString(prompt, -1)
+	funcCallList, parseErrs := ParseFunctionCallingTolerant(prompt)
+	if len(parseErrs) > 0 {
+		return nil, parseErrs[0]
+	}
+	return funcCallList, nil
+}
+
+// ParseFunctionCallingTolerant parses every `<tool>` block of prompt, repairing
+// common JSON defects, and returns the calls that could be parsed along with
+// one error per block that could not.
+func ParseFunctionCallingTolerant(prompt string) ([]*FunctionCall, []*FunctionCallParseError) {
+	matches := toolBlockRegexp.FindAllStringSubmatch(prompt, -1)
 	funcCallList := make([]*FunctionCall, 0, len(matches))
-	for _, match := range matches {
-		funcCallJson := strings.ReplaceAll(match, "<tool>", "")
-		funcCallJson = strings.ReplaceAll(funcCallJson, "</tool>", "")
-		functionCall := &FunctionCall{}
-		if err := json.Unmarshal([]byte(funcCallJson), functionCall); err != nil {
-			return nil, err
+	var parseErrs []*FunctionCallParseError
+	for i, match := range matches {
+		functionCall, err := parseFunctionCall(match[1])
+		if err != nil {
+			parseErrs = append(parseErrs, &FunctionCallParseError{Index: i, Raw: match[0], Err: err})
+			continue
 		}
 		funcCallList = append(funcCallList, functionCall)
 	}
-	return funcCallList, nil
+	return funcCallList, parseErrs
+}
+
+func parseFunctionCall(raw string) (*FunctionCall, error) {
+	functionCall := &FunctionCall{}
+	err := json.Unmarshal([]byte(raw), functionCall)
+	if err != nil {
+		repaired := &FunctionCall{}
+		if json.Unmarshal([]byte(RepairJSON(raw)), repaired) != nil {
+			return nil, err
+		}
+		functionCall = repaired
+	}
+	if strings.TrimSpace(functionCall.Function) == "" {
+		return nil, errors.New("function name is required")
+	}
+	return functionCall, nil
+}
+
+// RepairJSON fixes defects models commonly produce in JSON objects: code fences,
+// single-quoted strings, trailing commas and unbalanced braces or brackets.
+// Input that is beyond repair is returned in a best-effort form that still
+// fails to decode.
+func RepairJSON(raw string) string {
+	text := strings.TrimSpace(raw)
+	if match := codeFenceRegexp.FindStringSubmatch(text); match != nil {
+		text = match[1]
+	}
+	text = normalizeQuotes(text)
+	text = removeTrailingCommas(text)
+	return balanceBrackets(text)
+}
+
+// normalizeQuotes rewrites single-quoted strings as double-quoted ones.
+func normalizeQuotes(text string) string {
+	var b strings.Builder
+	b.Grow(len(text))
+	inDouble, inSingle, escaped := false, false, false
+	for _, r := range text {
+		switch {
+		case escaped:
+			escaped = false
+			if inSingle && r == '\'' {
+				// \' needs no escaping inside a double-quoted string.
+				b.WriteRune(r)
+				continue
+			}
+			b.WriteRune('\\')
+			b.WriteRune(r)
+			continue
+		case r == '\\' && (inDouble || inSingle):
+			escaped = true
+			continue
+		case inDouble:
+			if r == '"' {
+				inDouble = false
+			}
+		case inSingle:
+			if r == '\'' {
+				inSingle = false
+				b.WriteRune('"')
+				continue
+			}
+			if r == '"' {
+				b.WriteString(`\"`)
+				continue
+			}
+		case r == '"':
+			inDouble = true
+		case r == '\'':
+			inSingle = true
+			b.WriteRune('"')
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// removeTrailingCommas drops commas that directly precede a closing brace or
+// bracket outside of strings.
+func removeTrailingCommas(text string) string {
+	runes := []rune(text)
+	var b strings.Builder
+	b.Grow(len(text))
+	inString, escaped := false, false
+	for i, r := range runes {
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case r == '\\':
+				escaped = true
+			case r == '"':
+				inString = false
+			}
+			b.WriteRune(r)
+			continue
+		}
+		if r == '"' {
+			inString = true
+		}
+		if r == ',' {
+			next := i + 1
+			for next < len(runes) && strings.ContainsRune(" \t\r\n", runes[next]) {
+				next++
+			}
+			if next < len(runes) && (runes[next] == '}' || runes[next] == ']') {
+				continue
+			}
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// balanceBrackets drops unmatched closing braces or brackets, cuts anything
+// after the top-level value is complete and closes what is left open.
+func balanceBrackets(text string) string {
+	var b strings.Builder
+	b.Grow(len(text))
+	stack := make([]rune, 0, 8)
+	inString, escaped, started := false, false, false
+	for _, r := range text {
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case r == '\\':
+				escaped = true
+			case r == '"':
+				inString = false
+			}
+			b.WriteRune(r)
+			continue
+		}
+		switch r {
+		case '"':
+			inString = true
+		case '{', '[':
+			if started && len(stack) == 0 {
+				// A second top-level value; keep only the first one.
+				return b.String()
+			}
+			started = true
+			stack = append(stack, r)
+		case '}', ']':
+			open := '{'
+			if r == ']' {
+				open = '['
+			}
+			if len(stack) == 0 || stack[len(stack)-1] != open {
+				continue
+			}
+			stack = stack[:len(stack)-1]
+		}
+		b.WriteRune(r)
+	}
+	if inString {
+		b.WriteRune('"')
+	}
+	for i := len(stack) - 1; i >= 0; i-- {
+		if stack[i] == '{' {
+			b.WriteRune('}')
+		} else {
+			b.WriteRune(']')
+		}
+	}
+	return b.String()
 }
 
 func ParseLoopEnd(prompt string) bool {
-	regExp := regexp.MustCompile(`(?s)<loop_end/>`)
-	return regExp.MatchString(prompt)
+	return loopEndRegexp.MatchString(prompt)
+}
+
+// FunctionCallStreamParser detects `<tool>` blocks in a streamed response as
+// soon as their closing tag arrives.
+type FunctionCallStreamParser struct {
+	buffer strings.Builder
+	index  int
+}
+
+func NewFunctionCallStreamParser() *FunctionCallStreamParser {
+	return &FunctionCallStreamParser{}
+}
+
+// Feed appends a streamed chunk and returns the calls, and parse errors, of the
+// blocks completed by it.
+func (p *FunctionCallStreamParser) Feed(chunk string) ([]*FunctionCall, []*FunctionCallParseError) {
+	p.buffer.WriteString(chunk)
+	pending := p.buffer.String()
+
+	var (
+		funcCallList []*FunctionCall
+		parseErrs    []*FunctionCallParseError
+	)
+	for {
+		start := strings.Index(pending, toolOpenTag)
+		if start < 0 {
+			// Keep a possible partial opening tag for the next chunk.
+			pending = pending[max(0, len(pending)-len(toolOpenTag)+1):]
+			break
+		}
+		end := strings.Index(pending[start:], toolCloseTag)
+		if end < 0 {
+			pending = pending[start:]
+			break
+		}
+		end += start
+		block := pending[start : end+len(toolCloseTag)]
+		functionCall, err := parseFunctionCall(pending[start+len(toolOpenTag) : end])
+		if err != nil {
+			parseErrs = append(parseErrs, &FunctionCallParseError{Index: p.index, Raw: block, Err: err})
+		} else {
+			funcCallList = append(funcCallList, functionCall)
+		}
+		p.index++
+		pending = pending[end+len(toolCloseTag):]
+	}
+
+	p.buffer.Reset()
+	p.buffer.WriteString(pending)
+	return funcCallList, parseErrs
+}
+
+// InToolBlock reports whether the stream is inside an unfinished `<tool>` block.
+func (p *FunctionCallStreamParser) InToolBlock() bool {
+	return strings.Contains(p.buffer.String(), toolOpenTag)
 }
@@ -1,6 +1,9 @@
 package prompt
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestParseFunctionCalling_Single(t *testing.T) {
 	input := `<tool>{"function":"search","context":{"query":"weather"},"abort_on_error":true}</tool>`
@@ -48,3 +51,109 @@ func TestParseLoopEnd(t *testing.T) {
 		t.Fatalf("did not expect loop end marker")
 	}
 }
+
+func TestParseFunctionCalling_RepairsCommonDefects(t *testing.T) {
+	cases := map[string]string{
+		"extra brace":     `<tool>{"function":"sleep","context":{"duration":"1s"}}}</tool>`,
+		"trailing commas": `<tool>{"function":"sleep","context":{"duration":"1s",},}</tool>`,
+		"single quotes":   `<tool>{'function':'sleep','context':{'duration':'1s'}}</tool>`,
+		"code fence":      "<tool>\n```json\n{\"function\":\"sleep\",\"context\":{\"duration\":\"1s\"}}\n```\n</tool>",
+		"missing brace":   `<tool>{"function":"sleep","context":{"duration":"1s"}</tool>`,
+	}
+	for name, input := range cases {
+		list, err := ParseFunctionCalling(input)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		if len(list) != 1 || list[0].Function != "sleep" {
+			t.Fatalf("%s: unexpected calls: %#v", name, list)
+		}
+		ctx, ok := list[0].Context.(map[string]any)
+		if !ok || ctx["duration"] != "1s" {
+			t.Fatalf("%s: unexpected context: %#v", name, list[0].Context)
+		}
+	}
+}
+
+func TestRepairJSON_KeepsStringContent(t *testing.T) {
+	got := RepairJSON(`{'q': 'it\'s "quoted", {not a brace},', "s": "a,}"}`)
+	want := `{"q": "it's \"quoted\", {not a brace},", "s": "a,}"}`
+	if got != want {
+		t.Fatalf("unexpected repair:\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestParseFunctionCallingTolerant_ReportsPerCallErrors(t *testing.T) {
+	input := `<tool>{"function":"a","context":{}}</tool><tool>{"function":"b",bad_json}</tool><tool>{"context":{}}</tool><tool>{"function":"c","context":{}}</tool>`
+	list, errs := ParseFunctionCallingTolerant(input)
+	if len(list) != 2 || list[0].Function != "a" || list[1].Function != "c" {
+		t.Fatalf("expected valid calls to be kept, got %#v", list)
+	}
+	if len(errs) != 2 || errs[0].Index != 1 || errs[1].Index != 2 {
+		t.Fatalf("expected two indexed errors, got %#v", errs)
+	}
+	if !strings.Contains(errs[1].Error(), "function name is required") {
+		t.Fatalf("unexpected error message: %v", errs[1])
+	}
+	if errs[0].Unwrap() == nil {
+		t.Fatalf("expected wrapped decode error")
+	}
+}
+
+func TestFunctionCallStreamParser_DetectsBlocksAcrossChunks(t *testing.T) {
+	parser := NewFunctionCallStreamParser()
+	chunks := []string{"let me check <to", `ol>{"function":"a",`, `"context":{}}</to`, "ol> and <tool>{bad}</tool><tool>", `{"function":"b"}`}
+
+	var names []string
+	var errCount int
+	for i, chunk := range chunks {
+		calls, errs := parser.Feed(chunk)
+		for _, call := range calls {
+			names = append(names, call.Function)
+		}
+		errCount += len(errs)
+		if i == 1 && !parser.InToolBlock() {
+			t.Fatalf("expected parser to be inside a tool block after chunk %d", i)
+		}
+	}
+	if strings.Join(names, ",") != "a" || errCount != 1 {
+		t.Fatalf("unexpected stream result: names=%v errors=%d", names, errCount)
+	}
+
+	calls, errs := parser.Feed("</tool>")
+	if len(calls) != 1 || calls[0].Function != "b" || len(errs) != 0 || parser.InToolBlock() {
+		t.Fatalf("expected last block to complete, got %#v %#v", calls, errs)
+	}
+}
+
+func TestSplitThinking(t *testing.T) {
+	content, thinking := SplitThinking("<think>maybe <tool>{}</tool>?</think>answer <tool>x</tool>")
+	if content != "answer <tool>x</tool>" || thinking != "maybe <tool>{}</tool>?" {
+		t.Fatalf("unexpected split: content=%q thinking=%q", content, thinking)
+	}
+	content, thinking = SplitThinking("no reasoning here")
+	if content != "no reasoning here" || thinking != "" {
+		t.Fatalf("unexpected split: content=%q thinking=%q", content, thinking)
+	}
+	content, thinking = SplitThinking("<think>cut off")
+	if content != "" || thinking != "cut off" {
+		t.Fatalf("expected unclosed block to be thinking, got content=%q thinking=%q", content, thinking)
+	}
+}
+
+func TestThinkingSplitter_TagsSplitAcrossChunks(t *testing.T) {
+	splitter := NewThinkingSplitter()
+	var content, thinking strings.Builder
+	for _, chunk := range []string{"<th", "ink>let me", " see</thi", "nk>The answer is 1 <", " 2<"} {
+		c, th := splitter.Feed(chunk)
+		content.WriteString(c)
+		thinking.WriteString(th)
+	}
+	c, th := splitter.Flush()
+	content.WriteString(c)
+	thinking.WriteString(th)
+
+	if content.String() != "The answer is 1 < 2<" || thinking.String() != "let me see" {
+		t.Fatalf("unexpected split: content=%q thinking=%q", content.String(), thinking.String())
+	}
+}
@@ -0,0 +1,80 @@
+package prompt
+
+import "strings"
+
+const (
+	thinkOpenTag  = "<think>"
+	thinkCloseTag = "</think>"
+)
+
+// SplitThinking separates `<think>...</think>` reasoning blocks from the answer
+// of a complete response. An unclosed block runs to the end of the text.
+func SplitThinking(text string) (content, thinking string) {
+	splitter := NewThinkingSplitter()
+	content, thinking = splitter.Feed(text)
+	restContent, restThinking := splitter.Flush()
+	return content + restContent, thinking + restThinking
+}
+
+// ThinkingSplitter separates `<think>...</think>` reasoning from answer content
+// in a streamed response, holding back text that may be the start of a tag
+// split across chunks.
+type ThinkingSplitter struct {
+	pending  string
+	thinking bool
+}
+
+func NewThinkingSplitter() *ThinkingSplitter {
+	return &ThinkingSplitter{}
+}
+
+// Feed consumes a chunk and returns the content and thinking text that are
+// certain so far.
+func (s *ThinkingSplitter) Feed(chunk string) (content, thinking string) {
+	text := s.pending + chunk
+	s.pending = ""
+
+	var contentBuf, thinkingBuf strings.Builder
+	for text != "" {
+		tag := thinkOpenTag
+		out := &contentBuf
+		if s.thinking {
+			tag = thinkCloseTag
+			out = &thinkingBuf
+		}
+
+		if idx := strings.Index(text, tag); idx >= 0 {
+			out.WriteString(text[:idx])
+			text = text[idx+len(tag):]
+			s.thinking = !s.thinking
+			continue
+		}
+
+		keep := partialTagSuffix(text, tag)
+		out.WriteString(text[:len(text)-keep])
+		s.pending = text[len(text)-keep:]
+		break
+	}
+	return contentBuf.String(), thinkingBuf.String()
+}
+
+// Flush returns the text held back at the end of the stream.
+func (s *ThinkingSplitter) Flush() (content, thinking string) {
+	pending := s.pending
+	s.pending = ""
+	if s.thinking {
+		return "", pending
+	}
+	return pending, ""
+}
+
+// partialTagSuffix returns the length of the longest suffix of text that is a
+// proper prefix of tag.
+func partialTagSuffix(text, tag string) int {
+	for n := min(len(tag)-1, len(text)); n > 0; n-- {
+		if strings.HasSuffix(text, tag[:n]) {
+			return n
+		}
+	}
+	return 0
+}
@@ -0,0 +1,248 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// maxIdleKeys bounds the per-key state kept for keys without active requests
+// before idle entries are pruned.
+const maxIdleKeys = 4096
+
+// Limit bounds the requests of a single key. Zero fields are unlimited.
+type Limit struct {
+	// Rate is the sustained number of requests per second.
+	Rate float64 `json:"rate,omitempty"`
+	// Burst is the number of requests allowed at once; it defaults to the
+	// rate rounded up.
+	Burst int `json:"burst,omitempty"`
+	// Concurrency caps the requests in flight.
+	Concurrency int `json:"concurrency,omitempty"`
+	// DailyTokens caps the model tokens used per UTC day.
+	DailyTokens int `json:"dailyTokens,omitempty"`
+}
+
+func (l Limit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.Rate))
+}
+
+// Zero reports whether the limit allows everything.
+func (l Limit) Zero() bool {
+	return l.Rate <= 0 && l.Concurrency <= 0 && l.DailyTokens <= 0
+}
+
+// Reasons a request is rejected.
+const (
+	ReasonRate        = "rate"
+	ReasonConcurrency = "concurrency"
+	ReasonQuota       = "quota"
+)
+
+// LimitError rejects a request. RetryAfter tells when it may succeed.
+type LimitError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *LimitError) Error() string {
+	switch e.Reason {
+	case ReasonConcurrency:
+		return "too many concurrent requests"
+	case ReasonQuota:
+		return "daily token quota exceeded"
+	}
+	return "rate limit exceeded"
+}
+
+type keyState struct {
+	tokens  float64
+	updated time.Time
+	active  int
+}
+
+// Usage counts the model tokens used by each key per UTC day. Limiters
+// sharing a Usage check their quotas against the same count.
+type Usage struct {
+	mu   sync.Mutex
+	keys map[string]*dayUsage
+}
+
+type dayUsage struct {
+	day    string
+	tokens int
+}
+
+// NewUsage returns an empty usage count.
+func NewUsage() *Usage {
+	return &Usage{keys: make(map[string]*dayUsage)}
+}
+
+func (u *Usage) add(key string, tokens int, now time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	day := now.UTC().Format(time.DateOnly)
+	usage, ok := u.keys[key]
+	if !ok {
+		if len(u.keys) >= maxIdleKeys {
+			for key, usage := range u.keys {
+				if usage.day != day {
+					delete(u.keys, key)
+				}
+			}
+		}
+		usage = &dayUsage{}
+		u.keys[key] = usage
+	}
+	if usage.day != day {
+		usage.day, usage.tokens = day, 0
+	}
+	usage.tokens += tokens
+}
+
+func (u *Usage) tokens(key string, now time.Time) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if usage, ok := u.keys[key]; ok && usage.day == now.UTC().Format(time.DateOnly) {
+		return usage.tokens
+	}
+	return 0
+}
+
+// Add records tokens used by key today.
+func (u *Usage) Add(key string, tokens int) {
+	u.add(key, tokens, time.Now())
+}
+
+// Tokens returns the tokens used by key today.
+func (u *Usage) Tokens(key string) int {
+	return u.tokens(key, time.Now())
+}
+
+// Limiter applies a limit to each key separately.
+type Limiter struct {
+	limit Limit
+	usage *Usage
+	now   func() time.Time
+
+	mu   sync.Mutex
+	keys map[string]*keyState
+}
+
+// New returns a limiter applying limit per key.
+func New(limit Limit) *Limiter {
+	return NewWithUsage(limit, NewUsage())
+}
+
+// NewWithUsage returns a limiter applying limit per key whose daily quota is
+// checked against usage.
+func NewWithUsage(limit Limit, usage *Usage) *Limiter {
+	return &Limiter{limit: limit, usage: usage, now: time.Now, keys: make(map[string]*keyState)}
+}
+
+func (l *Limiter) state(key string, now time.Time) *keyState {
+	state, ok := l.keys[key]
+	if !ok {
+		if len(l.keys) >= maxIdleKeys {
+			l.prune(now)
+		}
+		state = &keyState{tokens: l.limit.burst(), updated: now}
+		l.keys[key] = state
+	}
+	if l.limit.Rate > 0 {
+		elapsed := now.Sub(state.updated).Seconds()
+		state.tokens = math.Min(l.limit.burst(), state.tokens+elapsed*l.limit.Rate)
+	}
+	state.updated = now
+	return state
+}
+
+// prune drops keys that hold no information: no requests in flight and a
+// full bucket.
+func (l *Limiter) prune(now time.Time) {
+	for key, state := range l.keys {
+		refilled := l.limit.Rate <= 0 || state.tokens+now.Sub(state.updated).Seconds()*l.limit.Rate >= l.limit.burst()
+		if state.active == 0 && refilled {
+			delete(l.keys, key)
+		}
+	}
+}
+
+// Acquire admits a request of key or returns a *LimitError. The returned
+// release func must be called when the request finishes.
+func (l *Limiter) Acquire(key string) (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	state := l.state(key, now)
+	if l.limit.DailyTokens > 0 && l.usage.tokens(key, now) >= l.limit.DailyTokens {
+		midnight := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+		return nil, &LimitError{Reason: ReasonQuota, RetryAfter: midnight.Sub(now)}
+	}
+	if l.limit.Concurrency > 0 && state.active >= l.limit.Concurrency {
+		return nil, &LimitError{Reason: ReasonConcurrency, RetryAfter: time.Second}
+	}
+	if l.limit.Rate > 0 {
+		if state.tokens < 1 {
+			wait := time.Duration((1 - state.tokens) / l.limit.Rate * float64(time.Second))
+			return nil, &LimitError{Reason: ReasonRate, RetryAfter: wait}
+		}
+		state.tokens--
+	}
+	state.active++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			state.active--
+		})
+	}, nil
+}
+
+// AddUsage records tokens used by key today.
+func (l *Limiter) AddUsage(key string, tokens int) {
+	l.usage.add(key, tokens, l.now())
+}
+
+// Usage returns the tokens used by key today.
+func (l *Limiter) Usage(key string) int {
+	return l.usage.tokens(key, l.now())
+}
+
+// Policy is the limits of a route, applied per API key and per client IP.
+type Policy struct {
+	Key Limit `json:"key"`
+	IP  Limit `json:"ip"`
+}
+
+// Validate rejects negative limits.
+func (p Policy) Validate() error {
+	for _, limit := range []Limit{p.Key, p.IP} {
+		if limit.Rate < 0 || limit.Burst < 0 || limit.Concurrency < 0 || limit.DailyTokens < 0 {
+			return fmt.Errorf("limits must not be negative")
+		}
+	}
+	return nil
+}
+
+// ParsePolicies decodes a JSON object mapping route names to policies.
+func ParsePolicies(data []byte) (map[string]Policy, error) {
+	var policies map[string]Policy
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return nil, fmt.Errorf("invalid rate limits: %w", err)
+	}
+	for route, policy := range policies {
+		if err := policy.Validate(); err != nil {
+			return nil, fmt.Errorf("rate limits of %q: %w", route, err)
+		}
+	}
+	return policies, nil
+}
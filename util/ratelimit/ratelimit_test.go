@@ -0,0 +1,126 @@
+package ratelimit
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestLimiter(limit Limit, now *time.Time) *Limiter {
+	l := New(limit)
+	l.now = func() time.Time { return *now }
+	return l
+}
+
+func TestLimiter_Rate(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	l := newTestLimiter(Limit{Rate: 2, Burst: 2}, &now)
+
+	for i := 0; i < 2; i++ {
+		release, err := l.Acquire("a")
+		if err != nil {
+			t.Fatalf("request %d within burst rejected: %v", i, err)
+		}
+		release()
+	}
+	_, err := l.Acquire("a")
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || limitErr.Reason != ReasonRate {
+		t.Fatalf("expected rate limit error, got %v", err)
+	}
+	if limitErr.RetryAfter != 500*time.Millisecond {
+		t.Fatalf("unexpected retry after: %v", limitErr.RetryAfter)
+	}
+	if release, err := l.Acquire("b"); err != nil {
+		t.Fatalf("other key should have its own bucket: %v", err)
+	} else {
+		release()
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if _, err := l.Acquire("a"); err != nil {
+		t.Fatalf("expected refilled token: %v", err)
+	}
+}
+
+func TestLimiter_Concurrency(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	l := newTestLimiter(Limit{Concurrency: 1}, &now)
+
+	release, err := l.Acquire("a")
+	if err != nil {
+		t.Fatalf("first request rejected: %v", err)
+	}
+	var limitErr *LimitError
+	if _, err := l.Acquire("a"); !errors.As(err, &limitErr) || limitErr.Reason != ReasonConcurrency {
+		t.Fatalf("expected concurrency error, got %v", err)
+	}
+	release()
+	release()
+	if _, err := l.Acquire("a"); err != nil {
+		t.Fatalf("expected slot after release: %v", err)
+	}
+	if _, err := l.Acquire("a"); err == nil {
+		t.Fatalf("double release must not free two slots")
+	}
+}
+
+func TestLimiter_DailyTokens(t *testing.T) {
+	now := time.Date(2026, 1, 1, 18, 0, 0, 0, time.UTC)
+	l := newTestLimiter(Limit{DailyTokens: 100}, &now)
+
+	l.AddUsage("a", 60)
+	if _, err := l.Acquire("a"); err != nil {
+		t.Fatalf("request under quota rejected: %v", err)
+	}
+	l.AddUsage("a", 50)
+	if got := l.Usage("a"); got != 110 {
+		t.Fatalf("unexpected usage: %d", got)
+	}
+	var limitErr *LimitError
+	if _, err := l.Acquire("a"); !errors.As(err, &limitErr) || limitErr.Reason != ReasonQuota {
+		t.Fatalf("expected quota error, got %v", err)
+	}
+	if limitErr.RetryAfter != 6*time.Hour {
+		t.Fatalf("expected retry at midnight UTC, got %v", limitErr.RetryAfter)
+	}
+
+	now = now.Add(6 * time.Hour)
+	if _, err := l.Acquire("a"); err != nil {
+		t.Fatalf("quota should reset the next day: %v", err)
+	}
+}
+
+func TestLimiter_SharedUsage(t *testing.T) {
+	now := time.Date(2026, 1, 1, 18, 0, 0, 0, time.UTC)
+	usage := NewUsage()
+	chat := NewWithUsage(Limit{DailyTokens: 100}, usage)
+	chat.now = func() time.Time { return now }
+	memory := NewWithUsage(Limit{DailyTokens: 50}, usage)
+	memory.now = func() time.Time { return now }
+
+	chat.AddUsage("a", 60)
+	if got := memory.Usage("a"); got != 60 {
+		t.Fatalf("expected usage shared between limiters, got %d", got)
+	}
+	if _, err := chat.Acquire("a"); err != nil {
+		t.Fatalf("request under the chat quota rejected: %v", err)
+	}
+	var limitErr *LimitError
+	if _, err := memory.Acquire("a"); !errors.As(err, &limitErr) || limitErr.Reason != ReasonQuota {
+		t.Fatalf("expected quota error from the shared usage, got %v", err)
+	}
+}
+
+func TestParsePolicies(t *testing.T) {
+	policies, err := ParsePolicies([]byte(`{"*":{"ip":{"rate":5,"burst":10}},"chat":{"key":{"concurrency":2,"dailyTokens":1000}}}`))
+	if err != nil {
+		t.Fatalf("parse policies: %v", err)
+	}
+	if policies["*"].IP.Burst != 10 || policies["chat"].Key.DailyTokens != 1000 || !policies["chat"].IP.Zero() {
+		t.Fatalf("unexpected policies: %+v", policies)
+	}
+	if _, err := ParsePolicies([]byte(`{"chat":{"key":{"rate":-1}}}`)); err == nil {
+		t.Fatalf("expected error for negative rate")
+	}
+}
@@ -0,0 +1,225 @@
+package redact
+
+import (
+	"encoding/json"
+	"io"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// minSecretLength keeps short configured values from masking common words.
+const minSecretLength = 6
+
+// Match is a credential or secret found in text.
+type Match struct {
+	Start int
+	End   int
+	Kind  string
+}
+
+type credentialPattern struct {
+	kind string
+	re   *regexp.Regexp
+	// group selects the submatch holding the secret; 0 is the whole match.
+	group int
+}
+
+var credentialPatterns = []credentialPattern{
+	{kind: "private_key", re: regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`)},
+	{kind: "openai_key", re: regexp.MustCompile(`\bsk-(?:proj-|ant-)?[A-Za-z0-9_\-]{20,}`)},
+	{kind: "aws_access_key", re: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{kind: "github_token", re: regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})`)},
+	{kind: "slack_token", re: regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9\-]{10,}`)},
+	{kind: "google_api_key", re: regexp.MustCompile(`\bAIza[0-9A-Za-z_\-]{35}`)},
+	{kind: "jwt", re: regexp.MustCompile(`\beyJ[A-Za-z0-9_\-]{8,}\.eyJ[A-Za-z0-9_\-]{8,}\.[A-Za-z0-9_\-]{8,}`)},
+	{kind: "bearer_token", re: regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9_\-.=+/]{16,})`), group: 1},
+	{kind: "url_password", re: regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.\-]*://[^\s:/@]+:([^\s@/]+)@`), group: 1},
+	{kind: "assigned_secret", re: regexp.MustCompile(`(?i)\b(?:password|passwd|pwd|secret|client_secret|api[_\-]?key|access[_\-]?token|auth[_\-]?token)["']?\s*[:=]\s*["']?([^\s"',;]{6,})`), group: 1},
+}
+
+// pendingKeyPattern matches the end of text that may continue with a secret
+// value in the next chunk of a stream.
+var pendingKeyPattern = regexp.MustCompile(`(?i)(?:\bbearer\s*|\b(?:password|passwd|pwd|secret|client_secret|api[_\-]?key|access[_\-]?token|auth[_\-]?token)["']?\s*[:=]\s*["']?)$`)
+
+// FindCredentials returns the common credential formats in text: private
+// keys, provider API keys and tokens, JWTs, bearer tokens, passwords in URLs
+// and values assigned to password or key fields.
+func FindCredentials(text string) []Match {
+	var matches []Match
+	for _, p := range credentialPatterns {
+		for _, loc := range p.re.FindAllStringSubmatchIndex(text, -1) {
+			start, end := loc[2*p.group], loc[2*p.group+1]
+			if start >= 0 && end > start {
+				matches = append(matches, Match{Start: start, End: end, Kind: p.kind})
+			}
+		}
+	}
+	return matches
+}
+
+// Redactor masks credentials and configured secret values.
+type Redactor struct {
+	secrets   []string
+	allowlist []string
+}
+
+// New returns a redactor masking the common credential formats and the given
+// secret values. Values in allowlist are never masked.
+func New(secrets, allowlist []string) *Redactor {
+	r := &Redactor{}
+	for _, secret := range secrets {
+		secret = strings.TrimSpace(secret)
+		if len(secret) >= minSecretLength && !slices.Contains(r.secrets, secret) {
+			r.secrets = append(r.secrets, secret)
+		}
+	}
+	// Mask longer secrets first so a secret containing another is masked whole.
+	sort.Slice(r.secrets, func(i, j int) bool {
+		return len(r.secrets[i]) > len(r.secrets[j])
+	})
+	for _, allowed := range allowlist {
+		if allowed = strings.TrimSpace(allowed); allowed != "" {
+			r.allowlist = append(r.allowlist, allowed)
+		}
+	}
+	return r
+}
+
+// Find returns the spans of text to mask.
+func (r *Redactor) Find(text string) []Match {
+	if r == nil || text == "" {
+		return nil
+	}
+	var matches []Match
+	for _, secret := range r.secrets {
+		if r.allowed(secret) {
+			continue
+		}
+		for offset := 0; ; {
+			i := strings.Index(text[offset:], secret)
+			if i < 0 {
+				break
+			}
+			matches = append(matches, Match{Start: offset + i, End: offset + i + len(secret), Kind: "secret"})
+			offset += i + len(secret)
+		}
+	}
+	for _, match := range FindCredentials(text) {
+		if !r.allowed(text[match.Start:match.End]) {
+			matches = append(matches, match)
+		}
+	}
+	return matches
+}
+
+func (r *Redactor) allowed(value string) bool {
+	for _, allowed := range r.allowlist {
+		if strings.Contains(allowed, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Redact replaces every credential and secret in text with a placeholder
+// naming its kind. A nil redactor returns text unchanged.
+func (r *Redactor) Redact(text string) string {
+	matches := r.Find(text)
+	if len(matches) == 0 {
+		return text
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Start < matches[j].Start
+	})
+
+	var b strings.Builder
+	pos := 0
+	for i := 0; i < len(matches); i++ {
+		start, end, kind := matches[i].Start, matches[i].End, matches[i].Kind
+		for i+1 < len(matches) && matches[i+1].Start < end {
+			i++
+			end = max(end, matches[i].End)
+		}
+		start = max(start, pos)
+		b.WriteString(text[pos:start])
+		b.WriteString("[REDACTED:" + kind + "]")
+		pos = end
+	}
+	b.WriteString(text[pos:])
+	return b.String()
+}
+
+// JSON returns v with credentials and secrets masked in its JSON encoding, for
+// values like structs and maps that are sent as JSON. The masks may break
+// non-string JSON values, which are then returned as text.
+func (r *Redactor) JSON(v any) any {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	redacted := r.Redact(string(data))
+	if !json.Valid([]byte(redacted)) {
+		return redacted
+	}
+	return json.RawMessage(redacted)
+}
+
+// Stream redacts text that arrives in chunks. It holds back the tail of the
+// text that may be the start of a secret completed by a later chunk.
+type Stream struct {
+	redactor *Redactor
+	pending  string
+}
+
+// NewStream returns a stream redacting with r.
+func (r *Redactor) NewStream() *Stream {
+	return &Stream{redactor: r}
+}
+
+// Write adds a chunk and returns the redacted text that is safe to emit.
+func (s *Stream) Write(chunk string) string {
+	if s.redactor == nil {
+		return chunk
+	}
+	s.pending += chunk
+	cut := strings.LastIndexAny(s.pending, " \t\r\n") + 1
+	if begin := strings.LastIndex(s.pending, "-----BEGIN "); begin >= 0 && begin > strings.LastIndex(s.pending, "-----END ") {
+		cut = min(cut, begin)
+	}
+	if loc := pendingKeyPattern.FindStringIndex(s.pending[:cut]); loc != nil {
+		cut = loc[0]
+	}
+	if cut <= 0 {
+		return ""
+	}
+	out := s.redactor.Redact(s.pending[:cut])
+	s.pending = s.pending[cut:]
+	return out
+}
+
+// Flush returns the redacted rest of the stream.
+func (s *Stream) Flush() string {
+	out := s.redactor.Redact(s.pending)
+	s.pending = ""
+	return out
+}
+
+type writer struct {
+	redactor *Redactor
+	w        io.Writer
+}
+
+// Writer redacts everything written to w, such as log output. Each write is
+// redacted on its own.
+func Writer(w io.Writer, r *Redactor) io.Writer {
+	return &writer{redactor: r, w: w}
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, w.redactor.Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
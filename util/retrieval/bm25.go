@@ -0,0 +1,152 @@
+package retrieval
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	defaultBM25K1 = 1.2
+	defaultBM25B  = 0.75
+)
+
+var termRegexp = regexp.MustCompile(`[\p{L}\p{N}_]+`)
+
+// ScoredDoc is a retrieved document with the score assigned by the last ranking stage.
+type ScoredDoc struct {
+	Content string
+	Score   float64
+}
+
+// BM25Index is an in-memory keyword index scored with Okapi BM25.
+type BM25Index struct {
+	mu sync.RWMutex
+
+	k1 float64
+	b  float64
+
+	docs      []string
+	docTerms  []map[string]int
+	docLens   []int
+	totalLen  int
+	docFreq   map[string]int
+	contentIx map[string]struct{}
+}
+
+func NewBM25Index() *BM25Index {
+	return &BM25Index{
+		k1:        defaultBM25K1,
+		b:         defaultBM25B,
+		docFreq:   make(map[string]int),
+		contentIx: make(map[string]struct{}),
+	}
+}
+
+func (idx *BM25Index) Add(doc string) {
+	if strings.TrimSpace(doc) == "" {
+		return
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if _, existed := idx.contentIx[doc]; existed {
+		return
+	}
+	idx.contentIx[doc] = struct{}{}
+
+	terms := Tokenize(doc)
+	termFreq := make(map[string]int, len(terms))
+	for _, term := range terms {
+		termFreq[term]++
+	}
+	for term := range termFreq {
+		idx.docFreq[term]++
+	}
+
+	idx.docs = append(idx.docs, doc)
+	idx.docTerms = append(idx.docTerms, termFreq)
+	idx.docLens = append(idx.docLens, len(terms))
+	idx.totalLen += len(terms)
+}
+
+func (idx *BM25Index) Len() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.docs)
+}
+
+func (idx *BM25Index) Search(query string, topK int) []ScoredDoc {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	if len(idx.docs) == 0 {
+		return nil
+	}
+
+	queryTerms := Tokenize(query)
+	if len(queryTerms) == 0 {
+		return nil
+	}
+
+	docCount := float64(len(idx.docs))
+	avgDocLen := float64(idx.totalLen) / docCount
+	if avgDocLen == 0 {
+		avgDocLen = 1
+	}
+
+	results := make([]ScoredDoc, 0, len(idx.docs))
+	for i, termFreq := range idx.docTerms {
+		score := 0.0
+		for _, term := range queryTerms {
+			tf := float64(termFreq[term])
+			if tf == 0 {
+				continue
+			}
+			df := float64(idx.docFreq[term])
+			idf := math.Log(1 + (docCount-df+0.5)/(df+0.5))
+			norm := tf + idx.k1*(1-idx.b+idx.b*float64(idx.docLens[i])/avgDocLen)
+			score += idf * tf * (idx.k1 + 1) / norm
+		}
+		if score > 0 {
+			results = append(results, ScoredDoc{Content: idx.docs[i], Score: score})
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+	if topK > 0 && len(results) > topK {
+		results = results[:topK]
+	}
+	return results
+}
+
+// Tokenize lowercases text and splits it into terms. Han characters are
+// indexed one rune per term since they are not separated by whitespace.
+func Tokenize(text string) []string {
+	words := termRegexp.FindAllString(strings.ToLower(text), -1)
+	terms := make([]string, 0, len(words))
+	for _, word := range words {
+		var latin strings.Builder
+		for _, r := range word {
+			if unicode.Is(unicode.Han, r) {
+				if latin.Len() > 0 {
+					terms = append(terms, latin.String())
+					latin.Reset()
+				}
+				terms = append(terms, string(r))
+				continue
+			}
+			latin.WriteRune(r)
+		}
+		if latin.Len() > 0 {
+			terms = append(terms, latin.String())
+		}
+	}
+	return terms
+}
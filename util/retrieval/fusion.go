@@ -0,0 +1,175 @@
+package retrieval
+
+import (
+	"sort"
+	"strings"
+)
+
+const DefaultRRFK = 60
+
+// ReciprocalRankFusion merges several ranked lists into one, scoring each
+// document by the sum of 1/(k+rank) over the lists it appears in.
+func ReciprocalRankFusion(k int, rankings ...[]string) []ScoredDoc {
+	if k <= 0 {
+		k = DefaultRRFK
+	}
+
+	scores := make(map[string]float64)
+	order := make([]string, 0)
+	for _, ranking := range rankings {
+		seen := make(map[string]struct{}, len(ranking))
+		for rank, doc := range ranking {
+			if _, dup := seen[doc]; dup {
+				continue
+			}
+			seen[doc] = struct{}{}
+			if _, existed := scores[doc]; !existed {
+				order = append(order, doc)
+			}
+			scores[doc] += 1.0 / float64(k+rank+1)
+		}
+	}
+
+	fused := make([]ScoredDoc, 0, len(order))
+	for _, doc := range order {
+		fused = append(fused, ScoredDoc{Content: doc, Score: scores[doc]})
+	}
+	sort.SliceStable(fused, func(i, j int) bool {
+		return fused[i].Score > fused[j].Score
+	})
+	return fused
+}
+
+// MMR selects up to topK documents balancing relevance against redundancy
+// with already selected documents. lambda=1 ranks by relevance only.
+func MMR(candidates []ScoredDoc, lambda float64, topK int) []ScoredDoc {
+	if topK <= 0 || topK > len(candidates) {
+		topK = len(candidates)
+	}
+	if lambda < 0 {
+		lambda = 0
+	}
+	if lambda > 1 {
+		lambda = 1
+	}
+
+	maxScore := 0.0
+	for _, c := range candidates {
+		if c.Score > maxScore {
+			maxScore = c.Score
+		}
+	}
+
+	termSets := make([]map[string]struct{}, len(candidates))
+	for i, c := range candidates {
+		termSets[i] = termSet(c.Content)
+	}
+
+	selected := make([]ScoredDoc, 0, topK)
+	selectedIdx := make([]int, 0, topK)
+	used := make([]bool, len(candidates))
+	for len(selected) < topK {
+		best := -1
+		bestScore := 0.0
+		for i, c := range candidates {
+			if used[i] {
+				continue
+			}
+			relevance := c.Score
+			if maxScore > 0 {
+				relevance = c.Score / maxScore
+			}
+			redundancy := 0.0
+			for _, j := range selectedIdx {
+				if sim := jaccard(termSets[i], termSets[j]); sim > redundancy {
+					redundancy = sim
+				}
+			}
+			mmrScore := lambda*relevance - (1-lambda)*redundancy
+			if best < 0 || mmrScore > bestScore {
+				best = i
+				bestScore = mmrScore
+			}
+		}
+		if best < 0 {
+			break
+		}
+		used[best] = true
+		selectedIdx = append(selectedIdx, best)
+		selected = append(selected, candidates[best])
+	}
+	return selected
+}
+
+// Deduplicate drops candidates that are already covered by existing texts,
+// either verbatim (after normalization) or with term overlap >= threshold.
+func Deduplicate(candidates []ScoredDoc, existing []string, threshold float64) []ScoredDoc {
+	existingNorm := make([]string, 0, len(existing))
+	existingSets := make([]map[string]struct{}, 0, len(existing))
+	for _, text := range existing {
+		existingNorm = append(existingNorm, normalize(text))
+		existingSets = append(existingSets, termSet(text))
+	}
+
+	kept := make([]ScoredDoc, 0, len(candidates))
+	keptSets := make([]map[string]struct{}, 0, len(candidates))
+	for _, c := range candidates {
+		norm := normalize(c.Content)
+		if norm == "" {
+			continue
+		}
+		set := termSet(c.Content)
+
+		duplicated := false
+		for i, ex := range existingNorm {
+			if strings.Contains(ex, norm) || (threshold > 0 && jaccard(set, existingSets[i]) >= threshold) {
+				duplicated = true
+				break
+			}
+		}
+		if !duplicated && threshold > 0 {
+			for _, keptSet := range keptSets {
+				if jaccard(set, keptSet) >= threshold {
+					duplicated = true
+					break
+				}
+			}
+		}
+		if duplicated {
+			continue
+		}
+		kept = append(kept, c)
+		keptSets = append(keptSets, set)
+	}
+	return kept
+}
+
+func normalize(text string) string {
+	return strings.Join(strings.Fields(strings.ToLower(text)), " ")
+}
+
+func termSet(text string) map[string]struct{} {
+	terms := Tokenize(text)
+	set := make(map[string]struct{}, len(terms))
+	for _, term := range terms {
+		set[term] = struct{}{}
+	}
+	return set
+}
+
+func jaccard(a, b map[string]struct{}) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	intersection := 0
+	for term := range a {
+		if _, ok := b[term]; ok {
+			intersection++
+		}
+	}
+	union := len(a) + len(b) - intersection
+	if union == 0 {
+		return 0
+	}
+	return float64(intersection) / float64(union)
+}
@@ -0,0 +1,93 @@
+package retrieval
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	httpPKG "github.com/luoxiaojun1992/ai-agent/pkg/http"
+)
+
+// Reranker scores each document against the query. The returned slice must
+// have the same length and order as docs; higher means more relevant.
+type Reranker interface {
+	Rerank(ctx context.Context, query string, docs []string) ([]float64, error)
+}
+
+// ApplyReranker rescores candidates with reranker and sorts them by the new score.
+func ApplyReranker(ctx context.Context, reranker Reranker, query string, candidates []ScoredDoc) ([]ScoredDoc, error) {
+	if reranker == nil || len(candidates) == 0 {
+		return candidates, nil
+	}
+
+	docs := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		docs = append(docs, c.Content)
+	}
+	scores, err := reranker.Rerank(ctx, query, docs)
+	if err != nil {
+		return nil, err
+	}
+	if len(scores) != len(candidates) {
+		return nil, fmt.Errorf("reranker returned %d scores for %d documents", len(scores), len(candidates))
+	}
+
+	reranked := make([]ScoredDoc, 0, len(candidates))
+	for i, c := range candidates {
+		reranked = append(reranked, ScoredDoc{Content: c.Content, Score: scores[i]})
+	}
+	sort.SliceStable(reranked, func(i, j int) bool {
+		return reranked[i].Score > reranked[j].Score
+	})
+	return reranked, nil
+}
+
+// CrossEncoderReranker calls a cross-encoder served behind a
+// text-embeddings-inference compatible `/rerank` endpoint.
+type CrossEncoderReranker struct {
+	Client httpPKG.IClient
+	Path   string
+}
+
+type crossEncoderRequest struct {
+	Query string   `json:"query"`
+	Texts []string `json:"texts"`
+}
+
+type crossEncoderResult struct {
+	Index int     `json:"index"`
+	Score float64 `json:"score"`
+}
+
+func (r *CrossEncoderReranker) Rerank(ctx context.Context, query string, docs []string) ([]float64, error) {
+	path := r.Path
+	if path == "" {
+		path = "/rerank"
+	}
+
+	resp, err := r.Client.SendRequestWithContext(ctx, http.MethodPost, path, &crossEncoderRequest{Query: query, Texts: docs}, nil, http.Header{
+		httpPKG.HeaderContentType: []string{httpPKG.ContentTypeJson},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, fmt.Errorf("error reranking documents, status code %d", resp.StatusCode)
+	}
+
+	var results []crossEncoderResult
+	if err := json.Unmarshal(resp.Body, &results); err != nil {
+		return nil, err
+	}
+
+	scores := make([]float64, len(docs))
+	for _, result := range results {
+		if result.Index < 0 || result.Index >= len(docs) {
+			return nil, fmt.Errorf("reranker returned out of range index %d", result.Index)
+		}
+		scores[result.Index] = result.Score
+	}
+	return scores, nil
+}
@@ -0,0 +1,207 @@
+package retrieval
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+
+	httpPKG "github.com/luoxiaojun1992/ai-agent/pkg/http"
+)
+
+func TestTokenize_SplitsHanRunes(t *testing.T) {
+	terms := Tokenize("Milvus 向量库 v2")
+	expected := []string{"milvus", "向", "量", "库", "v2"}
+	if len(terms) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, terms)
+	}
+	for i := range expected {
+		if terms[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, terms)
+		}
+	}
+}
+
+func TestBM25Index_RanksKeywordMatchesFirst(t *testing.T) {
+	idx := NewBM25Index()
+	idx.Add("the user prefers dark mode in the editor")
+	idx.Add("milvus collection ai_agent_memory stores embeddings")
+	idx.Add("weather in beijing is sunny")
+	idx.Add("weather in beijing is sunny")
+
+	if idx.Len() != 3 {
+		t.Fatalf("expected duplicate documents to be indexed once, got %d", idx.Len())
+	}
+
+	results := idx.Search("which milvus collection", 2)
+	if len(results) != 1 {
+		t.Fatalf("expected 1 keyword hit, got %d", len(results))
+	}
+	if results[0].Content != "milvus collection ai_agent_memory stores embeddings" {
+		t.Fatalf("unexpected top hit: %s", results[0].Content)
+	}
+
+	if hits := idx.Search("", 2); hits != nil {
+		t.Fatalf("expected no hits for empty query, got %v", hits)
+	}
+}
+
+func TestReciprocalRankFusion_RewardsAgreement(t *testing.T) {
+	fused := ReciprocalRankFusion(0,
+		[]string{"a", "b", "c"},
+		[]string{"c", "d", "a"},
+	)
+	if len(fused) != 4 {
+		t.Fatalf("expected 4 fused docs, got %d", len(fused))
+	}
+	if fused[0].Content != "a" {
+		t.Fatalf("expected doc ranked by both lists first, got %s", fused[0].Content)
+	}
+	if fused[len(fused)-1].Content != "d" && fused[len(fused)-1].Content != "b" {
+		t.Fatalf("expected single-list doc last, got %s", fused[len(fused)-1].Content)
+	}
+}
+
+func TestMMR_PrefersDiverseDocuments(t *testing.T) {
+	candidates := []ScoredDoc{
+		{Content: "beijing weather is sunny today", Score: 1.0},
+		{Content: "beijing weather is sunny today indeed", Score: 0.95},
+		{Content: "shanghai has heavy rain", Score: 0.6},
+	}
+
+	selected := MMR(candidates, 0.5, 2)
+	if len(selected) != 2 {
+		t.Fatalf("expected 2 selected docs, got %d", len(selected))
+	}
+	if selected[1].Content != "shanghai has heavy rain" {
+		t.Fatalf("expected diverse doc to be selected second, got %s", selected[1].Content)
+	}
+
+	relevanceOnly := MMR(candidates, 1, 2)
+	if relevanceOnly[1].Content != "beijing weather is sunny today indeed" {
+		t.Fatalf("expected relevance order with lambda=1, got %s", relevanceOnly[1].Content)
+	}
+}
+
+func TestDeduplicate_DropsDocsAlreadyInMemory(t *testing.T) {
+	candidates := []ScoredDoc{
+		{Content: "The user lives in Hangzhou"},
+		{Content: "the user likes green tea"},
+		{Content: "The user likes  green tea!"},
+	}
+	existing := []string{"Context: \nthe user lives in hangzhou"}
+
+	kept := Deduplicate(candidates, existing, 0.9)
+	if len(kept) != 1 {
+		t.Fatalf("expected 1 doc left, got %d: %v", len(kept), kept)
+	}
+	if kept[0].Content != "the user likes green tea" {
+		t.Fatalf("unexpected kept doc: %s", kept[0].Content)
+	}
+}
+
+type staticReranker struct {
+	scores []float64
+	err    error
+}
+
+func (r *staticReranker) Rerank(_ context.Context, _ string, _ []string) ([]float64, error) {
+	return r.scores, r.err
+}
+
+func TestApplyReranker(t *testing.T) {
+	candidates := []ScoredDoc{{Content: "a", Score: 1}, {Content: "b", Score: 0.5}}
+
+	reranked, err := ApplyReranker(context.Background(), &staticReranker{scores: []float64{0.1, 0.9}}, "q", candidates)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reranked[0].Content != "b" {
+		t.Fatalf("expected reranked order [b a], got %v", reranked)
+	}
+
+	if _, err := ApplyReranker(context.Background(), &staticReranker{scores: []float64{1}}, "q", candidates); err == nil {
+		t.Fatalf("expected score length mismatch error")
+	}
+	if _, err := ApplyReranker(context.Background(), &staticReranker{err: errors.New("boom")}, "q", candidates); err == nil {
+		t.Fatalf("expected reranker error")
+	}
+
+	unchanged, err := ApplyReranker(context.Background(), nil, "q", candidates)
+	if err != nil || len(unchanged) != 2 || unchanged[0].Content != "a" {
+		t.Fatalf("expected nil reranker to keep candidates, got %v %v", unchanged, err)
+	}
+}
+
+type mockHTTPClient struct {
+	method string
+	path   string
+	body   any
+	resp   *httpPKG.Response
+	err    error
+}
+
+func (m *mockHTTPClient) SetBaseURL(string)          {}
+func (m *mockHTTPClient) SetAllowedURLList([]string) {}
+func (m *mockHTTPClient) AddDefaultHeader(_, _ string) {
+}
+func (m *mockHTTPClient) Get(string, url.Values, http.Header) (*httpPKG.Response, error) {
+	return nil, nil
+}
+func (m *mockHTTPClient) Post(string, any, url.Values, http.Header) (*httpPKG.Response, error) {
+	return nil, nil
+}
+func (m *mockHTTPClient) Patch(string, any, url.Values, http.Header) (*httpPKG.Response, error) {
+	return nil, nil
+}
+func (m *mockHTTPClient) Delete(string, any, url.Values, http.Header) (*httpPKG.Response, error) {
+	return nil, nil
+}
+func (m *mockHTTPClient) SendRequest(string, string, any, url.Values, http.Header) (*httpPKG.Response, error) {
+	return nil, nil
+}
+func (m *mockHTTPClient) SendRequestWithContext(ctx context.Context, method, path string, body any, _ url.Values, _ http.Header) (*httpPKG.Response, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.method = method
+	m.path = path
+	m.body = body
+	return m.resp, m.err
+}
+
+func TestCrossEncoderReranker(t *testing.T) {
+	cli := &mockHTTPClient{resp: &httpPKG.Response{
+		StatusCode: 200,
+		Body:       []byte(`[{"index":1,"score":0.8},{"index":0,"score":0.2}]`),
+	}}
+	reranker := &CrossEncoderReranker{Client: cli}
+
+	scores, err := reranker.Rerank(context.Background(), "q", []string{"a", "b"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cli.method != http.MethodPost || cli.path != "/rerank" {
+		t.Fatalf("expected POST to the default rerank path, got %s %s", cli.method, cli.path)
+	}
+	if scores[0] != 0.2 || scores[1] != 0.8 {
+		t.Fatalf("unexpected scores: %v", scores)
+	}
+
+	cli.resp = &httpPKG.Response{StatusCode: 500}
+	if _, err := reranker.Rerank(context.Background(), "q", []string{"a"}); err == nil {
+		t.Fatalf("expected bad status error")
+	}
+
+	cli.resp = &httpPKG.Response{StatusCode: 200, Body: []byte(`[{"index":5,"score":1}]`)}
+	if _, err := reranker.Rerank(context.Background(), "q", []string{"a"}); err == nil {
+		t.Fatalf("expected out of range index error")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := reranker.Rerank(ctx, "q", []string{"a"}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the request cancelled with ctx, got %v", err)
+	}
+}
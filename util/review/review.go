@@ -0,0 +1,222 @@
+package review
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/luoxiaojun1992/ai-agent/util/prompt"
+)
+
+// Severity grades how serious a failed rubric is.
+type Severity string
+
+const (
+	SeverityNone     Severity = "none"
+	SeverityLow      Severity = "low"
+	SeverityMedium   Severity = "medium"
+	SeverityHigh     Severity = "high"
+	SeverityCritical Severity = "critical"
+)
+
+var severityRanks = map[Severity]int{
+	SeverityNone:     0,
+	SeverityLow:      1,
+	SeverityMedium:   2,
+	SeverityHigh:     3,
+	SeverityCritical: 4,
+}
+
+// ParseSeverity accepts a severity name in any case; unknown names are an
+// error.
+func ParseSeverity(name string) (Severity, error) {
+	severity := Severity(strings.ToLower(strings.TrimSpace(name)))
+	if _, ok := severityRanks[severity]; !ok {
+		return "", fmt.Errorf("unknown severity %q", name)
+	}
+	return severity, nil
+}
+
+// AtLeast reports whether s is as serious as other. Unknown severities rank
+// as medium.
+func (s Severity) AtLeast(other Severity) bool {
+	return s.rank() >= other.rank()
+}
+
+func (s Severity) rank() int {
+	if rank, ok := severityRanks[s]; ok {
+		return rank
+	}
+	return severityRanks[SeverityMedium]
+}
+
+// Rubric is one aspect a response is judged on.
+type Rubric struct {
+	Name     string `json:"name"`
+	Criteria string `json:"criteria"`
+}
+
+var (
+	RubricLogic = Rubric{
+		Name:     "logic",
+		Criteria: "The response is logically coherent: no contradictions, unreasonable causal relationships or incomplete reasoning.",
+	}
+	RubricSafety = Rubric{
+		Name:     "safety",
+		Criteria: "The response contains no harmful, dangerous, hateful or illegal content and does not leak secrets or personal data.",
+	}
+	RubricToolUse = Rubric{
+		Name:     "tool_use",
+		Criteria: "Every <tool> call uses an available function with sensible arguments, and the response does not claim tool results it has not received.",
+	}
+	RubricPolicy = Rubric{
+		Name:     "policy",
+		Criteria: "The response follows the system instructions and the persona of the assistant.",
+	}
+)
+
+// DefaultRubrics returns the built-in rubrics.
+func DefaultRubrics() []Rubric {
+	return []Rubric{RubricLogic, RubricSafety, RubricToolUse, RubricPolicy}
+}
+
+// RubricsByName returns the built-in rubrics with the given names, in order.
+func RubricsByName(names []string) ([]Rubric, error) {
+	builtin := make(map[string]Rubric)
+	for _, rubric := range DefaultRubrics() {
+		builtin[rubric.Name] = rubric
+	}
+	rubrics := make([]Rubric, 0, len(names))
+	for _, name := range names {
+		rubric, ok := builtin[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown review rubric %q", name)
+		}
+		rubrics = append(rubrics, rubric)
+	}
+	return rubrics, nil
+}
+
+// Verdict is the judgement of a response on one rubric.
+type Verdict struct {
+	Rubric   string   `json:"rubric"`
+	Pass     bool     `json:"pass"`
+	Severity Severity `json:"severity"`
+	Reasons  []string `json:"reasons,omitempty"`
+}
+
+// Request is what a reviewer judges: the response to the latest user
+// message, with the tool outputs gathered since then as context.
+type Request struct {
+	Prompt   string
+	Response string
+	Context  []string
+	Rubrics  []Rubric
+}
+
+// Reviewer judges a response on each rubric of the request.
+type Reviewer interface {
+	Review(ctx context.Context, req *Request) ([]*Verdict, error)
+}
+
+// Blocking returns the failed verdicts at least as severe as threshold.
+func Blocking(verdicts []*Verdict, threshold Severity) []*Verdict {
+	var blocking []*Verdict
+	for _, verdict := range verdicts {
+		if !verdict.Pass && verdict.Severity.AtLeast(threshold) {
+			blocking = append(blocking, verdict)
+		}
+	}
+	return blocking
+}
+
+// Critique renders failed verdicts as feedback for the model that wrote the
+// response.
+func Critique(verdicts []*Verdict) string {
+	var b strings.Builder
+	for _, verdict := range verdicts {
+		fmt.Fprintf(&b, "- %s (%s severity)", verdict.Rubric, verdict.Severity)
+		if len(verdict.Reasons) > 0 {
+			b.WriteString(": ")
+			b.WriteString(strings.Join(verdict.Reasons, "; "))
+		}
+		b.WriteString("\n")
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// VerdictSchema is the JSON Schema of the output ParseVerdicts expects.
+const VerdictSchema = `{"type":"object","properties":{"verdicts":{"type":"array","items":{"type":"object","properties":{"rubric":{"type":"string"},"pass":{"type":"boolean"},"severity":{"type":"string","enum":["none","low","medium","high","critical"]},"reasons":{"type":"array","items":{"type":"string"}}},"required":["rubric","pass","severity"]}}},"required":["verdicts"]}`
+
+// ParseVerdicts decodes reviewer model output shaped like VerdictSchema. It
+// tolerates code fences and common JSON defects, and accepts a bare array.
+// Every rubric of the request must be judged.
+func ParseVerdicts(output string, rubrics []Rubric) ([]*Verdict, error) {
+	content, _ := prompt.SplitThinking(output)
+	content = strings.TrimSpace(content)
+	if !json.Valid([]byte(content)) {
+		content = prompt.RepairJSON(content)
+	}
+
+	var wrapper struct {
+		Verdicts []*Verdict `json:"verdicts"`
+	}
+	if err := json.Unmarshal([]byte(content), &wrapper); err != nil {
+		if errArray := json.Unmarshal([]byte(content), &wrapper.Verdicts); errArray != nil {
+			return nil, fmt.Errorf("invalid review output: %w", err)
+		}
+	}
+
+	byRubric := make(map[string]*Verdict, len(wrapper.Verdicts))
+	for _, verdict := range wrapper.Verdicts {
+		if verdict == nil {
+			continue
+		}
+		verdict.Rubric = strings.TrimSpace(verdict.Rubric)
+		if severity, err := ParseSeverity(string(verdict.Severity)); err == nil {
+			verdict.Severity = severity
+		} else if verdict.Pass {
+			verdict.Severity = SeverityNone
+		} else {
+			verdict.Severity = SeverityMedium
+		}
+		byRubric[verdict.Rubric] = verdict
+	}
+
+	verdicts := make([]*Verdict, 0, len(rubrics))
+	for _, rubric := range rubrics {
+		verdict, ok := byRubric[rubric.Name]
+		if !ok {
+			return nil, errors.New("invalid review output: no verdict for rubric " + rubric.Name)
+		}
+		verdicts = append(verdicts, verdict)
+	}
+	return verdicts, nil
+}
+
+// Prompt builds the instruction for a reviewer model.
+func Prompt(req *Request) string {
+	var b strings.Builder
+	b.WriteString("You are a strict reviewer. Judge the assistant response below on each rubric.\n\nRubrics:\n")
+	for _, rubric := range req.Rubrics {
+		fmt.Fprintf(&b, "- %s: %s\n", rubric.Name, rubric.Criteria)
+	}
+	b.WriteString("\nAnswer with JSON only, in the form ")
+	b.WriteString(`{"verdicts":[{"rubric":"<name>","pass":true|false,"severity":"none|low|medium|high|critical","reasons":["..."]}]}`)
+	b.WriteString(" with one verdict per rubric. Passing verdicts have severity none.\n")
+	if req.Prompt != "" {
+		b.WriteString("\nUser message:\n")
+		b.WriteString(req.Prompt)
+		b.WriteString("\n")
+	}
+	if len(req.Context) > 0 {
+		b.WriteString("\nTool outputs so far:\n")
+		b.WriteString(strings.Join(req.Context, "\n"))
+		b.WriteString("\n")
+	}
+	b.WriteString("\nAssistant response:\n")
+	b.WriteString(req.Response)
+	return b.String()
+}
@@ -0,0 +1,66 @@
+package review
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseVerdicts(t *testing.T) {
+	rubrics := []Rubric{RubricLogic, RubricSafety}
+
+	verdicts, err := ParseVerdicts(`<think>checking</think>[{"rubric":"logic","pass":true},{"rubric":"safety","pass":false,"severity":"bogus","reasons":["x"],}]`, rubrics)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if verdicts[0].Severity != SeverityNone || verdicts[1].Severity != SeverityMedium {
+		t.Fatalf("unexpected default severities: %+v %+v", verdicts[0], verdicts[1])
+	}
+
+	if _, err := ParseVerdicts(`{"verdicts":[{"rubric":"logic","pass":true}]}`, rubrics); err == nil || !strings.Contains(err.Error(), "safety") {
+		t.Fatalf("expected missing rubric error, got %v", err)
+	}
+	if _, err := ParseVerdicts("true", rubrics); err == nil {
+		t.Fatalf("expected invalid output error")
+	}
+}
+
+func TestBlockingAndCritique(t *testing.T) {
+	verdicts := []*Verdict{
+		{Rubric: "logic", Pass: false, Severity: SeverityLow, Reasons: []string{"minor gap"}},
+		{Rubric: "safety", Pass: false, Severity: SeverityCritical, Reasons: []string{"a", "b"}},
+		{Rubric: "policy", Pass: true, Severity: SeverityNone},
+	}
+	blocking := Blocking(verdicts, SeverityMedium)
+	if len(blocking) != 1 || blocking[0].Rubric != "safety" {
+		t.Fatalf("unexpected blocking verdicts: %+v", blocking)
+	}
+	if got := Critique(blocking); got != "- safety (critical severity): a; b" {
+		t.Fatalf("unexpected critique: %q", got)
+	}
+	if len(Blocking(verdicts, SeverityLow)) != 2 {
+		t.Fatalf("expected low threshold to block both failures")
+	}
+}
+
+func TestRubricsAndSeverity(t *testing.T) {
+	rubrics, err := RubricsByName([]string{"tool_use", " policy"})
+	if err != nil || len(rubrics) != 2 || rubrics[0] != RubricToolUse || rubrics[1] != RubricPolicy {
+		t.Fatalf("unexpected rubrics: %+v %v", rubrics, err)
+	}
+	if _, err := RubricsByName([]string{"style"}); err == nil {
+		t.Fatalf("expected unknown rubric error")
+	}
+	if severity, err := ParseSeverity(" High "); err != nil || severity != SeverityHigh {
+		t.Fatalf("unexpected severity: %v %v", severity, err)
+	}
+	if _, err := ParseSeverity("urgent"); err == nil {
+		t.Fatalf("expected unknown severity error")
+	}
+
+	text := Prompt(&Request{Prompt: "q", Response: "r", Context: []string{"out"}, Rubrics: []Rubric{RubricLogic}})
+	for _, want := range []string{"- logic:", "User message:\nq", "Tool outputs so far:\nout", "Assistant response:\nr"} {
+		if !strings.Contains(text, want) {
+			t.Fatalf("expected %q in prompt %q", want, text)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/invopop/jsonschema"
+)
+
+// Schema is a decoded JSON Schema document.
+type Schema map[string]any
+
+// Parse decodes a JSON Schema document.
+func Parse(raw json.RawMessage) (Schema, error) {
+	var s Schema
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, fmt.Errorf("invalid json schema: %w", err)
+	}
+	return s, nil
+}
+
+// FromValue derives a JSON Schema from the type of v, typically a pointer to a
+// struct. Definitions are inlined because model servers translating schemas to
+// grammars often do not follow $ref.
+func FromValue(v any) (json.RawMessage, error) {
+	if v == nil {
+		return nil, errors.New("cannot derive a schema from nil")
+	}
+	reflector := &jsonschema.Reflector{
+		DoNotReference: true,
+		ExpandedStruct: true,
+	}
+	s := reflector.ReflectFromType(reflect.TypeOf(v))
+	s.Version = ""
+	s.ID = ""
+	return json.Marshal(s)
+}
+
+// ValidationError lists every violation found in a document.
+type ValidationError struct {
+	Violations []string
+}
+
+func (e *ValidationError) Error() string {
+	return strings.Join(e.Violations, "; ")
+}
+
+// Validate checks the JSON document data against the schema. It supports the
+// keywords structured output schemas use: type, enum, const, properties,
+// required, additionalProperties, items, min/max bounds, pattern, anyOf,
+// oneOf, allOf and local $ref.
+func (s Schema) Validate(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return fmt.Errorf("invalid json: %w", err)
+	}
+	if decoder.More() {
+		return errors.New("invalid json: unexpected data after the top-level value")
+	}
+
+	v := &validator{root: s}
+	v.validate(map[string]any(s), value, "$")
+	if len(v.violations) > 0 {
+		return &ValidationError{Violations: v.violations}
+	}
+	return nil
+}
+
+type validator struct {
+	root       Schema
+	violations []string
+}
+
+func (v *validator) fail(path, format string, args ...any) {
+	v.violations = append(v.violations, path+": "+fmt.Sprintf(format, args...))
+}
+
+func (v *validator) validate(s map[string]any, value any, path string) {
+	if ref, ok := s["$ref"].(string); ok {
+		resolved, err := v.resolve(ref)
+		if err != nil {
+			v.fail(path, "%v", err)
+			return
+		}
+		s = resolved
+	}
+
+	if types, ok := schemaTypes(s["type"]); ok && !matchesAnyType(value, types) {
+		v.fail(path, "expected %s, got %s", strings.Join(types, " or "), typeName(value))
+		return
+	}
+	if enum, ok := s["enum"].([]any); ok && !containsJSON(enum, value) {
+		v.fail(path, "value is not one of the allowed values")
+	}
+	if constant, ok := s["const"]; ok && !equalJSON(constant, value) {
+		v.fail(path, "value does not match the constant")
+	}
+
+	switch typed := value.(type) {
+	case map[string]any:
+		v.validateObject(s, typed, path)
+	case []any:
+		v.validateArray(s, typed, path)
+	case string:
+		v.validateString(s, typed, path)
+	case json.Number:
+		v.validateNumber(s, typed, path)
+	}
+
+	v.validateCombinators(s, value, path)
+}
+
+func (v *validator) validateObject(s map[string]any, object map[string]any, path string) {
+	properties, _ := s["properties"].(map[string]any)
+	if required, ok := s["required"].([]any); ok {
+		for _, name := range required {
+			key, _ := name.(string)
+			if _, present := object[key]; !present {
+				v.fail(path, "missing required property %q", key)
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		childPath := path + "." + key
+		if propSchema, ok := properties[key].(map[string]any); ok {
+			v.validate(propSchema, object[key], childPath)
+			continue
+		}
+		switch additional := s["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				v.fail(path, "unexpected property %q", key)
+			}
+		case map[string]any:
+			v.validate(additional, object[key], childPath)
+		}
+	}
+}
+
+func (v *validator) validateArray(s map[string]any, array []any, path string) {
+	if min, ok := number(s["minItems"]); ok && float64(len(array)) < min {
+		v.fail(path, "expected at least %v items, got %d", min, len(array))
+	}
+	if max, ok := number(s["maxItems"]); ok && float64(len(array)) > max {
+		v.fail(path, "expected at most %v items, got %d", max, len(array))
+	}
+	if items, ok := s["items"].(map[string]any); ok {
+		for i, item := range array {
+			v.validate(items, item, fmt.Sprintf("%s[%d]", path, i))
+		}
+	}
+}
+
+func (v *validator) validateString(s map[string]any, str, path string) {
+	length := float64(utf8.RuneCountInString(str))
+	if min, ok := number(s["minLength"]); ok && length < min {
+		v.fail(path, "expected at least %v characters", min)
+	}
+	if max, ok := number(s["maxLength"]); ok && length > max {
+		v.fail(path, "expected at most %v characters", max)
+	}
+	if pattern, ok := s["pattern"].(string); ok {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			v.fail(path, "invalid pattern %q in schema", pattern)
+		} else if !re.MatchString(str) {
+			v.fail(path, "value does not match pattern %q", pattern)
+		}
+	}
+}
+
+func (v *validator) validateNumber(s map[string]any, num json.Number, path string) {
+	f, err := num.Float64()
+	if err != nil {
+		v.fail(path, "invalid number %s", num)
+		return
+	}
+	if min, ok := number(s["minimum"]); ok && f < min {
+		v.fail(path, "expected a value >= %v", min)
+	}
+	if max, ok := number(s["maximum"]); ok && f > max {
+		v.fail(path, "expected a value <= %v", max)
+	}
+	if min, ok := number(s["exclusiveMinimum"]); ok && f <= min {
+		v.fail(path, "expected a value > %v", min)
+	}
+	if max, ok := number(s["exclusiveMaximum"]); ok && f >= max {
+		v.fail(path, "expected a value < %v", max)
+	}
+}
+
+func (v *validator) validateCombinators(s map[string]any, value any, path string) {
+	if allOf, ok := s["allOf"].([]any); ok {
+		for _, sub := range allOf {
+			if subSchema, ok := sub.(map[string]any); ok {
+				v.validate(subSchema, value, path)
+			}
+		}
+	}
+	if anyOf, ok := s["anyOf"].([]any); ok && v.countMatches(anyOf, value, path) == 0 {
+		v.fail(path, "value does not match any of the allowed schemas")
+	}
+	if oneOf, ok := s["oneOf"].([]any); ok && v.countMatches(oneOf, value, path) != 1 {
+		v.fail(path, "value must match exactly one of the allowed schemas")
+	}
+}
+
+func (v *validator) countMatches(schemas []any, value any, path string) int {
+	matches := 0
+	for _, sub := range schemas {
+		subSchema, ok := sub.(map[string]any)
+		if !ok {
+			continue
+		}
+		probe := &validator{root: v.root}
+		probe.validate(subSchema, value, path)
+		if len(probe.violations) == 0 {
+			matches++
+		}
+	}
+	return matches
+}
+
+// resolve follows local references such as "#/$defs/Item".
+func (v *validator) resolve(ref string) (map[string]any, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("unsupported remote reference %q", ref)
+	}
+	var node any = map[string]any(v.root)
+	for _, part := range strings.Split(strings.TrimPrefix(strings.TrimPrefix(ref, "#"), "/"), "/") {
+		if part == "" {
+			continue
+		}
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		object, ok := node.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("unresolvable reference %q", ref)
+		}
+		node = object[part]
+	}
+	resolved, ok := node.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("unresolvable reference %q", ref)
+	}
+	return resolved, nil
+}
+
+func schemaTypes(raw any) ([]string, bool) {
+	switch typed := raw.(type) {
+	case string:
+		return []string{typed}, true
+	case []any:
+		types := make([]string, 0, len(typed))
+		for _, t := range typed {
+			if name, ok := t.(string); ok {
+				types = append(types, name)
+			}
+		}
+		return types, len(types) > 0
+	}
+	return nil, false
+}
+
+func matchesAnyType(value any, types []string) bool {
+	for _, t := range types {
+		if matchesType(value, t) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesType(value any, t string) bool {
+	switch t {
+	case "object":
+		_, ok := value.(map[string]any)
+		return ok
+	case "array":
+		_, ok := value.([]any)
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	case "number":
+		_, ok := value.(json.Number)
+		return ok
+	case "integer":
+		num, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		f, err := num.Float64()
+		return err == nil && f == math.Trunc(f)
+	}
+	return false
+}
+
+func typeName(value any) string {
+	switch value.(type) {
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	case nil:
+		return "null"
+	}
+	return "unknown"
+}
+
+func number(raw any) (float64, bool) {
+	f, ok := raw.(float64)
+	return f, ok
+}
+
+func containsJSON(values []any, value any) bool {
+	for _, candidate := range values {
+		if equalJSON(candidate, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// equalJSON compares a schema literal with a decoded value by their canonical
+// JSON encoding, so numbers compare by value regardless of representation.
+func equalJSON(a, b any) bool {
+	left, errA := canonicalJSON(a)
+	right, errB := canonicalJSON(b)
+	return errA == nil && errB == nil && left == right
+}
+
+func canonicalJSON(value any) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	var normalized any
+	if err := json.Unmarshal(data, &normalized); err != nil {
+		return "", err
+	}
+	data, err = json.Marshal(normalized)
+	return string(data), err
+}
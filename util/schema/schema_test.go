@@ -0,0 +1,90 @@
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+type testAnswer struct {
+	Title string   `json:"title" jsonschema:"minLength=1"`
+	Score int      `json:"score" jsonschema:"minimum=0,maximum=10"`
+	Tags  []string `json:"tags,omitempty"`
+	Item  struct {
+		Name string `json:"name"`
+	} `json:"item"`
+}
+
+func TestFromValue_DerivesInlineObjectSchema(t *testing.T) {
+	raw, err := FromValue(&testAnswer{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(string(raw), "$ref") || strings.Contains(string(raw), "$schema") {
+		t.Fatalf("expected inlined schema without $ref/$schema, got %s", raw)
+	}
+	s, err := Parse(raw)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if s["type"] != "object" {
+		t.Fatalf("expected object schema, got %s", raw)
+	}
+
+	if err := s.Validate([]byte(`{"title":"ok","score":3,"item":{"name":"x"}}`)); err != nil {
+		t.Fatalf("expected valid document, got %v", err)
+	}
+	err = s.Validate([]byte(`{"title":"","score":11.5,"extra":1}`))
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("expected validation error, got %v", err)
+	}
+	msg := validationErr.Error()
+	for _, want := range []string{`missing required property "item"`, `unexpected property "extra"`, "$.score: expected integer", "$.title: expected at least 1 characters"} {
+		if !strings.Contains(msg, want) {
+			t.Fatalf("expected %q in %q", want, msg)
+		}
+	}
+
+	if _, err := FromValue(nil); err == nil {
+		t.Fatalf("expected error for nil value")
+	}
+}
+
+func TestValidate_Keywords(t *testing.T) {
+	s, err := Parse(json.RawMessage(`{
+  "$defs": {"level": {"enum": ["low", "high"]}},
+  "type": "object",
+  "properties": {
+    "level": {"$ref": "#/$defs/level"},
+    "items": {"type": "array", "items": {"type": ["string", "null"]}, "maxItems": 2},
+    "id": {"type": "string", "pattern": "^[a-z]+$"},
+    "value": {"oneOf": [{"type": "integer"}, {"type": "string"}]},
+    "fixed": {"const": 1}
+  }
+}`))
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	if err := s.Validate([]byte(`{"level":"low","items":["a",null],"id":"abc","value":3,"fixed":1.0}`)); err != nil {
+		t.Fatalf("expected valid document, got %v", err)
+	}
+	err = s.Validate([]byte(`{"level":"mid","items":["a",1,"c"],"id":"ABC","value":true,"fixed":2}`))
+	if err == nil {
+		t.Fatalf("expected violations")
+	}
+	for _, want := range []string{"$.level: value is not one of", "$.items: expected at most 2 items", "$.items[1]: expected string or null", "$.id: value does not match pattern", "$.value: value must match exactly one", "$.fixed: value does not match the constant"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %q in %q", want, err.Error())
+		}
+	}
+
+	if err := s.Validate([]byte(`{"level":"low"} {}`)); err == nil || !strings.Contains(err.Error(), "invalid json") {
+		t.Fatalf("expected trailing data error, got %v", err)
+	}
+	if _, err := Parse(json.RawMessage(`[`)); err == nil {
+		t.Fatalf("expected parse error")
+	}
+}
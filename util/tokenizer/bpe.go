@@ -0,0 +1,172 @@
+package tokenizer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// bpe merges adjacent symbols by ascending rank until no ranked pair remains.
+// Symbols are byte strings for tiktoken files and byte-to-unicode mapped
+// strings for HuggingFace byte-level BPE.
+type bpe struct {
+	// tokenRanks holds whole-token ranks (tiktoken).
+	tokenRanks map[string]int
+	// mergeRanks holds pair ranks keyed by "left right" (HuggingFace merges).
+	mergeRanks map[string]int
+	byteLevel  bool
+}
+
+func (b *bpe) Count(text string) int {
+	count := 0
+	for _, piece := range pretokenize(text) {
+		count += b.countPiece(piece)
+	}
+	return count
+}
+
+func (b *bpe) countPiece(piece string) int {
+	symbols := b.initialSymbols(piece)
+	if len(symbols) <= 1 {
+		return len(symbols)
+	}
+	if b.tokenRanks != nil {
+		if _, ok := b.tokenRanks[piece]; ok {
+			return 1
+		}
+	}
+
+	for len(symbols) > 1 {
+		bestIdx := -1
+		bestRank := 0
+		for i := 0; i < len(symbols)-1; i++ {
+			rank, ok := b.pairRank(symbols[i], symbols[i+1])
+			if !ok {
+				continue
+			}
+			if bestIdx < 0 || rank < bestRank {
+				bestIdx = i
+				bestRank = rank
+			}
+		}
+		if bestIdx < 0 {
+			break
+		}
+		symbols[bestIdx] += symbols[bestIdx+1]
+		symbols = append(symbols[:bestIdx+1], symbols[bestIdx+2:]...)
+	}
+	return len(symbols)
+}
+
+func (b *bpe) initialSymbols(piece string) []string {
+	raw := []byte(piece)
+	symbols := make([]string, 0, len(raw))
+	for _, c := range raw {
+		if b.byteLevel {
+			symbols = append(symbols, string(byteToUnicode[c]))
+			continue
+		}
+		symbols = append(symbols, string([]byte{c}))
+	}
+	return symbols
+}
+
+func (b *bpe) pairRank(left, right string) (int, bool) {
+	if b.mergeRanks != nil {
+		rank, ok := b.mergeRanks[left+" "+right]
+		return rank, ok
+	}
+	rank, ok := b.tokenRanks[left+right]
+	return rank, ok
+}
+
+func parseTiktoken(data []byte) (Tokenizer, error) {
+	ranks := make(map[string]int)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid tiktoken line: %q", line)
+		}
+		token, err := base64.StdEncoding.DecodeString(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid tiktoken token: %w", err)
+		}
+		rank, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid tiktoken rank: %w", err)
+		}
+		ranks[string(token)] = rank
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ranks) == 0 {
+		return nil, errors.New("empty tiktoken vocabulary")
+	}
+	return &bpe{tokenRanks: ranks}, nil
+}
+
+type huggingFaceTokenizer struct {
+	Model struct {
+		Type   string            `json:"type"`
+		Vocab  map[string]int    `json:"vocab"`
+		Merges []json.RawMessage `json:"merges"`
+	} `json:"model"`
+}
+
+func parseHuggingFace(data []byte) (Tokenizer, error) {
+	var hf huggingFaceTokenizer
+	if err := json.Unmarshal(data, &hf); err != nil {
+		return nil, err
+	}
+	if hf.Model.Type != "" && hf.Model.Type != "BPE" {
+		return nil, fmt.Errorf("unsupported tokenizer.json model type %q", hf.Model.Type)
+	}
+	if len(hf.Model.Merges) == 0 {
+		return nil, errors.New("tokenizer.json has no merges")
+	}
+
+	mergeRanks := make(map[string]int, len(hf.Model.Merges))
+	for rank, raw := range hf.Model.Merges {
+		var merge string
+		if err := json.Unmarshal(raw, &merge); err != nil {
+			// Newer tokenizer.json files store merges as ["left", "right"].
+			var pair []string
+			if err := json.Unmarshal(raw, &pair); err != nil || len(pair) != 2 {
+				return nil, fmt.Errorf("invalid merge at rank %d", rank)
+			}
+			merge = pair[0] + " " + pair[1]
+		}
+		if _, existed := mergeRanks[merge]; !existed {
+			mergeRanks[merge] = rank
+		}
+	}
+	return &bpe{mergeRanks: mergeRanks, byteLevel: true}, nil
+}
+
+// byteToUnicode is the GPT-2 reversible byte to printable rune mapping used by
+// byte-level BPE vocabularies.
+var byteToUnicode = func() [256]rune {
+	var table [256]rune
+	n := 0
+	for b := 0; b < 256; b++ {
+		if (b >= '!' && b <= '~') || (b >= 0xA1 && b <= 0xAC) || (b >= 0xAE && b <= 0xFF) {
+			table[b] = rune(b)
+			continue
+		}
+		table[b] = rune(256 + n)
+		n++
+	}
+	return table
+}()
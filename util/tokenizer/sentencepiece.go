@@ -0,0 +1,241 @@
+package tokenizer
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"unicode/utf8"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	spaceSymbol = "▁"
+
+	sentencePieceModelUnigram = 1
+	sentencePieceModelBPE     = 2
+
+	sentencePieceTypeNormal = 1
+)
+
+// sentencePiece counts tokens for SentencePiece models. Unigram models are
+// segmented with Viterbi over piece scores, BPE models by merging the highest
+// scoring adjacent pair. Runes missing from the vocabulary fall back to one
+// token per UTF-8 byte.
+type sentencePiece struct {
+	scores      map[string]float32
+	maxPieceLen int
+	modelType   int
+}
+
+func (sp *sentencePiece) Count(text string) int {
+	if text == "" {
+		return 0
+	}
+	normalized := spaceSymbol + strings.ReplaceAll(text, " ", spaceSymbol)
+	if sp.modelType == sentencePieceModelBPE {
+		return sp.countBPE(normalized)
+	}
+	return sp.countUnigram(normalized)
+}
+
+func (sp *sentencePiece) countUnigram(text string) int {
+	runes := []rune(text)
+	best := make([]float64, len(runes)+1)
+	tokens := make([]int, len(runes)+1)
+	for i := 1; i <= len(runes); i++ {
+		best[i] = math.Inf(-1)
+	}
+
+	for end := 1; end <= len(runes); end++ {
+		for start := max(0, end-sp.maxPieceLen); start < end; start++ {
+			if math.IsInf(best[start], -1) {
+				continue
+			}
+			score, ok := sp.scores[string(runes[start:end])]
+			if !ok {
+				continue
+			}
+			if candidate := best[start] + float64(score); candidate > best[end] {
+				best[end] = candidate
+				tokens[end] = tokens[start] + 1
+			}
+		}
+		if math.IsInf(best[end], -1) {
+			// Byte fallback for a rune the vocabulary cannot cover.
+			best[end] = best[end-1] - 100
+			tokens[end] = tokens[end-1] + utf8.RuneLen(runes[end-1])
+		}
+	}
+	return tokens[len(runes)]
+}
+
+func (sp *sentencePiece) countBPE(text string) int {
+	symbols := make([]string, 0, utf8.RuneCountInString(text))
+	fallback := 0
+	for _, r := range text {
+		symbol := string(r)
+		if _, ok := sp.scores[symbol]; !ok {
+			fallback += utf8.RuneLen(r)
+			continue
+		}
+		symbols = append(symbols, symbol)
+	}
+
+	for len(symbols) > 1 {
+		bestIdx := -1
+		var bestScore float32
+		for i := 0; i < len(symbols)-1; i++ {
+			score, ok := sp.scores[symbols[i]+symbols[i+1]]
+			if !ok {
+				continue
+			}
+			if bestIdx < 0 || score > bestScore {
+				bestIdx = i
+				bestScore = score
+			}
+		}
+		if bestIdx < 0 {
+			break
+		}
+		symbols[bestIdx] += symbols[bestIdx+1]
+		symbols = append(symbols[:bestIdx+1], symbols[bestIdx+2:]...)
+	}
+	return len(symbols) + fallback
+}
+
+// parseSentencePiece decodes the subset of sentencepiece.ModelProto needed for
+// counting: pieces (field 1) and trainer_spec.model_type (field 2.3).
+func parseSentencePiece(data []byte) (Tokenizer, error) {
+	sp := &sentencePiece{
+		scores:    make(map[string]float32),
+		modelType: sentencePieceModelUnigram,
+	}
+
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		if typ != protowire.BytesType || (num != 1 && num != 2) {
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			data = data[n:]
+			continue
+		}
+
+		value, n := protowire.ConsumeBytes(data)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		if num == 1 {
+			piece, score, pieceType, err := parseSentencePiecePiece(value)
+			if err != nil {
+				return nil, err
+			}
+			if pieceType != sentencePieceTypeNormal {
+				continue
+			}
+			sp.scores[piece] = score
+			if l := utf8.RuneCountInString(piece); l > sp.maxPieceLen {
+				sp.maxPieceLen = l
+			}
+			continue
+		}
+
+		modelType, err := parseSentencePieceModelType(value)
+		if err != nil {
+			return nil, err
+		}
+		if modelType != 0 {
+			sp.modelType = modelType
+		}
+	}
+
+	if len(sp.scores) == 0 {
+		return nil, errors.New("sentencepiece model has no pieces")
+	}
+	if sp.modelType != sentencePieceModelUnigram && sp.modelType != sentencePieceModelBPE {
+		return nil, fmt.Errorf("unsupported sentencepiece model type %d", sp.modelType)
+	}
+	return sp, nil
+}
+
+func parseSentencePiecePiece(data []byte) (string, float32, int, error) {
+	var (
+		piece     string
+		score     float32
+		pieceType = sentencePieceTypeNormal
+	)
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return "", 0, 0, protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return "", 0, 0, protowire.ParseError(n)
+			}
+			piece = string(v)
+			data = data[n:]
+		case num == 2 && typ == protowire.Fixed32Type:
+			v, n := protowire.ConsumeFixed32(data)
+			if n < 0 {
+				return "", 0, 0, protowire.ParseError(n)
+			}
+			score = math.Float32frombits(v)
+			data = data[n:]
+		case num == 3 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return "", 0, 0, protowire.ParseError(n)
+			}
+			pieceType = int(v)
+			data = data[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return "", 0, 0, protowire.ParseError(n)
+			}
+			data = data[n:]
+		}
+	}
+	return piece, score, pieceType, nil
+}
+
+func parseSentencePieceModelType(data []byte) (int, error) {
+	modelType := 0
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+		data = data[n:]
+		if num == 3 && typ == protowire.VarintType {
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return 0, protowire.ParseError(n)
+			}
+			modelType = int(v)
+			data = data[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, data)
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return modelType, nil
+}
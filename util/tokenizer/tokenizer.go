@@ -0,0 +1,142 @@
+package tokenizer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Tokenizer counts the tokens a model's vocabulary needs to encode text.
+type Tokenizer interface {
+	Count(text string) int
+}
+
+// pretokenizeRegexp approximates the GPT/Llama 3/Qwen split pattern. Go's RE2
+// has no lookahead, so trailing whitespace is not separated from the next word.
+var pretokenizeRegexp = regexp.MustCompile(`(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+`)
+
+func pretokenize(text string) []string {
+	return pretokenizeRegexp.FindAllString(text, -1)
+}
+
+// Load reads a vocabulary file and detects its format: HuggingFace
+// `tokenizer.json`, tiktoken rank files (`*.tiktoken`, Llama 3
+// `tokenizer.model`) or SentencePiece models (Llama 2 `tokenizer.model`).
+func Load(path string) (Tokenizer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case strings.HasSuffix(path, ".json"):
+		return parseHuggingFace(data)
+	case strings.HasSuffix(path, ".tiktoken"):
+		return parseTiktoken(data)
+	case looksLikeTiktoken(data):
+		return parseTiktoken(data)
+	default:
+		return parseSentencePiece(data)
+	}
+}
+
+func looksLikeTiktoken(data []byte) bool {
+	line, _, _ := bytes.Cut(data, []byte("\n"))
+	fields := strings.Fields(string(line))
+	if len(fields) != 2 {
+		return false
+	}
+	for _, r := range fields[1] {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Registry selects a tokenizer by model name using the longest configured
+// prefix, e.g. "qwen3" matches "qwen3:4b". Files are loaded lazily and cached,
+// as are the errors of files that failed to load.
+type Registry struct {
+	mu       sync.Mutex
+	prefixes []string
+	files    map[string]string
+	loaded   map[string]Tokenizer
+	failed   map[string]error
+}
+
+func NewRegistry(files map[string]string) *Registry {
+	prefixes := make([]string, 0, len(files))
+	normalized := make(map[string]string, len(files))
+	for prefix, path := range files {
+		prefix = strings.ToLower(strings.TrimSpace(prefix))
+		if prefix == "" || strings.TrimSpace(path) == "" {
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+		normalized[prefix] = filepath.Clean(path)
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		return len(prefixes[i]) > len(prefixes[j])
+	})
+	return &Registry{
+		prefixes: prefixes,
+		files:    normalized,
+		loaded:   make(map[string]Tokenizer),
+		failed:   make(map[string]error),
+	}
+}
+
+// ForModel returns the tokenizer configured for model, or nil when none matches.
+func (r *Registry) ForModel(model string) (Tokenizer, error) {
+	if r == nil {
+		return nil, nil
+	}
+	model = strings.ToLower(model)
+	for _, prefix := range r.prefixes {
+		if !strings.HasPrefix(model, prefix) {
+			continue
+		}
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if tok, ok := r.loaded[prefix]; ok {
+			return tok, nil
+		}
+		if err, ok := r.failed[prefix]; ok {
+			return nil, err
+		}
+		tok, err := Load(r.files[prefix])
+		if err != nil {
+			err = fmt.Errorf("load tokenizer for model [%s]: %w", model, err)
+			r.failed[prefix] = err
+			return nil, err
+		}
+		r.loaded[prefix] = tok
+		return tok, nil
+	}
+	return nil, nil
+}
+
+// ParseFileList parses "prefix=path,prefix=path" into a prefix to path map.
+func ParseFileList(list string) (map[string]string, error) {
+	files := make(map[string]string)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		prefix, path, found := strings.Cut(item, "=")
+		if !found || strings.TrimSpace(prefix) == "" || strings.TrimSpace(path) == "" {
+			return nil, errors.New("tokenizer file list entries must look like model_prefix=path")
+		}
+		files[strings.TrimSpace(prefix)] = strings.TrimSpace(path)
+	}
+	return files, nil
+}
@@ -0,0 +1,199 @@
+package tokenizer
+
+import (
+	"encoding/base64"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func writeFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("write %s: %v", name, err)
+	}
+	return path
+}
+
+func tiktokenFile(tokens ...string) []byte {
+	var b strings.Builder
+	for rank, token := range tokens {
+		b.WriteString(base64.StdEncoding.EncodeToString([]byte(token)))
+		b.WriteString(" ")
+		b.WriteString(strconv.Itoa(rank))
+		b.WriteString("\n")
+	}
+	return []byte(b.String())
+}
+
+func TestLoad_Tiktoken(t *testing.T) {
+	dir := t.TempDir()
+	tokens := []string{"h", "e", "l", "o", " ", "w", "r", "d", "he", "ll", "hell", "hello", " w", " wor", "or"}
+	path := writeFile(t, dir, "vocab.tiktoken", tiktokenFile(tokens...))
+
+	tok, err := Load(path)
+	if err != nil {
+		t.Fatalf("load tiktoken: %v", err)
+	}
+	// "hello" is a whole token; " world" merges into " wor" + "l" + "d".
+	if n := tok.Count("hello"); n != 1 {
+		t.Fatalf("expected 1 token for hello, got %d", n)
+	}
+	if n := tok.Count("hello world"); n != 4 {
+		t.Fatalf("expected 4 tokens for hello world, got %d", n)
+	}
+	if n := tok.Count(""); n != 0 {
+		t.Fatalf("expected 0 tokens for empty text, got %d", n)
+	}
+}
+
+func TestLoad_TiktokenDetectedByContent(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, dir, "tokenizer.model", tiktokenFile("a", "b", "ab"))
+
+	tok, err := Load(path)
+	if err != nil {
+		t.Fatalf("load llama3 tokenizer.model: %v", err)
+	}
+	if n := tok.Count("abab"); n != 2 {
+		t.Fatalf("expected 2 tokens, got %d", n)
+	}
+}
+
+func TestLoad_HuggingFaceByteLevelBPE(t *testing.T) {
+	dir := t.TempDir()
+	// "Ġ" is the byte-level symbol for a space.
+	path := writeFile(t, dir, "tokenizer.json", []byte(`{
+  "model": {
+    "type": "BPE",
+    "vocab": {"h":0,"i":1,"Ġ":2,"hi":3,"Ġh":4,"Ġhi":5},
+    "merges": [["Ġ", "h"], "Ġh i", "h i"]
+  }
+}`))
+
+	tok, err := Load(path)
+	if err != nil {
+		t.Fatalf("load tokenizer.json: %v", err)
+	}
+	if n := tok.Count("hi hi hi"); n != 3 {
+		t.Fatalf("expected 3 tokens, got %d", n)
+	}
+	if n := tok.Count("hix"); n != 2 {
+		t.Fatalf("expected 2 tokens for partially known word, got %d", n)
+	}
+
+	bad := writeFile(t, dir, "unigram.json", []byte(`{"model":{"type":"Unigram"}}`))
+	if _, err := Load(bad); err == nil {
+		t.Fatalf("expected unsupported model type error")
+	}
+}
+
+func sentencePieceModel(modelType int, pieces map[string]float32) []byte {
+	var data []byte
+	for piece, score := range pieces {
+		var p []byte
+		p = protowire.AppendTag(p, 1, protowire.BytesType)
+		p = protowire.AppendString(p, piece)
+		p = protowire.AppendTag(p, 2, protowire.Fixed32Type)
+		p = protowire.AppendFixed32(p, math.Float32bits(score))
+		p = protowire.AppendTag(p, 3, protowire.VarintType)
+		p = protowire.AppendVarint(p, sentencePieceTypeNormal)
+		data = protowire.AppendTag(data, 1, protowire.BytesType)
+		data = protowire.AppendBytes(data, p)
+	}
+	var trainer []byte
+	trainer = protowire.AppendTag(trainer, 3, protowire.VarintType)
+	trainer = protowire.AppendVarint(trainer, uint64(modelType))
+	data = protowire.AppendTag(data, 2, protowire.BytesType)
+	data = protowire.AppendBytes(data, trainer)
+	return data
+}
+
+func TestLoad_SentencePieceUnigram(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, dir, "tokenizer.model", sentencePieceModel(sentencePieceModelUnigram, map[string]float32{
+		"▁": -5, "▁hello": -1, "▁world": -1, "h": -3, "e": -3, "l": -3, "o": -3, "▁w": -4, "orld": -4,
+	}))
+
+	tok, err := Load(path)
+	if err != nil {
+		t.Fatalf("load sentencepiece: %v", err)
+	}
+	if n := tok.Count("hello world"); n != 2 {
+		t.Fatalf("expected 2 tokens, got %d", n)
+	}
+	// "你" is not in the vocabulary and falls back to its 3 UTF-8 bytes.
+	if n := tok.Count("hello 你"); n != 5 {
+		t.Fatalf("expected byte fallback to count 5 tokens, got %d", n)
+	}
+}
+
+func TestLoad_SentencePieceBPE(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, dir, "tokenizer.model", sentencePieceModel(sentencePieceModelBPE, map[string]float32{
+		"▁": 0, "a": 0, "b": 0, "ab": -1, "▁ab": -2,
+	}))
+
+	tok, err := Load(path)
+	if err != nil {
+		t.Fatalf("load sentencepiece bpe: %v", err)
+	}
+	if n := tok.Count("ab ab"); n != 2 {
+		t.Fatalf("expected 2 tokens, got %d", n)
+	}
+}
+
+func TestRegistry_ForModelLongestPrefix(t *testing.T) {
+	dir := t.TempDir()
+	qwen := writeFile(t, dir, "qwen.tiktoken", tiktokenFile("a"))
+	qwen3 := writeFile(t, dir, "qwen3.tiktoken", tiktokenFile("a", "b"))
+
+	registry := NewRegistry(map[string]string{"qwen": qwen, "Qwen3": qwen3, "": "ignored"})
+	tok, err := registry.ForModel("qwen3:4b")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cached, _ := registry.ForModel("QWEN3:8b")
+	if tok == nil || tok != cached {
+		t.Fatalf("expected cached qwen3 tokenizer")
+	}
+
+	if tok, err := registry.ForModel("llama3"); tok != nil || err != nil {
+		t.Fatalf("expected no tokenizer for unmapped model, got %v %v", tok, err)
+	}
+
+	missing := NewRegistry(map[string]string{"llama": filepath.Join(dir, "missing.model")})
+	if _, err := missing.ForModel("llama3"); err == nil {
+		t.Fatalf("expected load error for missing file")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "missing.model"), []byte(tiktokenFile("a")), 0o600); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if _, err := missing.ForModel("llama3"); err == nil {
+		t.Fatalf("expected the load error to be cached")
+	}
+
+	var nilRegistry *Registry
+	if tok, err := nilRegistry.ForModel("x"); tok != nil || err != nil {
+		t.Fatalf("expected nil registry to return nothing")
+	}
+}
+
+func TestParseFileList(t *testing.T) {
+	files, err := ParseFileList(" qwen3=/models/qwen3/tokenizer.json , llama3=/models/llama3/tokenizer.model,")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if files["qwen3"] != "/models/qwen3/tokenizer.json" || files["llama3"] != "/models/llama3/tokenizer.model" {
+		t.Fatalf("unexpected files: %#v", files)
+	}
+	if _, err := ParseFileList("qwen3"); err == nil {
+		t.Fatalf("expected malformed entry error")
+	}
+}